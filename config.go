@@ -3,6 +3,5 @@ package currencytrader
 import "github.com/spf13/viper"
 
 func init() {
-	viper.SetDefault("currencytrader.tickersvc.streamBufferSize", 64)
 	viper.SetDefault("currencytrader.tickersvc.streamBufferSize", 4)
 }
@@ -20,7 +20,10 @@ func main() {
 	trader.Start()
 
 	// Get the wallets
-	wallets := trader.WalletSvc().Wallets()
+	wallets, err := trader.AccountSvc().Wallets()
+	if err != nil {
+		log.WithError(err).Fatal("could not get wallets")
+	}
 
 	// Setup a close channel
 	killSwitch := make(chan bool)
@@ -2,9 +2,86 @@ package currencytrader
 
 import (
 	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/middleware"
+	"github.com/sinisterminister/currencytrader/types/provider/multi"
+	"github.com/sinisterminister/currencytrader/types/reconcile"
+	"github.com/sinisterminister/currencytrader/types/risk"
 	"github.com/sinisterminister/currencytrader/types/trader"
 )
 
-func New(provider types.Provider) types.Trader {
-	return trader.New(provider)
+// New creates a trader for the provider. Every provider call runs through the interceptors, the first one
+// outermost.
+func New(provider types.Provider, interceptors ...middleware.Interceptor) types.Trader {
+	return trader.New(wrap(provider, interceptors))
+}
+
+// TraderConfig holds the optional parts of a trader
+type TraderConfig struct {
+	// Interceptors wrap every provider call, the first one outermost
+	Interceptors []middleware.Interceptor
+
+	// Journal keeps the orders the trader places so they are picked up again when it next starts. See the journal
+	// package for stores.
+	Journal types.OrderJournal
+
+	// Reconcile has the trader reconcile its journal with the provider the first time it starts
+	Reconcile *reconcile.Config
+
+	// Risk checks every order against its limits before it is placed. The trader's OrderSvc is then a risk.Manager,
+	// which holds the kill switch.
+	Risk *risk.Config
+}
+
+// NewWithConfig creates a trader for the provider like New, with the optional parts set in the config. Pass it a
+// provider from multi.New to trade across venues.
+func NewWithConfig(provider types.Provider, config TraderConfig) types.Trader {
+	return trader.NewWithConfig(wrap(provider, config.Interceptors), config.trader())
+}
+
+// NewMulti creates a trader across several named providers. Markets are qualified by the name of their venue,
+// wallets are aggregated across venues and orders are placed with the provider of their market. The interceptors
+// wrap each venue on its own, so limits and circuit breakers apply per venue.
+func NewMulti(venues map[string]types.Provider, interceptors ...middleware.Interceptor) types.Trader {
+	return NewMultiWithConfig(venues, TraderConfig{Interceptors: interceptors})
+}
+
+// NewMultiWithConfig creates a trader across several named providers like NewMulti, with the optional parts set in
+// the config. The interceptors wrap each venue on its own.
+func NewMultiWithConfig(venues map[string]types.Provider, config TraderConfig) types.Trader {
+	return trader.NewWithConfig(multi.New(wrapVenues(venues, config.Interceptors)), config.trader())
+}
+
+// NewRouted creates a trader across several named providers like NewMulti, and splits orders placed on a market
+// without a venue across every venue trading it. Get such a market from VenueMarket with an empty venue.
+func NewRouted(venues map[string]types.Provider, interceptors ...middleware.Interceptor) types.Trader {
+	return NewRoutedWithConfig(venues, TraderConfig{Interceptors: interceptors})
+}
+
+// NewRoutedWithConfig creates a routed trader like NewRouted, with the optional parts set in the config. Risk limits
+// check each order the router places on a venue.
+func NewRoutedWithConfig(venues map[string]types.Provider, config TraderConfig) types.Trader {
+	return trader.NewRoutedWithConfig(multi.New(wrapVenues(venues, config.Interceptors)), config.trader())
+}
+
+func (config TraderConfig) trader() trader.TraderConfig {
+	return trader.TraderConfig{
+		Journal:   config.Journal,
+		Reconcile: config.Reconcile,
+		Risk:      config.Risk,
+	}
+}
+
+func wrap(provider types.Provider, interceptors []middleware.Interceptor) types.Provider {
+	if len(interceptors) == 0 {
+		return provider
+	}
+	return middleware.Wrap(provider, interceptors...)
+}
+
+func wrapVenues(venues map[string]types.Provider, interceptors []middleware.Interceptor) map[string]types.Provider {
+	wrapped := make(map[string]types.Provider, len(venues))
+	for name, provider := range venues {
+		wrapped[name] = wrap(provider, interceptors)
+	}
+	return wrapped
 }
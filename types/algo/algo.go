@@ -0,0 +1,71 @@
+// Package algo works large orders into a market over time as a series of smaller child orders, so they don't hit
+// the book all at once
+package algo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+// Execution is the parent order an algorithm works. Filled, Paid and Fees are the sums of its children. It is
+// partially filled while it runs, and once it ends it is filled if what is left is too small to place, and
+// canceled otherwise.
+type Execution interface {
+	types.AggregateOrder
+
+	// Cancel stops the execution and cancels its open child. The execution is done once the child is.
+	Cancel()
+
+	// Scheduled is how much of the parent the schedule has called for so far
+	Scheduled() decimal.Decimal
+}
+
+// Config is what every algorithm needs to know about the parent order
+type Config struct {
+	Market   types.Market
+	Side     types.OrderSide
+	Quantity decimal.Decimal
+
+	// Type is the type of the child orders. Limit children rest at the best price on their side of the book.
+	// Defaults to order.Limit.
+	Type types.OrderType
+
+	// LimitPrice is the worst price children are placed at. Market children aren't placed while the book is
+	// beyond it. There is no limit when it is zero.
+	LimitPrice decimal.Decimal
+
+	// RepriceInterval is how often a limit child that is no longer at the best price is replaced at it. Defaults to
+	// currencytrader.algo.repriceInterval.
+	RepriceInterval time.Duration
+
+	// MaxChildQuantity caps the quantity of each child. There is no cap when it is zero.
+	MaxChildQuantity decimal.Decimal
+
+	// Complete places what is left as market orders once the schedule ends, so the parent fills unless the limit
+	// price or the market's minimums stop it. Cancelled executions aren't completed.
+	Complete bool
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.Market == nil:
+		return fmt.Errorf("%w: no market", types.ErrInvalidRequest)
+	case c.Side != order.Buy && c.Side != order.Sell:
+		return fmt.Errorf("%w: side %q", types.ErrInvalidRequest, c.Side)
+	case !c.Quantity.IsPositive():
+		return fmt.Errorf("%w: quantity %s", types.ErrInvalidRequest, c.Quantity)
+	case c.Type != order.Limit && c.Type != order.Market:
+		return fmt.Errorf("%w: order type %q", types.ErrInvalidRequest, c.Type)
+	}
+	return nil
+}
+
+// slice is a point in a schedule: by the time, the parent should have been worked up to the target
+type slice struct {
+	at     time.Time
+	target decimal.Decimal
+}
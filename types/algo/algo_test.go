@@ -0,0 +1,347 @@
+package algo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/algo"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/trader/tradertest"
+)
+
+func TestTWAPFillsInSlices(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+
+	quantity := decimal.NewFromFloat(0.03)
+	exec, err := algo.NewTWAP(trader, algo.TWAPConfig{
+		Config: algo.Config{
+			Market:   mkt,
+			Side:     order.Buy,
+			Quantity: quantity,
+			Type:     order.Market,
+		},
+		Duration:  300 * time.Millisecond,
+		Slices:    3,
+		Randomize: 0.2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Filled || !exec.Filled().Equal(quantity) {
+		t.Errorf("execution ended %s with %s filled; expected %s filled", exec.Status(), exec.Filled(), quantity)
+	}
+	if n := len(exec.Children()); n != 3 {
+		t.Errorf("execution placed %d children; expected 3", n)
+	}
+	if !exec.Scheduled().Equal(quantity) {
+		t.Errorf("execution scheduled %s; expected %s", exec.Scheduled(), quantity)
+	}
+}
+
+func TestTWAPCancel(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Children rest at the limit, well under the market
+	exec, err := algo.NewTWAP(trader, algo.TWAPConfig{
+		Config: algo.Config{
+			Market:     mkt,
+			Side:       order.Buy,
+			Quantity:   decimal.NewFromFloat(0.02),
+			LimitPrice: tkr.Bid().Div(decimal.NewFromInt(2)).Round(2),
+		},
+		Duration: time.Minute,
+		Slices:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(exec.Children()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("execution didn't place its first child")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	exec.Cancel()
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Canceled {
+		t.Errorf("cancelled execution is %s; expected %s", exec.Status(), order.Canceled)
+	}
+	for _, child := range exec.Children() {
+		if !child.IsDone() {
+			t.Errorf("child %s is still %s", child.ID(), child.Status())
+		}
+	}
+}
+
+func TestTWAPRejectsBadConfig(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	if _, err := algo.NewTWAP(trader, algo.TWAPConfig{Config: algo.Config{Market: mkt, Side: order.Buy, Quantity: decimal.NewFromInt(1)}}); err == nil {
+		t.Error("NewTWAP() accepted a config without a duration")
+	}
+}
+
+func TestVWAPFollowsVolumeCurve(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+
+	quantity := decimal.NewFromFloat(0.03)
+	exec, err := algo.NewVWAP(trader, algo.VWAPConfig{
+		Config:   algo.Config{Market: mkt, Side: order.Sell, Quantity: quantity, Type: order.Market},
+		Duration: 300 * time.Millisecond,
+		Interval: "100ms",
+		Days:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Filled || !exec.Filled().Equal(quantity) {
+		t.Errorf("execution ended %s with %s filled; expected %s filled", exec.Status(), exec.Filled(), quantity)
+	}
+	if n := len(exec.Children()); n < 2 {
+		t.Errorf("execution placed %d children; expected one for each interval with volume", n)
+	}
+}
+
+func TestPOVKeepsToRate(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+
+	quantity := decimal.NewFromFloat(0.02)
+	exec, err := algo.NewPOV(trader, algo.POVConfig{
+		Config: algo.Config{
+			Market:           mkt,
+			Side:             order.Buy,
+			Quantity:         quantity,
+			Type:             order.Market,
+			MaxChildQuantity: decimal.NewFromFloat(0.01),
+		},
+		Rate:     decimal.NewFromFloat(0.001),
+		Duration: 10 * time.Second,
+		Interval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Filled || !exec.Filled().Equal(quantity) {
+		t.Errorf("execution ended %s with %s filled; expected %s filled", exec.Status(), exec.Filled(), quantity)
+	}
+	for _, child := range exec.Children() {
+		if child.Request().Quantity().GreaterThan(decimal.NewFromFloat(0.01)) {
+			t.Errorf("child %s is for %s, over the cap", child.ID(), child.Request().Quantity())
+		}
+	}
+}
+
+func TestCompleteFillsWhatIsLeft(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+
+	// The rate is too low to get anywhere before the deadline
+	quantity := decimal.NewFromFloat(0.02)
+	exec, err := algo.NewPOV(trader, algo.POVConfig{
+		Config:   algo.Config{Market: mkt, Side: order.Buy, Quantity: quantity, Type: order.Market, Complete: true},
+		Rate:     decimal.NewFromFloat(0.0000001),
+		Duration: 200 * time.Millisecond,
+		Interval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Filled || !exec.Filled().Equal(quantity) {
+		t.Errorf("execution ended %s with %s filled; expected %s filled", exec.Status(), exec.Filled(), quantity)
+	}
+}
+
+func TestIcebergShowsASliceAtATime(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is over the market, so each slice fills as soon as it is shown
+	quantity := decimal.NewFromFloat(0.05)
+	visible := decimal.NewFromFloat(0.01)
+	o, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequestFromDTO(mkt, types.OrderRequestDTO{
+		Type:            order.Limit,
+		Side:            order.Buy,
+		Price:           tkr.Ask().Mul(decimal.NewFromFloat(1.1)).Round(2),
+		Quantity:        quantity,
+		Market:          mkt.ToDTO(),
+		DisplayQuantity: visible,
+		DisplayVariance: 0.5,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec, ok := o.(algo.Execution)
+	if !ok {
+		t.Fatalf("order service returned a %T for an iceberg", o)
+	}
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Filled || !exec.Filled().Equal(quantity) {
+		t.Errorf("iceberg ended %s with %s filled; expected %s filled", exec.Status(), exec.Filled(), quantity)
+	}
+	paid := decimal.Zero
+	max := visible.Mul(decimal.NewFromFloat(1.5))
+	for _, child := range exec.Children() {
+		paid = paid.Add(child.Paid())
+		if child.Request().Quantity().GreaterThan(max) {
+			t.Errorf("slice %s shows %s; expected at most %s", child.ID(), child.Request().Quantity(), max)
+		}
+	}
+	if n := len(exec.Children()); n < 3 {
+		t.Errorf("iceberg placed %d slices; expected at least 3", n)
+	}
+	if !exec.Paid().Equal(paid) {
+		t.Errorf("iceberg paid %s; expected the %s its slices paid", exec.Paid(), paid)
+	}
+}
+
+func TestIcebergCancel(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is well under the market, so the first slice rests
+	o, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequestFromDTO(mkt, types.OrderRequestDTO{
+		Type:            order.Limit,
+		Side:            order.Buy,
+		Price:           tkr.Bid().Div(decimal.NewFromInt(2)).Round(2),
+		Quantity:        decimal.NewFromFloat(0.05),
+		Market:          mkt.ToDTO(),
+		DisplayQuantity: decimal.NewFromFloat(0.01),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := o.(algo.Execution)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(exec.Children()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("iceberg didn't show its first slice")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if again, err := trader.OrderSvc().Order(mkt, exec.ID()); err != nil || again != o {
+		t.Errorf("Order(%s) = %v, %v; expected the running iceberg", exec.ID(), again, err)
+	}
+	if err := trader.OrderSvc().CancelOrder(o); err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, exec)
+
+	// The order service lets go of the iceberg once it is done
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if again, _ := trader.OrderSvc().Order(mkt, exec.ID()); again != o {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("order service still returns the iceberg after it is done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if exec.Status() != order.Canceled {
+		t.Errorf("cancelled iceberg is %s; expected %s", exec.Status(), order.Canceled)
+	}
+	if n := len(exec.Children()); n != 1 {
+		t.Errorf("resting iceberg placed %d slices; expected 1", n)
+	}
+	for _, child := range exec.Children() {
+		if !child.IsDone() {
+			t.Errorf("slice %s is still %s", child.ID(), child.Status())
+		}
+	}
+}
+
+func TestIcebergRejectedSlice(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first slice sells more than the wallet holds
+	o, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequestFromDTO(mkt, types.OrderRequestDTO{
+		Type:            order.Limit,
+		Side:            order.Sell,
+		Price:           tkr.Ask().Mul(decimal.NewFromInt(2)).Round(2),
+		Quantity:        decimal.NewFromInt(10),
+		Market:          mkt.ToDTO(),
+		DisplayQuantity: decimal.NewFromInt(5),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := o.(algo.Execution)
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Rejected {
+		t.Errorf("iceberg whose first slice was rejected is %s; expected %s", exec.Status(), order.Rejected)
+	}
+	if n := len(exec.Children()); n != 0 {
+		t.Errorf("iceberg has %d slices; expected none", n)
+	}
+}
+
+func TestIcebergSliceCancelledElsewhere(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequestFromDTO(mkt, types.OrderRequestDTO{
+		Type:            order.Limit,
+		Side:            order.Buy,
+		Price:           tkr.Bid().Div(decimal.NewFromInt(2)).Round(2),
+		Quantity:        decimal.NewFromFloat(0.05),
+		Market:          mkt.ToDTO(),
+		DisplayQuantity: decimal.NewFromFloat(0.01),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := o.(algo.Execution)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(exec.Children()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("iceberg didn't show its first slice")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Cancelling the slice rather than the iceberg ends the iceberg too
+	if err := trader.OrderSvc().CancelOrder(exec.Children()[0]); err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, exec)
+
+	if exec.Status() != order.Canceled {
+		t.Errorf("iceberg whose slice was cancelled is %s; expected %s", exec.Status(), order.Canceled)
+	}
+	if n := len(exec.Children()); n != 1 {
+		t.Errorf("iceberg placed %d slices; expected 1", n)
+	}
+}
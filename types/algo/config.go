@@ -0,0 +1,13 @@
+package algo
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("currencytrader.algo.cancelTimeout", 30*time.Second)
+	viper.SetDefault("currencytrader.algo.repriceInterval", 5*time.Second)
+	viper.SetDefault("currencytrader.algo.sweepAttempts", 3)
+}
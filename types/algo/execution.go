@@ -0,0 +1,555 @@
+package algo
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+// execution works a parent order through a schedule, keeping one child open at a time
+type execution struct {
+	log          log.Entry
+	trader       types.Trader
+	config       Config
+	id           string
+	creationTime time.Time
+	request      types.OrderRequestDTO
+	plan         []slice
+	targets      <-chan decimal.Decimal
+	end          time.Time
+
+	// fixed keeps limit children at the limit price instead of the best price
+	fixed bool
+
+	// slice sizes each child in place of MaxChildQuantity when it is set
+	slice func(price decimal.Decimal) decimal.Decimal
+
+	// strict ends the execution when a child can't be placed or ends unfilled, since without a schedule nothing
+	// would place another
+	strict bool
+
+	cancel     chan bool
+	cancelOnce sync.Once
+
+	// changed is poked whenever a child changes, coalescing the updates
+	changed chan bool
+
+	mutex     sync.RWMutex
+	children  []types.Order
+	active    types.Order
+	scheduled decimal.Decimal
+	status    types.OrderStatus
+	halted    types.OrderStatus
+	streams   []chan types.OrderStatus
+	done      chan bool
+}
+
+// newExecution starts working the plan, along with any targets sent on the channel, ending at the end time or once
+// the parent is filled
+func newExecution(trader types.Trader, config Config, plan []slice, targets <-chan decimal.Decimal, end time.Time) *execution {
+	e := buildExecution(trader, config, plan, targets, end)
+	go e.run()
+	return e
+}
+
+// buildExecution sets up an execution without starting it. An execution with a zero end time runs until it fills
+// or is cancelled.
+func buildExecution(trader types.Trader, config Config, plan []slice, targets <-chan decimal.Decimal, end time.Time) *execution {
+	if config.RepriceInterval <= 0 {
+		config.RepriceInterval = viper.GetDuration("currencytrader.algo.repriceInterval")
+	}
+	e := &execution{
+		log:          log.WithField("source", "algo.execution"),
+		trader:       trader,
+		config:       config,
+		id:           uuid.New().String(),
+		creationTime: time.Now(),
+		plan:         plan,
+		targets:      targets,
+		end:          end,
+		cancel:       make(chan bool),
+		changed:      make(chan bool, 1),
+		status:       order.Pending,
+		done:         make(chan bool),
+	}
+	e.request = types.OrderRequestDTO{
+		ClientID: e.id,
+		Market:   config.Market.ToDTO(),
+		Type:     config.Type,
+		Side:     config.Side,
+		Quantity: config.Quantity,
+		Price:    config.LimitPrice,
+	}
+	return e
+}
+
+func (e *execution) run() {
+	defer e.finish()
+	for _, s := range e.plan {
+		if !e.wait(s.at) {
+			return
+		}
+		e.schedule(s.target)
+	}
+	if e.wait(e.end) && e.config.Complete {
+		e.sweep()
+	}
+}
+
+// schedule raises the target and places what it calls for along with whatever is left unfilled. The open child is
+// left alone when the target doesn't call for enough more to place.
+func (e *execution) schedule(target decimal.Decimal) {
+	e.mutex.Lock()
+	if target.GreaterThan(e.scheduled) {
+		e.scheduled = decimal.Min(target, e.config.Quantity)
+	}
+	extra := e.scheduled.Sub(e.committed())
+	e.mutex.Unlock()
+	if !e.placeable(extra) {
+		return
+	}
+
+	e.cancelActive()
+	e.place(e.config.Type, true)
+}
+
+// sweep places what is left of the parent as market orders, waiting for each to be done. The parent is rejected if
+// it still isn't filled after as many market orders as currencytrader.algo.sweepAttempts allows.
+func (e *execution) sweep() {
+	e.mutex.Lock()
+	e.scheduled = e.config.Quantity
+	e.mutex.Unlock()
+	e.cancelActive()
+
+	attempts := viper.GetInt("currencytrader.algo.sweepAttempts")
+	for i := 0; !e.filled(); i++ {
+		if i == attempts {
+			e.log.Warnf("could not complete order %s with %s left after %d market orders", e.id,
+				e.config.Quantity.Sub(e.Filled()), attempts)
+			e.halt(order.Rejected)
+			return
+		}
+		child := e.place(order.Market, false)
+		if child == nil {
+			e.log.Warnf("could not complete order %s with %s left", e.id, e.config.Quantity.Sub(e.Filled()))
+			return
+		}
+		select {
+		case <-child.Done():
+		case <-time.After(viper.GetDuration("currencytrader.algo.cancelTimeout")):
+			e.log.Warnf("child %s completing order %s is still open", child.ID(), e.id)
+			return
+		}
+	}
+}
+
+// wait reprices the open child and follows its updates until the time comes. It returns false if the execution
+// was cancelled or the parent filled first.
+func (e *execution) wait(until time.Time) bool {
+	var deadline <-chan time.Time
+	if !until.IsZero() {
+		timer := time.NewTimer(time.Until(until))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	reprice := time.NewTicker(e.config.RepriceInterval)
+	defer reprice.Stop()
+
+	for {
+		select {
+		case <-e.cancel:
+			return false
+		case <-deadline:
+			return true
+		case target := <-e.targets:
+			e.schedule(target)
+		case <-e.changed:
+			e.update()
+			if e.complete() {
+				return false
+			}
+
+			// A capped child that filled makes way for the next one
+			active := e.activeChild()
+			if active != nil && active.Status() == order.Filled {
+				e.schedule(decimal.Zero)
+			} else if e.strict && active != nil && active.IsDone() {
+				e.log.Warnf("child %s of order %s ended %s", active.ID(), e.id, active.Status())
+				e.halt(order.Canceled)
+			}
+		case <-reprice.C:
+			e.reprice()
+		}
+	}
+}
+
+// reprice replaces a resting limit child that is no longer at the best price
+func (e *execution) reprice() {
+	active := e.activeChild()
+	if e.fixed || e.config.Type != order.Limit || active == nil || active.IsDone() {
+		return
+	}
+	price, ok := e.price(order.Limit)
+	if !ok || price.Equal(active.Request().Price()) {
+		return
+	}
+	e.cancelActive()
+	e.place(order.Limit, true)
+}
+
+// place places a child of the type for what the schedule calls for that isn't filled or working yet, held to
+// MaxChildQuantity if it is capped. It returns the child, or nil if there was nothing that could be placed.
+func (e *execution) place(typ types.OrderType, capped bool) types.Order {
+	mkt := e.config.Market
+	e.mutex.RLock()
+	want := e.scheduled.Sub(e.committed())
+	e.mutex.RUnlock()
+
+	quantity := roundDown(want, mkt.QuantityStepSize())
+	if max := mkt.MaxQuantity(); max.IsPositive() && quantity.GreaterThan(max) {
+		quantity = max
+	}
+	price, ok := e.price(typ)
+	if !ok {
+		return nil
+	}
+	max := e.config.MaxChildQuantity
+	if e.slice != nil {
+		max = e.slice(price)
+	}
+	if capped && max.IsPositive() && quantity.GreaterThan(max) {
+		quantity = roundDown(max, mkt.QuantityStepSize())
+	}
+	if !e.placeable(quantity) || quantity.Mul(price).LessThan(mkt.MinFunds()) {
+		return nil
+	}
+
+	req := types.OrderRequestDTO{
+		Market:   mkt.ToDTO(),
+		Type:     typ,
+		Side:     e.config.Side,
+		Quantity: quantity,
+	}
+	if typ == order.Limit {
+		req.Price = price
+	}
+	child, err := e.trader.OrderSvc().AttemptOrder(mkt, order.NewRequestFromDTO(mkt, req))
+	if err != nil {
+		e.log.WithError(err).Warnf("could not place child of order %s", e.id)
+		if e.strict {
+			e.halt(order.Rejected)
+		}
+		return nil
+	}
+
+	e.mutex.Lock()
+	e.children = append(e.children, child)
+	e.active = child
+	e.mutex.Unlock()
+	go e.watch(child)
+	return child
+}
+
+// placeable reports whether the quantity is enough for a child
+func (e *execution) placeable(quantity decimal.Decimal) bool {
+	mkt := e.config.Market
+	quantity = roundDown(quantity, mkt.QuantityStepSize())
+	return quantity.IsPositive() && !quantity.LessThan(mkt.MinQuantity())
+}
+
+// price is where a child of the type goes: the best price on its side of the book, held to the limit price. It
+// reports false when a market child would go beyond the limit.
+func (e *execution) price(typ types.OrderType) (decimal.Decimal, bool) {
+	if e.fixed && typ == order.Limit {
+		return e.config.LimitPrice, true
+	}
+	tkr, err := e.config.Market.Ticker()
+	if err != nil {
+		e.log.WithError(err).Warnf("could not price child of order %s", e.id)
+		return decimal.Zero, false
+	}
+
+	limit := e.config.LimitPrice
+	if typ == order.Market {
+		touch := tkr.Ask()
+		if e.config.Side == order.Sell {
+			touch = tkr.Bid()
+		}
+		beyond := limit.IsPositive() && ((e.config.Side == order.Buy && touch.GreaterThan(limit)) || (e.config.Side == order.Sell && touch.LessThan(limit)))
+		return touch, touch.IsPositive() && !beyond
+	}
+
+	if e.config.Side == order.Buy {
+		price := tkr.Bid()
+		if limit.IsPositive() && price.GreaterThan(limit) {
+			price = limit
+		}
+		return roundDown(price, e.config.Market.PriceIncrement()), price.IsPositive()
+	}
+	price := tkr.Ask()
+	if limit.IsPositive() && price.LessThan(limit) {
+		price = limit
+	}
+	return roundUp(price, e.config.Market.PriceIncrement()), price.IsPositive()
+}
+
+// cancelActive cancels the open child and waits for it to be done, for up to currencytrader.algo.cancelTimeout. A
+// child that outlasts the wait keeps counting as working.
+func (e *execution) cancelActive() {
+	active := e.activeChild()
+	if active == nil || active.IsDone() {
+		return
+	}
+	if err := e.trader.OrderSvc().CancelOrder(active); err != nil {
+		e.log.WithError(err).Warnf("could not cancel child %s of order %s", active.ID(), e.id)
+	}
+	select {
+	case <-active.Done():
+	case <-time.After(viper.GetDuration("currencytrader.algo.cancelTimeout")):
+		e.log.Warnf("child %s of order %s is still open after cancelling it", active.ID(), e.id)
+	}
+	e.update()
+}
+
+// committed is what the children filled, plus what the open ones may still fill. The caller holds the lock.
+func (e *execution) committed() decimal.Decimal {
+	total := decimal.Zero
+	for _, child := range e.children {
+		total = total.Add(child.Filled())
+		if !child.IsDone() {
+			total = total.Add(child.Request().Quantity().Sub(child.Filled()))
+		}
+	}
+	return total
+}
+
+// watch pokes the execution whenever the child changes, until it is done
+func (e *execution) watch(child types.Order) {
+	stop := make(chan bool)
+	defer close(stop)
+	for range child.StatusStream(stop) {
+		select {
+		case e.changed <- true:
+		default:
+		}
+	}
+}
+
+// halt stops the execution, which ends with the status unless it filled. An execution that filled some of the
+// parent ends cancelled rather than rejected.
+func (e *execution) halt(status types.OrderStatus) {
+	if status == order.Rejected && e.Filled().IsPositive() {
+		status = order.Canceled
+	}
+	e.mutex.Lock()
+	if e.halted == "" {
+		e.halted = status
+	}
+	e.mutex.Unlock()
+	e.Cancel()
+}
+
+// finish cancels the open child and settles the parent's status
+func (e *execution) finish() {
+	e.cancelActive()
+	e.mutex.RLock()
+	halted := e.halted
+	e.mutex.RUnlock()
+
+	switch {
+	case e.filled():
+		e.setStatus(order.Filled)
+	case halted != "":
+		e.setStatus(halted)
+	default:
+		e.setStatus(order.Canceled)
+	}
+}
+
+// filled reports whether what is left of the parent is too small to place
+func (e *execution) filled() bool {
+	filled := e.Filled()
+	left := e.config.Quantity.Sub(filled)
+	mkt := e.config.Market
+	return !left.IsPositive() || (filled.IsPositive() && left.LessThan(decimal.Max(mkt.QuantityStepSize(), mkt.MinQuantity())))
+}
+
+// complete reports whether the whole parent was scheduled and filled, with no child left open
+func (e *execution) complete() bool {
+	e.mutex.RLock()
+	scheduled := e.scheduled.Equal(e.config.Quantity)
+	open := e.active != nil && !e.active.IsDone()
+	e.mutex.RUnlock()
+	return scheduled && !open && e.filled()
+}
+
+// update moves the parent to partial once a child fills
+func (e *execution) update() {
+	if e.Filled().IsPositive() {
+		e.setStatus(order.Partial)
+	}
+}
+
+func (e *execution) setStatus(status types.OrderStatus) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if order.IsDone(e.status) || status == e.status {
+		return
+	}
+	e.status = status
+
+	for _, stream := range e.streams {
+		select {
+		case stream <- status:
+		default:
+			e.log.Warnf("skipping blocked order status channel for order %s", e.id)
+		}
+	}
+	if order.IsDone(status) {
+		for _, stream := range e.streams {
+			close(stream)
+		}
+		e.streams = nil
+		close(e.done)
+	}
+}
+
+func (e *execution) activeChild() types.Order {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.active
+}
+
+func (e *execution) Cancel() {
+	e.cancelOnce.Do(func() { close(e.cancel) })
+}
+
+func (e *execution) Children() []types.Order {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return append([]types.Order{}, e.children...)
+}
+
+func (e *execution) CreationTime() time.Time { return e.creationTime }
+
+func (e *execution) Done() <-chan bool { return e.done }
+
+func (e *execution) Fees() (types.OrderSide, decimal.Decimal) {
+	dto := e.ToDTO()
+	return dto.FeesSide, dto.Fees
+}
+
+func (e *execution) Filled() decimal.Decimal { return e.ToDTO().Filled }
+
+func (e *execution) ID() string { return e.id }
+
+func (e *execution) IsDone() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *execution) Market() types.Market { return e.config.Market }
+
+func (e *execution) Paid() decimal.Decimal { return e.ToDTO().Paid }
+
+func (e *execution) Refresh() (err error) {
+	for _, child := range e.Children() {
+		if child.IsDone() {
+			continue
+		}
+		if e := child.Refresh(); e != nil && err == nil {
+			err = e
+		}
+	}
+	e.update()
+	return
+}
+
+func (e *execution) Request() types.OrderRequest {
+	return order.NewRequestFromDTO(e.config.Market, e.request)
+}
+
+func (e *execution) Scheduled() decimal.Decimal {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.scheduled
+}
+
+func (e *execution) Status() types.OrderStatus {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.status
+}
+
+func (e *execution) StatusStream(stop <-chan bool) <-chan types.OrderStatus {
+	stream := make(chan types.OrderStatus, viper.GetInt("currencytrader.order.streamBufferSize")+1)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	stream <- e.status
+	if order.IsDone(e.status) {
+		close(stream)
+		return stream
+	}
+	e.streams = append(e.streams, stream)
+
+	go func() {
+		select {
+		case <-stop:
+		case <-e.done:
+			return
+		}
+
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		for i, s := range e.streams {
+			if s == stream {
+				e.streams = append(e.streams[:i], e.streams[i+1:]...)
+				close(stream)
+				break
+			}
+		}
+	}()
+	return stream
+}
+
+func (e *execution) ToDTO() types.OrderDTO {
+	e.mutex.RLock()
+	dto := types.OrderDTO{
+		Market:       e.request.Market,
+		CreationTime: e.creationTime,
+		ID:           e.id,
+		Request:      e.request,
+		Status:       e.status,
+	}
+	children := make([]types.OrderDTO, 0, len(e.children))
+	for _, child := range e.children {
+		children = append(children, child.ToDTO())
+	}
+	e.mutex.RUnlock()
+	return order.Sum(dto, children)
+}
+
+func roundDown(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Floor().Mul(step)
+}
+
+func roundUp(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Ceil().Mul(step)
+}
@@ -0,0 +1,74 @@
+package algo
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type IcebergConfig struct {
+	// Config holds the parent order. Its LimitPrice is the price every slice rests at, and Type, RepriceInterval,
+	// MaxChildQuantity and Complete are ignored.
+	Config
+
+	// ClientID identifies the parent. Defaults to a new ID.
+	ClientID string
+
+	// Visible is how much of the parent is shown on the book at a time
+	Visible decimal.Decimal
+
+	// Variance varies each slice by up to this fraction of Visible, so the slices don't all look alike. It is
+	// between 0 and 1.
+	Variance float64
+}
+
+// NewIceberg places the parent as a limit order that shows only a slice of itself at a time, placing the next slice
+// as each one fills. It runs until it fills or is cancelled. A slice that can't be placed ends it rejected, or
+// cancelled once some of it filled, and a slice cancelled or expired by anyone else ends it cancelled.
+func NewIceberg(trader types.Trader, config IcebergConfig) (Execution, error) {
+	config.Type = order.Limit
+	config.MaxChildQuantity = decimal.Zero
+	config.Complete = false
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	switch {
+	case !config.LimitPrice.IsPositive():
+		return nil, fmt.Errorf("%w: iceberg price %s", types.ErrInvalidRequest, config.LimitPrice)
+	case !config.Visible.IsPositive():
+		return nil, fmt.Errorf("%w: visible quantity %s", types.ErrInvalidRequest, config.Visible)
+	case config.Variance < 0 || config.Variance > 1:
+		return nil, fmt.Errorf("%w: variance %v", types.ErrInvalidRequest, config.Variance)
+	}
+
+	now := time.Now()
+	e := buildExecution(trader, config.Config, []slice{{at: now, target: config.Quantity}}, nil, time.Time{})
+	if config.ClientID != "" {
+		e.id = config.ClientID
+		e.request.ClientID = config.ClientID
+	}
+	e.fixed = true
+	e.strict = true
+	e.slice = icebergSlices(config, rand.New(rand.NewSource(now.UnixNano())))
+
+	go e.run()
+	return e, nil
+}
+
+// icebergSlices sizes each slice around the visible quantity, never under what the market accepts
+func icebergSlices(config IcebergConfig, rnd *rand.Rand) func(price decimal.Decimal) decimal.Decimal {
+	mkt := config.Market
+	return func(price decimal.Decimal) decimal.Decimal {
+		size := config.Visible.Mul(decimal.NewFromFloat(1 + config.Variance*(rnd.Float64()*2-1)))
+		size = roundDown(size, mkt.QuantityStepSize())
+		size = decimal.Max(size, mkt.MinQuantity())
+		if price.IsPositive() && mkt.MinFunds().IsPositive() {
+			size = decimal.Max(size, roundUp(mkt.MinFunds().Div(price), mkt.QuantityStepSize()))
+		}
+		return size
+	}
+}
@@ -0,0 +1,79 @@
+package algo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type POVConfig struct {
+	Config
+
+	// Rate is the share of the market's traded volume the parent keeps to, between 0 and 1. The volume is what the
+	// tickers report trading, the parent's own fills included.
+	Rate decimal.Decimal
+
+	// Duration is the longest the parent is worked for. Set Complete to fill what is left when it runs out.
+	Duration time.Duration
+
+	// Interval is how often the target is raised to keep up with the volume. Defaults to a second.
+	Interval time.Duration
+}
+
+// NewPOV starts working the parent order as a share of the volume the market trades, counting the quantity of each
+// trade the tickers report. A trade is counted once however many tickers carry it.
+func NewPOV(trader types.Trader, config POVConfig) (Execution, error) {
+	if config.Type == "" {
+		config.Type = order.Limit
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if !config.Rate.IsPositive() || config.Rate.GreaterThan(decimal.NewFromInt(1)) {
+		return nil, fmt.Errorf("%w: rate %s", types.ErrInvalidRequest, config.Rate)
+	}
+	if config.Duration <= 0 {
+		return nil, fmt.Errorf("%w: duration %s", types.ErrInvalidRequest, config.Duration)
+	}
+
+	targets := make(chan decimal.Decimal)
+	e := newExecution(trader, config.Config, nil, targets, time.Now().Add(config.Duration))
+	go trackVolume(e, config, targets)
+	return e, nil
+}
+
+// trackVolume sends the execution a target of its share of the volume traded since it started, every interval
+func trackVolume(e *execution, config POVConfig, targets chan<- decimal.Decimal) {
+	tickers := config.Market.TickerStream(e.done)
+	interval := time.NewTicker(config.Interval)
+	defer interval.Stop()
+
+	volume := decimal.Zero
+	var last time.Time
+	for {
+		select {
+		case <-e.done:
+			return
+		case tkr, ok := <-tickers:
+			if !ok {
+				return
+			}
+			if !tkr.Timestamp().Equal(last) {
+				last = tkr.Timestamp()
+				volume = volume.Add(tkr.Quantity())
+			}
+		case <-interval.C:
+			select {
+			case targets <- volume.Mul(config.Rate):
+			case <-e.done:
+				return
+			}
+		}
+	}
+}
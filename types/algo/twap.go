@@ -0,0 +1,82 @@
+package algo
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type TWAPConfig struct {
+	Config
+
+	// Duration is how long the parent is worked over
+	Duration time.Duration
+
+	// Slices is how many child orders the parent is split into, spread evenly over the duration. Defaults to one a
+	// minute.
+	Slices int
+
+	// Randomize varies the size of each slice and when it is placed by up to this fraction of its share, so the
+	// schedule is harder to spot. It is between 0 and 1.
+	Randomize float64
+}
+
+// NewTWAP starts working the parent order evenly over the duration. Children are placed through the trader's order
+// service, and whatever is unfilled when a slice comes due is cancelled and placed again along with it.
+func NewTWAP(trader types.Trader, config TWAPConfig) (Execution, error) {
+	if config.Type == "" {
+		config.Type = order.Limit
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.Duration <= 0 {
+		return nil, fmt.Errorf("%w: duration %s", types.ErrInvalidRequest, config.Duration)
+	}
+	if config.Randomize < 0 || config.Randomize > 1 {
+		return nil, fmt.Errorf("%w: randomize %v", types.ErrInvalidRequest, config.Randomize)
+	}
+
+	slices := config.Slices
+	if slices <= 0 {
+		slices = int(config.Duration / time.Minute)
+	}
+	if slices < 1 {
+		slices = 1
+	}
+
+	start := time.Now()
+	plan := twapPlan(start, config, slices, rand.New(rand.NewSource(start.UnixNano())))
+	return newExecution(trader, config.Config, plan, nil, start.Add(config.Duration)), nil
+}
+
+// twapPlan spreads the quantity over evenly spaced slices, moving each by up to half the randomized share of its
+// interval so they stay in order
+func twapPlan(start time.Time, config TWAPConfig, slices int, rnd *rand.Rand) []slice {
+	interval := config.Duration / time.Duration(slices)
+	jitter := func() float64 { return config.Randomize * (rnd.Float64()*2 - 1) }
+
+	sizes := make([]decimal.Decimal, slices)
+	total := decimal.Zero
+	for i := range sizes {
+		sizes[i] = decimal.NewFromFloat(1 + jitter())
+		total = total.Add(sizes[i])
+	}
+
+	plan := make([]slice, slices)
+	target := decimal.Zero
+	for i := range plan {
+		target = target.Add(config.Quantity.Mul(sizes[i]).Div(total))
+		at := start.Add(time.Duration(i) * interval)
+		if i > 0 {
+			at = at.Add(time.Duration(jitter() * float64(interval) / 2))
+		}
+		plan[i] = slice{at: at, target: target}
+	}
+	plan[slices-1].target = config.Quantity
+	return plan
+}
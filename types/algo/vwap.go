@@ -0,0 +1,92 @@
+package algo
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/candle"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type VWAPConfig struct {
+	Config
+
+	// Duration is how long the parent is worked over
+	Duration time.Duration
+
+	// Interval is the size of the candles the volume curve is built from, and how often a slice is placed. Defaults
+	// to candle.FiveMinutes.
+	Interval types.CandleInterval
+
+	// Days is how many past days the volume curve averages over, at the same time of day. Defaults to 5.
+	Days int
+}
+
+// NewVWAP starts working the parent order along the market's volume curve, placing more of it at the times of day
+// the market usually trades more. The curve is built from the market's candles over the past days. A market
+// without candles for the period is worked evenly.
+func NewVWAP(trader types.Trader, config VWAPConfig) (Execution, error) {
+	if config.Type == "" {
+		config.Type = order.Limit
+	}
+	if config.Interval == "" {
+		config.Interval = candle.FiveMinutes
+	}
+	if config.Days <= 0 {
+		config.Days = 5
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.Duration <= 0 {
+		return nil, fmt.Errorf("%w: duration %s", types.ErrInvalidRequest, config.Duration)
+	}
+	length, err := time.ParseDuration(string(config.Interval))
+	if err != nil || length <= 0 {
+		return nil, fmt.Errorf("%w: candle interval %q", types.ErrInvalidRequest, config.Interval)
+	}
+
+	start := time.Now()
+	curve, err := volumeCurve(config, start, length)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := make([]slice, len(curve))
+	total := decimal.Sum(decimal.Zero, curve...)
+	target := decimal.Zero
+	for i, volume := range curve {
+		target = target.Add(config.Quantity.Mul(volume).Div(total))
+		plan[i] = slice{at: start.Add(time.Duration(i) * length), target: target}
+	}
+	plan[len(plan)-1].target = config.Quantity
+	return newExecution(trader, config.Config, plan, nil, start.Add(config.Duration)), nil
+}
+
+// volumeCurve sums the volume traded in each interval of the duration on the past days. Intervals that saw no
+// volume count as one, so every slice gets something and a market without history is worked evenly.
+func volumeCurve(config VWAPConfig, start time.Time, length time.Duration) ([]decimal.Decimal, error) {
+	buckets := int((config.Duration + length - 1) / length)
+	curve := make([]decimal.Decimal, buckets)
+	for day := 1; day <= config.Days; day++ {
+		from := start.Add(-time.Duration(day) * 24 * time.Hour)
+		candles, err := config.Market.Candles(config.Interval, from, from.Add(config.Duration))
+		if err != nil {
+			return nil, fmt.Errorf("could not get the volume curve of %s: %w", config.Market.Name(), err)
+		}
+		for _, c := range candles {
+			if i := int(c.Timestamp().Sub(from) / length); i >= 0 && i < buckets {
+				curve[i] = curve[i].Add(c.Volume())
+			}
+		}
+	}
+
+	for i := range curve {
+		if !curve[i].IsPositive() {
+			curve[i] = decimal.NewFromInt(1)
+		}
+	}
+	return curve, nil
+}
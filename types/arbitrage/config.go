@@ -0,0 +1,7 @@
+package arbitrage
+
+import "github.com/spf13/viper"
+
+func init() {
+	viper.SetDefault("currencytrader.arbitrage.streamBufferSize", 16)
+}
@@ -0,0 +1,358 @@
+package arbitrage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+// Scanner watches every three-currency cycle of markets on a venue for trades that end with more of the starting
+// currency than they began with
+type Scanner interface {
+	types.Administerable
+
+	// Cycles returns the latest evaluation of every cycle that can be priced, most profitable first
+	Cycles() []Opportunity
+
+	// Opportunities streams cycles as their return meets the threshold
+	Opportunities(stop <-chan bool) <-chan Opportunity
+}
+
+type ScannerConfig struct {
+	// Amounts sizes cycles by the symbol of the currency they start from. Cycles only start from these currencies.
+	Amounts map[string]decimal.Decimal
+
+	// Threshold is the return after fees and rounding, as a fraction of the amount, a cycle needs to be reported
+	Threshold decimal.Decimal
+}
+
+// Opportunity is a priced cycle along with the orders that capture it
+type Opportunity struct {
+	Venue string
+
+	// Path lists the currency symbols the cycle trades through, ending where it started
+	Path []string
+
+	// Start is the amount of the first currency spent and End the amount received back
+	Start decimal.Decimal
+	End   decimal.Decimal
+
+	// Return is End over Start, less one
+	Return decimal.Decimal
+
+	// Requests are the limit orders to place in sequence, each spending what the one before it received
+	Requests []types.OrderRequest
+
+	Timestamp time.Time
+}
+
+// hop trades from one currency to the next on a market, buying its base currency or selling it
+type hop struct {
+	market types.Market
+	buy    bool
+}
+
+type cycle struct {
+	key   string
+	venue string
+	path  []string
+	hops  []hop
+}
+
+type scanner struct {
+	log    log.Entry
+	trader types.Trader
+	config ScannerConfig
+
+	mutex      sync.RWMutex
+	stop       chan bool
+	running    bool
+	byMarket   map[string][]*cycle
+	tickers    map[string]types.Ticker
+	takerRates map[string]decimal.Decimal
+	latest     map[string]Opportunity
+	reported   map[string]decimal.Decimal
+	streams    []chan Opportunity
+}
+
+// New creates a scanner over the markets of the trader. The trader needs to be started for tickers to flow.
+func New(trader types.Trader, config ScannerConfig) Scanner {
+	return &scanner{
+		log:    log.WithField("source", "arbitrage.scanner"),
+		trader: trader,
+		config: config,
+	}
+}
+
+func (s *scanner) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.running {
+		return
+	}
+
+	fees, err := s.trader.AccountSvc().Fees()
+	if err != nil {
+		s.log.WithError(err).Error("could not get fees; not scanning")
+		return
+	}
+	s.takerRates = map[string]decimal.Decimal{"": fees.TakerRate()}
+	for _, f := range fees.Breakdown() {
+		s.takerRates[f.Venue()] = f.TakerRate()
+	}
+
+	s.byMarket = make(map[string][]*cycle)
+	s.tickers = make(map[string]types.Ticker)
+	s.latest = make(map[string]Opportunity)
+	s.reported = make(map[string]decimal.Decimal)
+	markets := map[string]types.Market{}
+	for _, c := range buildCycles(s.trader.MarketSvc().Markets(), s.config.Amounts) {
+		for _, h := range c.hops {
+			key := marketKey(h.market)
+			s.byMarket[key] = append(s.byMarket[key], c)
+			markets[key] = h.market
+		}
+	}
+
+	s.stop = make(chan bool)
+	s.running = true
+	for key, mkt := range markets {
+		go s.watch(key, mkt.TickerStream(s.stop))
+	}
+	s.log.Debugf("scanning %d markets", len(markets))
+}
+
+func (s *scanner) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.running {
+		return
+	}
+	close(s.stop)
+	s.running = false
+}
+
+func (s *scanner) Cycles() []Opportunity {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	opps := make([]Opportunity, 0, len(s.latest))
+	for _, opp := range s.latest {
+		opps = append(opps, opp)
+	}
+	sort.Slice(opps, func(i, j int) bool { return opps[i].Return.GreaterThan(opps[j].Return) })
+	return opps
+}
+
+func (s *scanner) Opportunities(stop <-chan bool) <-chan Opportunity {
+	stream := make(chan Opportunity, viper.GetInt("currencytrader.arbitrage.streamBufferSize"))
+
+	s.mutex.Lock()
+	s.streams = append(s.streams, stream)
+	s.mutex.Unlock()
+
+	go func() {
+		<-stop
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for i, c := range s.streams {
+			if c == stream {
+				s.streams = append(s.streams[:i], s.streams[i+1:]...)
+				close(stream)
+				break
+			}
+		}
+	}()
+	return stream
+}
+
+func (s *scanner) watch(key string, stream <-chan types.Ticker) {
+	for tkr := range stream {
+		s.update(key, tkr)
+	}
+}
+
+// update reprices every cycle through the market and reports the ones that meet the threshold
+func (s *scanner) update(key string, tkr types.Ticker) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tickers[key] = tkr
+
+	for _, c := range s.byMarket[key] {
+		opp, ok := s.evaluate(c)
+		if !ok {
+			delete(s.latest, c.key)
+			continue
+		}
+		s.latest[c.key] = opp
+
+		if opp.Return.LessThan(s.config.Threshold) {
+			delete(s.reported, c.key)
+			continue
+		}
+		if last, ok := s.reported[c.key]; ok && last.Equal(opp.Return) {
+			continue
+		}
+		s.reported[c.key] = opp.Return
+
+		for _, stream := range s.streams {
+			select {
+			case stream <- opp:
+			default:
+				s.log.Warn("skipping blocked opportunity channel")
+			}
+		}
+	}
+}
+
+// evaluate walks the cycle at the latest prices. Prices are rounded to the market's increment against us and
+// quantities down to its step size, so the orders can be placed as they are.
+func (s *scanner) evaluate(c *cycle) (Opportunity, bool) {
+	taker, ok := s.takerRates[c.venue]
+	if !ok {
+		taker = s.takerRates[""]
+	}
+	one := decimal.NewFromInt(1)
+
+	start := s.config.Amounts[c.path[0]]
+	amount := start
+	requests := make([]types.OrderRequest, 0, len(c.hops))
+	for _, h := range c.hops {
+		tkr, ok := s.tickers[marketKey(h.market)]
+		if !ok {
+			return Opportunity{}, false
+		}
+		mkt := h.market
+
+		var price, quantity decimal.Decimal
+		if h.buy {
+			price = roundUp(tkr.Ask(), mkt.PriceIncrement())
+			if !price.IsPositive() {
+				return Opportunity{}, false
+			}
+			quantity = roundDown(amount.Div(price.Mul(one.Add(taker))), mkt.QuantityStepSize())
+			amount = quantity
+		} else {
+			price = roundDown(tkr.Bid(), mkt.PriceIncrement())
+			quantity = roundDown(amount, mkt.QuantityStepSize())
+			amount = roundDown(quantity.Mul(price).Mul(one.Sub(taker)), mkt.QuoteCurrency().Increment())
+		}
+
+		funds := quantity.Mul(price)
+		if !price.IsPositive() || !quantity.IsPositive() || quantity.LessThan(mkt.MinQuantity()) || funds.LessThan(mkt.MinFunds()) {
+			return Opportunity{}, false
+		}
+
+		side := order.Sell
+		if h.buy {
+			side = order.Buy
+		}
+		requests = append(requests, order.NewRequest(mkt, order.Limit, side, quantity, price, decimal.Zero, false))
+	}
+
+	return Opportunity{
+		Venue:     c.venue,
+		Path:      append([]string{}, c.path...),
+		Start:     start,
+		End:       amount,
+		Return:    amount.Div(start).Sub(one),
+		Requests:  requests,
+		Timestamp: time.Now(),
+	}, true
+}
+
+// buildCycles finds every cycle of three currencies on a venue that starts from one of the sized currencies
+func buildCycles(markets []types.Market, amounts map[string]decimal.Decimal) []*cycle {
+	graphs := map[string]map[string]map[string]hop{}
+	link := func(venue string, from string, to string, h hop) {
+		if graphs[venue] == nil {
+			graphs[venue] = map[string]map[string]hop{}
+		}
+		if graphs[venue][from] == nil {
+			graphs[venue][from] = map[string]hop{}
+		}
+		graphs[venue][from][to] = h
+	}
+	for _, mkt := range markets {
+		base, quote := mkt.BaseCurrency().Symbol(), mkt.QuoteCurrency().Symbol()
+		link(mkt.Venue(), base, quote, hop{market: mkt})
+		link(mkt.Venue(), quote, base, hop{market: mkt, buy: true})
+	}
+
+	cycles := []*cycle{}
+	for _, venue := range venueKeys(graphs) {
+		graph := graphs[venue]
+		for _, start := range amountKeys(amounts) {
+			if !amounts[start].IsPositive() {
+				continue
+			}
+			for _, second := range hopKeys(graph[start]) {
+				for _, third := range hopKeys(graph[second]) {
+					back, ok := graph[third][start]
+					if third == start || !ok {
+						continue
+					}
+					path := []string{start, second, third, start}
+					cycles = append(cycles, &cycle{
+						key:   venue + ":" + start + ">" + second + ">" + third,
+						venue: venue,
+						path:  path,
+						hops:  []hop{graph[start][second], graph[second][third], back},
+					})
+				}
+			}
+		}
+	}
+	return cycles
+}
+
+func venueKeys(m map[string]map[string]map[string]hop) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func amountKeys(m map[string]decimal.Decimal) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hopKeys(m map[string]hop) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func marketKey(mkt types.Market) string {
+	return mkt.Venue() + ":" + mkt.Name()
+}
+
+func roundDown(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Floor().Mul(step)
+}
+
+func roundUp(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Ceil().Mul(step)
+}
@@ -0,0 +1,160 @@
+package arbitrage_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/arbitrage"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+// fixedPrices quotes the same prices for every tick so cycles have a known return
+type fixedPrices struct {
+	types.Provider
+	tickers map[string]types.TickerDTO
+}
+
+func (p *fixedPrices) Ticker(mkt types.MarketDTO) (types.TickerDTO, error) {
+	tkr, ok := p.tickers[mkt.Name]
+	if !ok {
+		return tkr, fmt.Errorf("no price for %s", mkt.Name)
+	}
+	tkr.Timestamp = time.Now()
+	return tkr, nil
+}
+
+func (p *fixedPrices) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	stream := make(chan types.TickerDTO)
+	go func() {
+		defer close(stream)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			tkr, err := p.Ticker(mkt)
+			if err != nil {
+				continue
+			}
+			select {
+			case stream <- tkr:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return stream, nil
+}
+
+func quote(bid string, ask string) types.TickerDTO {
+	return types.TickerDTO{Bid: decimal.RequireFromString(bid), Ask: decimal.RequireFromString(ask)}
+}
+
+// newScanner prices BTC at 10000 USD and ETH at 1000 USD, but BTC at 11 ETH, so selling USD for BTC, BTC for ETH
+// and ETH back for USD makes about 10% before fees
+func newScanner(t *testing.T, taker float64, threshold float64) arbitrage.Scanner {
+	provider := &fixedPrices{
+		Provider: simulated.New(simulated.ProviderConfig{
+			Fees: types.FeesDTO{
+				MakerRate: decimal.NewFromFloat(taker),
+				TakerRate: decimal.NewFromFloat(taker),
+			},
+			TickInterval: 20 * time.Millisecond,
+		}),
+		tickers: map[string]types.TickerDTO{
+			"USDBTC": quote("0.0001", "0.00010001"),
+			"USDETH": quote("0.001", "0.00100001"),
+			"BTCETH": quote("11", "11.00000001"),
+		},
+	}
+
+	trader := currencytrader.New(provider)
+	trader.Start()
+	t.Cleanup(trader.Stop)
+
+	scanner := arbitrage.New(trader, arbitrage.ScannerConfig{
+		Amounts:   map[string]decimal.Decimal{"USD": decimal.NewFromInt(1000)},
+		Threshold: decimal.NewFromFloat(threshold),
+	})
+	scanner.Start()
+	t.Cleanup(scanner.Stop)
+	return scanner
+}
+
+func TestOpportunityNetOfFees(t *testing.T) {
+	scanner := newScanner(t, 0.01, 0.05)
+	stop := make(chan bool)
+	defer close(stop)
+	stream := scanner.Opportunities(stop)
+
+	var opp arbitrage.Opportunity
+	select {
+	case opp = <-stream:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no opportunity was reported")
+	}
+
+	if fmt.Sprint(opp.Path) != "[USD BTC ETH USD]" {
+		t.Fatalf("cycle is %v; expected [USD BTC ETH USD]", opp.Path)
+	}
+
+	// Sell 1000 USD for 0.099 BTC after fees, which sells for 1.07811 ETH, which buys back 1067.42 USD after fees
+	expected := []struct {
+		market   string
+		side     types.OrderSide
+		quantity string
+		price    string
+	}{
+		{"USDBTC", order.Sell, "1000", "0.0001"},
+		{"BTCETH", order.Sell, "0.099", "11"},
+		{"USDETH", order.Buy, "1067.42", "0.00100001"},
+	}
+	if len(opp.Requests) != len(expected) {
+		t.Fatalf("opportunity has %d requests; expected %d", len(opp.Requests), len(expected))
+	}
+	for i, e := range expected {
+		req := opp.Requests[i]
+		if req.Market().Name() != e.market || req.Side() != e.side || !req.Quantity().Equal(decimal.RequireFromString(e.quantity)) || !req.Price().Equal(decimal.RequireFromString(e.price)) {
+			t.Errorf("request %d is %s %s %s at %s; expected %s %s %s at %s", i, req.Side(), req.Quantity(), req.Market().Name(), req.Price(), e.side, e.quantity, e.market, e.price)
+		}
+	}
+	if !opp.End.Equal(decimal.RequireFromString("1067.42")) || !opp.Return.Equal(decimal.RequireFromString("0.06742")) {
+		t.Errorf("cycle ends with %s for a return of %s; expected 1067.42 for 0.06742", opp.End, opp.Return)
+	}
+}
+
+func TestOpportunityBelowThreshold(t *testing.T) {
+	// At 2% a trade the cycle only makes about 3.5%
+	scanner := newScanner(t, 0.02, 0.05)
+	stop := make(chan bool)
+	defer close(stop)
+	stream := scanner.Opportunities(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(scanner.Cycles()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no cycles were priced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	best := scanner.Cycles()[0]
+	if fmt.Sprint(best.Path) != "[USD BTC ETH USD]" || !best.Return.IsPositive() || !best.Return.LessThan(decimal.NewFromFloat(0.05)) {
+		t.Errorf("best cycle is %v returning %s; expected [USD BTC ETH USD] returning under 5%%", best.Path, best.Return)
+	}
+
+	select {
+	case opp := <-stream:
+		t.Errorf("cycle %v returning %s was reported below the threshold", opp.Path, opp.Return)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,239 @@
+package contingent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+// bracket closes what its entry fills with a take-profit and a stop-loss that cancel each other
+type bracket struct {
+	handle
+	trader       types.Trader
+	config       BracketConfig
+	creationTime time.Time
+	request      types.OrderRequestDTO
+	entry        types.Order
+
+	cancel     chan bool
+	cancelOnce sync.Once
+	changed    chan bool
+
+	// exits is guarded by the handle's mutex and only set by the goroutine working the bracket
+	exits     *oco
+	cancelled bool
+}
+
+// NewBracket places the entry, then closes what it fills with a take-profit and a stop-loss on the other side of
+// the market that cancel each other. The exits are sized to what the entry filled and grow as it fills. Filled,
+// Paid and Fees are the entry's, and the bracket is filled once the exits closed the whole position.
+func NewBracket(trader types.Trader, config BracketConfig) (Group, error) {
+	if err := validate(config.Market, config.Side, config.Quantity); err != nil {
+		return nil, err
+	}
+	config.Entry = config.Entry.withDefaults()
+	if err := config.Entry.validate(); err != nil {
+		return nil, err
+	}
+	switch {
+	case config.Entry.StopPrice.IsPositive():
+		return nil, fmt.Errorf("%w: the entry of a bracket can't have a stop price", types.ErrInvalidRequest)
+	case !config.TakeProfit.IsPositive() || !config.StopLoss.IsPositive() || config.StopLimit.IsNegative():
+		return nil, fmt.Errorf("%w: take profit %s, stop loss %s, stop limit %s", types.ErrInvalidRequest, config.TakeProfit, config.StopLoss, config.StopLimit)
+	case config.Side == order.Buy && !config.TakeProfit.GreaterThan(config.StopLoss):
+		return nil, fmt.Errorf("%w: take profit %s isn't over stop loss %s", types.ErrInvalidRequest, config.TakeProfit, config.StopLoss)
+	case config.Side == order.Sell && !config.TakeProfit.LessThan(config.StopLoss):
+		return nil, fmt.Errorf("%w: take profit %s isn't under stop loss %s", types.ErrInvalidRequest, config.TakeProfit, config.StopLoss)
+	}
+
+	id := uuid.New().String()
+	req := types.OrderRequestDTO{
+		Market:   config.Market.ToDTO(),
+		Side:     config.Side,
+		Type:     config.Entry.Type,
+		Quantity: config.Quantity,
+	}
+	if config.Entry.Type == order.Limit {
+		req.Price = config.Entry.Price
+	}
+	entry, err := trader.OrderSvc().AttemptOrder(config.Market, order.NewRequestFromDTO(config.Market, req))
+	if err != nil {
+		return nil, fmt.Errorf("could not place the entry of order %s: %w", id, err)
+	}
+
+	req.ClientID = id
+	b := &bracket{
+		handle:       newHandle("contingent.bracket", id),
+		trader:       trader,
+		config:       config,
+		creationTime: time.Now(),
+		request:      req,
+		entry:        entry,
+		cancel:       make(chan bool),
+		changed:      make(chan bool, 1),
+	}
+	go watch(entry, b.changed)
+	go b.run()
+	return b, nil
+}
+
+func (b *bracket) run() {
+	cancel := b.cancel
+	for {
+		b.step()
+		if b.IsDone() {
+			return
+		}
+
+		select {
+		case <-cancel:
+			cancel = nil
+			b.cancelAll()
+		case <-b.changed:
+		}
+	}
+}
+
+// step sizes the exits to what the entry filled, placing them once it starts filling, and updates the status
+func (b *bracket) step() {
+	filled := b.entry.Filled()
+	final := b.entry.IsDone()
+	b.mutex.RLock()
+	exits, cancelled := b.exits, b.cancelled
+	b.mutex.RUnlock()
+
+	switch {
+	case !filled.IsPositive() || cancelled:
+	case exits == nil:
+		stop := Leg{Type: order.Market, StopPrice: b.config.StopLoss}
+		if b.config.StopLimit.IsPositive() {
+			stop = Leg{Type: order.Limit, Price: b.config.StopLimit, StopPrice: b.config.StopLoss}
+		}
+		legs := []Leg{{Type: order.Limit, Price: b.config.TakeProfit}, stop}
+		placed, err := newOCO(b.trader, b.config.Market, opposite(b.config.Side), size{quantity: filled, final: final}, legs, b.id+":exits")
+		if err != nil {
+			// The exits are tried again as the entry fills some more
+			b.log.WithError(err).Errorf("could not place the exits of order %s", b.id)
+			b.trader.Events().Publish(types.Event{Type: types.EventError, Market: b.request.Market, Err: err})
+			break
+		}
+		b.mutex.Lock()
+		b.exits = placed
+		b.mutex.Unlock()
+		exits = placed
+		go watch(placed, b.changed)
+	default:
+		exits.setSize(size{quantity: filled, final: final})
+	}
+
+	b.setStatus(b.derive(exits))
+}
+
+// derive works the status out from the entry and the exits: partial from the entry's first fill until the exits
+// close the position, and filled once they have
+func (b *bracket) derive(exits *oco) types.OrderStatus {
+	entry := b.entry
+	filled := entry.Filled()
+	switch {
+	case !entry.IsDone() && filled.IsPositive():
+		return order.Partial
+	case !entry.IsDone():
+		return order.Pending
+	case !filled.IsPositive() && entry.Status() == order.Rejected:
+		return order.Rejected
+	case !filled.IsPositive() || exits == nil:
+		return order.Canceled
+	case !exits.IsDone():
+		return order.Partial
+	case exits.Status() == order.Filled:
+		return order.Filled
+	default:
+		return order.Canceled
+	}
+}
+
+func (b *bracket) cancelAll() {
+	b.mutex.Lock()
+	b.cancelled = true
+	exits := b.exits
+	b.mutex.Unlock()
+
+	if !b.entry.IsDone() {
+		if err := b.trader.OrderSvc().CancelOrder(b.entry); err != nil {
+			b.log.WithError(err).Warnf("could not cancel the entry of order %s", b.id)
+		}
+	}
+	if exits != nil {
+		exits.Cancel()
+	}
+}
+
+func (b *bracket) Cancel() {
+	b.cancelOnce.Do(func() { close(b.cancel) })
+}
+
+// Children lists the entry and the orders placed to exit
+func (b *bracket) Children() []types.Order {
+	b.mutex.RLock()
+	exits := b.exits
+	b.mutex.RUnlock()
+
+	children := []types.Order{b.entry}
+	if exits != nil {
+		children = append(children, exits.Children()...)
+	}
+	return children
+}
+
+func (b *bracket) CreationTime() time.Time { return b.creationTime }
+
+func (b *bracket) Fees() (types.OrderSide, decimal.Decimal) { return b.entry.Fees() }
+
+func (b *bracket) Filled() decimal.Decimal { return b.entry.Filled() }
+
+func (b *bracket) Market() types.Market { return b.config.Market }
+
+func (b *bracket) Paid() decimal.Decimal { return b.entry.Paid() }
+
+func (b *bracket) Refresh() (err error) {
+	if !b.entry.IsDone() {
+		err = b.entry.Refresh()
+	}
+	b.mutex.RLock()
+	exits := b.exits
+	b.mutex.RUnlock()
+	if exits != nil {
+		if e := exits.Refresh(); e != nil && err == nil {
+			err = e
+		}
+	}
+	select {
+	case b.changed <- true:
+	default:
+	}
+	return
+}
+
+func (b *bracket) Request() types.OrderRequest {
+	return order.NewRequestFromDTO(b.config.Market, b.request)
+}
+
+func (b *bracket) ToDTO() types.OrderDTO {
+	entry := b.entry.ToDTO()
+	return types.OrderDTO{
+		Market:       b.request.Market,
+		CreationTime: b.creationTime,
+		Fees:         entry.Fees,
+		FeesSide:     entry.FeesSide,
+		Filled:       entry.Filled,
+		ID:           b.id,
+		Paid:         entry.Paid,
+		Request:      b.request,
+		Status:       b.Status(),
+	}
+}
@@ -0,0 +1,13 @@
+package contingent
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("currencytrader.contingent.cancelTimeout", 30*time.Second)
+	viper.SetDefault("currencytrader.contingent.retryInterval", time.Second)
+	viper.SetDefault("currencytrader.contingent.streamBufferSize", 8)
+}
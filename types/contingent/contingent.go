@@ -0,0 +1,247 @@
+// Package contingent places groups of orders that depend on each other: one-cancels-other groups, where the first
+// order to fill cancels the rest, and brackets, which close what an entry order fills with a take-profit and a
+// stop-loss. Groups last as long as the process; the orders they place are listed and journaled by the order service
+// like any other.
+package contingent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+// Group is a set of orders worked as one. Children lists every order placed for it.
+type Group interface {
+	types.AggregateOrder
+
+	// Cancel cancels the group's open orders and drops the ones it holds back. The group is done once its orders
+	// are.
+	Cancel()
+}
+
+// Leg is one of the orders of a group
+type Leg struct {
+	// Type is the type of the order. Defaults to order.Limit, or order.Market for a leg with a stop price.
+	Type types.OrderType
+
+	// Price is the limit price of a limit order
+	Price decimal.Decimal
+
+	// StopPrice holds the order back until the market's last price reaches it: until it falls to it for a sell
+	// and rises to it for a buy. Stops are kept on the client, so they only work while the group runs.
+	StopPrice decimal.Decimal
+}
+
+type OCOConfig struct {
+	Market   types.Market
+	Side     types.OrderSide
+	Quantity decimal.Decimal
+
+	// Legs are the orders that cancel each other, each for the whole quantity. There are at least two.
+	Legs []Leg
+}
+
+type BracketConfig struct {
+	Market   types.Market
+	Side     types.OrderSide
+	Quantity decimal.Decimal
+
+	// Entry is the order that opens the position
+	Entry Leg
+
+	// TakeProfit is the limit price of the order closing the position at a profit
+	TakeProfit decimal.Decimal
+
+	// StopLoss is the stop price of the order closing the position at a loss. It is placed as a market order
+	// unless StopLimit gives it a limit price.
+	StopLoss  decimal.Decimal
+	StopLimit decimal.Decimal
+}
+
+func (l Leg) withDefaults() Leg {
+	if l.Type == "" {
+		l.Type = order.Limit
+		if l.StopPrice.IsPositive() {
+			l.Type = order.Market
+		}
+	}
+	return l
+}
+
+func (l Leg) validate() error {
+	switch {
+	case l.Type != order.Limit && l.Type != order.Market:
+		return fmt.Errorf("%w: order type %q", types.ErrInvalidRequest, l.Type)
+	case l.Type == order.Limit && !l.Price.IsPositive():
+		return fmt.Errorf("%w: limit price %s", types.ErrInvalidRequest, l.Price)
+	case l.StopPrice.IsNegative():
+		return fmt.Errorf("%w: stop price %s", types.ErrInvalidRequest, l.StopPrice)
+	}
+	return nil
+}
+
+func validate(mkt types.Market, side types.OrderSide, quantity decimal.Decimal) error {
+	switch {
+	case mkt == nil:
+		return fmt.Errorf("%w: no market", types.ErrInvalidRequest)
+	case side != order.Buy && side != order.Sell:
+		return fmt.Errorf("%w: side %q", types.ErrInvalidRequest, side)
+	case !quantity.IsPositive():
+		return fmt.Errorf("%w: quantity %s", types.ErrInvalidRequest, quantity)
+	}
+	return nil
+}
+
+// handle holds the status of a group and the streams following it
+type handle struct {
+	log log.Entry
+	id  string
+
+	mutex   sync.RWMutex
+	status  types.OrderStatus
+	streams []chan types.OrderStatus
+	done    chan bool
+}
+
+func newHandle(source string, id string) handle {
+	return handle{
+		log:    log.WithField("source", source),
+		id:     id,
+		status: order.Pending,
+		done:   make(chan bool),
+	}
+}
+
+// setStatus moves the group to the status and tells the streams, closing them once it is done
+func (h *handle) setStatus(status types.OrderStatus) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if order.IsDone(h.status) || status == h.status {
+		return
+	}
+	h.status = status
+
+	for _, stream := range h.streams {
+		select {
+		case stream <- status:
+		default:
+			h.log.Warnf("skipping blocked order status channel for order %s", h.id)
+		}
+	}
+	if order.IsDone(status) {
+		for _, stream := range h.streams {
+			close(stream)
+		}
+		h.streams = nil
+		close(h.done)
+	}
+}
+
+func (h *handle) Done() <-chan bool { return h.done }
+
+func (h *handle) ID() string { return h.id }
+
+func (h *handle) IsDone() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (h *handle) Status() types.OrderStatus {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.status
+}
+
+func (h *handle) StatusStream(stop <-chan bool) <-chan types.OrderStatus {
+	stream := make(chan types.OrderStatus, viper.GetInt("currencytrader.contingent.streamBufferSize"))
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	stream <- h.status
+	if order.IsDone(h.status) {
+		close(stream)
+		return stream
+	}
+	h.streams = append(h.streams, stream)
+
+	go func() {
+		select {
+		case <-stop:
+		case <-h.done:
+			return
+		}
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		for i, s := range h.streams {
+			if s == stream {
+				h.streams = append(h.streams[:i], h.streams[i+1:]...)
+				close(stream)
+				break
+			}
+		}
+	}()
+	return stream
+}
+
+// watch pokes changed whenever the order changes, until it is done
+func watch(o types.Order, changed chan<- bool) {
+	stop := make(chan bool)
+	defer close(stop)
+	for range o.StatusStream(stop) {
+		select {
+		case changed <- true:
+		default:
+		}
+	}
+	select {
+	case changed <- true:
+	default:
+	}
+}
+
+// awaitDone waits for the order to be done, for up to currencytrader.contingent.cancelTimeout, reporting whether
+// it was
+func awaitDone(o types.Order) bool {
+	select {
+	case <-o.Done():
+		return true
+	case <-time.After(viper.GetDuration("currencytrader.contingent.cancelTimeout")):
+		return false
+	}
+}
+
+// price is the ticker's last price, or the side of the book an order on the side would take without one
+func price(tkr types.Ticker, side types.OrderSide) decimal.Decimal {
+	if tkr.Price().IsPositive() {
+		return tkr.Price()
+	}
+	if side == order.Sell {
+		return tkr.Bid()
+	}
+	return tkr.Ask()
+}
+
+func opposite(side types.OrderSide) types.OrderSide {
+	if side == order.Buy {
+		return order.Sell
+	}
+	return order.Buy
+}
+
+func roundDown(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Floor().Mul(step)
+}
@@ -0,0 +1,185 @@
+package contingent_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/contingent"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/trader/tradertest"
+)
+
+func setup(t *testing.T) (types.Trader, types.Market, types.Ticker) {
+	trader, mkt := tradertest.Start(t)
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trader, mkt, tkr
+}
+
+// scale moves a price by the factor, keeping it to two places
+func scale(price decimal.Decimal, factor float64) decimal.Decimal {
+	return price.Mul(decimal.NewFromFloat(factor)).Round(2)
+}
+
+func TestOCOCancelsTheOtherLeg(t *testing.T) {
+	trader, mkt, tkr := setup(t)
+
+	// The first leg rests well over the market while the second one is under it and fills
+	quantity := decimal.NewFromFloat(0.01)
+	group, err := contingent.NewOCO(trader, contingent.OCOConfig{
+		Market:   mkt,
+		Side:     order.Sell,
+		Quantity: quantity,
+		Legs: []contingent.Leg{
+			{Price: scale(tkr.Ask(), 2)},
+			{Price: scale(tkr.Bid(), 0.9)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tradertest.WaitDone(t, group)
+
+	if group.Status() != order.Filled || !group.Filled().Equal(quantity) {
+		t.Errorf("group ended %s with %s filled; expected %s filled", group.Status(), group.Filled(), quantity)
+	}
+	children := group.Children()
+	if len(children) != 2 || children[0].Status() != order.Canceled || children[1].Status() != order.Filled {
+		for _, child := range children {
+			t.Logf("leg %s is %s at %s", child.ID(), child.Status(), child.Request().Price())
+		}
+		t.Error("expected the resting leg cancelled and the other one filled")
+	}
+}
+
+func TestOCOStopLegFires(t *testing.T) {
+	trader, mkt, tkr := setup(t)
+
+	// The stop is over the market, so the first ticker sets off the sell
+	group, err := contingent.NewOCO(trader, contingent.OCOConfig{
+		Market:   mkt,
+		Side:     order.Sell,
+		Quantity: decimal.NewFromFloat(0.01),
+		Legs: []contingent.Leg{
+			{Price: scale(tkr.Ask(), 2)},
+			{StopPrice: scale(tkr.Ask(), 1.5)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(group.Children()); n != 1 {
+		t.Fatalf("group placed %d legs up front; expected the stop to be held back", n)
+	}
+	tradertest.WaitDone(t, group)
+
+	children := group.Children()
+	if group.Status() != order.Filled || len(children) != 2 || children[1].Request().Type() != order.Market {
+		t.Errorf("group ended %s with %d legs; expected the stop to fire a market order and fill", group.Status(), len(children))
+	}
+}
+
+func TestBracketClosesWhatTheEntryFills(t *testing.T) {
+	trader, mkt, tkr := setup(t)
+
+	// The entry and the take-profit both cross the market. The simulated exchange fills each order in two steps, so
+	// the exits start at half the entry and grow with it.
+	quantity := decimal.NewFromFloat(0.02)
+	group, err := contingent.NewBracket(trader, contingent.BracketConfig{
+		Market:     mkt,
+		Side:       order.Buy,
+		Quantity:   quantity,
+		Entry:      contingent.Leg{Price: scale(tkr.Ask(), 1.1)},
+		TakeProfit: scale(tkr.Bid(), 0.9),
+		StopLoss:   scale(tkr.Bid(), 0.5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := group.StatusStream(make(chan bool))
+	tradertest.WaitDone(t, group)
+
+	seen := []types.OrderStatus{}
+	for status := range statuses {
+		seen = append(seen, status)
+	}
+	if group.Status() != order.Filled || !group.Filled().Equal(quantity) {
+		t.Errorf("bracket ended %s with %s filled after %v; expected %s filled", group.Status(), group.Filled(), seen, quantity)
+	}
+
+	exited := decimal.Zero
+	for _, child := range group.Children()[1:] {
+		if child.Request().Side() != order.Sell || child.Request().Type() != order.Limit {
+			t.Errorf("exit %s is a %s %s; expected take-profit sells", child.ID(), child.Request().Side(), child.Request().Type())
+		}
+		exited = exited.Add(child.Filled())
+	}
+	if !exited.Equal(quantity) {
+		t.Errorf("exits sold %s; expected the %s the entry bought", exited, quantity)
+	}
+}
+
+func TestBracketResizesAndCancels(t *testing.T) {
+	trader, mkt, tkr := setup(t)
+
+	// The exits are out of the market's reach, so they rest until the bracket is cancelled
+	quantity := decimal.NewFromFloat(0.02)
+	group, err := contingent.NewBracket(trader, contingent.BracketConfig{
+		Market:     mkt,
+		Side:       order.Buy,
+		Quantity:   quantity,
+		Entry:      contingent.Leg{Price: scale(tkr.Ask(), 1.1)},
+		TakeProfit: scale(tkr.Ask(), 2),
+		StopLoss:   scale(tkr.Bid(), 0.5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resting types.Order
+	deadline := time.Now().Add(5 * time.Second)
+	for resting == nil {
+		for _, child := range group.Children()[1:] {
+			if !child.IsDone() && child.Request().Quantity().Equal(quantity) {
+				resting = child
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("take-profit wasn't resized to the whole entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if group.Status() != order.Partial {
+		t.Errorf("bracket with a filled entry is %s; expected %s", group.Status(), order.Partial)
+	}
+
+	group.Cancel()
+	tradertest.WaitDone(t, group)
+	if group.Status() != order.Canceled {
+		t.Errorf("cancelled bracket is %s; expected %s", group.Status(), order.Canceled)
+	}
+	for _, child := range group.Children() {
+		if !child.IsDone() {
+			t.Errorf("order %s is still %s", child.ID(), child.Status())
+		}
+	}
+}
+
+func TestBracketRejectsCrossedExits(t *testing.T) {
+	trader, mkt, tkr := setup(t)
+	_, err := contingent.NewBracket(trader, contingent.BracketConfig{
+		Market:     mkt,
+		Side:       order.Buy,
+		Quantity:   decimal.NewFromFloat(0.01),
+		Entry:      contingent.Leg{Price: tkr.Bid()},
+		TakeProfit: scale(tkr.Bid(), 0.5),
+		StopLoss:   scale(tkr.Bid(), 0.9),
+	})
+	if err == nil {
+		t.Error("NewBracket() accepted a take-profit under the stop-loss of a buy")
+	}
+}
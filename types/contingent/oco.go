@@ -0,0 +1,510 @@
+package contingent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+// oco works legs that cancel each other. The first leg to fill wins and works the whole quantity, and the others
+// are cancelled.
+type oco struct {
+	handle
+	trader       types.Trader
+	market       types.Market
+	side         types.OrderSide
+	creationTime time.Time
+	request      types.OrderRequestDTO
+
+	cancel     chan bool
+	cancelOnce sync.Once
+	sizes      chan size
+	changed    chan bool
+
+	// The rest is guarded by the handle's mutex and only changed by the goroutine working the group
+	quantity  decimal.Decimal
+	final     bool
+	cancelled bool
+	legs      []*leg
+	children  []types.Order
+	winner    *leg
+}
+
+// size is how much the group has to fill, and whether that can still grow
+type size struct {
+	quantity decimal.Decimal
+	final    bool
+}
+
+type leg struct {
+	Leg
+	orders []types.Order
+
+	// target is the size of the group when the leg last placed an order
+	target decimal.Decimal
+
+	// dropped legs place no more orders, since another leg filled first or the group was cancelled
+	dropped bool
+}
+
+// NewOCO places the legs, holding back the ones with a stop price until the market reaches it. Once one of them
+// fills, the rest are cancelled. Filled, Paid and Fees are the sums of the legs.
+func NewOCO(trader types.Trader, config OCOConfig) (Group, error) {
+	if err := validate(config.Market, config.Side, config.Quantity); err != nil {
+		return nil, err
+	}
+	if len(config.Legs) < 2 {
+		return nil, fmt.Errorf("%w: %d legs", types.ErrInvalidRequest, len(config.Legs))
+	}
+	legs := make([]Leg, len(config.Legs))
+	for i, l := range config.Legs {
+		legs[i] = l.withDefaults()
+		if err := legs[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return newOCO(trader, config.Market, config.Side, size{quantity: config.Quantity, final: true}, legs, uuid.New().String())
+}
+
+// newOCO places the legs that aren't held back, cancelling them again if any of them fails, and works the group. A
+// group whose size isn't final stays open until it is, even once its orders are done.
+func newOCO(trader types.Trader, mkt types.Market, side types.OrderSide, s size, legs []Leg, id string) (*oco, error) {
+	o := &oco{
+		handle:       newHandle("contingent.oco", id),
+		trader:       trader,
+		market:       mkt,
+		side:         side,
+		creationTime: time.Now(),
+		cancel:       make(chan bool),
+		sizes:        make(chan size, 1),
+		changed:      make(chan bool, 1),
+		quantity:     s.quantity,
+		final:        s.final,
+	}
+	o.request = types.OrderRequestDTO{
+		ClientID: id,
+		Market:   mkt.ToDTO(),
+		Side:     side,
+		Quantity: s.quantity,
+		Type:     legs[0].Type,
+		Price:    legs[0].Price,
+	}
+	for _, l := range legs {
+		o.legs = append(o.legs, &leg{Leg: l})
+	}
+
+	for _, l := range o.legs {
+		if l.StopPrice.IsPositive() {
+			continue
+		}
+		if err := o.place(l, o.size()); err != nil {
+			for _, placed := range o.children {
+				if err := trader.OrderSvc().CancelOrder(placed); err != nil {
+					o.log.WithError(err).Errorf("could not cancel leg %s after placing order %s failed", placed.ID(), id)
+				}
+			}
+			return nil, fmt.Errorf("could not place a leg of order %s: %w", id, err)
+		}
+	}
+
+	go o.run()
+	return o, nil
+}
+
+func (o *oco) run() {
+	var tickers <-chan types.Ticker
+	var retry <-chan time.Time
+	var tickStop chan bool
+	follow := func() {
+		tickStop = make(chan bool)
+		tickers = o.market.TickerStream(tickStop)
+	}
+	unfollow := func() {
+		if tickStop != nil {
+			close(tickStop)
+			tickStop, tickers = nil, nil
+		}
+	}
+	defer unfollow()
+	if o.holding() {
+		follow()
+	}
+
+	cancel := o.cancel
+	for {
+		o.settle()
+		o.topUp()
+		o.update()
+		if o.IsDone() {
+			return
+		}
+		if !o.holding() {
+			unfollow()
+		}
+
+		select {
+		case <-cancel:
+			cancel = nil
+			o.cancelAll()
+		case s := <-o.sizes:
+			o.resize(s)
+		case <-o.changed:
+		case tkr, ok := <-tickers:
+			if !ok {
+				o.log.Warnf("ticker stream for order %s closed; opening it again", o.id)
+				tickStop, tickers = nil, nil
+				retry = time.After(viper.GetDuration("currencytrader.contingent.retryInterval"))
+				continue
+			}
+			o.trigger(price(tkr, o.side))
+		case <-retry:
+			retry = nil
+			if o.holding() {
+				follow()
+			}
+		}
+	}
+}
+
+// settle picks the first leg to fill as the winner, cancelling the others
+func (o *oco) settle() {
+	var siblings []types.Order
+	o.mutex.Lock()
+	if o.winner == nil {
+		for _, l := range o.legs {
+			if l.filled().IsPositive() {
+				o.winner = l
+				break
+			}
+		}
+		if o.winner != nil {
+			for _, l := range o.legs {
+				if l != o.winner {
+					l.dropped = true
+					siblings = append(siblings, l.open()...)
+				}
+			}
+		}
+	}
+	o.mutex.Unlock()
+
+	for _, sibling := range siblings {
+		if err := o.trader.OrderSvc().CancelOrder(sibling); err != nil {
+			o.log.WithError(err).Warnf("could not cancel leg %s of order %s", sibling.ID(), o.id)
+		}
+	}
+}
+
+func (o *oco) update() {
+	o.mutex.RLock()
+	status := o.legStatus()
+	o.mutex.RUnlock()
+	o.setStatus(status)
+}
+
+// legStatus derives the status from the legs: filled once the winner filled the whole quantity, rejected when
+// every order placed was, and canceled when the legs finished any other way. The caller holds the lock.
+func (o *oco) legStatus() types.OrderStatus {
+	open, rejected, filled := !o.final, !o.cancelled, decimal.Zero
+	for _, l := range o.legs {
+		open = open || l.held() || len(l.open()) > 0
+		rejected = rejected && len(l.orders) > 0
+		for _, child := range l.orders {
+			rejected = rejected && child.Status() == order.Rejected
+		}
+		filled = filled.Add(l.filled())
+	}
+
+	switch {
+	case open && filled.IsPositive():
+		return order.Partial
+	case open:
+		return order.Pending
+	case o.winner != nil && o.complete(o.winner.filled()):
+		return order.Filled
+	case rejected:
+		return order.Rejected
+	default:
+		return order.Canceled
+	}
+}
+
+// resize sets how much the group has to fill. Before a leg fills, the open ones are replaced at the new size; after,
+// topUp has the winner place whatever more it has to fill.
+func (o *oco) resize(s size) {
+	o.mutex.Lock()
+	if o.cancelled {
+		o.mutex.Unlock()
+		return
+	}
+	grown := !s.quantity.Equal(o.quantity)
+	o.quantity, o.final = s.quantity, s.final
+	o.request.Quantity = s.quantity
+	winner := o.winner
+	o.mutex.Unlock()
+	if !grown || winner != nil {
+		return
+	}
+
+	for _, l := range o.legs {
+		for _, child := range l.open() {
+			if err := o.trader.OrderSvc().CancelOrder(child); err != nil {
+				o.log.WithError(err).Warnf("could not cancel leg %s of order %s to resize it", child.ID(), o.id)
+				continue
+			}
+			if !awaitDone(child) {
+				o.log.Warnf("leg %s of order %s is still open after cancelling it", child.ID(), o.id)
+				continue
+			}
+
+			// A leg that filled before the cancel went through is the winner, which settle picks up
+			if child.Filled().IsPositive() {
+				return
+			}
+			if err := o.place(l, o.size()); err != nil {
+				o.fail(l, err)
+			}
+		}
+	}
+}
+
+// topUp has the winner place what the group grew by since it last placed an order, so a leg that filled while the
+// group was resized still fills the whole of it
+func (o *oco) topUp() {
+	o.mutex.RLock()
+	winner := o.winner
+	due := winner != nil && !o.cancelled && !winner.dropped && winner.target.LessThan(o.quantity)
+	o.mutex.RUnlock()
+	if !due {
+		return
+	}
+
+	extra := roundDown(o.size().Sub(winner.committed()), o.market.QuantityStepSize())
+	if !extra.IsPositive() || extra.LessThan(o.market.MinQuantity()) {
+		o.mutex.Lock()
+		winner.target = o.quantity
+		o.mutex.Unlock()
+		return
+	}
+	if err := o.place(winner, extra); err != nil {
+		o.fail(winner, err)
+	}
+}
+
+// trigger places the held legs whose stop the price reached
+func (o *oco) trigger(p decimal.Decimal) {
+	if !p.IsPositive() {
+		return
+	}
+	o.mutex.RLock()
+	var due []*leg
+	for _, l := range o.legs {
+		if !l.held() {
+			continue
+		}
+		if (o.side == order.Sell && p.LessThanOrEqual(l.StopPrice)) || (o.side == order.Buy && p.GreaterThanOrEqual(l.StopPrice)) {
+			due = append(due, l)
+		}
+	}
+	o.mutex.RUnlock()
+
+	for _, l := range due {
+		o.log.Infof("stop of order %s reached at %s", o.id, p)
+		if err := o.place(l, o.size()); err != nil {
+			o.fail(l, err)
+		}
+	}
+}
+
+// place places an order for the leg, which then covers the group's current size
+func (o *oco) place(l *leg, quantity decimal.Decimal) error {
+	req := types.OrderRequestDTO{
+		Market:   o.market.ToDTO(),
+		Side:     o.side,
+		Type:     l.Type,
+		Quantity: quantity,
+	}
+	if l.Type == order.Limit {
+		req.Price = l.Price
+	}
+	child, err := o.trader.OrderSvc().AttemptOrder(o.market, order.NewRequestFromDTO(o.market, req))
+	if err != nil {
+		return err
+	}
+
+	o.mutex.Lock()
+	l.orders = append(l.orders, child)
+	l.target = o.quantity
+	o.children = append(o.children, child)
+	o.mutex.Unlock()
+	go watch(child, o.changed)
+	return nil
+}
+
+// fail drops a leg that couldn't be placed, publishing the error
+func (o *oco) fail(l *leg, err error) {
+	o.log.WithError(err).Errorf("could not place a leg of order %s", o.id)
+	o.trader.Events().Publish(types.Event{Type: types.EventError, Market: o.request.Market, Err: err})
+	o.mutex.Lock()
+	l.dropped = true
+	o.mutex.Unlock()
+}
+
+func (o *oco) cancelAll() {
+	var open []types.Order
+	o.mutex.Lock()
+	o.cancelled, o.final = true, true
+	for _, l := range o.legs {
+		l.dropped = true
+		open = append(open, l.open()...)
+	}
+	o.mutex.Unlock()
+
+	for _, child := range open {
+		if err := o.trader.OrderSvc().CancelOrder(child); err != nil {
+			o.log.WithError(err).Warnf("could not cancel leg %s of order %s", child.ID(), o.id)
+		}
+	}
+}
+
+// setSize hands the group a new size, replacing any it hasn't taken yet
+func (o *oco) setSize(s size) {
+	for {
+		select {
+		case o.sizes <- s:
+			return
+		default:
+		}
+		select {
+		case <-o.sizes:
+		default:
+		}
+	}
+}
+
+// size is the quantity rounded to what the market takes
+func (o *oco) size() decimal.Decimal {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return roundDown(o.quantity, o.market.QuantityStepSize())
+}
+
+// complete reports whether what is left after the fill is too small to place. The caller holds the lock.
+func (o *oco) complete(filled decimal.Decimal) bool {
+	left := o.quantity.Sub(filled)
+	return !left.IsPositive() || left.LessThan(decimal.Max(o.market.QuantityStepSize(), o.market.MinQuantity()))
+}
+
+func (o *oco) holding() bool {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	for _, l := range o.legs {
+		if l.held() {
+			return true
+		}
+	}
+	return false
+}
+
+// held reports whether the leg is waiting for its stop
+func (l *leg) held() bool {
+	return !l.dropped && len(l.orders) == 0 && l.StopPrice.IsPositive()
+}
+
+func (l *leg) filled() decimal.Decimal {
+	total := decimal.Zero
+	for _, child := range l.orders {
+		total = total.Add(child.Filled())
+	}
+	return total
+}
+
+// committed is what the leg filled, plus what its open orders may still fill
+func (l *leg) committed() decimal.Decimal {
+	total := decimal.Zero
+	for _, child := range l.orders {
+		total = total.Add(child.Filled())
+		if !child.IsDone() {
+			total = total.Add(child.Request().Quantity().Sub(child.Filled()))
+		}
+	}
+	return total
+}
+
+func (l *leg) open() []types.Order {
+	var open []types.Order
+	for _, child := range l.orders {
+		if !child.IsDone() {
+			open = append(open, child)
+		}
+	}
+	return open
+}
+
+func (o *oco) Cancel() {
+	o.cancelOnce.Do(func() { close(o.cancel) })
+}
+
+func (o *oco) Children() []types.Order {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return append([]types.Order{}, o.children...)
+}
+
+func (o *oco) CreationTime() time.Time { return o.creationTime }
+
+func (o *oco) Fees() (types.OrderSide, decimal.Decimal) {
+	dto := o.ToDTO()
+	return dto.FeesSide, dto.Fees
+}
+
+func (o *oco) Filled() decimal.Decimal { return o.ToDTO().Filled }
+
+func (o *oco) Market() types.Market { return o.market }
+
+func (o *oco) Paid() decimal.Decimal { return o.ToDTO().Paid }
+
+func (o *oco) Refresh() (err error) {
+	for _, child := range o.Children() {
+		if child.IsDone() {
+			continue
+		}
+		if e := child.Refresh(); e != nil && err == nil {
+			err = e
+		}
+	}
+	select {
+	case o.changed <- true:
+	default:
+	}
+	return
+}
+
+func (o *oco) Request() types.OrderRequest {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+	return order.NewRequestFromDTO(o.market, o.request)
+}
+
+func (o *oco) ToDTO() types.OrderDTO {
+	o.mutex.RLock()
+	dto := types.OrderDTO{
+		Market:       o.request.Market,
+		CreationTime: o.creationTime,
+		ID:           o.id,
+		Request:      o.request,
+		Status:       o.status,
+	}
+	children := make([]types.OrderDTO, 0, len(o.children))
+	for _, child := range o.children {
+		children = append(children, child.ToDTO())
+	}
+	o.mutex.RUnlock()
+	return order.Sum(dto, children)
+}
@@ -0,0 +1,37 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of provider failure. Providers wrap their errors so callers can tell them apart with errors.Is.
+var (
+	ErrAuthFailed         = errors.New("authentication failed")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrMarketHalted       = errors.New("market halted")
+	ErrNotSupported       = errors.New("not supported")
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrPostOnlyWouldCross = errors.New("post only order would cross")
+	ErrRateLimited        = errors.New("rate limited")
+)
+
+// ProviderError ties an error returned by a provider's API to the kind of failure it is. errors.Is matches it
+// against its Kind and errors.As still reaches the API error underneath.
+type ProviderError struct {
+	Kind error
+	Err  error
+}
+
+func (e *ProviderError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Err)
+}
+
+func (e *ProviderError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
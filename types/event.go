@@ -0,0 +1,87 @@
+package types
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// Kinds of events a trader publishes
+const (
+	// EventConnection is published when one of the provider's websockets changes state
+	EventConnection EventType = "connection"
+
+	// EventError is published for failures that happen away from any caller, such as in a stream
+	EventError EventType = "error"
+
+	// EventFill is published for every fill of an order, along with the order event for the new state
+	EventFill EventType = "fill"
+
+	EventOrderCanceled EventType = "orderCanceled"
+	EventOrderCreated  EventType = "orderCreated"
+	EventOrderFilled   EventType = "orderFilled"
+
+	// EventOrderUpdated is published when an order moves to any other state, such as partially filled or rejected
+	EventOrderUpdated EventType = "orderUpdated"
+
+	EventTicker EventType = "ticker"
+
+	// EventWallet is published when a wallet is seen to change
+	EventWallet EventType = "wallet"
+)
+
+// Event is something that happened to a trader. Only the fields that go with its type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Market is the market the event is about. It is empty for wallet and connection events.
+	Market MarketDTO
+
+	Order  *OrderDTO
+	Fill   *FillDTO
+	Ticker *TickerDTO
+	Wallet *WalletDTO
+
+	// Venue is the provider whose websocket changed state. It is empty for a single-provider trader.
+	Venue      string
+	Connection *WebsocketHealth
+
+	Err error
+}
+
+// EventBus passes a trader's events on to everyone subscribed to them
+type EventBus interface {
+	// Publish sends the event to the subscriptions it matches, skipping the ones that are too far behind to take it.
+	// Events without a time get the current one.
+	Publish(event Event)
+
+	// Subscribe streams the events that match the filter until stop is closed or the trader shuts down
+	Subscribe(stop <-chan bool, filter EventFilter) <-chan Event
+}
+
+// EventFilter picks the events a subscription gets. Its empty fields let every event through.
+type EventFilter struct {
+	Types []EventType
+
+	// Markets are names of markets. Events that aren't about a market are left out when it is set.
+	Markets []string
+
+	// Orders are IDs of orders. Events that aren't about an order are left out when it is set.
+	Orders []string
+}
+
+type EventType string
+
+// FillDTO is the part of an order that filled in one go
+type FillDTO struct {
+	OrderID  string
+	Side     OrderSide
+	Quantity decimal.Decimal
+
+	// Price is the average price of the fill, before fees
+	Price decimal.Decimal
+
+	// Fees are charged on the side of the market the order's FeesSide says
+	Fees decimal.Decimal
+}
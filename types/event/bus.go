@@ -0,0 +1,150 @@
+// Package event is the bus a trader publishes its events on
+package event
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/spf13/viper"
+)
+
+type bus struct {
+	log log.Entry
+
+	mutex         sync.RWMutex
+	subscriptions map[*subscription]bool
+	closed        bool
+}
+
+type subscription struct {
+	filter  filter
+	stream  chan types.Event
+	stopped bool
+}
+
+// filter is an EventFilter turned into sets
+type filter struct {
+	types   map[types.EventType]bool
+	markets map[string]bool
+	orders  map[string]bool
+}
+
+func New() internal.EventBus {
+	return &bus{
+		log:           log.WithField("source", "event.bus"),
+		subscriptions: make(map[*subscription]bool),
+	}
+}
+
+func (b *bus) Publish(event types.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for sub := range b.subscriptions {
+		if !sub.filter.matches(event) {
+			continue
+		}
+		select {
+		case sub.stream <- event:
+		default:
+			b.log.Warnf("skipping blocked event subscription for %s event", event.Type)
+		}
+	}
+}
+
+func (b *bus) Subscribe(stop <-chan bool, f types.EventFilter) <-chan types.Event {
+	sub := &subscription{
+		filter: newFilter(f),
+		stream: make(chan types.Event, viper.GetInt("currencytrader.events.streamBufferSize")),
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		close(sub.stream)
+		return sub.stream
+	}
+	b.subscriptions[sub] = true
+	b.mutex.Unlock()
+
+	go func() {
+		<-stop
+		b.unsubscribe(sub)
+	}()
+	return sub.stream
+}
+
+func (b *bus) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	for sub := range b.subscriptions {
+		b.end(sub)
+	}
+}
+
+func (b *bus) unsubscribe(sub *subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.end(sub)
+}
+
+// end closes the subscription's stream once. The caller holds the lock.
+func (b *bus) end(sub *subscription) {
+	if sub.stopped {
+		return
+	}
+	sub.stopped = true
+	delete(b.subscriptions, sub)
+	close(sub.stream)
+}
+
+func newFilter(f types.EventFilter) filter {
+	out := filter{}
+	if len(f.Types) > 0 {
+		out.types = make(map[types.EventType]bool, len(f.Types))
+		for _, t := range f.Types {
+			out.types[t] = true
+		}
+	}
+	if len(f.Markets) > 0 {
+		out.markets = make(map[string]bool, len(f.Markets))
+		for _, m := range f.Markets {
+			out.markets[m] = true
+		}
+	}
+	if len(f.Orders) > 0 {
+		out.orders = make(map[string]bool, len(f.Orders))
+		for _, id := range f.Orders {
+			out.orders[id] = true
+		}
+	}
+	return out
+}
+
+func (f filter) matches(event types.Event) bool {
+	if f.types != nil && !f.types[event.Type] {
+		return false
+	}
+	if f.markets != nil && (event.Market.Name == "" || !f.markets[event.Market.Name]) {
+		return false
+	}
+	if f.orders != nil {
+		id := ""
+		if event.Order != nil {
+			id = event.Order.ID
+		} else if event.Fill != nil {
+			id = event.Fill.OrderID
+		}
+		if id == "" || !f.orders[id] {
+			return false
+		}
+	}
+	return true
+}
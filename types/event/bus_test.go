@@ -0,0 +1,71 @@
+package event_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/event"
+)
+
+func TestSubscriptionsAreFiltered(t *testing.T) {
+	bus := event.New()
+	defer bus.Close()
+	stop := make(chan bool)
+	defer close(stop)
+
+	fills := bus.Subscribe(stop, types.EventFilter{Types: []types.EventType{types.EventFill}, Orders: []string{"a"}})
+	btc := bus.Subscribe(stop, types.EventFilter{Markets: []string{"BTCUSD"}})
+
+	bus.Publish(types.Event{Type: types.EventFill, Fill: &types.FillDTO{OrderID: "b"}})
+	bus.Publish(types.Event{Type: types.EventOrderFilled, Order: &types.OrderDTO{ID: "a"}})
+	bus.Publish(types.Event{Type: types.EventFill, Market: types.MarketDTO{Name: "BTCUSD"}, Fill: &types.FillDTO{OrderID: "a"}})
+	bus.Publish(types.Event{Type: types.EventWallet, Wallet: &types.WalletDTO{}})
+
+	select {
+	case e := <-fills:
+		if e.Fill.OrderID != "a" || e.Time.IsZero() {
+			t.Errorf("got fill for order %s at %s; expected order a with a time", e.Fill.OrderID, e.Time)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fill was not delivered")
+	}
+	select {
+	case e := <-btc:
+		if e.Type != types.EventFill {
+			t.Errorf("got %s event for BTCUSD; expected fill", e.Type)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("market event was not delivered")
+	}
+
+	if len(fills) != 0 || len(btc) != 0 {
+		t.Errorf("subscriptions got %d and %d events that don't match their filters", len(fills), len(btc))
+	}
+}
+
+func TestStopAndCloseEndSubscriptions(t *testing.T) {
+	bus := event.New()
+	stop := make(chan bool)
+	stopped := bus.Subscribe(stop, types.EventFilter{})
+	open := bus.Subscribe(make(chan bool), types.EventFilter{})
+
+	close(stop)
+	select {
+	case _, ok := <-stopped:
+		if ok {
+			t.Error("got an event after stopping")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription was not closed when stopped")
+	}
+
+	bus.Close()
+	if _, ok := <-open; ok {
+		t.Error("got an event after closing the bus")
+	}
+	if _, ok := <-bus.Subscribe(make(chan bool), types.EventFilter{}); ok {
+		t.Error("subscribing to a closed bus got an event")
+	}
+	bus.Publish(types.Event{Type: types.EventTicker})
+}
@@ -0,0 +1,7 @@
+package event
+
+import "github.com/spf13/viper"
+
+func init() {
+	viper.SetDefault("currencytrader.events.streamBufferSize", 256)
+}
@@ -20,10 +20,20 @@ func ZeroFee() types.Fees {
 	return &fees{dto: types.FeesDTO{}}
 }
 
+func (f *fees) Breakdown() []types.Fees {
+	breakdown := make([]types.Fees, 0, len(f.dto.Breakdown))
+	for _, dto := range f.dto.Breakdown {
+		breakdown = append(breakdown, New(f.trader, dto))
+	}
+	return breakdown
+}
+
 func (f *fees) MakerRate() decimal.Decimal { return f.dto.MakerRate }
 
 func (f *fees) TakerRate() decimal.Decimal { return f.dto.TakerRate }
 
+func (f *fees) Venue() string { return f.dto.Venue }
+
 func (f *fees) Volume() decimal.Decimal { return f.dto.Volume }
 
 func (f *fees) ToDTO() types.FeesDTO { return f.dto }
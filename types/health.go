@@ -0,0 +1,76 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+// States a provider's websocket can be in
+const (
+	WebsocketIdle         WebsocketState = "idle"
+	WebsocketConnecting   WebsocketState = "connecting"
+	WebsocketConnected    WebsocketState = "connected"
+	WebsocketDisconnected WebsocketState = "disconnected"
+	WebsocketStopped      WebsocketState = "stopped"
+)
+
+// Health is a snapshot of how a trader and its providers are doing
+type Health struct {
+	// Running reports whether the trader's services are started
+	Running bool
+
+	// Providers holds a report for the provider, or one for each venue of a trader across several. Providers that
+	// can't report on themselves are left out.
+	Providers []ProviderHealth
+}
+
+// HealthReporter is implemented by providers that can report on their connections and request budgets
+type HealthReporter interface {
+	Health() []ProviderHealth
+}
+
+type ProviderHealth struct {
+	// Venue is the name of the provider. It is empty for a single-provider trader.
+	Venue string
+
+	Websockets []WebsocketHealth
+	RateLimits []RateLimitHealth
+}
+
+type RateLimitHealth struct {
+	// Budget is the pool of calls being limited, such as public or private
+	Budget string
+
+	// Rate is how many calls a second the budget currently refills by. It is zero for an unlimited budget.
+	Rate  float64
+	Burst int
+
+	// Remaining is how many calls can be made right now without waiting
+	Remaining float64
+
+	// Waiting is how many calls are blocked on the budget
+	Waiting int
+
+	// Throttled counts the times the API asked for fewer calls
+	Throttled int64
+}
+
+// Stoppable is implemented by providers that hold connections or goroutines open. Shutdown stops the provider as
+// its kill switch would and waits for its streams to close, giving up with the context's error once it is done.
+type Stoppable interface {
+	Shutdown(ctx context.Context) error
+}
+
+type WebsocketHealth struct {
+	// Name tells the provider's websockets apart, such as its market and user data feeds
+	Name  string
+	State WebsocketState
+
+	// LastMessage is when the last message arrived. It is zero if none has.
+	LastMessage time.Time
+
+	// LastMessageAge is how long before the report the last message arrived. It is zero if none has.
+	LastMessageAge time.Duration
+}
+
+type WebsocketState string
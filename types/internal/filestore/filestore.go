@@ -0,0 +1,32 @@
+// Package filestore writes the files that stores keep their state in
+package filestore
+
+import (
+	"io"
+	"os"
+)
+
+// Replace rewrites the file at path with what write writes to it, syncing it to disk and swapping it in with a rename
+// so a crash leaves either the old file or the new one
+func Replace(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = write(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
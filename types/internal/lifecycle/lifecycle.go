@@ -0,0 +1,132 @@
+// Package lifecycle helps services and providers shut down cleanly
+package lifecycle
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// Group tracks goroutines, such as the ones that close streams, so a shutdown can wait for them to finish. The
+// zero value is ready to use.
+type Group struct {
+	mutex   sync.Mutex
+	running map[chan bool]bool
+}
+
+// Go runs fn in a goroutine of the group
+func (g *Group) Go(fn func()) {
+	done := make(chan bool)
+	g.mutex.Lock()
+	if g.running == nil {
+		g.running = make(map[chan bool]bool)
+	}
+	g.running[done] = true
+	g.mutex.Unlock()
+
+	go func() {
+		defer func() {
+			g.mutex.Lock()
+			delete(g.running, done)
+			g.mutex.Unlock()
+			close(done)
+		}()
+		fn()
+	}()
+}
+
+// Wait blocks until the goroutines running when it was called have returned, or returns the context's error if it
+// is done first
+func (g *Group) Wait(ctx context.Context) error {
+	g.mutex.Lock()
+	running := make([]chan bool, 0, len(g.running))
+	for done := range g.running {
+		running = append(running, done)
+	}
+	g.mutex.Unlock()
+
+	for _, done := range running {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Switch is a stop channel closed by a provider's kill switch or by Shutdown, whichever comes first
+type Switch struct {
+	Group
+
+	stop chan bool
+	once sync.Once
+}
+
+// NewSwitch returns a switch that flips when the kill switch is closed
+func NewSwitch(killSwitch <-chan bool) *Switch {
+	s := &Switch{stop: make(chan bool)}
+	go func() {
+		select {
+		case <-killSwitch:
+			s.Flip()
+		case <-s.stop:
+		}
+	}()
+	return s
+}
+
+// Stop is closed once the switch flips
+func (s *Switch) Stop() <-chan bool {
+	return s.stop
+}
+
+// Flip closes the stop channel. Flipping it again does nothing.
+func (s *Switch) Flip() {
+	s.once.Do(func() { close(s.stop) })
+}
+
+// Shutdown flips the switch and waits for the goroutines of the group to return
+func (s *Switch) Shutdown(ctx context.Context) error {
+	s.Flip()
+	return s.Wait(ctx)
+}
+
+// Monitor keeps track of a websocket's state and the last message it received
+type Monitor struct {
+	name string
+
+	mutex       sync.Mutex
+	state       types.WebsocketState
+	lastMessage time.Time
+}
+
+func NewMonitor(name string) *Monitor {
+	return &Monitor{name: name, state: types.WebsocketIdle}
+}
+
+// SetState records the state the websocket moved to
+func (m *Monitor) SetState(state types.WebsocketState) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.state = state
+}
+
+// Received records that a message arrived
+func (m *Monitor) Received() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastMessage = time.Now()
+}
+
+func (m *Monitor) Health() types.WebsocketHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h := types.WebsocketHealth{Name: m.name, State: m.state, LastMessage: m.lastMessage}
+	if !m.lastMessage.IsZero() {
+		h.LastMessageAge = time.Since(m.lastMessage)
+	}
+	return h
+}
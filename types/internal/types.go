@@ -2,13 +2,27 @@ package internal
 
 import "github.com/sinisterminister/currencytrader/types"
 
+type EventBus interface {
+	types.EventBus
+
+	// Close ends every subscription. Later events are dropped.
+	Close()
+}
+
 type MarketSvc interface {
 	types.MarketSvc
 }
 
+type OrderSvc interface {
+	types.OrderSvc
+	types.Administerable
+	types.Stoppable
+}
+
 type TickerSvc interface {
 	types.TickerSvc
 	types.Administerable
+	types.Stoppable
 }
 
 type AccountSvc interface {
@@ -26,10 +40,7 @@ type Order interface {
 }
 
 type Trader interface {
-	types.Administerable
-	OrderSvc() types.OrderSvc
-	AccountSvc() types.AccountSvc
-	MarketSvc() types.MarketSvc
-	TickerSvc() types.TickerSvc
+	types.Trader
+	Journal() types.OrderJournal
 	Provider() types.Provider
 }
@@ -0,0 +1,135 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/filestore"
+)
+
+// entry is a line of the journal file
+type entry struct {
+	Time  time.Time      `json:"time"`
+	Order types.OrderDTO `json:"order"`
+}
+
+type file struct {
+	log  log.Entry
+	path string
+
+	mutex   sync.RWMutex
+	file    *os.File
+	encoder *json.Encoder
+	orders  map[string]types.OrderDTO
+}
+
+// NewFile opens a journal kept as JSON lines at path, one line for each state an order passes through, creating
+// the file if needed. The orders that are done are dropped from the file as it is opened so it doesn't grow without
+// bounds across restarts. The journal is an io.Closer.
+func NewFile(path string) (types.OrderJournal, error) {
+	f := &file{
+		log:    log.WithField("source", "journal.file"),
+		path:   path,
+		orders: make(map[string]types.OrderDTO),
+	}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	if err := f.compact(); err != nil {
+		return nil, err
+	}
+
+	out, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.file = out
+	f.encoder = json.NewEncoder(out)
+	return f, nil
+}
+
+// Close closes the file. The trader closes its journal when it shuts down.
+func (f *file) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+func (f *file) Open() ([]types.OrderDTO, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return open(f.orders), nil
+}
+
+// Record appends the order's state to the file and syncs it to disk before returning
+func (f *file) Record(dto types.OrderDTO) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.encoder.Encode(entry{Time: time.Now(), Order: dto}); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	apply(f.orders, dto)
+	return nil
+}
+
+// load replays the file. A broken last line is what a crash mid-write leaves behind, so it is skipped; a broken
+// line anywhere else means the file can't be trusted.
+func (f *file) load() error {
+	in, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var broken error
+	line := 0
+	for scanner.Scan() {
+		line++
+		if broken != nil {
+			return broken
+		}
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			broken = fmt.Errorf("journal %s line %d: %w", f.path, line, err)
+			continue
+		}
+		apply(f.orders, e.Order)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if broken != nil {
+		f.log.WithError(broken).Warn("skipping the incomplete last line of the journal")
+	}
+	return nil
+}
+
+// compact rewrites the file with the open orders alone, replacing it in one step so a crash leaves either the old
+// file or the new one
+func (f *file) compact() error {
+	return filestore.Replace(f.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		now := time.Now()
+		for _, dto := range open(f.orders) {
+			if err := encoder.Encode(entry{Time: now, Order: dto}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,62 @@
+// Package journal keeps the orders a trader placed so they survive a restart
+package journal
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type memory struct {
+	mutex  sync.RWMutex
+	orders map[string]types.OrderDTO
+}
+
+// NewMemory returns a journal that only lasts as long as the process, for paper trading and tests
+func NewMemory() types.OrderJournal {
+	return &memory{orders: make(map[string]types.OrderDTO)}
+}
+
+func (m *memory) Open() ([]types.OrderDTO, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return open(m.orders), nil
+}
+
+func (m *memory) Record(dto types.OrderDTO) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	apply(m.orders, dto)
+	return nil
+}
+
+// apply keeps the latest state of open orders, dropping the ones that are done
+func apply(orders map[string]types.OrderDTO, dto types.OrderDTO) {
+	if order.IsDone(dto.Status) {
+		delete(orders, key(dto))
+		return
+	}
+	orders[key(dto)] = dto
+}
+
+// open lists the orders oldest first
+func open(orders map[string]types.OrderDTO) []types.OrderDTO {
+	dtos := make([]types.OrderDTO, 0, len(orders))
+	for _, dto := range orders {
+		dtos = append(dtos, dto)
+	}
+	sort.Slice(dtos, func(i, j int) bool {
+		if !dtos[i].CreationTime.Equal(dtos[j].CreationTime) {
+			return dtos[i].CreationTime.Before(dtos[j].CreationTime)
+		}
+		return key(dtos[i]) < key(dtos[j])
+	})
+	return dtos
+}
+
+// key tells orders apart across venues, since each venue hands out IDs of its own
+func key(dto types.OrderDTO) string {
+	return dto.Market.Venue + "/" + dto.ID
+}
@@ -0,0 +1,106 @@
+package journal_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/journal"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+func dto(venue string, id string, status types.OrderStatus, created time.Time) types.OrderDTO {
+	return types.OrderDTO{
+		Market:       types.MarketDTO{Name: "BTC-USD", Venue: venue},
+		CreationTime: created,
+		Filled:       decimal.Zero,
+		ID:           id,
+		Status:       status,
+	}
+}
+
+func ids(t *testing.T, j types.OrderJournal) []string {
+	dtos, err := j.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := []string{}
+	for _, d := range dtos {
+		out = append(out, d.Market.Venue+"/"+d.ID)
+	}
+	return out
+}
+
+func TestOpenKeepsLatestStateOfOpenOrders(t *testing.T) {
+	now := time.Now()
+	j := journal.NewMemory()
+	j.Record(dto("alpha", "2", order.Pending, now.Add(time.Second)))
+	j.Record(dto("alpha", "1", order.Pending, now))
+	j.Record(dto("beta", "1", order.Pending, now))
+	j.Record(dto("alpha", "2", order.Filled, now.Add(time.Second)))
+
+	partial := dto("alpha", "1", order.Partial, now)
+	partial.Filled = decimal.NewFromInt(1)
+	j.Record(partial)
+
+	dtos, _ := j.Open()
+	if got := ids(t, j); len(got) != 2 || got[0] != "alpha/1" || got[1] != "beta/1" {
+		t.Fatalf("Open() returned %v; expected [alpha/1 beta/1]", got)
+	}
+	if dtos[0].Status != order.Partial {
+		t.Errorf("alpha/1 is %s; expected its latest state %s", dtos[0].Status, order.Partial)
+	}
+}
+
+func TestFileSurvivesReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	now := time.Now()
+
+	j, err := journal.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Record(dto("", "1", order.Pending, now))
+	j.Record(dto("", "2", order.Pending, now.Add(time.Second)))
+	j.Record(dto("", "1", order.Canceled, now))
+	j.(interface{ Close() error }).Close()
+
+	// A crash in the middle of a write leaves half a line behind
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"time":"2020-01-01T00:00:00Z","order":{"id":"3"`)
+	f.Close()
+
+	j, err = journal.NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.(interface{ Close() error }).Close()
+	if got := ids(t, j); len(got) != 1 || got[0] != "/2" {
+		t.Fatalf("Open() returned %v after reopening; expected [/2]", got)
+	}
+
+	// Reopening compacted the file down to the open order
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := len(bytes.Split(bytes.TrimSpace(data), []byte("\n"))); lines != 1 {
+		t.Errorf("journal has %d lines after reopening; expected 1", lines)
+	}
+}
+
+func TestFileRejectsCorruptHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+	ioutil.WriteFile(path, []byte("not json\n{\"order\":{\"id\":\"1\"}}\n"), 0600)
+	if _, err := journal.NewFile(path); err == nil {
+		t.Error("NewFile() accepted a journal with a broken line before the last one")
+	}
+}
@@ -1,6 +1,7 @@
 package market
 
 import (
+	"context"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -8,6 +9,7 @@ import (
 	"github.com/sinisterminister/currencytrader/types/candle"
 	"github.com/sinisterminister/currencytrader/types/currency"
 	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
 )
 
 // market is where you can trade one currency for another.
@@ -51,17 +53,31 @@ func (m *market) MaxFunds() decimal.Decimal { return m.dto.MaxFunds }
 
 func (m *market) QuantityStepSize() decimal.Decimal { return m.dto.QuantityStepSize }
 
+func (m *market) Venue() string { return m.dto.Venue }
+
 func (m *market) Ticker() (types.Ticker, error) {
-	return m.trader.TickerSvc().Ticker(m)
+	return m.TickerContext(context.Background())
+}
+
+func (m *market) TickerContext(ctx context.Context) (types.Ticker, error) {
+	return m.trader.TickerSvc().TickerContext(ctx, m)
 }
 
 func (m *market) TickerStream(stop <-chan bool) <-chan types.Ticker {
 	return m.trader.TickerSvc().TickerStream(stop, m)
 }
 
+func (m *market) TickerStreamContext(ctx context.Context) <-chan types.Ticker {
+	return m.trader.TickerSvc().TickerStreamContext(ctx, m)
+}
+
 func (m *market) Candles(interval types.CandleInterval, start time.Time, end time.Time) ([]types.Candle, error) {
+	return m.CandlesContext(context.Background(), interval, start, end)
+}
+
+func (m *market) CandlesContext(ctx context.Context, interval types.CandleInterval, start time.Time, end time.Time) ([]types.Candle, error) {
 	candles := []types.Candle{}
-	dtos, err := m.trader.Provider().Candles(m.ToDTO(), interval, start, end)
+	dtos, err := contextual.Wrap(m.trader.Provider()).CandlesContext(ctx, m.ToDTO(), interval, start, end)
 	if err != nil {
 		return candles, err
 	}
@@ -74,11 +90,19 @@ func (m *market) Candles(interval types.CandleInterval, start time.Time, end tim
 }
 
 func (m *market) AttemptOrder(req types.OrderRequest) (types.Order, error) {
-	return m.trader.OrderSvc().AttemptOrder(m, req)
+	return m.AttemptOrderContext(context.Background(), req)
+}
+
+func (m *market) AttemptOrderContext(ctx context.Context, req types.OrderRequest) (types.Order, error) {
+	return m.trader.OrderSvc().AttemptOrderContext(ctx, m, req)
 }
 
 func (m *market) AverageTradeVolume() (decimal.Decimal, error) {
-	vol, err := m.trader.Provider().AverageTradeVolume(m.ToDTO())
+	return m.AverageTradeVolumeContext(context.Background())
+}
+
+func (m *market) AverageTradeVolumeContext(ctx context.Context) (decimal.Decimal, error) {
+	vol, err := contextual.Wrap(m.trader.Provider()).AverageTradeVolumeContext(ctx, m.ToDTO())
 	if err != nil {
 		return decimal.Zero, err
 	}
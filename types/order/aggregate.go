@@ -0,0 +1,277 @@
+package order
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/sinisterminister/currencytrader/types/market"
+	"github.com/spf13/viper"
+)
+
+// aggregate is a parent order tracked through the child orders it was split into
+type aggregate struct {
+	log          log.Entry
+	trader       internal.Trader
+	id           string
+	creationTime time.Time
+	request      types.OrderRequestDTO
+	children     []types.Order
+
+	mutex   sync.RWMutex
+	status  types.OrderStatus
+	streams []chan types.OrderStatus
+	done    chan bool
+}
+
+// NewAggregate tracks the children as a single order for the parent request. Filled, Paid and Fees are the sums
+// of the children, and the order is done once every child is.
+func NewAggregate(trader internal.Trader, id string, req types.OrderRequestDTO, children []types.Order) types.AggregateOrder {
+	a := &aggregate{
+		log:          log.WithField("source", "currencytrader.aggregate"),
+		trader:       trader,
+		id:           id,
+		creationTime: time.Now(),
+		request:      req,
+		children:     append([]types.Order{}, children...),
+		done:         make(chan bool),
+	}
+	a.status = a.childStatus()
+	if IsDone(a.status) {
+		close(a.done)
+		return a
+	}
+
+	go a.watch()
+	return a
+}
+
+func (a *aggregate) Children() []types.Order {
+	return append([]types.Order{}, a.children...)
+}
+
+func (a *aggregate) CreationTime() time.Time { return a.creationTime }
+
+func (a *aggregate) Done() <-chan bool { return a.done }
+
+// Fees sums the fees of the children. Fees charged in the base currency are converted at the child's average price
+// when the children don't all charge the same side.
+func (a *aggregate) Fees() (types.OrderSide, decimal.Decimal) {
+	dto := a.ToDTO()
+	return dto.FeesSide, dto.Fees
+}
+
+func (a *aggregate) Filled() decimal.Decimal { return a.ToDTO().Filled }
+
+func (a *aggregate) ID() string { return a.id }
+
+func (a *aggregate) IsDone() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *aggregate) Market() types.Market { return market.New(a.trader, a.request.Market) }
+
+func (a *aggregate) Paid() decimal.Decimal { return a.ToDTO().Paid }
+
+func (a *aggregate) Refresh() (err error) {
+	for _, child := range a.children {
+		if child.IsDone() {
+			continue
+		}
+		if e := child.Refresh(); e != nil && err == nil {
+			err = e
+		}
+	}
+	a.update()
+	return
+}
+
+func (a *aggregate) Request() types.OrderRequest {
+	return NewRequestFromDTO(a.Market(), a.request)
+}
+
+func (a *aggregate) Status() types.OrderStatus {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.status
+}
+
+func (a *aggregate) StatusStream(stop <-chan bool) <-chan types.OrderStatus {
+	stream := make(chan types.OrderStatus, viper.GetInt("currencytrader.order.streamBufferSize")+1)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	stream <- a.status
+	if IsDone(a.status) {
+		close(stream)
+		return stream
+	}
+	a.streams = append(a.streams, stream)
+
+	go func() {
+		select {
+		case <-stop:
+		case <-a.done:
+			return
+		}
+
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		for i, s := range a.streams {
+			if s == stream {
+				a.streams = append(a.streams[:i], a.streams[i+1:]...)
+				close(stream)
+				break
+			}
+		}
+	}()
+	return stream
+}
+
+func (a *aggregate) ToDTO() types.OrderDTO {
+	dto := types.OrderDTO{
+		Market:       a.request.Market,
+		CreationTime: a.creationTime,
+		Fees:         decimal.Zero,
+		Filled:       decimal.Zero,
+		ID:           a.id,
+		Paid:         decimal.Zero,
+		Request:      a.request,
+		Status:       a.Status(),
+	}
+
+	children := make([]types.OrderDTO, 0, len(a.children))
+	for _, child := range a.children {
+		children = append(children, child.ToDTO())
+	}
+	return Sum(dto, children)
+}
+
+// Sum adds the fills, payments and fees of the children to the parent. Fees charged in the base currency are
+// converted at the child's average price when the children don't all charge the same side.
+func Sum(parent types.OrderDTO, children []types.OrderDTO) types.OrderDTO {
+	mixed := false
+	for _, child := range children {
+		mixed = mixed || child.FeesSide != children[0].FeesSide
+	}
+	for _, child := range children {
+		parent.Filled = parent.Filled.Add(child.Filled)
+		parent.Paid = parent.Paid.Add(child.Paid)
+
+		fees := child.Fees
+		if mixed && child.FeesSide == Buy && child.Filled.IsPositive() {
+			fees = fees.Mul(child.Paid.Div(child.Filled))
+		}
+		parent.Fees = parent.Fees.Add(fees)
+	}
+	if !mixed && len(children) > 0 {
+		parent.FeesSide = children[0].FeesSide
+	}
+	return parent
+}
+
+// watch follows the children and keeps the aggregate status current until they are all done
+func (a *aggregate) watch() {
+	stop := make(chan bool)
+	defer close(stop)
+
+	// Updates are coalesced since the status is read from the children anyway
+	changed := make(chan bool, 1)
+	for _, child := range a.children {
+		go func(child types.Order) {
+			statuses := child.StatusStream(stop)
+			for {
+				select {
+				case <-stop:
+					return
+				case <-child.Done():
+				case _, ok := <-statuses:
+					if !ok {
+						statuses = nil
+					}
+				}
+
+				select {
+				case changed <- true:
+				default:
+				}
+				if child.IsDone() {
+					return
+				}
+			}
+		}(child)
+	}
+
+	for !a.update() {
+		<-changed
+	}
+}
+
+// update recomputes the status from the children and tells the streams about any change. It reports whether the
+// aggregate is done.
+func (a *aggregate) update() bool {
+	status := a.childStatus()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if IsDone(a.status) {
+		return true
+	}
+	if status == a.status {
+		return false
+	}
+	a.status = status
+
+	for _, stream := range a.streams {
+		select {
+		case stream <- status:
+		default:
+			a.log.Warnf("skipping blocked order status channel for order %s", a.id)
+		}
+	}
+
+	if IsDone(status) {
+		a.log.Debugf("closing status streams for order %s", a.id)
+		for _, stream := range a.streams {
+			close(stream)
+		}
+		a.streams = nil
+		close(a.done)
+		return true
+	}
+	return false
+}
+
+// childStatus derives the parent status: filled once every child is, rejected when they all were, and canceled when
+// the children finished any other way
+func (a *aggregate) childStatus() types.OrderStatus {
+	done, filled, rejected, partial := true, true, true, false
+	for _, child := range a.children {
+		status := child.Status()
+		done = done && IsDone(status)
+		filled = filled && status == Filled
+		rejected = rejected && status == Rejected
+		partial = partial || child.Filled().IsPositive()
+	}
+
+	switch {
+	case done && filled:
+		return Filled
+	case done && rejected:
+		return Rejected
+	case done:
+		return Canceled
+	case partial:
+		return Partial
+	default:
+		return Pending
+	}
+}
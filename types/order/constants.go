@@ -21,6 +21,9 @@ const (
 	// Expired is for order that expired
 	Expired types.OrderStatus = "EXPIRED"
 
+	// Triggered is for stop orders that fired the order they hold back
+	Triggered types.OrderStatus = "TRIGGERED"
+
 	// Updated is for orders that have been updated
 	Updated types.OrderStatus = "UPDATED"
 
@@ -28,6 +31,15 @@ const (
 	Unknown types.OrderStatus = "UNKNOWN"
 )
 
+// IsDone reports whether an order with the status is done for good
+func IsDone(status types.OrderStatus) bool {
+	switch status {
+	case Filled, Canceled, Expired, Rejected:
+		return true
+	}
+	return false
+}
+
 const (
 	// Buy represents a buy sided order
 	Buy types.OrderSide = "BUY"
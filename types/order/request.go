@@ -1,6 +1,7 @@
 package order
 
 import (
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"github.com/sinisterminister/currencytrader/types"
 )
@@ -11,16 +12,23 @@ type request struct {
 	market types.Market
 }
 
+// NewRequestFromDTO builds a request from the DTO, keeping its client ID or giving it a new one. Attempting the same
+// request again then reuses the ID, so it can't place a second order.
 func NewRequestFromDTO(m types.Market, dto types.OrderRequestDTO) types.OrderRequest {
+	if dto.ClientID == "" {
+		dto.ClientID = uuid.New().String()
+	}
 	return &request{
 		dto:    dto,
 		market: m,
 	}
 }
 
+// NewRequest builds a request with a client ID of its own, so attempting it again can't place a second order
 func NewRequest(m types.Market, t types.OrderType, s types.OrderSide, quantity decimal.Decimal, price decimal.Decimal, funds decimal.Decimal, forceMaker bool) types.OrderRequest {
 	return &request{
 		dto: types.OrderRequestDTO{
+			ClientID:   uuid.New().String(),
 			Type:       t,
 			Side:       s,
 			Price:      price,
@@ -47,6 +55,8 @@ func (r *request) Type() types.OrderType { return r.dto.Type }
 
 func (r *request) Market() types.Market { return r.market }
 
+func (r *request) ClientID() string { return r.dto.ClientID }
+
 func (r *request) ForceMaker() bool { return r.dto.ForceMaker }
 
 func (r *request) Funds() decimal.Decimal { return r.dto.Funds }
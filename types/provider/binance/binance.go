@@ -0,0 +1,491 @@
+package binance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/binance/client"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+// Most klines the API returns per request
+const klineLimit = 1000
+
+type provider struct {
+	streamSvc *streamSvc
+	client    *client.Client
+	lifecycle *lifecycle.Switch
+	limiter   ratelimit.Limiter
+}
+
+// New returns a provider for the client. Its REST calls are held to the limiter's budgets, or to the ones configured
+// under binance.rateLimit when the limiter is nil.
+func New(stop <-chan bool, c *client.Client, limiter ratelimit.Limiter) types.ContextProvider {
+	if limiter == nil {
+		limiter = ratelimit.New(ratelimit.ConfigFromViper("binance"))
+	}
+	c.HTTPClient.Transport = ratelimit.NewTransport(limiter, ratelimit.TransportConfig{
+		Budget: budget,
+		Base:   c.HTTPClient.Transport,
+	})
+
+	sw := lifecycle.NewSwitch(stop)
+	p := &provider{
+		client:    c,
+		lifecycle: sw,
+		limiter:   limiter,
+	}
+	p.streamSvc = newStreamSvc(sw.Stop(), &sw.Group, c, p.snapshot)
+
+	return p
+}
+
+func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	return p.AttemptOrderContext(context.Background(), req)
+}
+
+func (p *provider) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	// Make sure order updates are flowing before the order exists
+	p.streamSvc.startUserStream()
+
+	// Reuse the client order id so a retried request can't place the order twice
+	cid := clientOrderID(req.ClientID)
+
+	orderRequest := client.OrderRequest{
+		Symbol:           req.Market.Name,
+		Side:             string(req.Side),
+		NewClientOrderID: cid,
+	}
+	switch req.Type {
+	case order.Limit:
+		orderRequest.Type = "LIMIT"
+		orderRequest.TimeInForce = "GTC"
+		if req.ForceMaker {
+			// Maker only orders are rejected instead of crossing and take no time in force
+			orderRequest.Type = "LIMIT_MAKER"
+			orderRequest.TimeInForce = ""
+		}
+		orderRequest.Price = req.Price
+		orderRequest.Quantity = req.Quantity
+	case order.Market:
+		orderRequest.Type = "MARKET"
+		orderRequest.Quantity = req.Quantity
+		if req.Quantity.IsZero() {
+			orderRequest.QuoteOrderQty = req.Funds
+		}
+	default:
+		return types.OrderDTO{}, fmt.Errorf("%w: order type %s not implemented", types.ErrInvalidRequest, req.Type)
+	}
+
+	// Place the order
+	placed, err := p.client.WithContext(ctx).CreateOrder(orderRequest)
+	if err != nil {
+		// The order may have made it there anyway, or been placed by an earlier attempt with the same id
+		log.WithError(err).Debugf("error creating order %s checking if it posted", cid)
+		var err2 error
+		placed, err2 = p.client.WithContext(ctx).GetOrder(req.Market.Name, cid)
+		if err2 != nil {
+			return
+		}
+		err = nil
+	}
+
+	fills := map[int64]fill{}
+	for _, f := range placed.Fills {
+		fills[f.TradeID] = fill{commission: f.Commission, asset: f.CommissionAsset}
+	}
+	dto = toDTO(req.Market, cid, placed, fills)
+	dto.Request = req
+	if req.Type == order.Market {
+		dto.Request.Price = averagePrice(placed)
+	}
+	return
+}
+
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, error) {
+	return p.AverageTradeVolumeContext(context.Background(), mkt)
+}
+
+func (p *provider) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (decimal.Decimal, error) {
+	trades, err := p.client.WithContext(ctx).Trades(mkt.Name, 500)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if len(trades) == 0 {
+		return decimal.Zero, nil
+	}
+
+	total := decimal.Zero
+	for _, t := range trades {
+		total = total.Add(t.Qty)
+	}
+	return total.Div(decimal.NewFromInt(int64(len(trades)))), nil
+}
+
+func (p *provider) CancelOrder(ord types.OrderDTO) (err error) {
+	return p.CancelOrderContext(context.Background(), ord)
+}
+
+func (p *provider) CancelOrderContext(ctx context.Context, ord types.OrderDTO) (err error) {
+	_, err = p.client.WithContext(ctx).CancelOrder(ord.Market.Name, ord.ID)
+	return
+}
+
+func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	return p.CandlesContext(context.Background(), mkt, interval, start, end)
+}
+
+func (p *provider) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	name, granularity, err := getInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+
+	// Page through the klines since each request is capped
+	candles = []types.CandleDTO{}
+	for from := start; from.Before(end); {
+		klines, err := p.client.WithContext(ctx).Klines(mkt.Name, name, from, end, klineLimit)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range klines {
+			candles = append(candles, types.CandleDTO{
+				Open:      k.Open,
+				Close:     k.Close,
+				High:      k.High,
+				Low:       k.Low,
+				Volume:    k.Volume,
+				Timestamp: k.OpenTime,
+			})
+		}
+
+		if len(klines) < klineLimit {
+			break
+		}
+		from = klines[len(klines)-1].OpenTime.Add(granularity)
+	}
+
+	sort.Slice(candles, func(i, j int) bool {
+		return candles[i].Timestamp.Before(candles[j].Timestamp)
+	})
+	return
+}
+
+func (p *provider) Currencies() (curs []types.CurrencyDTO, err error) {
+	return p.CurrenciesContext(context.Background())
+}
+
+func (p *provider) CurrenciesContext(ctx context.Context) (curs []types.CurrencyDTO, err error) {
+	mkts, err := p.MarketsContext(ctx)
+	if err != nil {
+		return
+	}
+
+	// The exchange only describes assets as part of their markets
+	seen := map[string]bool{}
+	curs = []types.CurrencyDTO{}
+	for _, mkt := range mkts {
+		for _, cur := range []types.CurrencyDTO{mkt.BaseCurrency, mkt.QuoteCurrency} {
+			if !seen[cur.Symbol] {
+				seen[cur.Symbol] = true
+				curs = append(curs, cur)
+			}
+		}
+	}
+	return
+}
+
+func (p *provider) Fees() (fees types.FeesDTO, err error) {
+	return p.FeesContext(context.Background())
+}
+
+func (p *provider) FeesContext(ctx context.Context) (fees types.FeesDTO, err error) {
+	acct, err := p.client.WithContext(ctx).Account()
+	if err != nil {
+		return
+	}
+
+	// Commissions are given in basis points
+	fees = types.FeesDTO{
+		MakerRate: decimal.New(int64(acct.MakerCommission), -4),
+		TakerRate: decimal.New(int64(acct.TakerCommission), -4),
+		Volume:    decimal.Zero,
+	}
+	return
+}
+
+// Health reports on the market and user data websockets and the REST budgets
+func (p *provider) Health() []types.ProviderHealth {
+	return []types.ProviderHealth{{
+		Websockets: []types.WebsocketHealth{p.streamSvc.market.Health(), p.streamSvc.user.Health()},
+		RateLimits: ratelimit.Health(p.limiter),
+	}}
+}
+
+func (p *provider) Markets() (mkts []types.MarketDTO, err error) {
+	return p.MarketsContext(context.Background())
+}
+
+func (p *provider) MarketsContext(ctx context.Context) (mkts []types.MarketDTO, err error) {
+	info, err := p.client.WithContext(ctx).ExchangeInfo()
+	if err != nil {
+		return
+	}
+
+	mkts = []types.MarketDTO{}
+	for _, sym := range info.Symbols {
+		if sym.Status != "TRADING" {
+			continue
+		}
+		mkts = append(mkts, getMarket(sym))
+	}
+	return
+}
+
+// OpenOrders lists the account's open orders, including the ones placed outside the trader, by their client order ids
+func (p *provider) OpenOrders() (orders []types.OrderDTO, err error) {
+	return p.OpenOrdersContext(context.Background())
+}
+
+func (p *provider) OpenOrdersContext(ctx context.Context) (orders []types.OrderDTO, err error) {
+	mkts, err := p.MarketsContext(ctx)
+	if err != nil {
+		return
+	}
+	markets := make(map[string]types.MarketDTO, len(mkts))
+	for _, mkt := range mkts {
+		markets[mkt.Name] = mkt
+	}
+
+	raws, err := p.client.WithContext(ctx).OpenOrders("")
+	if err != nil {
+		return
+	}
+
+	orders = []types.OrderDTO{}
+	for _, raw := range raws {
+		fills, err := p.fills(ctx, raw)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, fromOrder(markets[raw.Symbol], raw.ClientOrderID, raw, fills))
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreationTime.Before(orders[j].CreationTime) })
+	return
+}
+
+func (p *provider) Order(mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	return p.OrderContext(context.Background(), mkt, id)
+}
+
+func (p *provider) OrderContext(ctx context.Context, mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	ord, _, err := p.snapshotContext(ctx, types.OrderDTO{Market: mkt, ID: id})
+	return ord, err
+}
+
+func (p *provider) OrderStream(stop <-chan bool, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	return p.streamSvc.OrderStream(stop, ord), nil
+}
+
+func (p *provider) OrderStreamContext(ctx context.Context, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.OrderStream(contextual.Stop(ctx), ord)
+}
+
+func (p *provider) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err error) {
+	return p.RefreshOrderContext(context.Background(), in)
+}
+
+func (p *provider) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (out types.OrderDTO, err error) {
+	out, err = p.OrderContext(ctx, in.Market, in.ID)
+	if errors.Is(err, types.ErrOrderNotFound) {
+		log.Debugf("could not find order %s in API; assuming it was cancelled", in.ID)
+		out = in
+		out.Status = order.Canceled
+		err = nil
+	}
+	return
+}
+
+// Shutdown stops the provider as the kill switch would and waits for its streams to close
+func (p *provider) Shutdown(ctx context.Context) error {
+	return p.lifecycle.Shutdown(ctx)
+}
+
+func (p *provider) Ticker(mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	return p.TickerContext(context.Background(), mkt)
+}
+
+func (p *provider) TickerContext(ctx context.Context, mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	raw, err := p.client.WithContext(ctx).Ticker(mkt.Name)
+	if err != nil {
+		return
+	}
+
+	tkr = types.TickerDTO{
+		Ask:       raw.AskPrice,
+		Bid:       raw.BidPrice,
+		Price:     raw.LastPrice,
+		Quantity:  raw.LastQty,
+		Timestamp: client.FromMillis(raw.CloseTime),
+		Volume:    raw.Volume,
+	}
+	return
+}
+
+func (p *provider) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	return p.streamSvc.TickerStream(stop, mkt), nil
+}
+
+func (p *provider) TickerStreamContext(ctx context.Context, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.TickerStream(contextual.Stop(ctx), mkt)
+}
+
+func (p *provider) Wallet(cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	return p.WalletContext(context.Background(), cur)
+}
+
+func (p *provider) WalletContext(ctx context.Context, cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	wals, err := p.WalletsContext(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, w := range wals {
+		if w.Currency.Symbol == cur.Symbol {
+			return w, nil
+		}
+	}
+
+	// Assets that were never held don't show up in the account
+	return types.WalletDTO{ID: cur.Symbol, Currency: cur, Free: decimal.Zero, Locked: decimal.Zero}, nil
+}
+
+func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
+	return p.WalletsContext(context.Background())
+}
+
+func (p *provider) WalletsContext(ctx context.Context) (wals []types.WalletDTO, err error) {
+	curs, err := p.CurrenciesContext(ctx)
+	if err != nil {
+		return
+	}
+	known := map[string]types.CurrencyDTO{}
+	for _, cur := range curs {
+		known[cur.Symbol] = cur
+	}
+
+	acct, err := p.client.WithContext(ctx).Account()
+	if err != nil {
+		return
+	}
+
+	wals = []types.WalletDTO{}
+	for _, bal := range acct.Balances {
+		cur, ok := known[bal.Asset]
+		if !ok {
+			cur = getCurrency(bal.Asset, 8)
+		}
+		wals = append(wals, types.WalletDTO{
+			ID:       bal.Asset,
+			Currency: cur,
+			Free:     bal.Free,
+			Locked:   bal.Locked,
+		})
+	}
+	return
+}
+
+// snapshot fetches an order along with the trades made against it
+func (p *provider) snapshot(in types.OrderDTO) (types.OrderDTO, map[int64]fill, error) {
+	return p.snapshotContext(context.Background(), in)
+}
+
+func (p *provider) snapshotContext(ctx context.Context, in types.OrderDTO) (types.OrderDTO, map[int64]fill, error) {
+	raw, err := p.client.WithContext(ctx).GetOrder(in.Market.Name, in.ID)
+	if err != nil {
+		return types.OrderDTO{}, nil, err
+	}
+
+	fills, err := p.fills(ctx, raw)
+	if err != nil {
+		return types.OrderDTO{}, nil, err
+	}
+	return fromOrder(in.Market, in.ID, raw, fills), fills, nil
+}
+
+// fills fetches the trades made against an order
+func (p *provider) fills(ctx context.Context, raw client.Order) (map[int64]fill, error) {
+	fills := map[int64]fill{}
+	if !raw.ExecutedQty.IsPositive() {
+		return fills, nil
+	}
+
+	trades, err := p.client.WithContext(ctx).MyTrades(raw.Symbol, raw.OrderID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range trades {
+		fills[t.ID] = fill{commission: t.Commission, asset: t.CommissionAsset}
+	}
+	return fills, nil
+}
+
+// fromOrder is toDTO along with the request the order was placed with
+func fromOrder(mkt types.MarketDTO, id string, raw client.Order, fills map[int64]fill) types.OrderDTO {
+	out := toDTO(mkt, id, raw, fills)
+	out.Request = types.OrderRequestDTO{
+		Market:     mkt,
+		Type:       getType(raw.Type),
+		Side:       getSide(raw.Side),
+		Price:      raw.Price,
+		Quantity:   raw.OrigQty,
+		Funds:      raw.OrigQuoteOrderQty,
+		ForceMaker: raw.Type == "LIMIT_MAKER",
+	}
+	if raw.Type == "MARKET" {
+		out.Request.Price = averagePrice(raw)
+	}
+	return out
+}
+
+func toDTO(mkt types.MarketDTO, id string, raw client.Order, fills map[int64]fill) types.OrderDTO {
+	created := raw.Time
+	if created == 0 {
+		created = raw.TransactTime
+	}
+
+	dto := types.OrderDTO{
+		Market:       mkt,
+		CreationTime: client.FromMillis(created),
+		Filled:       raw.ExecutedQty,
+		ID:           id,
+		Paid:         raw.CummulativeQuoteQty,
+		Status:       getStatus(raw.Status, raw.ExecutedQty),
+	}
+	dto.FeesSide, dto.Fees = sumFees(mkt, fills)
+	return dto
+}
+
+// averagePrice is the price a market order executed at
+func averagePrice(raw client.Order) decimal.Decimal {
+	if raw.ExecutedQty.IsZero() {
+		return decimal.Zero
+	}
+	return raw.CummulativeQuoteQty.Div(raw.ExecutedQty)
+}
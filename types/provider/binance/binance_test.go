@@ -0,0 +1,239 @@
+package binance_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/binance"
+	"github.com/sinisterminister/currencytrader/types/provider/binance/binancetest"
+	"github.com/sinisterminister/currencytrader/types/provider/binance/client"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/spf13/viper"
+)
+
+var srv *binancetest.Server
+
+func TestMain(m *testing.M) {
+	providertest.Main(m, func() {
+		srv = binancetest.NewServer(binancetest.Config{
+			Key:             "key",
+			Secret:          "secret",
+			TickInterval:    20 * time.Millisecond,
+			MakerCommission: 10,
+			TakerCommission: 10,
+		})
+
+		// Viper is global, so configure it once before any provider is reading from it
+		viper.Set("binance.websocketURL", srv.WebsocketURL)
+		viper.Set("binance.websocket.reconnectDelay", "20ms")
+	}, func() { srv.Close() })
+}
+
+func newProvider(t *testing.T, secret string) types.ContextProvider {
+	c := client.NewClient()
+	c.UpdateConfig(&client.ClientConfig{
+		BaseURL: srv.URL,
+		Key:     "key",
+		Secret:  secret,
+	})
+
+	return binance.New(providertest.Stop(t), c, providertest.Limiter())
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			return newProvider(t, "secret")
+		},
+		Market:  "BTCUSDT",
+		Timeout: 5 * time.Second,
+	})
+}
+
+func TestMarketFilters(t *testing.T) {
+	mkt := providertest.Market(t, newProvider(t, "secret"), "ETHBTC")
+
+	expect := map[string][2]decimal.Decimal{
+		"MinPrice":         {mkt.MinPrice, decimal.RequireFromString("0.00001")},
+		"MaxPrice":         {mkt.MaxPrice, decimal.NewFromInt(1000000)},
+		"PriceIncrement":   {mkt.PriceIncrement, decimal.RequireFromString("0.00001")},
+		"MinQuantity":      {mkt.MinQuantity, decimal.RequireFromString("0.001")},
+		"MaxQuantity":      {mkt.MaxQuantity, decimal.NewFromInt(1000)},
+		"QuantityStepSize": {mkt.QuantityStepSize, decimal.RequireFromString("0.001")},
+		"MinFunds":         {mkt.MinFunds, decimal.RequireFromString("0.0001")},
+	}
+	for field, values := range expect {
+		if !values[0].Equal(values[1]) {
+			t.Errorf("%s is %s; expected %s", field, values[0], values[1])
+		}
+	}
+	if mkt.BaseCurrency.Symbol != "ETH" || mkt.QuoteCurrency.Symbol != "BTC" {
+		t.Errorf("market currencies are %s/%s; expected ETH/BTC", mkt.BaseCurrency.Symbol, mkt.QuoteCurrency.Symbol)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	_, err := newProvider(t, "wrong").Wallets()
+
+	var apiErr client.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != -1022 {
+		t.Fatalf("expected a signature error; got %v", err)
+	}
+	var provErr *types.ProviderError
+	if !errors.As(err, &provErr) || provErr.Kind != types.ErrAuthFailed {
+		t.Errorf("signature error %v is not %s", err, types.ErrAuthFailed)
+	}
+}
+
+func TestCancelUnknownOrder(t *testing.T) {
+	p := newProvider(t, "secret")
+	mkt := providertest.Market(t, p, "ETHUSDT")
+
+	err := p.CancelOrder(types.OrderDTO{Market: mkt, ID: "123456789"})
+	var provErr *types.ProviderError
+	if !errors.As(err, &provErr) || provErr.Kind != types.ErrOrderNotFound {
+		t.Fatalf("expected %s; got %v", types.ErrOrderNotFound, err)
+	}
+}
+
+func TestTickerStreamSurvivesDisconnect(t *testing.T) {
+	p := newProvider(t, "secret")
+	mkt := providertest.Market(t, p, "ETHUSDT")
+
+	stop := make(chan bool)
+	defer close(stop)
+	stream, err := p.TickerStream(stop, mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stream
+
+	for i := 0; i < 2; i++ {
+		srv.Disconnect()
+		providertest.WaitFor(t, "resubscription", func() bool { return srv.Subscribed("ethusdt@ticker") })
+
+		select {
+		case <-stream:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ticker stream did not resume after disconnect")
+		}
+	}
+}
+
+func TestOrderStreamAfterListenKeyExpiry(t *testing.T) {
+	p := newProvider(t, "secret")
+	mkt := providertest.Market(t, p, "BTCUSDT")
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto, err := p.AttemptOrder(providertest.RestingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := p.OrderStream(make(chan bool), dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providertest.WaitFor(t, "user data stream", func() bool { return srv.UserStreams() > 0 })
+
+	// The stream has to reconnect with a new key before it sees the fill
+	connects := srv.UserStreamConnects()
+	srv.ExpireListenKeys()
+	providertest.WaitFor(t, "user data stream reconnect", func() bool { return srv.UserStreamConnects() > connects })
+	srv.SetPrice("BTCUSDT", dto.Request.Price.Sub(mkt.PriceIncrement))
+	defer srv.SetPrice("BTCUSDT", tkr.Price)
+
+	var last types.OrderDTO
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case dto, ok := <-stream:
+			if !ok {
+				done = true
+				break
+			}
+			last = dto
+		case <-timeout:
+			t.Fatalf("order stream did not finish; last saw %s", last.Status)
+		}
+	}
+	if last.Status != order.Filled || !last.Filled.Equal(dto.Request.Quantity) {
+		t.Fatalf("order finished as %s with %s filled; expected %s with %s", last.Status, last.Filled, order.Filled, dto.Request.Quantity)
+	}
+
+	// Buys are charged commission in the asset bought
+	if last.FeesSide != order.Buy || !last.Fees.Equal(dto.Request.Quantity.Mul(decimal.New(10, -4))) {
+		t.Fatalf("fees are %s on the %s side; expected commission on the base currency", last.Fees, last.FeesSide)
+	}
+}
+
+func TestOpenOrdersIncludeOutsideOrders(t *testing.T) {
+	p := newProvider(t, "secret")
+	mkt := providertest.Market(t, p, "BTCUSDT")
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placed, err := p.AttemptOrder(providertest.RestingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CancelOrder(placed)
+
+	// An order placed on the website gets a client order id from the exchange
+	c := client.NewClient()
+	c.UpdateConfig(&client.ClientConfig{BaseURL: srv.URL, Key: "key", Secret: "secret"})
+	outside, err := c.CreateOrder(client.OrderRequest{
+		Symbol:      "BTCUSDT",
+		Side:        "BUY",
+		Type:        "LIMIT",
+		TimeInForce: "GTC",
+		Price:       placed.Request.Price,
+		Quantity:    placed.Request.Quantity,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.CancelOrder("BTCUSDT", outside.ClientOrderID)
+
+	orders, err := p.(types.OpenOrderLister).OpenOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]types.OrderDTO{}
+	for _, dto := range orders {
+		found[dto.ID] = dto
+	}
+	if dto, ok := found[placed.ID]; !ok || dto.Market.Name != "BTCUSDT" || dto.Status != order.Pending {
+		t.Errorf("open orders %v don't include the placed order %s", orders, placed.ID)
+	}
+	if _, ok := found[outside.ClientOrderID]; !ok {
+		t.Fatalf("open orders %v don't include the outside order %s", orders, outside.ClientOrderID)
+	}
+
+	// The outside order can be looked up by the id it was listed under
+	if dto, err := p.Order(mkt, outside.ClientOrderID); err != nil || dto.ID != outside.ClientOrderID {
+		t.Errorf("Order() returned %+v, %v for the outside order", dto, err)
+	}
+}
+
+func TestContextCancelsRequests(t *testing.T) {
+	p := newProvider(t, "secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.WalletsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled context's error, got %v", err)
+	}
+	if _, err := p.WalletsContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
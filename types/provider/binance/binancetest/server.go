@@ -0,0 +1,772 @@
+// Package binancetest runs an in-process fake of the Binance spot REST API and websocket
+// streams so the binance provider can be exercised without touching the real exchange.
+//
+// The server speaks the endpoints the provider uses: exchange info, tickers, trades, klines,
+// account, orders, account trades and user data stream keys, plus ticker and user data streams.
+// Holds and matching are left to the simulated exchange engine: orders that cross the book fill
+// in two trades, and orders that rest fill once SetPrice moves the market through them.
+// Commissions are charged in the asset received, as the exchange does.
+package binancetest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ws "github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	ord "github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/internal/exchange"
+)
+
+// Config tunes the fake server
+type Config struct {
+	// Key and Secret are the API credentials the server accepts. Signatures aren't checked when empty.
+	Key    string
+	Secret string
+
+	// TickInterval controls how often ticker messages are published. Defaults to 100ms.
+	TickInterval time.Duration
+
+	// FillDelay is how often working orders are matched against the market. Defaults to 50ms.
+	FillDelay time.Duration
+
+	// MakerCommission and TakerCommission are the commissions in basis points
+	MakerCommission int
+	TakerCommission int
+}
+
+// Server is a fake Binance exchange
+type Server struct {
+	// URL is the base URL of the REST API
+	URL string
+
+	// WebsocketURL is the base URL of the websocket streams
+	WebsocketURL string
+
+	config   Config
+	server   *httptest.Server
+	upgrader ws.Upgrader
+	exchange *exchange.Exchange
+	stop     chan bool
+	once     sync.Once
+
+	// Symbols don't change once the server is up, apart from their prices
+	symbols  map[string]*symbol
+	assets   []string
+	priceMtx sync.RWMutex
+
+	mutex      sync.Mutex
+	tradeID    int64
+	orderID    int64
+	orders     map[string]*order
+	engineIDs  map[string]*order
+	trades     []accountTrade
+	listenKeys map[string]bool
+
+	streamMtx    sync.Mutex
+	conns        map[*streamConn]bool
+	userConnects int
+}
+
+type symbol struct {
+	name        string
+	base        string
+	quote       string
+	price       decimal.Decimal
+	tickSize    decimal.Decimal
+	stepSize    decimal.Decimal
+	minQty      decimal.Decimal
+	maxQty      decimal.Decimal
+	minNotional decimal.Decimal
+}
+
+// order is what the exchange knows of an order beyond what the engine keeps: its ids, type and request
+type order struct {
+	id        int64
+	engineID  string
+	clientID  string
+	symbol    string
+	side      string
+	orderType string
+	price     decimal.Decimal
+	qty       decimal.Decimal
+	quoteQty  decimal.Decimal
+	created   time.Time
+	announced bool
+}
+
+type accountTrade struct {
+	ID              int64  `json:"id"`
+	Symbol          string `json:"symbol"`
+	OrderID         int64  `json:"orderId"`
+	Price           string `json:"price"`
+	Qty             string `json:"qty"`
+	QuoteQty        string `json:"quoteQty"`
+	Commission      string `json:"commission"`
+	CommissionAsset string `json:"commissionAsset"`
+	Time            int64  `json:"time"`
+	IsBuyer         bool   `json:"isBuyer"`
+	IsMaker         bool   `json:"isMaker"`
+}
+
+// NewServer starts a fake exchange with BTCUSDT, ETHUSDT and ETHBTC markets and funded balances
+func NewServer(config Config) *Server {
+	if config.TickInterval <= 0 {
+		config.TickInterval = 100 * time.Millisecond
+	}
+	if config.FillDelay <= 0 {
+		config.FillDelay = 50 * time.Millisecond
+	}
+
+	s := &Server{
+		config:     config,
+		stop:       make(chan bool),
+		symbols:    make(map[string]*symbol),
+		assets:     []string{"USDT", "BTC", "ETH"},
+		orders:     make(map[string]*order),
+		engineIDs:  make(map[string]*order),
+		listenKeys: make(map[string]bool),
+		conns:      make(map[*streamConn]bool),
+	}
+
+	s.addSymbol("BTCUSDT", "BTC", "USDT", "10000", "0.01", "0.00001", "0.001", "100", "10")
+	s.addSymbol("ETHUSDT", "ETH", "USDT", "300", "0.01", "0.0001", "0.001", "5000", "10")
+	s.addSymbol("ETHBTC", "ETH", "BTC", "0.03", "0.00001", "0.001", "0.001", "1000", "0.0001")
+	s.exchange = exchange.New(exchange.Config{
+		Balances: map[string]decimal.Decimal{
+			"USDT": decimal.NewFromInt(100000),
+			"BTC":  decimal.NewFromInt(10),
+			"ETH":  decimal.NewFromInt(100),
+		},
+		Fees: types.FeesDTO{
+			MakerRate: decimal.New(int64(config.MakerCommission), -4),
+			TakerRate: decimal.New(int64(config.TakerCommission), -4),
+		},
+		TickInterval:   config.FillDelay,
+		FeesInProceeds: true,
+		OnFill:         s.onFill,
+	}, s.quote)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleMarketStream)
+	mux.HandleFunc("/ws/", s.handleUserStream)
+	mux.HandleFunc("/", s.handleREST)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	s.WebsocketURL = "ws" + strings.TrimPrefix(s.server.URL, "http")
+
+	go s.publishTickers()
+
+	return s
+}
+
+// Close shuts the server down and drops all stream connections
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.Disconnect()
+		s.server.Close()
+	})
+}
+
+// SetPrice moves the market price for the symbol. Resting orders it crosses fill the next time they are matched.
+func (s *Server) SetPrice(sym string, price decimal.Decimal) {
+	s.priceMtx.Lock()
+	defer s.priceMtx.Unlock()
+	if info, ok := s.symbols[sym]; ok {
+		info.price = price
+	}
+}
+
+// SetBalance sets the free balance of the asset
+func (s *Server) SetBalance(asset string, amount decimal.Decimal) {
+	s.exchange.SetBalance(currency(asset), amount)
+}
+
+func (s *Server) addSymbol(name, base, quote, price, tickSize, stepSize, minQty, maxQty, minNotional string) {
+	s.symbols[name] = &symbol{
+		name:        name,
+		base:        base,
+		quote:       quote,
+		price:       decimal.RequireFromString(price),
+		tickSize:    decimal.RequireFromString(tickSize),
+		stepSize:    decimal.RequireFromString(stepSize),
+		minQty:      decimal.RequireFromString(minQty),
+		maxQty:      decimal.RequireFromString(maxQty),
+		minNotional: decimal.RequireFromString(minNotional),
+	}
+}
+
+func (s *Server) handleREST(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/exchangeInfo":
+		s.exchangeInfo(w)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/ticker/24hr":
+		s.ticker(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/trades":
+		s.publicTrades(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/klines":
+		s.klines(w, r)
+	case r.URL.Path == "/api/v3/userDataStream":
+		s.userDataStream(w, r)
+	case !s.authorized(w, r):
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/account":
+		s.account(w)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v3/order":
+		s.createOrder(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/order":
+		s.getOrder(w, r)
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/v3/order":
+		s.cancelOrder(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/openOrders":
+		s.openOrders(w, r)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v3/myTrades":
+		s.myTrades(w, r)
+	default:
+		writeError(w, http.StatusNotFound, -1000, "Unknown endpoint.")
+	}
+}
+
+// authorized checks the key and signature of a signed request, writing the error if they are bad
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.config.Secret == "" {
+		return true
+	}
+	if r.Header.Get("X-MBX-APIKEY") != s.config.Key {
+		writeError(w, http.StatusUnauthorized, -2015, "Invalid API-key, IP, or permissions for action.")
+		return false
+	}
+
+	query := r.URL.RawQuery
+	i := strings.LastIndex(query, "&signature=")
+	if i < 0 {
+		writeError(w, http.StatusBadRequest, -1102, "Mandatory parameter 'signature' was not sent, was empty/null, or malformed.")
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.config.Secret))
+	mac.Write([]byte(query[:i]))
+	if hex.EncodeToString(mac.Sum(nil)) != query[i+len("&signature="):] {
+		writeError(w, http.StatusBadRequest, -1022, "Signature for this request is not valid.")
+		return false
+	}
+	return true
+}
+
+func (s *Server) exchangeInfo(w http.ResponseWriter) {
+	symbols := []map[string]interface{}{}
+	for _, name := range []string{"BTCUSDT", "ETHUSDT", "ETHBTC"} {
+		info := s.symbols[name]
+		symbols = append(symbols, map[string]interface{}{
+			"symbol":              info.name,
+			"status":              "TRADING",
+			"baseAsset":           info.base,
+			"baseAssetPrecision":  8,
+			"quoteAsset":          info.quote,
+			"quoteAssetPrecision": 8,
+			"orderTypes":          []string{"LIMIT", "LIMIT_MAKER", "MARKET"},
+			"filters": []map[string]interface{}{
+				{"filterType": "PRICE_FILTER", "minPrice": info.tickSize.String(), "maxPrice": "1000000.00000000", "tickSize": info.tickSize.String()},
+				{"filterType": "PERCENT_PRICE", "multiplierUp": "5", "multiplierDown": "0.2", "avgPriceMins": 5},
+				{"filterType": "LOT_SIZE", "minQty": info.minQty.String(), "maxQty": info.maxQty.String(), "stepSize": info.stepSize.String()},
+				{"filterType": "MIN_NOTIONAL", "minNotional": info.minNotional.String(), "applyToMarket": true, "avgPriceMins": 5},
+				{"filterType": "MAX_NUM_ORDERS", "maxNumOrders": 200},
+			},
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"timezone":   "UTC",
+		"serverTime": toMillis(time.Now()),
+		"symbols":    symbols,
+	})
+}
+
+func (s *Server) ticker(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.symbols[r.Form.Get("symbol")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+
+	price, bid, ask := s.spread(info)
+	writeJSON(w, map[string]interface{}{
+		"symbol":    info.name,
+		"lastPrice": price.String(),
+		"lastQty":   "0.01",
+		"bidPrice":  bid.String(),
+		"askPrice":  ask.String(),
+		"volume":    "1000",
+		"closeTime": toMillis(time.Now()),
+	})
+}
+
+func (s *Server) publicTrades(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.symbols[r.Form.Get("symbol")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	price, _, _ := s.spread(info)
+
+	trades := []map[string]interface{}{}
+	for i, qty := range []string{"0.01", "0.02", "0.03"} {
+		trades = append(trades, map[string]interface{}{
+			"id":    i + 1,
+			"price": price.String(),
+			"qty":   qty,
+			"time":  toMillis(time.Now()),
+		})
+	}
+	writeJSON(w, trades)
+}
+
+var intervals = map[string]time.Duration{
+	"1m": time.Minute, "3m": 3 * time.Minute, "5m": 5 * time.Minute, "15m": 15 * time.Minute,
+	"30m": 30 * time.Minute, "1h": time.Hour, "2h": 2 * time.Hour, "4h": 4 * time.Hour,
+	"6h": 6 * time.Hour, "8h": 8 * time.Hour, "12h": 12 * time.Hour, "1d": 24 * time.Hour,
+}
+
+func (s *Server) klines(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.symbols[r.Form.Get("symbol")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+	last, _, _ := s.spread(info)
+	price, _ := last.Float64()
+
+	step, ok := intervals[r.Form.Get("interval")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, -1120, "Invalid interval.")
+		return
+	}
+	limit, err := strconv.Atoi(r.Form.Get("limit"))
+	if err != nil || limit <= 0 || limit > 1000 {
+		limit = 500
+	}
+	end := time.Now()
+	if ms, err := strconv.ParseInt(r.Form.Get("endTime"), 10, 64); err == nil {
+		end = fromMillis(ms)
+	}
+	start := end.Add(-time.Duration(limit) * step)
+	if ms, err := strconv.ParseInt(r.Form.Get("startTime"), 10, 64); err == nil {
+		start = fromMillis(ms)
+	}
+
+	// Oldest klines come first, same as the real API
+	klines := [][]interface{}{}
+	ts := start.Truncate(step)
+	if ts.Before(start) {
+		ts = ts.Add(step)
+	}
+	for ; !ts.After(end) && len(klines) < limit; ts = ts.Add(step) {
+		wobble := float64(ts.Unix()/int64(step.Seconds())%7) / 1000
+		open := price * (1 - wobble)
+		close := price * (1 + wobble)
+		klines = append(klines, []interface{}{
+			toMillis(ts), format(open), format(close * 1.01), format(open * 0.99), format(close), "10",
+			toMillis(ts.Add(step)) - 1, "0", 1, "0", "0", "0",
+		})
+	}
+	writeJSON(w, klines)
+}
+
+func (s *Server) userDataStream(w http.ResponseWriter, r *http.Request) {
+	if s.config.Key != "" && r.Header.Get("X-MBX-APIKEY") != s.config.Key {
+		writeError(w, http.StatusUnauthorized, -2015, "Invalid API-key, IP, or permissions for action.")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		key := strings.ReplaceAll(uuid.New().String(), "-", "")
+		s.listenKeys[key] = true
+		writeJSON(w, map[string]string{"listenKey": key})
+	case http.MethodPut, http.MethodDelete:
+		if !s.listenKeys[r.Form.Get("listenKey")] {
+			writeError(w, http.StatusBadRequest, -1125, "This listenKey does not exist.")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(s.listenKeys, r.Form.Get("listenKey"))
+		}
+		writeJSON(w, map[string]string{})
+	default:
+		writeError(w, http.StatusNotFound, -1000, "Unknown endpoint.")
+	}
+}
+
+func (s *Server) account(w http.ResponseWriter) {
+	curs := []types.CurrencyDTO{}
+	for _, asset := range s.assets {
+		curs = append(curs, currency(asset))
+	}
+
+	balances := []map[string]string{}
+	for _, wal := range s.exchange.Wallets(curs) {
+		balances = append(balances, map[string]string{
+			"asset":  wal.Currency.Symbol,
+			"free":   wal.Free.String(),
+			"locked": wal.Locked.String(),
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"makerCommission": s.config.MakerCommission,
+		"takerCommission": s.config.TakerCommission,
+		"canTrade":        true,
+		"balances":        balances,
+	})
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info, ok := s.symbols[r.Form.Get("symbol")]
+	if !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+
+	o := &order{
+		clientID:  r.Form.Get("newClientOrderId"),
+		symbol:    info.name,
+		side:      r.Form.Get("side"),
+		orderType: r.Form.Get("type"),
+		created:   time.Now(),
+	}
+	o.price, _ = decimal.NewFromString(r.Form.Get("price"))
+	o.qty, _ = decimal.NewFromString(r.Form.Get("quantity"))
+	o.quoteQty, _ = decimal.NewFromString(r.Form.Get("quoteOrderQty"))
+	if o.clientID == "" {
+		o.clientID = uuid.New().String()
+	}
+	if _, ok := s.orders[o.clientID]; ok {
+		writeError(w, http.StatusBadRequest, -2010, "Duplicate order sent.")
+		return
+	}
+	if o.side != "BUY" && o.side != "SELL" {
+		writeError(w, http.StatusBadRequest, -1100, "Illegal characters found in parameter 'side'.")
+		return
+	}
+
+	req := types.OrderRequestDTO{
+		ClientID: o.clientID,
+		Market:   info.market(),
+		Type:     ord.Limit,
+		Side:     ord.Sell,
+		Price:    o.price,
+		Quantity: o.qty,
+	}
+	if o.side == "BUY" {
+		req.Side = ord.Buy
+	}
+
+	_, bid, ask := s.spread(info)
+	price := o.price
+	switch o.orderType {
+	case "LIMIT", "LIMIT_MAKER":
+		if o.orderType == "LIMIT" && r.Form.Get("timeInForce") == "" {
+			writeError(w, http.StatusBadRequest, -1102, "Mandatory parameter 'timeInForce' was not sent, was empty/null, or malformed.")
+			return
+		}
+		if !o.price.IsPositive() || !o.qty.IsPositive() {
+			writeError(w, http.StatusBadRequest, -1102, "Mandatory parameter 'price' was not sent, was empty/null, or malformed.")
+			return
+		}
+		if !o.price.Mod(info.tickSize).IsZero() {
+			writeError(w, http.StatusBadRequest, -1013, "Filter failure: PRICE_FILTER")
+			return
+		}
+		req.ForceMaker = o.orderType == "LIMIT_MAKER"
+	case "MARKET":
+		if !o.qty.IsPositive() && !o.quoteQty.IsPositive() {
+			writeError(w, http.StatusBadRequest, -1102, "Mandatory parameter 'quantity' was not sent, was empty/null, or malformed.")
+			return
+		}
+		price = ask
+		if o.side == "SELL" {
+			price = bid
+		}
+		if !o.qty.IsPositive() {
+			o.qty = o.quoteQty.Div(price).Div(info.stepSize).Floor().Mul(info.stepSize)
+		}
+		req.Type = ord.Market
+		req.Price = decimal.Zero
+		req.Quantity = o.qty
+		req.Funds = o.quoteQty
+	default:
+		writeError(w, http.StatusBadRequest, -1116, "Invalid orderType.")
+		return
+	}
+
+	// Check the order against the trading rules
+	if o.qty.LessThan(info.minQty) || o.qty.GreaterThan(info.maxQty) || !o.qty.Mod(info.stepSize).IsZero() {
+		writeError(w, http.StatusBadRequest, -1013, "Filter failure: LOT_SIZE")
+		return
+	}
+	if o.qty.Mul(price).LessThan(info.minNotional) {
+		writeError(w, http.StatusBadRequest, -1013, "Filter failure: MIN_NOTIONAL")
+		return
+	}
+
+	placed, err := s.exchange.AttemptOrder(req)
+	switch {
+	case errors.Is(err, types.ErrPostOnlyWouldCross):
+		writeError(w, http.StatusBadRequest, -2010, "Order would immediately match and take.")
+		return
+	case errors.Is(err, types.ErrInsufficientFunds):
+		writeError(w, http.StatusBadRequest, -2010, "Account has insufficient balance for requested action.")
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, -1013, err.Error())
+		return
+	}
+
+	s.orderID++
+	o.id = s.orderID
+	o.engineID = placed.ID
+	s.orders[o.clientID] = o
+	s.engineIDs[o.engineID] = o
+	resp := o.toOrder(placed)
+	resp["transactTime"] = toMillis(o.created)
+	resp["fills"] = []interface{}{}
+	writeJSON(w, resp)
+
+	go func() {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.config.FillDelay / 2):
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.announce(o)
+	}()
+}
+
+// announce reports a new order on the user data stream, unless it was already announced
+func (s *Server) announce(o *order) {
+	if o.announced {
+		return
+	}
+	o.announced = true
+
+	dto, _ := s.exchange.Order(o.engineID)
+	dto.Status = ord.Pending
+	dto.Filled, dto.Paid = decimal.Zero, decimal.Zero
+	s.report(o, dto, "NEW", "", nil)
+}
+
+// onFill records a match the engine made as an account trade and reports it on the user data stream
+func (s *Server) onFill(dto types.OrderDTO, f exchange.Fill) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.engineIDs[dto.ID]
+	if !ok {
+		return
+	}
+	s.announce(o)
+
+	// Commissions come out of the asset received
+	info := s.symbols[o.symbol]
+	commissionAsset := info.quote
+	if o.side == "BUY" {
+		commissionAsset = info.base
+	}
+
+	s.tradeID++
+	s.trades = append(s.trades, accountTrade{
+		ID:              s.tradeID,
+		Symbol:          o.symbol,
+		OrderID:         o.id,
+		Price:           f.Price.String(),
+		Qty:             f.Quantity.String(),
+		QuoteQty:        f.Cost.String(),
+		Commission:      f.Fee.String(),
+		CommissionAsset: commissionAsset,
+		Time:            toMillis(time.Now()),
+		IsBuyer:         o.side == "BUY",
+		IsMaker:         !f.Taker,
+	})
+	s.report(o, dto, "TRADE", "", map[string]interface{}{
+		"l": f.Quantity.String(),
+		"L": f.Price.String(),
+		"n": f.Fee.String(),
+		"N": commissionAsset,
+		"t": s.tradeID,
+		"m": !f.Taker,
+	})
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.orders[r.Form.Get("origClientOrderId")]
+	if !ok || o.symbol != r.Form.Get("symbol") {
+		writeError(w, http.StatusBadRequest, -2013, "Order does not exist.")
+		return
+	}
+	dto, _ := s.exchange.Order(o.engineID)
+	writeJSON(w, o.toOrder(dto))
+}
+
+func (s *Server) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.orders[r.Form.Get("origClientOrderId")]
+	if !ok || o.symbol != r.Form.Get("symbol") || s.exchange.CancelOrder(types.OrderDTO{ID: o.engineID}) != nil {
+		writeError(w, http.StatusBadRequest, -2011, "Unknown order sent.")
+		return
+	}
+
+	dto, _ := s.exchange.Order(o.engineID)
+	cancelID := strings.ReplaceAll(uuid.New().String(), "-", "")
+	s.announce(o)
+	s.report(o, dto, "CANCELED", cancelID, nil)
+
+	resp := o.toOrder(dto)
+	resp["origClientOrderId"] = o.clientID
+	resp["clientOrderId"] = cancelID
+	writeJSON(w, resp)
+}
+
+func (s *Server) openOrders(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sym := r.Form.Get("symbol")
+	if _, ok := s.symbols[sym]; sym != "" && !ok {
+		writeError(w, http.StatusBadRequest, -1121, "Invalid symbol.")
+		return
+	}
+
+	orders := []map[string]interface{}{}
+	for _, dto := range s.exchange.OpenOrders() {
+		o := s.engineIDs[dto.ID]
+		if sym == "" || o.symbol == sym {
+			orders = append(orders, o.toOrder(dto))
+		}
+	}
+	writeJSON(w, orders)
+}
+
+func (s *Server) myTrades(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	orderID, _ := strconv.ParseInt(r.Form.Get("orderId"), 10, 64)
+
+	trades := []accountTrade{}
+	for _, t := range s.trades {
+		if t.Symbol == r.Form.Get("symbol") && (orderID == 0 || t.OrderID == orderID) {
+			trades = append(trades, t)
+		}
+	}
+	writeJSON(w, trades)
+}
+
+// spread is the last price of the symbol and the best bid and ask around it
+func (s *Server) spread(info *symbol) (price decimal.Decimal, bid decimal.Decimal, ask decimal.Decimal) {
+	s.priceMtx.RLock()
+	defer s.priceMtx.RUnlock()
+	return info.price, info.price.Sub(info.tickSize), info.price.Add(info.tickSize)
+}
+
+// quote is the ticker the engine matches orders against
+func (s *Server) quote(mkt types.MarketDTO) (types.TickerDTO, error) {
+	info, ok := s.symbols[mkt.Name]
+	if !ok {
+		return types.TickerDTO{}, types.ErrInvalidRequest
+	}
+	price, bid, ask := s.spread(info)
+	return types.TickerDTO{Ask: ask, Bid: bid, Price: price, Timestamp: time.Now()}, nil
+}
+
+// market describes the symbol to the engine
+func (info *symbol) market() types.MarketDTO {
+	base := currency(info.base)
+	base.Increment = info.stepSize
+	return types.MarketDTO{Name: info.name, BaseCurrency: base, QuoteCurrency: currency(info.quote)}
+}
+
+func currency(asset string) types.CurrencyDTO {
+	return types.CurrencyDTO{Name: asset, Symbol: asset, Precision: 8, Increment: decimal.New(1, -8)}
+}
+
+func (o *order) toOrder(dto types.OrderDTO) map[string]interface{} {
+	return map[string]interface{}{
+		"symbol":              o.symbol,
+		"orderId":             o.id,
+		"clientOrderId":       o.clientID,
+		"price":               o.priceString(),
+		"origQty":             o.qty.String(),
+		"origQuoteOrderQty":   o.quoteQty.String(),
+		"executedQty":         dto.Filled.String(),
+		"cummulativeQuoteQty": dto.Paid.String(),
+		"status":              status(dto.Status),
+		"timeInForce":         "GTC",
+		"type":                o.orderType,
+		"side":                o.side,
+		"time":                toMillis(o.created),
+		"updateTime":          toMillis(time.Now()),
+	}
+}
+
+// status is the API's name for the order status
+func status(st types.OrderStatus) string {
+	switch st {
+	case ord.Partial:
+		return "PARTIALLY_FILLED"
+	case ord.Filled:
+		return "FILLED"
+	case ord.Canceled:
+		return "CANCELED"
+	}
+	return "NEW"
+}
+
+// priceString is the order price, which the API reports as zero for market orders
+func (o *order) priceString() string {
+	if o.orderType == "MARKET" {
+		return "0.00000000"
+	}
+	return o.price.String()
+}
+
+var decimalThousand = decimal.NewFromInt(1000)
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func format(f float64) string {
+	return strconv.FormatFloat(f, 'f', 8, 64)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "msg": message})
+}
@@ -0,0 +1,282 @@
+package binancetest
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+type streamConn struct {
+	conn      *ws.Conn
+	listenKey string
+
+	mutex   sync.Mutex
+	streams map[string]bool
+}
+
+type streamRequest struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	ID     int64    `json:"id"`
+}
+
+// Disconnect drops every stream connection, as if the exchange had hung up
+func (s *Server) Disconnect() {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		conn.conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Subscribed reports whether any market stream connection is subscribed to the stream, e.g. btcusdt@ticker
+func (s *Server) Subscribed(stream string) bool {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		if conn.subscribed(stream) {
+			return true
+		}
+	}
+	return false
+}
+
+// UserStreams reports how many user data stream connections are open
+func (s *Server) UserStreams() int {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	count := 0
+	for conn := range s.conns {
+		if conn.listenKey != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// UserStreamConnects reports how many user data stream connections have ever been opened
+func (s *Server) UserStreamConnects() int {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	return s.userConnects
+}
+
+// ExpireListenKeys invalidates every listen key and tells the user data streams about it
+func (s *Server) ExpireListenKeys() {
+	s.mutex.Lock()
+	s.listenKeys = make(map[string]bool)
+	s.mutex.Unlock()
+
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		if conn.listenKey != "" {
+			conn.write(map[string]interface{}{"e": "listenKeyExpired", "E": toMillis(time.Now())})
+		}
+	}
+}
+
+func (s *Server) handleMarketStream(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	sc := &streamConn{conn: conn, streams: make(map[string]bool)}
+	s.register(sc)
+	defer s.unregister(sc)
+
+	for {
+		var req streamRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		switch req.Method {
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			sc.update(req)
+			sc.write(map[string]interface{}{"result": nil, "id": req.ID})
+		case "LIST_SUBSCRIPTIONS":
+			sc.write(map[string]interface{}{"result": sc.list(), "id": req.ID})
+		default:
+			sc.write(map[string]interface{}{"code": 2, "msg": "Invalid request: unknown method", "id": req.ID})
+		}
+	}
+}
+
+func (s *Server) handleUserStream(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/ws/")
+	s.mutex.Lock()
+	valid := s.listenKeys[key]
+	s.mutex.Unlock()
+	if !valid {
+		writeError(w, http.StatusBadRequest, -1125, "This listenKey does not exist.")
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	sc := &streamConn{conn: conn, listenKey: key, streams: make(map[string]bool)}
+	s.register(sc)
+	s.streamMtx.Lock()
+	s.userConnects++
+	s.streamMtx.Unlock()
+	defer s.unregister(sc)
+
+	// User data streams take no requests; read until the client goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) register(sc *streamConn) {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	s.conns[sc] = true
+}
+
+func (s *Server) unregister(sc *streamConn) {
+	s.streamMtx.Lock()
+	delete(s.conns, sc)
+	s.streamMtx.Unlock()
+	sc.conn.Close()
+}
+
+func (sc *streamConn) update(req streamRequest) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	for _, stream := range req.Params {
+		if req.Method == "SUBSCRIBE" {
+			sc.streams[stream] = true
+		} else {
+			delete(sc.streams, stream)
+		}
+	}
+}
+
+func (sc *streamConn) list() []string {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	streams := []string{}
+	for stream := range sc.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+func (sc *streamConn) subscribed(stream string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.streams[stream]
+}
+
+func (sc *streamConn) write(msg interface{}) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	sc.conn.WriteJSON(msg)
+}
+
+// report sends an execution report for the order to every user data stream
+func (s *Server) report(o *order, dto types.OrderDTO, execType string, cancelID string, extra map[string]interface{}) {
+	msg := map[string]interface{}{
+		"e": "executionReport",
+		"E": toMillis(time.Now()),
+		"s": o.symbol,
+		"c": o.clientID,
+		"S": o.side,
+		"o": o.orderType,
+		"f": "GTC",
+		"q": o.qty.String(),
+		"p": o.priceString(),
+		"C": "",
+		"x": execType,
+		"X": status(dto.Status),
+		"r": "NONE",
+		"i": o.id,
+		"l": "0.00000000",
+		"z": dto.Filled.String(),
+		"L": "0.00000000",
+		"n": "0",
+		"N": nil,
+		"T": toMillis(time.Now()),
+		"t": -1,
+		"m": false,
+		"O": toMillis(o.created),
+		"Z": dto.Paid.String(),
+		"Q": o.quoteQty.String(),
+	}
+	if cancelID != "" {
+		msg["c"] = cancelID
+		msg["C"] = o.clientID
+	}
+	for k, v := range extra {
+		msg[k] = v
+	}
+
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		if conn.listenKey != "" {
+			conn.write(msg)
+		}
+	}
+}
+
+func (s *Server) publishTickers() {
+	ticker := time.NewTicker(s.config.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		msgs := map[string]interface{}{}
+		for name, info := range s.symbols {
+			price, bid, ask := s.spread(info)
+			now := toMillis(time.Now())
+			msgs[strings.ToLower(name)+"@ticker"] = map[string]interface{}{
+				"e": "24hrTicker",
+				"E": now,
+				"s": name,
+				"c": price.String(),
+				"Q": "0.01",
+				"b": bid.String(),
+				"B": "1.00000000",
+				"a": ask.String(),
+				"A": "1.00000000",
+				"o": price.String(),
+				"h": price.String(),
+				"l": price.String(),
+				"v": "1000.00000000",
+				"q": price.Mul(decimalThousand).String(),
+				"O": now - int64(24*time.Hour/time.Millisecond),
+				"C": now,
+				"n": 1,
+			}
+		}
+
+		s.streamMtx.Lock()
+		for conn := range s.conns {
+			for stream, msg := range msgs {
+				if conn.subscribed(stream) {
+					conn.write(msg)
+				}
+			}
+		}
+		s.streamMtx.Unlock()
+	}
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// Error is an error reported by the Binance API
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"code"`
+	Message    string `json:"msg"`
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("binance error %d: %s", e.Code, e.Message)
+}
+
+// Temporary reports whether the request may succeed if it is sent again
+func (e Error) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests ||
+		e.Code == CodeTooManyRequests
+}
+
+// Wrap ties the error to the kind of failure in types it is, so callers can branch on it with errors.Is. Errors
+// of no known kind are returned as they are.
+func (e Error) Wrap() error {
+	for _, kind := range kinds {
+		if e.is(kind) {
+			return &types.ProviderError{Kind: kind, Err: e}
+		}
+	}
+	return e
+}
+
+// Kinds of failure in the order Wrap tries them
+var kinds = []error{types.ErrAuthFailed, types.ErrRateLimited, types.ErrOrderNotFound, types.ErrInsufficientFunds,
+	types.ErrPostOnlyWouldCross, types.ErrMarketHalted, types.ErrInvalidRequest}
+
+func (e Error) is(kind error) bool {
+	message := strings.ToLower(e.Message)
+	switch kind {
+	case types.ErrAuthFailed:
+		return e.StatusCode == http.StatusUnauthorized || e.Code == CodeBadAPIKey || e.Code == CodeRejectedAPIKey ||
+			e.Code == CodeBadSignature
+	case types.ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusTeapot || e.Code == CodeTooManyRequests
+	case types.ErrOrderNotFound:
+		return e.Code == CodeUnknownOrder || e.Code == CodeNoSuchOrder
+	case types.ErrInsufficientFunds:
+		return strings.Contains(message, "insufficient balance")
+	case types.ErrPostOnlyWouldCross:
+		return strings.Contains(message, "immediately match")
+	case types.ErrMarketHalted:
+		return strings.Contains(message, "market is closed") || strings.Contains(message, "trading is disabled")
+	case types.ErrInvalidRequest:
+		return e.Code == CodeFilterFailure || (e.Code <= -1100 && e.Code > -1200)
+	}
+	return false
+}
+
+// Error codes the provider acts on
+const (
+	CodeUnknownOrder    = -2011
+	CodeNoSuchOrder     = -2013
+	CodeNewOrderRejects = -2010
+	CodeTooManyRequests = -1003
+	CodeBadAPIKey       = -2014
+	CodeRejectedAPIKey  = -2015
+	CodeFilterFailure   = -1013
+	CodeBadSignature    = -1022
+)
+
+type ClientConfig struct {
+	BaseURL    string
+	Key        string
+	Secret     string
+	RecvWindow time.Duration
+}
+
+type Client struct {
+	HTTPClient *http.Client
+
+	mutex  sync.RWMutex
+	config ClientConfig
+
+	// Views made by WithContext make their requests with ctx and share the configuration of base
+	ctx  context.Context
+	base *Client
+}
+
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+		config: ClientConfig{
+			BaseURL:    "https://api.binance.com",
+			RecvWindow: 5 * time.Second,
+		},
+	}
+}
+
+// WithContext returns a view of the client whose requests are made with the context, so they are cut short once it is
+// done and wait on the rate limiter no longer than it allows
+func (c *Client) WithContext(ctx context.Context) *Client {
+	return &Client{HTTPClient: c.HTTPClient, ctx: ctx, base: c.root()}
+}
+
+func (c *Client) root() *Client {
+	if c.base != nil {
+		return c.base
+	}
+	return c
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+func (c *Client) UpdateConfig(config *ClientConfig) {
+	c = c.root()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if config.BaseURL != "" {
+		c.config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	}
+	if config.RecvWindow > 0 {
+		c.config.RecvWindow = config.RecvWindow
+	}
+	c.config.Key = config.Key
+	c.config.Secret = config.Secret
+}
+
+func (c *Client) ExchangeInfo() (info ExchangeInfo, err error) {
+	err = c.request(http.MethodGet, "/api/v3/exchangeInfo", nil, false, &info)
+	return
+}
+
+func (c *Client) Ticker(symbol string) (tkr Ticker, err error) {
+	err = c.request(http.MethodGet, "/api/v3/ticker/24hr", url.Values{"symbol": {symbol}}, false, &tkr)
+	return
+}
+
+func (c *Client) Trades(symbol string, limit int) (trades []Trade, err error) {
+	params := url.Values{"symbol": {symbol}, "limit": {strconv.Itoa(limit)}}
+	err = c.request(http.MethodGet, "/api/v3/trades", params, false, &trades)
+	return
+}
+
+func (c *Client) Klines(symbol string, interval string, start time.Time, end time.Time, limit int) (klines []Kline, err error) {
+	params := url.Values{
+		"symbol":    {symbol},
+		"interval":  {interval},
+		"startTime": {strconv.FormatInt(toMillis(start), 10)},
+		"endTime":   {strconv.FormatInt(toMillis(end), 10)},
+		"limit":     {strconv.Itoa(limit)},
+	}
+	err = c.request(http.MethodGet, "/api/v3/klines", params, false, &klines)
+	return
+}
+
+func (c *Client) Account() (acct Account, err error) {
+	err = c.request(http.MethodGet, "/api/v3/account", url.Values{}, true, &acct)
+	return
+}
+
+func (c *Client) CreateOrder(req OrderRequest) (ord Order, err error) {
+	err = c.request(http.MethodPost, "/api/v3/order", req.values(), true, &ord)
+	return
+}
+
+func (c *Client) GetOrder(symbol string, clientOrderID string) (ord Order, err error) {
+	params := url.Values{"symbol": {symbol}, "origClientOrderId": {clientOrderID}}
+	err = c.request(http.MethodGet, "/api/v3/order", params, true, &ord)
+	return
+}
+
+func (c *Client) CancelOrder(symbol string, clientOrderID string) (ord Order, err error) {
+	params := url.Values{"symbol": {symbol}, "origClientOrderId": {clientOrderID}}
+	err = c.request(http.MethodDelete, "/api/v3/order", params, true, &ord)
+	return
+}
+
+// OpenOrders lists the open orders on the symbol, or on every symbol when it is empty
+func (c *Client) OpenOrders(symbol string) (orders []Order, err error) {
+	params := url.Values{}
+	if symbol != "" {
+		params.Set("symbol", symbol)
+	}
+	err = c.request(http.MethodGet, "/api/v3/openOrders", params, true, &orders)
+	return
+}
+
+func (c *Client) MyTrades(symbol string, orderID int64) (trades []AccountTrade, err error) {
+	params := url.Values{"symbol": {symbol}, "orderId": {strconv.FormatInt(orderID, 10)}}
+	err = c.request(http.MethodGet, "/api/v3/myTrades", params, true, &trades)
+	return
+}
+
+// CreateListenKey opens a user data stream and returns its key
+func (c *Client) CreateListenKey() (key string, err error) {
+	var resp struct {
+		ListenKey string `json:"listenKey"`
+	}
+	err = c.request(http.MethodPost, "/api/v3/userDataStream", nil, false, &resp)
+	key = resp.ListenKey
+	return
+}
+
+// KeepAliveListenKey extends the life of a user data stream
+func (c *Client) KeepAliveListenKey(key string) error {
+	return c.request(http.MethodPut, "/api/v3/userDataStream", url.Values{"listenKey": {key}}, false, nil)
+}
+
+func (c *Client) request(method string, path string, params url.Values, signed bool, result interface{}) error {
+	root := c.root()
+	root.mutex.RLock()
+	config := root.config
+	root.mutex.RUnlock()
+
+	if params == nil {
+		params = url.Values{}
+	}
+
+	// Sign the request
+	query := params.Encode()
+	if signed {
+		params.Set("timestamp", strconv.FormatInt(toMillis(time.Now()), 10))
+		params.Set("recvWindow", strconv.FormatInt(config.RecvWindow.Milliseconds(), 10))
+		query = params.Encode()
+		mac := hmac.New(sha256.New, []byte(config.Secret))
+		mac.Write([]byte(query))
+		query += "&signature=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	endpoint := config.BaseURL + path
+	if query != "" {
+		endpoint += "?" + query
+	}
+	req, err := http.NewRequestWithContext(c.context(), method, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if config.Key != "" {
+		req.Header.Set("X-MBX-APIKEY", config.Key)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := Error{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(body, &apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr.Wrap()
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(body, result)
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type ExchangeInfo struct {
+	ServerTime int64    `json:"serverTime"`
+	Symbols    []Symbol `json:"symbols"`
+}
+
+type Symbol struct {
+	Symbol              string   `json:"symbol"`
+	Status              string   `json:"status"`
+	BaseAsset           string   `json:"baseAsset"`
+	BaseAssetPrecision  int      `json:"baseAssetPrecision"`
+	QuoteAsset          string   `json:"quoteAsset"`
+	QuoteAssetPrecision int      `json:"quoteAssetPrecision"`
+	OrderTypes          []string `json:"orderTypes"`
+	Filters             []Filter `json:"filters"`
+}
+
+// Filter is any of the trading rules of a symbol; only the fields of its type are set
+type Filter struct {
+	FilterType  string          `json:"filterType"`
+	MinPrice    decimal.Decimal `json:"minPrice"`
+	MaxPrice    decimal.Decimal `json:"maxPrice"`
+	TickSize    decimal.Decimal `json:"tickSize"`
+	MinQty      decimal.Decimal `json:"minQty"`
+	MaxQty      decimal.Decimal `json:"maxQty"`
+	StepSize    decimal.Decimal `json:"stepSize"`
+	MinNotional decimal.Decimal `json:"minNotional"`
+	MaxNotional decimal.Decimal `json:"maxNotional"`
+}
+
+type Ticker struct {
+	Symbol    string          `json:"symbol"`
+	LastPrice decimal.Decimal `json:"lastPrice"`
+	LastQty   decimal.Decimal `json:"lastQty"`
+	BidPrice  decimal.Decimal `json:"bidPrice"`
+	AskPrice  decimal.Decimal `json:"askPrice"`
+	Volume    decimal.Decimal `json:"volume"`
+	CloseTime int64           `json:"closeTime"`
+}
+
+type Trade struct {
+	ID    int64           `json:"id"`
+	Price decimal.Decimal `json:"price"`
+	Qty   decimal.Decimal `json:"qty"`
+	Time  int64           `json:"time"`
+}
+
+// Kline is a candle, which the API sends as an array
+type Kline struct {
+	OpenTime time.Time
+	Open     decimal.Decimal
+	High     decimal.Decimal
+	Low      decimal.Decimal
+	Close    decimal.Decimal
+	Volume   decimal.Decimal
+}
+
+func (k *Kline) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) < 6 {
+		return errors.New("kline has too few fields")
+	}
+
+	var openTime int64
+	if err := json.Unmarshal(raw[0], &openTime); err != nil {
+		return err
+	}
+	k.OpenTime = FromMillis(openTime)
+
+	for i, field := range []*decimal.Decimal{&k.Open, &k.High, &k.Low, &k.Close, &k.Volume} {
+		if err := json.Unmarshal(raw[i+1], field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Account struct {
+	MakerCommission int       `json:"makerCommission"`
+	TakerCommission int       `json:"takerCommission"`
+	CanTrade        bool      `json:"canTrade"`
+	Balances        []Balance `json:"balances"`
+}
+
+type Balance struct {
+	Asset  string          `json:"asset"`
+	Free   decimal.Decimal `json:"free"`
+	Locked decimal.Decimal `json:"locked"`
+}
+
+type OrderRequest struct {
+	Symbol           string
+	Side             string
+	Type             string
+	TimeInForce      string
+	Quantity         decimal.Decimal
+	QuoteOrderQty    decimal.Decimal
+	Price            decimal.Decimal
+	NewClientOrderID string
+}
+
+func (r OrderRequest) values() url.Values {
+	params := url.Values{
+		"symbol":           {r.Symbol},
+		"side":             {r.Side},
+		"type":             {r.Type},
+		"newClientOrderId": {r.NewClientOrderID},
+		"newOrderRespType": {"FULL"},
+	}
+	if r.TimeInForce != "" {
+		params.Set("timeInForce", r.TimeInForce)
+	}
+	if r.Quantity.IsPositive() {
+		params.Set("quantity", r.Quantity.String())
+	}
+	if r.QuoteOrderQty.IsPositive() {
+		params.Set("quoteOrderQty", r.QuoteOrderQty.String())
+	}
+	if r.Price.IsPositive() {
+		params.Set("price", r.Price.String())
+	}
+	return params
+}
+
+type Order struct {
+	Symbol              string          `json:"symbol"`
+	OrderID             int64           `json:"orderId"`
+	ClientOrderID       string          `json:"clientOrderId"`
+	OrigClientOrderID   string          `json:"origClientOrderId"`
+	Price               decimal.Decimal `json:"price"`
+	OrigQty             decimal.Decimal `json:"origQty"`
+	OrigQuoteOrderQty   decimal.Decimal `json:"origQuoteOrderQty"`
+	ExecutedQty         decimal.Decimal `json:"executedQty"`
+	CummulativeQuoteQty decimal.Decimal `json:"cummulativeQuoteQty"`
+	Status              string          `json:"status"`
+	Type                string          `json:"type"`
+	Side                string          `json:"side"`
+	Time                int64           `json:"time"`
+	TransactTime        int64           `json:"transactTime"`
+	Fills               []Fill          `json:"fills"`
+}
+
+type Fill struct {
+	TradeID         int64           `json:"tradeId"`
+	Price           decimal.Decimal `json:"price"`
+	Qty             decimal.Decimal `json:"qty"`
+	Commission      decimal.Decimal `json:"commission"`
+	CommissionAsset string          `json:"commissionAsset"`
+}
+
+type AccountTrade struct {
+	ID              int64           `json:"id"`
+	OrderID         int64           `json:"orderId"`
+	Price           decimal.Decimal `json:"price"`
+	Qty             decimal.Decimal `json:"qty"`
+	QuoteQty        decimal.Decimal `json:"quoteQty"`
+	Commission      decimal.Decimal `json:"commission"`
+	CommissionAsset string          `json:"commissionAsset"`
+	IsMaker         bool            `json:"isMaker"`
+}
+
+// FromMillis converts a timestamp in milliseconds into a time
+func FromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,16 @@
+package binance
+
+import "github.com/spf13/viper"
+
+func init() {
+	viper.SetDefault("binance.websocketURL", "wss://stream.binance.com:9443")
+	viper.SetDefault("binance.websocket.reconnectDelay", "1s")
+	viper.SetDefault("binance.websocket.listenKeyKeepAlive", "30m")
+	viper.SetDefault("binance.streams.tickerStreamBufferSize", 64)
+	viper.SetDefault("binance.streams.orderStreamBufferSize", 8)
+
+	viper.SetDefault("binance.rateLimit.public.rate", 20)
+	viper.SetDefault("binance.rateLimit.public.burst", 40)
+	viper.SetDefault("binance.rateLimit.private.rate", 10)
+	viper.SetDefault("binance.rateLimit.private.burst", 20)
+}
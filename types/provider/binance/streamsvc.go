@@ -0,0 +1,458 @@
+package binance
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/binance/client"
+	"github.com/sinisterminister/currencytrader/types/provider/internal/socket"
+	"github.com/spf13/viper"
+)
+
+// snapshotFunc fetches the current state of an order along with its fills
+type snapshotFunc func(types.OrderDTO) (types.OrderDTO, map[int64]fill, error)
+
+type streamSvc struct {
+	log      log.Entry
+	stop     <-chan bool
+	group    *lifecycle.Group
+	client   *client.Client
+	snapshot snapshotFunc
+
+	market    *socket.Socket
+	requestID int64
+
+	tickerMtx     sync.Mutex
+	tickerStreams map[string]map[chan types.TickerDTO]bool
+
+	user      *socket.Socket
+	userOnce  sync.Once
+	keyMtx    sync.Mutex
+	listenKey string
+
+	orderMtx sync.Mutex
+	orders   map[string]*orderState
+}
+
+type orderState struct {
+	mutex   sync.Mutex
+	dto     types.OrderDTO
+	fills   map[int64]fill
+	streams []*orderStream
+}
+
+type orderStream struct {
+	once   sync.Once
+	stream chan types.OrderDTO
+}
+
+func (s *orderStream) close() {
+	s.once.Do(func() { close(s.stream) })
+}
+
+// Stream messages use single letter keys that differ only by case. Decoding matches keys without
+// regard to case when there is no exact match, so every colliding key gets a field of its own.
+
+type event struct {
+	Type      string `json:"e"`
+	EventTime int64  `json:"E"`
+	Symbol    string `json:"s"`
+	Side      string `json:"S"`
+}
+
+type tickerEvent struct {
+	event
+	Price       decimal.Decimal `json:"c"`
+	CloseTime   int64           `json:"C"`
+	Bid         decimal.Decimal `json:"b"`
+	BidQuantity decimal.Decimal `json:"B"`
+	Ask         decimal.Decimal `json:"a"`
+	AskQuantity decimal.Decimal `json:"A"`
+	Quantity    decimal.Decimal `json:"Q"`
+	QuoteVolume decimal.Decimal `json:"q"`
+	Volume      decimal.Decimal `json:"v"`
+}
+
+type executionReport struct {
+	event
+	ClientOrderID     string          `json:"c"`
+	OrigClientOrderID string          `json:"C"`
+	Status            string          `json:"X"`
+	ExecutionType     string          `json:"x"`
+	Filled            decimal.Decimal `json:"z"`
+	Paid              decimal.Decimal `json:"Z"`
+	Commission        decimal.Decimal `json:"n"`
+	CommissionAsset   string          `json:"N"`
+	TradeID           int64           `json:"t"`
+	TransactTime      int64           `json:"T"`
+}
+
+type subscription struct {
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+	ID     int64    `json:"id"`
+}
+
+// socketConfig sets up the market and user sockets
+var socketConfig = socket.Config{Source: "binance", ReconnectDelayKey: "binance.websocket.reconnectDelay"}
+
+func newStreamSvc(stop <-chan bool, group *lifecycle.Group, c *client.Client, snapshot snapshotFunc) *streamSvc {
+	svc := &streamSvc{
+		log:           log.WithField("source", "binance.streamSvc"),
+		stop:          stop,
+		group:         group,
+		client:        c,
+		snapshot:      snapshot,
+		tickerStreams: make(map[string]map[chan types.TickerDTO]bool),
+		orders:        make(map[string]*orderState),
+	}
+
+	svc.market = socket.New(stop, "marketSocket", socketConfig, func() (string, error) {
+		return viper.GetString("binance.websocketURL") + "/ws", nil
+	}, svc.resubscribe, svc.handleMarketMessage)
+	svc.group.Go(svc.market.Run)
+
+	svc.user = socket.New(stop, "userSocket", socketConfig, svc.userStreamURL, svc.refreshOrders, svc.handleUserMessage)
+
+	return svc
+}
+
+func (svc *streamSvc) TickerStream(stop <-chan bool, mkt types.MarketDTO) <-chan types.TickerDTO {
+	stream := make(chan types.TickerDTO, viper.GetInt("binance.streams.tickerStreamBufferSize"))
+
+	svc.tickerMtx.Lock()
+	streams, ok := svc.tickerStreams[mkt.Name]
+	if !ok {
+		streams = make(map[chan types.TickerDTO]bool)
+		svc.tickerStreams[mkt.Name] = streams
+
+		// The subscription is retried on reconnect if the socket isn't up yet
+		if err := svc.subscribe("SUBSCRIBE", mkt.Name); err != nil {
+			svc.log.WithError(err).Debugf("deferring ticker subscription for %s", mkt.Name)
+		}
+	}
+	streams[stream] = true
+	svc.tickerMtx.Unlock()
+
+	svc.group.Go(func() {
+		select {
+		case <-stop:
+		case <-svc.stop:
+		}
+
+		svc.tickerMtx.Lock()
+		defer svc.tickerMtx.Unlock()
+		delete(streams, stream)
+		close(stream)
+
+		if len(streams) == 0 {
+			delete(svc.tickerStreams, mkt.Name)
+			svc.subscribe("UNSUBSCRIBE", mkt.Name)
+		}
+	})
+
+	return stream
+}
+
+func (svc *streamSvc) subscribe(method string, symbols ...string) error {
+	params := []string{}
+	for _, symbol := range symbols {
+		params = append(params, strings.ToLower(symbol)+"@ticker")
+	}
+	return svc.market.Send(subscription{
+		Method: method,
+		Params: params,
+		ID:     atomic.AddInt64(&svc.requestID, 1),
+	})
+}
+
+// resubscribe restores the ticker subscriptions on a fresh connection
+func (svc *streamSvc) resubscribe() error {
+	svc.tickerMtx.Lock()
+	defer svc.tickerMtx.Unlock()
+
+	symbols := []string{}
+	for symbol := range svc.tickerStreams {
+		symbols = append(symbols, symbol)
+	}
+	if len(symbols) == 0 {
+		return nil
+	}
+	return svc.subscribe("SUBSCRIBE", symbols...)
+}
+
+func (svc *streamSvc) handleMarketMessage(msg []byte) {
+	var evt event
+	if err := json.Unmarshal(msg, &evt); err != nil || evt.Type != "24hrTicker" {
+		return
+	}
+
+	var raw tickerEvent
+	if err := json.Unmarshal(msg, &raw); err != nil {
+		svc.log.WithError(err).Warn("could not parse ticker message")
+		return
+	}
+	tkr := types.TickerDTO{
+		Ask:       raw.Ask,
+		Bid:       raw.Bid,
+		Price:     raw.Price,
+		Quantity:  raw.Quantity,
+		Timestamp: client.FromMillis(raw.EventTime),
+		Volume:    raw.Volume,
+	}
+
+	svc.tickerMtx.Lock()
+	defer svc.tickerMtx.Unlock()
+	for stream := range svc.tickerStreams[evt.Symbol] {
+		select {
+		case stream <- tkr:
+		default:
+			svc.log.Warnf("skipping blocked ticker stream for %s", evt.Symbol)
+		}
+	}
+}
+
+// startUserStream connects to the user data stream the first time orders are involved
+func (svc *streamSvc) startUserStream() {
+	svc.userOnce.Do(func() {
+		svc.group.Go(svc.user.Run)
+		go svc.keepAlive()
+	})
+}
+
+func (svc *streamSvc) userStreamURL() (string, error) {
+	key, err := svc.client.CreateListenKey()
+	if err != nil {
+		return "", err
+	}
+
+	svc.keyMtx.Lock()
+	svc.listenKey = key
+	svc.keyMtx.Unlock()
+	return viper.GetString("binance.websocketURL") + "/ws/" + key, nil
+}
+
+func (svc *streamSvc) keepAlive() {
+	ticker := time.NewTicker(viper.GetDuration("binance.websocket.listenKeyKeepAlive"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-svc.stop:
+			return
+		case <-ticker.C:
+		}
+
+		svc.keyMtx.Lock()
+		key := svc.listenKey
+		svc.keyMtx.Unlock()
+		if key == "" {
+			continue
+		}
+		if err := svc.client.KeepAliveListenKey(key); err != nil {
+			svc.log.WithError(err).Warn("could not keep user data stream alive")
+		}
+	}
+}
+
+func (svc *streamSvc) handleUserMessage(msg []byte) {
+	var evt event
+	if err := json.Unmarshal(msg, &evt); err != nil {
+		return
+	}
+
+	switch evt.Type {
+	case "listenKeyExpired":
+		// Reconnecting fetches a new key
+		svc.log.Warn("user data stream expired; reconnecting")
+		svc.user.Close()
+	case "executionReport":
+		var report executionReport
+		if err := json.Unmarshal(msg, &report); err != nil {
+			svc.log.WithError(err).Warn("could not parse execution report")
+			return
+		}
+		svc.handleExecutionReport(report)
+	}
+}
+
+func (svc *streamSvc) handleExecutionReport(report executionReport) {
+	// Cancels carry the id of the cancel request with the order's own id alongside
+	id := report.ClientOrderID
+	if report.OrigClientOrderID != "" {
+		id = report.OrigClientOrderID
+	}
+
+	svc.orderMtx.Lock()
+	state, ok := svc.orders[id]
+	svc.orderMtx.Unlock()
+	if !ok {
+		return
+	}
+
+	fills := map[int64]fill{}
+	if report.ExecutionType == "TRADE" && report.TradeID >= 0 {
+		fills[report.TradeID] = fill{commission: report.Commission, asset: report.CommissionAsset}
+	}
+
+	state.apply(func(dto types.OrderDTO) types.OrderDTO {
+		dto.Status = getStatus(report.Status, report.Filled)
+		dto.Filled = report.Filled
+		dto.Paid = report.Paid
+		return dto
+	}, fills)
+	svc.forgetIfDone(id, state)
+}
+
+func (svc *streamSvc) OrderStream(stop <-chan bool, dto types.OrderDTO) <-chan types.OrderDTO {
+	svc.startUserStream()
+
+	svc.orderMtx.Lock()
+	state, ok := svc.orders[dto.ID]
+	if !ok {
+		state = &orderState{dto: dto, fills: make(map[int64]fill)}
+		svc.orders[dto.ID] = state
+	}
+	svc.orderMtx.Unlock()
+
+	s := &orderStream{stream: make(chan types.OrderDTO, viper.GetInt("binance.streams.orderStreamBufferSize"))}
+	state.mutex.Lock()
+	s.stream <- state.dto
+	if order.IsDone(state.dto.Status) {
+		s.close()
+	} else {
+		state.streams = append(state.streams, s)
+	}
+	state.mutex.Unlock()
+
+	svc.group.Go(func() {
+		select {
+		case <-stop:
+		case <-svc.stop:
+		}
+		state.mutex.Lock()
+		filtered := state.streams[:0]
+		for _, c := range state.streams {
+			if c != s {
+				filtered = append(filtered, c)
+			}
+		}
+		state.streams = filtered
+		remaining := len(filtered)
+		state.mutex.Unlock()
+		s.close()
+
+		if remaining == 0 {
+			svc.orderMtx.Lock()
+			if svc.orders[dto.ID] == state {
+				delete(svc.orders, dto.ID)
+			}
+			svc.orderMtx.Unlock()
+		}
+	})
+
+	// Catch the stream up on anything that happened before it was tracked
+	go svc.refreshOrder(state)
+
+	return s.stream
+}
+
+// refreshOrders catches every tracked order up after the user stream (re)connects
+func (svc *streamSvc) refreshOrders() error {
+	svc.orderMtx.Lock()
+	defer svc.orderMtx.Unlock()
+	for _, state := range svc.orders {
+		go svc.refreshOrder(state)
+	}
+	return nil
+}
+
+func (svc *streamSvc) refreshOrder(state *orderState) {
+	state.mutex.Lock()
+	dto := state.dto
+	state.mutex.Unlock()
+
+	snapshot, fills, err := svc.snapshot(dto)
+	if err != nil {
+		svc.log.WithError(err).Warnf("could not get snapshot for order %s", dto.ID)
+		return
+	}
+
+	state.apply(func(types.OrderDTO) types.OrderDTO { return snapshot }, fills)
+	svc.forgetIfDone(dto.ID, state)
+}
+
+func (svc *streamSvc) forgetIfDone(id string, state *orderState) {
+	state.mutex.Lock()
+	done := order.IsDone(state.dto.Status)
+	state.mutex.Unlock()
+	if !done {
+		return
+	}
+
+	svc.orderMtx.Lock()
+	defer svc.orderMtx.Unlock()
+	if svc.orders[id] == state {
+		delete(svc.orders, id)
+	}
+}
+
+// apply folds an update into the order and publishes it if anything changed. Snapshots and
+// stream messages can cross, so an update never moves the order backwards.
+func (state *orderState) apply(update func(types.OrderDTO) types.OrderDTO, fills map[int64]fill) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	current := state.dto
+	if order.IsDone(current.Status) {
+		return
+	}
+
+	next := update(current)
+	next.ID = current.ID
+	next.Market = current.Market
+	if next.Filled.LessThan(current.Filled) {
+		next.Filled = current.Filled
+		next.Paid = current.Paid
+	}
+	if !order.IsDone(next.Status) {
+		next.Status = current.Status
+		if next.Filled.IsPositive() {
+			next.Status = order.Partial
+		}
+	}
+
+	for id, f := range fills {
+		state.fills[id] = f
+	}
+	next.FeesSide, next.Fees = sumFees(current.Market, state.fills)
+
+	changed := next.Status != current.Status || !next.Filled.Equal(current.Filled) || !next.Fees.Equal(current.Fees)
+	state.dto = next
+	if !changed {
+		return
+	}
+
+	done := order.IsDone(next.Status)
+	for _, s := range state.streams {
+		select {
+		case s.stream <- next:
+		default:
+			log.Warn("skipping blocked order update channel")
+		}
+		if done {
+			s.close()
+		}
+	}
+	if done {
+		state.streams = nil
+	}
+}
@@ -0,0 +1,173 @@
+package binance
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/binance/client"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+// Client order ids the API accepts
+var clientIDPattern = regexp.MustCompile(`^[.A-Za-z0-9:/_-]{1,36}$`)
+
+// Kline intervals supported by the API
+var intervals = map[time.Duration]string{
+	time.Minute:        "1m",
+	3 * time.Minute:    "3m",
+	5 * time.Minute:    "5m",
+	15 * time.Minute:   "15m",
+	30 * time.Minute:   "30m",
+	time.Hour:          "1h",
+	2 * time.Hour:      "2h",
+	4 * time.Hour:      "4h",
+	6 * time.Hour:      "6h",
+	8 * time.Hour:      "8h",
+	12 * time.Hour:     "12h",
+	24 * time.Hour:     "1d",
+	3 * 24 * time.Hour: "3d",
+	7 * 24 * time.Hour: "1w",
+}
+
+func getInterval(interval types.CandleInterval) (string, time.Duration, error) {
+	granularity, err := time.ParseDuration(string(interval))
+	if err != nil {
+		return "", 0, err
+	}
+	name, ok := intervals[granularity]
+	if !ok {
+		return "", 0, fmt.Errorf("%w: candle interval %s is not supported", types.ErrInvalidRequest, interval)
+	}
+	return name, granularity, nil
+}
+
+func getStatus(status string, filled decimal.Decimal) types.OrderStatus {
+	switch status {
+	case "NEW", "PENDING_NEW":
+		if filled.IsPositive() {
+			return order.Partial
+		}
+		return order.Pending
+	case "PARTIALLY_FILLED", "PENDING_CANCEL":
+		return order.Partial
+	case "FILLED":
+		return order.Filled
+	case "CANCELED":
+		return order.Canceled
+	case "REJECTED":
+		return order.Rejected
+	case "EXPIRED", "EXPIRED_IN_MATCH":
+		return order.Expired
+	}
+	return order.Unknown
+}
+
+func getType(typ string) types.OrderType {
+	if typ == "MARKET" {
+		return order.Market
+	}
+	return order.Limit
+}
+
+func getSide(side string) types.OrderSide {
+	if side == "BUY" {
+		return order.Buy
+	}
+	return order.Sell
+}
+
+// getMarket maps a symbol and its trading rule filters onto a market
+func getMarket(sym client.Symbol) types.MarketDTO {
+	mkt := types.MarketDTO{
+		Name:          sym.Symbol,
+		BaseCurrency:  getCurrency(sym.BaseAsset, sym.BaseAssetPrecision),
+		QuoteCurrency: getCurrency(sym.QuoteAsset, sym.QuoteAssetPrecision),
+	}
+
+	for _, filter := range sym.Filters {
+		switch filter.FilterType {
+		case "PRICE_FILTER":
+			mkt.MinPrice = filter.MinPrice
+			mkt.MaxPrice = filter.MaxPrice
+			mkt.PriceIncrement = filter.TickSize
+		case "LOT_SIZE":
+			mkt.MinQuantity = filter.MinQty
+			mkt.MaxQuantity = filter.MaxQty
+			mkt.QuantityStepSize = filter.StepSize
+		case "MIN_NOTIONAL":
+			mkt.MinFunds = filter.MinNotional
+		case "NOTIONAL":
+			mkt.MinFunds = filter.MinNotional
+			mkt.MaxFunds = filter.MaxNotional
+		}
+	}
+
+	// A zero tick or step size means the filter is disabled
+	if mkt.PriceIncrement.IsZero() {
+		mkt.PriceIncrement = mkt.QuoteCurrency.Increment
+	}
+	if mkt.QuantityStepSize.IsZero() {
+		mkt.QuantityStepSize = mkt.BaseCurrency.Increment
+	}
+	return mkt
+}
+
+func getCurrency(asset string, precision int) types.CurrencyDTO {
+	return types.CurrencyDTO{
+		Name:      asset,
+		Symbol:    asset,
+		Precision: precision,
+		Increment: decimal.New(1, int32(-precision)),
+	}
+}
+
+// fill is a single trade against an order, keyed by trade id so it is only counted once
+type fill struct {
+	commission decimal.Decimal
+	asset      string
+}
+
+// sumFees totals the commissions in the currency they were charged in. Commissions paid in
+// any other asset, such as BNB discounts, can't be expressed on the order and are left out.
+func sumFees(mkt types.MarketDTO, fills map[int64]fill) (types.OrderSide, decimal.Decimal) {
+	base, quote := decimal.Zero, decimal.Zero
+	for _, f := range fills {
+		switch f.asset {
+		case mkt.BaseCurrency.Symbol:
+			base = base.Add(f.commission)
+		case mkt.QuoteCurrency.Symbol:
+			quote = quote.Add(f.commission)
+		}
+	}
+
+	if base.IsPositive() {
+		return order.Buy, base
+	}
+	return "", quote
+}
+
+// clientOrderID uses the request's client id when the API accepts it, deriving a UUID from it otherwise so the same
+// request always gets the same id
+func clientOrderID(clientID string) string {
+	if clientID == "" {
+		return uuid.New().String()
+	}
+	if clientIDPattern.MatchString(clientID) {
+		return clientID
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(clientID)).String()
+}
+
+// budget charges requests made with the API key to the private budget and the rest to the public one
+func budget(req *http.Request) ratelimit.Budget {
+	if req.Header.Get("X-MBX-APIKEY") != "" {
+		return ratelimit.Private
+	}
+	return ratelimit.Public
+}
@@ -1,6 +1,10 @@
 package client
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+
 	"github.com/shopspring/decimal"
 	"github.com/sinisterminister/go-coinbasepro/v2"
 )
@@ -19,6 +23,30 @@ func NewClient() *Client {
 	return &Client{coinbasepro.NewClient()}
 }
 
+// WithContext returns a copy of the client whose requests are made with the context, so they are cut short once it
+// is done and wait on the rate limiter no longer than it allows
+func (c *Client) WithContext(ctx context.Context) *Client {
+	base := *c.Client
+	httpClient := *c.HTTPClient
+	httpClient.Transport = &contextTransport{ctx: ctx, base: httpClient.Transport}
+	base.HTTPClient = &httpClient
+	return &Client{&base}
+}
+
+// contextTransport makes requests with its context in place of the background one the API client uses
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req.WithContext(t.ctx))
+}
+
 func (c *Client) GetFees() (fees Fees, err error) {
 	// Fetch the fees
 	_, err = c.Request("GET", "/fees", nil, &fees)
@@ -28,3 +56,33 @@ func (c *Client) GetFees() (fees Fees, err error) {
 
 	return
 }
+
+// CreateOrder places the order, keeping the status of a failed request so it can be retried safely
+func (c *Client) CreateOrder(newOrder *coinbasepro.Order) (saved coinbasepro.Order, err error) {
+	if len(newOrder.Type) == 0 {
+		newOrder.Type = "limit"
+	}
+	res, err := c.Request("POST", "/orders", newOrder, &saved)
+	err = wrapError(res, err)
+	return
+}
+
+// GetOrder looks up an order by id, or by client id when it is prefixed with "client:"
+func (c *Client) GetOrder(id string) (saved coinbasepro.Order, err error) {
+	res, err := c.Request("GET", fmt.Sprintf("/orders/%s", id), nil, &saved)
+	err = wrapError(res, err)
+	return
+}
+
+// CancelOrder cancels an order by id, or by client id when it is prefixed with "client:"
+func (c *Client) CancelOrder(id string) error {
+	res, err := c.Request("DELETE", fmt.Sprintf("/orders/%s", id), nil, nil)
+	return wrapError(res, err)
+}
+
+func wrapError(res *http.Response, err error) error {
+	if err == nil || res == nil || res.StatusCode == http.StatusOK {
+		return err
+	}
+	return Error{StatusCode: res.StatusCode, Err: err}
+}
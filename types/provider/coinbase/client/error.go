@@ -0,0 +1,30 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Error is an error reported by the Coinbase Pro API along with the status it came back with
+type Error struct {
+	StatusCode int
+	Err        error
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("coinbase error %d: %s", e.StatusCode, e.Err)
+}
+
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the request may succeed if it is sent again
+func (e Error) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.StatusCode == http.StatusTooManyRequests
+}
+
+// NotFound reports whether the API could not find what was asked for
+func (e Error) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
@@ -1,62 +1,83 @@
 package coinbase
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-playground/log/v7"
-	"github.com/google/uuid"
 
 	"github.com/shopspring/decimal"
 
 	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
 	"github.com/sinisterminister/currencytrader/types/order"
 	providerclient "github.com/sinisterminister/currencytrader/types/provider/coinbase/client"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
 	"github.com/sinisterminister/go-coinbasepro/v2"
 )
 
 type provider struct {
 	streamSvc *streamSvc
+	lifecycle *lifecycle.Switch
+	limiter   ratelimit.Limiter
 
 	mutex         sync.Mutex
 	client        *providerclient.Client
 	currencies    map[string]types.CurrencyDTO
 	socketStreams map[string]chan interface{}
 	accounts      map[string]string
-	rateLimiter   chan interface{}
-	throttleOnce  sync.Once
 }
 
-func New(stop <-chan bool, client *providerclient.Client, rateLimit int, burstLimit int) types.Provider {
+// New returns a provider for the client. Its REST calls are held to the limiter's budgets, or to the ones configured
+// under coinbase.rateLimit when the limiter is nil. The deadlines of the context-aware calls carry over to the REST
+// requests and websocket subscriptions they make.
+func New(stop <-chan bool, client *providerclient.Client, limiter ratelimit.Limiter) types.ContextProvider {
+	if limiter == nil {
+		limiter = ratelimit.New(ratelimit.ConfigFromViper("coinbase"))
+	}
+	client.HTTPClient.Transport = ratelimit.NewTransport(limiter, ratelimit.TransportConfig{
+		Budget: budget,
+		Base:   client.HTTPClient.Transport,
+	})
+
+	// Stop on the kill switch or on Shutdown
+	sw := lifecycle.NewSwitch(stop)
+
 	// Instantiate websocket handler
-	wssvc, err := newWebsocketSvc(stop)
+	wssvc, err := newWebsocketSvc(sw.Stop(), &sw.Group)
 	if err != nil {
 
 	}
 
 	// Instantiate stream service
-	svc := newStreamService(stop, wssvc)
+	svc := newStreamService(sw.Stop(), &sw.Group, wssvc)
 	provider := &provider{
-		client:      client,
-		currencies:  make(map[string]types.CurrencyDTO),
-		streamSvc:   svc,
-		accounts:    make(map[string]string),
-		rateLimiter: make(chan interface{}, burstLimit-rateLimit),
+		lifecycle:  sw,
+		limiter:    limiter,
+		client:     client,
+		currencies: make(map[string]types.CurrencyDTO),
+		streamSvc:  svc,
+		accounts:   make(map[string]string),
 	}
-	provider.startThrottler(rateLimit, burstLimit)
 	provider.refreshCaches()
 
 	return provider
 }
 
 func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
-	// Create a client order id
-	cid, err := uuid.NewRandom()
-	if err != nil {
-		return
-	}
+	return p.AttemptOrderContext(context.Background(), req)
+}
+
+func (p *provider) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	client := p.client.WithContext(ctx)
+	// Reuse the client order id so a retried request can't place the order twice
+	cid := clientOrderID(req.ClientID)
 
 	var orderRequest coinbasepro.Order
 	switch req.Type {
@@ -93,22 +114,21 @@ func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO,
 			ClientOID: cid.String(),
 		}
 	default:
-		return types.OrderDTO{}, fmt.Errorf("order type %s not implemented", req.Type)
+		return types.OrderDTO{}, fmt.Errorf("%w: order type %s not implemented", types.ErrInvalidRequest, req.Type)
 	}
 
-	// Mind the rate limit
-	<-p.rateLimiter
-
 	// Place the order
-	placedOrder, err := p.client.CreateOrder(&orderRequest)
+	placedOrder, err := client.CreateOrder(&orderRequest)
 	if err != nil {
-		// Make sure the order didn't manage to make it there somehow
+		// The order may have made it there anyway, or been placed by an earlier attempt with the same id
 		log.WithError(err).Debugf("error creating order %s checking if it posted", cid.String())
 		var err2 error
-		placedOrder, err2 = p.client.GetOrder("client:" + cid.String())
+		placedOrder, err2 = client.GetOrder("client:" + cid.String())
 		if err2 != nil {
+			err = mapError(err)
 			return
 		}
+		err = nil
 	}
 
 	// Register client ID
@@ -119,11 +139,12 @@ func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO,
 	}
 
 	// Convert the order to a DTO
+	filled, _ := decimal.NewFromString(placedOrder.FilledSize)
 	dto = types.OrderDTO{
 		Request:      req,
 		Market:       req.Market,
 		CreationTime: time.Time(placedOrder.CreatedAt),
-		Filled:       decimal.RequireFromString(placedOrder.FilledSize),
+		Filled:       filled,
 		ID:           cid.String(),
 		Status:       getStatus(placedOrder),
 	}
@@ -132,20 +153,21 @@ func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO,
 }
 
 func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, error) {
+	return p.AverageTradeVolumeContext(context.Background(), mkt)
+}
+
+func (p *provider) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (decimal.Decimal, error) {
+	client := p.client.WithContext(ctx)
 	var trades, buffer []coinbasepro.Trade
 	trades = []coinbasepro.Trade{}
 
-	// Mind the rate limit
-	<-p.rateLimiter
-
 	// Get the trades
-	cursor := p.client.ListTrades(mkt.Name)
+	cursor := client.ListTrades(mkt.Name)
 	for cursor.HasMore {
 		if err := cursor.NextPage(&buffer); err != nil {
-			for _, t := range trades {
-				trades = append(trades, t)
-			}
+			return decimal.Zero, mapError(err)
 		}
+		trades = append(trades, buffer...)
 	}
 
 	// Get the average volume for the trades
@@ -158,13 +180,21 @@ func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, err
 }
 
 func (p *provider) CancelOrder(ord types.OrderDTO) (err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
-	err = p.client.CancelOrder(fmt.Sprintf("client:%s", ord.ID))
+	return p.CancelOrderContext(context.Background(), ord)
+}
+
+func (p *provider) CancelOrderContext(ctx context.Context, ord types.OrderDTO) (err error) {
+	client := p.client.WithContext(ctx)
+	err = orderError(client.CancelOrder(fmt.Sprintf("client:%s", ord.ID)))
 	return
 }
 
 func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	return p.CandlesContext(context.Background(), mkt, interval, start, end)
+}
+
+func (p *provider) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	client := p.client.WithContext(ctx)
 	// Convert the interval into a granularity
 	granularity, err := time.ParseDuration(string(interval))
 	if err != nil {
@@ -174,15 +204,16 @@ func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, s
 	// Create a slice for candles
 	candles = []types.CandleDTO{}
 
-	// Mind the rate limit
-	<-p.rateLimiter
-
 	// Get the rates from the server
-	rates, err := p.client.GetHistoricRates(mkt.Name, coinbasepro.GetHistoricRatesParams{
+	rates, err := client.GetHistoricRates(mkt.Name, coinbasepro.GetHistoricRatesParams{
 		Start:       start,
 		End:         end,
 		Granularity: int(granularity.Seconds()),
 	})
+	if err != nil {
+		err = mapError(err)
+		return
+	}
 
 	// Convert them into CandleDTOs
 	for _, rate := range rates {
@@ -196,15 +227,23 @@ func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, s
 		})
 	}
 
+	// The API returns the newest candles first
+	sort.Slice(candles, func(i, j int) bool {
+		return candles[i].Timestamp.Before(candles[j].Timestamp)
+	})
+
 	return
 }
 
 func (p *provider) Currencies() (curs []types.CurrencyDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.CurrenciesContext(context.Background())
+}
 
-	rawCurs, err := p.client.GetCurrencies()
+func (p *provider) CurrenciesContext(ctx context.Context) (curs []types.CurrencyDTO, err error) {
+	client := p.client.WithContext(ctx)
+	rawCurs, err := client.GetCurrencies()
 	if err != nil {
+		err = mapError(err)
 		return
 	}
 
@@ -222,11 +261,14 @@ func (p *provider) Currencies() (curs []types.CurrencyDTO, err error) {
 }
 
 func (p *provider) Fees() (fees types.FeesDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.FeesContext(context.Background())
+}
 
-	rawFees, err := p.client.GetFees()
+func (p *provider) FeesContext(ctx context.Context) (fees types.FeesDTO, err error) {
+	client := p.client.WithContext(ctx)
+	rawFees, err := client.GetFees()
 	if err != nil {
+		err = mapError(err)
 		return
 	}
 
@@ -239,10 +281,16 @@ func (p *provider) Fees() (fees types.FeesDTO, err error) {
 }
 
 func (p *provider) Markets() (mkts []types.MarketDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.MarketsContext(context.Background())
+}
 
-	products, err := p.client.GetProducts()
+func (p *provider) MarketsContext(ctx context.Context) (mkts []types.MarketDTO, err error) {
+	client := p.client.WithContext(ctx)
+	products, err := client.GetProducts()
+	if err != nil {
+		err = mapError(err)
+		return
+	}
 
 	mkts = []types.MarketDTO{}
 
@@ -267,60 +315,104 @@ func (p *provider) Markets() (mkts []types.MarketDTO, err error) {
 }
 
 func (p *provider) Order(market types.MarketDTO, id string) (ord types.OrderDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.OrderContext(context.Background(), market, id)
+}
+
+func (p *provider) OrderContext(ctx context.Context, market types.MarketDTO, id string) (ord types.OrderDTO, err error) {
+	client := p.client.WithContext(ctx)
 	log.Debugf("getting order %s", fmt.Sprintf("client:%s", id))
 
-	raw, err := p.client.GetOrder(fmt.Sprintf("client:%s", id))
+	raw, err := client.GetOrder(fmt.Sprintf("client:%s", id))
+	if err = orderError(err); errors.Is(err, types.ErrOrderNotFound) {
+		// Orders placed outside the trader have no client id and go by their own. If that finds nothing either, the
+		// order isn't found.
+		if byID, idErr := client.GetOrder(id); idErr == nil {
+			raw, err = byID, nil
+		}
+	}
 	if err != nil {
 		return
 	}
 
 	// Register the client id with the stream service to capture data
 	p.streamSvc.registerClientId(raw.ID, id)
+	ord = orderDTO(market, id, raw)
+	return
+}
+
+// OpenOrders lists the open orders on every market. Orders placed outside the trader have no client id, so they
+// are identified by the exchange's id for them.
+func (p *provider) OpenOrders() (orders []types.OrderDTO, err error) {
+	return p.OpenOrdersContext(context.Background())
+}
 
-	// Normalize the price, size, and funds
-	price, _ := decimal.NewFromString(raw.Price)
-	execVal, _ := decimal.NewFromString(raw.ExecutedValue)
-	size, _ := decimal.NewFromString(raw.Size)
-	funds, _ := decimal.NewFromString(raw.Funds)
-	filled, _ := decimal.NewFromString(raw.FilledSize)
-
-	// Set the price for market orders
-	if price.Equal(decimal.Zero) && !execVal.Equal(decimal.Zero) && !filled.Equal(decimal.Zero) {
-		price = execVal.Div(filled)
-	}
-
-	ord.CreationTime = time.Time(raw.CreatedAt)
-	ord.Filled = filled
-	ord.ID = id
-	ord.Status = getStatus(raw)
-	ord.Request = types.OrderRequestDTO{
-		Market:   market,
-		Type:     getType(raw),
-		Side:     getSide(raw),
-		Price:    price,
-		Quantity: size,
-		Funds:    funds,
-	}
-	ord.Market = market
-	ord.Fees = decimal.RequireFromString(raw.FillFees)
-	if raw.Funds != "" {
-		ord.Paid = decimal.RequireFromString(raw.Funds).Add(ord.Fees)
-	} else {
-		ord.Paid = decimal.Zero
+func (p *provider) OpenOrdersContext(ctx context.Context) (orders []types.OrderDTO, err error) {
+	client := p.client.WithContext(ctx)
+	mkts, err := p.MarketsContext(ctx)
+	if err != nil {
+		return
+	}
+	markets := make(map[string]types.MarketDTO, len(mkts))
+	for _, mkt := range mkts {
+		markets[mkt.Name] = mkt
+	}
+
+	// Without a status the API lists every order that isn't done: pending, open and active ones
+	var raws, buffer []coinbasepro.Order
+	cursor := client.ListOrders()
+	for cursor.HasMore {
+		if err = cursor.NextPage(&buffer); err != nil {
+			err = mapError(err)
+			return
+		}
+		raws = append(raws, buffer...)
+	}
+
+	orders = []types.OrderDTO{}
+	for _, raw := range raws {
+		id := raw.ClientOID
+		if id == "" {
+			id = raw.ID
+		}
+		p.streamSvc.registerClientId(raw.ID, id)
+		orders = append(orders, orderDTO(markets[raw.ProductID], id, raw))
 	}
 	return
 }
 
 func (p *provider) OrderStream(stop <-chan bool, order types.OrderDTO) (stream <-chan types.OrderDTO, err error) {
-	return p.streamSvc.OrderStream(stop, order)
+	return p.OrderStreamContext(contextual.FromStop(stop), order)
+}
+
+func (p *provider) OrderStreamContext(ctx context.Context, order types.OrderDTO) (stream <-chan types.OrderDTO, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	stream, err = p.streamSvc.OrderStream(ctx, order)
+	if err != nil {
+		return
+	}
+
+	// Catch the stream up on anything that happened before the subscription
+	go func() {
+		snapshot, err := p.RefreshOrderContext(ctx, order)
+		if err != nil {
+			log.WithError(err).Warnf("could not get snapshot for order %s", order.ID)
+			return
+		}
+		p.streamSvc.publishOrderSnapshot(snapshot)
+	}()
+	return
 }
 
 func (p *provider) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err error) {
-	out, err = p.Order(in.Market, in.ID)
+	return p.RefreshOrderContext(context.Background(), in)
+}
+
+func (p *provider) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (out types.OrderDTO, err error) {
+	out, err = p.OrderContext(ctx, in.Market, in.ID)
 	if err != nil {
-		if strings.Contains(err.Error(), "NotFound") {
+		if errors.Is(err, types.ErrOrderNotFound) {
 			log.Debugf("could not find order %s in API; assuming it was cancelled", in.ID)
 			out = in
 			out.Status = order.Canceled
@@ -331,11 +423,14 @@ func (p *provider) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err erro
 }
 
 func (p *provider) Ticker(market types.MarketDTO) (tkr types.TickerDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.TickerContext(context.Background(), market)
+}
 
-	raw, err := p.client.GetTicker(market.Name)
+func (p *provider) TickerContext(ctx context.Context, market types.MarketDTO) (tkr types.TickerDTO, err error) {
+	client := p.client.WithContext(ctx)
+	raw, err := client.GetTicker(market.Name)
 	if err != nil {
+		err = mapError(err)
 		return
 	}
 
@@ -349,15 +444,25 @@ func (p *provider) Ticker(market types.MarketDTO) (tkr types.TickerDTO, err erro
 }
 
 func (p *provider) TickerStream(stop <-chan bool, market types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
-	return p.streamSvc.TickerStream(stop, market)
+	return p.TickerStreamContext(contextual.FromStop(stop), market)
+}
+
+func (p *provider) TickerStreamContext(ctx context.Context, market types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return p.streamSvc.TickerStream(ctx, market)
 }
 
 func (p *provider) Wallet(currency types.CurrencyDTO) (wal types.WalletDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.WalletContext(context.Background(), currency)
+}
 
-	acct, err := p.client.GetAccount(p.accounts[currency.Symbol])
+func (p *provider) WalletContext(ctx context.Context, currency types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	client := p.client.WithContext(ctx)
+	acct, err := client.GetAccount(p.accounts[currency.Symbol])
 	if err != nil {
+		err = mapError(err)
 		return
 	}
 
@@ -365,16 +470,20 @@ func (p *provider) Wallet(currency types.CurrencyDTO) (wal types.WalletDTO, err
 		Currency: p.getCurrency(acct.Currency),
 		Free:     decimal.RequireFromString(acct.Available),
 		Locked:   decimal.RequireFromString(acct.Hold),
+		ID:       acct.ID,
 	}
 	return
 }
 
 func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
-	// Mind the rate limit
-	<-p.rateLimiter
+	return p.WalletsContext(context.Background())
+}
 
-	accts, err := p.client.GetAccounts()
+func (p *provider) WalletsContext(ctx context.Context) (wals []types.WalletDTO, err error) {
+	client := p.client.WithContext(ctx)
+	accts, err := client.GetAccounts()
 	if err != nil {
+		err = mapError(err)
 		return
 	}
 
@@ -390,17 +499,17 @@ func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
 	return
 }
 
-func (p *provider) startThrottler(rateLimit int, burstLimit int) {
-	p.mutex.Lock()
-	limiter := p.rateLimiter
-	p.mutex.Unlock()
-	go func(limiter chan interface{}) {
-		ticker := time.Tick(time.Second / time.Duration(rateLimit))
-		for {
-			<-ticker
-			limiter <- struct{}{}
-		}
-	}(limiter)
+// Health reports on the websocket feed and the REST budgets
+func (p *provider) Health() []types.ProviderHealth {
+	return []types.ProviderHealth{{
+		Websockets: []types.WebsocketHealth{p.streamSvc.wsSvc.monitor.Health()},
+		RateLimits: ratelimit.Health(p.limiter),
+	}}
+}
+
+// Shutdown stops the provider as the kill switch would and waits for its streams to close
+func (p *provider) Shutdown(ctx context.Context) error {
+	return p.lifecycle.Shutdown(ctx)
 }
 
 func (p *provider) refreshCaches() {
@@ -416,8 +525,6 @@ func (p *provider) refreshCaches() {
 		p.currencies[cur.Symbol] = cur
 	}
 
-	// Mind the rate limit
-	<-p.rateLimiter
 	accts, err := p.client.GetAccounts()
 	if err != nil {
 		log.WithError(err).Error("Failed fetching accounts")
@@ -0,0 +1,261 @@
+package coinbase_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/coinbase"
+	providerclient "github.com/sinisterminister/currencytrader/types/provider/coinbase/client"
+	"github.com/sinisterminister/currencytrader/types/provider/coinbase/coinbasetest"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+	"github.com/sinisterminister/go-coinbasepro/v2"
+	"github.com/spf13/viper"
+)
+
+var srv *coinbasetest.Server
+
+func TestMain(m *testing.M) {
+	providertest.Main(m, func() {
+		srv = coinbasetest.NewServer(coinbasetest.Config{
+			TickInterval: 20 * time.Millisecond,
+			MakerRate:    decimal.NewFromFloat(0.005),
+			TakerRate:    decimal.NewFromFloat(0.005),
+		})
+
+		// Viper is global, so configure it once before any provider is reading from it
+		viper.Set("coinbase.websocketURL", srv.WebsocketURL)
+		viper.Set("coinbase.websocket.reconnectDelay", "20ms")
+	}, func() { srv.Close() })
+}
+
+func newProvider(t *testing.T) types.Provider {
+	client := providerclient.NewClient()
+	client.UpdateConfig(&coinbasepro.ClientConfig{
+		BaseURL:    srv.URL,
+		Key:        "key",
+		Passphrase: "passphrase",
+		Secret:     "c2VjcmV0",
+	})
+
+	return coinbase.New(providertest.Stop(t), client, providertest.Limiter())
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			return newProvider(t)
+		},
+		Market:  "BTC-USD",
+		Timeout: 5 * time.Second,
+	})
+}
+
+func TestAverageTradeVolumeFailsOnPageError(t *testing.T) {
+	p := newProvider(t)
+	mkt := providertest.Market(t, p, "BTC-USD")
+	mkt.Name = "NOPE-USD"
+
+	if avg, err := p.AverageTradeVolume(mkt); err == nil {
+		t.Fatalf("expected an error for an unknown market; got an average of %s", avg)
+	}
+}
+
+func TestDeadlineReachesRateLimiter(t *testing.T) {
+	client := providerclient.NewClient()
+	client.UpdateConfig(&coinbasepro.ClientConfig{
+		BaseURL:    srv.URL,
+		Key:        "key",
+		Passphrase: "passphrase",
+		Secret:     "c2VjcmV0",
+	})
+	limiter := ratelimit.New(ratelimit.Config{
+		Public:  ratelimit.BudgetConfig{Rate: 50, Burst: 100},
+		Private: ratelimit.BudgetConfig{Rate: 0.1, Burst: 1},
+	})
+	stop := make(chan bool)
+	defer close(stop)
+	p := coinbase.New(stop, client, limiter)
+
+	// Starting up used the one private request the budget allows for the next ten seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.FeesContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("FeesContext() returned %v; expected %s", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("FeesContext() took %s to give up", elapsed)
+	}
+}
+
+func TestTickerStreamSurvivesDisconnect(t *testing.T) {
+	p := newProvider(t)
+
+	stop := make(chan bool)
+	defer close(stop)
+	stream, err := p.TickerStream(stop, providertest.Market(t, p, "BTC-USD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-stream:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no ticker data after %d disconnects", i)
+		}
+
+		srv.Disconnect()
+		providertest.WaitFor(t, "resubscription", func() bool { return srv.Subscribed("ticker", "BTC-USD") })
+
+		// Drain anything delivered before the disconnect
+		for len(stream) > 0 {
+			<-stream
+		}
+	}
+}
+
+func TestOrderStreamOutOfOrderMessages(t *testing.T) {
+	p := newProvider(t)
+	mkt := providertest.Market(t, p, "BTC-USD")
+
+	// Rest an order below the market
+	dto, err := p.AttemptOrder(types.OrderRequestDTO{
+		Market:   mkt,
+		Type:     order.Limit,
+		Side:     order.Buy,
+		Price:    decimal.NewFromInt(9000),
+		Quantity: decimal.NewFromFloat(0.01),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	stream, err := p.OrderStream(stop, dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providertest.WaitFor(t, "full channel subscription", func() bool { return srv.Subscribed("full", "BTC-USD") })
+	time.Sleep(100 * time.Millisecond)
+
+	// Fill the order and deliver the match after the done message
+	srv.PauseFeed()
+	srv.SetPrice("BTC-USD", decimal.NewFromInt(8000))
+	srv.ResumeFeed(true)
+
+	last := dto
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case update, ok := <-stream:
+			if !ok {
+				if last.Status != order.Filled {
+					t.Fatalf("stream closed with status %s", last.Status)
+				}
+				if !last.Filled.Equal(dto.Request.Quantity) {
+					t.Errorf("filled is %s; expected %s", last.Filled, dto.Request.Quantity)
+				}
+				return
+			}
+			if !providertest.ValidTransition(last.Status, update.Status) {
+				t.Errorf("invalid order transition %s -> %s", last.Status, update.Status)
+			}
+			last = update
+		case <-timeout:
+			t.Fatalf("timed out waiting for order to fill; last status %s", last.Status)
+		}
+	}
+}
+
+func TestHealthAndShutdown(t *testing.T) {
+	p := newProvider(t)
+	stream, err := p.TickerStream(make(chan bool), providertest.Market(t, p, "BTC-USD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stream:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no ticker data")
+	}
+
+	reports := p.(types.HealthReporter).Health()
+	if len(reports) != 1 || len(reports[0].Websockets) != 1 {
+		t.Fatalf("Health() returned %+v; expected one websocket", reports)
+	}
+	if ws := reports[0].Websockets[0]; ws.State != types.WebsocketConnected || ws.LastMessage.IsZero() {
+		t.Errorf("websocket health is %+v; expected connected with a message", ws)
+	}
+	if len(reports[0].RateLimits) != 2 {
+		t.Errorf("Health() reported %d rate limits; expected 2", len(reports[0].RateLimits))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.(types.Stoppable).Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() returned %v", err)
+	}
+
+	// The stream closes without its own stop channel being closed
+	for range stream {
+	}
+	if state := p.(types.HealthReporter).Health()[0].Websockets[0].State; state != types.WebsocketStopped {
+		t.Errorf("websocket is %s after shutdown; expected %s", state, types.WebsocketStopped)
+	}
+}
+
+func TestOpenOrdersIncludeOutsideOrders(t *testing.T) {
+	p := newProvider(t)
+	mkt := providertest.Market(t, p, "BTC-USD")
+
+	placed, err := p.AttemptOrder(types.OrderRequestDTO{
+		ClientID: uuid.New().String(),
+		Market:   mkt,
+		Type:     order.Limit,
+		Side:     order.Buy,
+		Price:    decimal.NewFromInt(100),
+		Quantity: decimal.NewFromFloat(0.01),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CancelOrder(placed)
+
+	// An order placed on the website has no client id
+	raw := coinbasepro.NewClient()
+	raw.UpdateConfig(&coinbasepro.ClientConfig{BaseURL: srv.URL, Key: "key", Passphrase: "passphrase", Secret: "c2VjcmV0"})
+	outside, err := raw.CreateOrder(&coinbasepro.Order{ProductID: "BTC-USD", Side: "buy", Price: "100", Size: "0.01"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.CancelOrder(outside.ID)
+
+	orders, err := p.(types.OpenOrderLister).OpenOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]types.OrderDTO{}
+	for _, dto := range orders {
+		found[dto.ID] = dto
+	}
+	if dto, ok := found[placed.ID]; !ok || dto.Market.Name != "BTC-USD" || dto.Status != order.Pending {
+		t.Errorf("open orders %v don't include the placed order %s", orders, placed.ID)
+	}
+	if _, ok := found[outside.ID]; !ok {
+		t.Fatalf("open orders %v don't include the outside order %s", orders, outside.ID)
+	}
+
+	// The outside order can be looked up by the id it was listed under
+	if dto, err := p.Order(mkt, outside.ID); err != nil || dto.ID != outside.ID {
+		t.Errorf("Order() returned %+v, %v for the outside order", dto, err)
+	}
+}
@@ -0,0 +1,248 @@
+package coinbasetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+)
+
+type feedConn struct {
+	conn *ws.Conn
+
+	mutex         sync.Mutex
+	subscriptions map[string]map[string]bool
+}
+
+type queuedMessage struct {
+	channel   string
+	productID string
+	msg       interface{}
+}
+
+type subscribeRequest struct {
+	Type       string            `json:"type"`
+	ProductIDs []string          `json:"product_ids"`
+	Channels   []json.RawMessage `json:"channels"`
+}
+
+type channel struct {
+	Name       string   `json:"name"`
+	ProductIDs []string `json:"product_ids"`
+}
+
+// Disconnect drops every feed connection, as if the exchange had hung up
+func (s *Server) Disconnect() {
+	s.feedMtx.Lock()
+	defer s.feedMtx.Unlock()
+	for conn := range s.conns {
+		conn.conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// PauseFeed queues feed messages instead of sending them until ResumeFeed is called
+func (s *Server) PauseFeed() {
+	s.feedMtx.Lock()
+	defer s.feedMtx.Unlock()
+	s.paused = true
+}
+
+// ResumeFeed sends the queued feed messages, in reverse order if requested, and resumes the feed
+func (s *Server) ResumeFeed(reverse bool) {
+	s.feedMtx.Lock()
+	defer s.feedMtx.Unlock()
+	queue := s.queue
+	s.queue = nil
+	s.paused = false
+
+	if reverse {
+		for i, j := 0, len(queue)-1; i < j; i, j = i+1, j-1 {
+			queue[i], queue[j] = queue[j], queue[i]
+		}
+	}
+	for _, q := range queue {
+		s.deliver(q)
+	}
+}
+
+// Subscribed reports whether any feed connection is subscribed to the channel for the product
+func (s *Server) Subscribed(channel string, productID string) bool {
+	s.feedMtx.Lock()
+	defer s.feedMtx.Unlock()
+	for conn := range s.conns {
+		if conn.subscribed(channel, productID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Publish sends a raw message to every feed connection regardless of subscriptions
+func (s *Server) Publish(msg interface{}) {
+	s.feedMtx.Lock()
+	defer s.feedMtx.Unlock()
+	for conn := range s.conns {
+		conn.write(msg)
+	}
+}
+
+func (s *Server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	fc := &feedConn{conn: conn, subscriptions: make(map[string]map[string]bool)}
+	s.feedMtx.Lock()
+	s.conns[fc] = true
+	s.feedMtx.Unlock()
+
+	defer func() {
+		s.feedMtx.Lock()
+		delete(s.conns, fc)
+		s.feedMtx.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var req subscribeRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		switch req.Type {
+		case "subscribe", "unsubscribe":
+			fc.update(req)
+			fc.write(fc.subscriptionsMessage())
+		default:
+			fc.write(map[string]string{"type": "error", "message": "Failed to subscribe", "reason": req.Type + " is not a valid message"})
+		}
+	}
+}
+
+func (fc *feedConn) update(req subscribeRequest) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	for _, raw := range req.Channels {
+		// Channels can be given by name or with their own product ids
+		var ch channel
+		if err := json.Unmarshal(raw, &ch.Name); err != nil {
+			json.Unmarshal(raw, &ch)
+		}
+		if len(ch.ProductIDs) == 0 {
+			ch.ProductIDs = req.ProductIDs
+		}
+
+		if _, ok := fc.subscriptions[ch.Name]; !ok {
+			fc.subscriptions[ch.Name] = make(map[string]bool)
+		}
+		for _, id := range ch.ProductIDs {
+			if req.Type == "subscribe" {
+				fc.subscriptions[ch.Name][id] = true
+			} else {
+				delete(fc.subscriptions[ch.Name], id)
+			}
+		}
+		if len(fc.subscriptions[ch.Name]) == 0 {
+			delete(fc.subscriptions, ch.Name)
+		}
+	}
+}
+
+func (fc *feedConn) subscriptionsMessage() interface{} {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	channels := []channel{}
+	for name, ids := range fc.subscriptions {
+		ch := channel{Name: name, ProductIDs: []string{}}
+		for id := range ids {
+			ch.ProductIDs = append(ch.ProductIDs, id)
+		}
+		channels = append(channels, ch)
+	}
+	return map[string]interface{}{"type": "subscriptions", "channels": channels}
+}
+
+func (fc *feedConn) subscribed(channel string, productID string) bool {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.subscriptions[channel][productID]
+}
+
+func (fc *feedConn) write(msg interface{}) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	fc.conn.WriteJSON(msg)
+}
+
+// publish sends a feed message to the subscribers of the channel for the product
+func (s *Server) publish(channel string, productID string, msg interface{}) {
+	s.feedMtx.Lock()
+	defer s.feedMtx.Unlock()
+	q := queuedMessage{channel: channel, productID: productID, msg: msg}
+	if s.paused {
+		s.queue = append(s.queue, q)
+		return
+	}
+	s.deliver(q)
+}
+
+func (s *Server) deliver(q queuedMessage) {
+	for conn := range s.conns {
+		if conn.subscribed(q.channel, q.productID) {
+			conn.write(q.msg)
+		}
+	}
+}
+
+// publishOrder stamps an order message and sends it out on the full channel
+func (s *Server) publishOrder(o *order, msg map[string]interface{}) {
+	s.sequence++
+	msg["sequence"] = s.sequence
+	msg["product_id"] = o.productID
+	msg["time"] = timestamp()
+	s.publish("full", o.productID, msg)
+}
+
+func (s *Server) publishTickers() {
+	ticker := time.NewTicker(s.config.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mutex.Lock()
+		msgs := []queuedMessage{}
+		for id, prod := range s.products {
+			bid, ask := s.spread(prod)
+			s.sequence++
+			msgs = append(msgs, queuedMessage{channel: "ticker", productID: id, msg: map[string]interface{}{
+				"type":       "ticker",
+				"sequence":   s.sequence,
+				"trade_id":   s.tradeID,
+				"product_id": id,
+				"price":      prod.price.String(),
+				"best_bid":   bid.String(),
+				"best_ask":   ask.String(),
+				"side":       "buy",
+				"last_size":  "0.01",
+				"time":       timestamp(),
+			}})
+		}
+		s.mutex.Unlock()
+
+		for _, q := range msgs {
+			s.publish(q.channel, q.productID, q.msg)
+		}
+	}
+}
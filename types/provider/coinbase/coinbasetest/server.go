@@ -0,0 +1,721 @@
+// Package coinbasetest runs an in-process fake of the Coinbase Pro REST API and websocket
+// feed so the coinbase provider can be exercised without touching the real exchange.
+//
+// The server speaks the endpoints the provider uses: products, currencies, accounts, orders,
+// fees, tickers, trades and candles, plus the ticker and full feed channels. Orders that cross
+// the book fill in two matches; orders that rest fill when SetPrice moves the market through them.
+package coinbasetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ws "github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+	cbp "github.com/sinisterminister/go-coinbasepro/v2"
+)
+
+// Config tunes the fake server
+type Config struct {
+	// TickInterval controls how often ticker messages are published. Defaults to 100ms.
+	TickInterval time.Duration
+
+	// FillDelay is how long the server waits before working a new order. Defaults to 50ms.
+	FillDelay time.Duration
+
+	// MakerRate and TakerRate are the fee rates charged on fills
+	MakerRate decimal.Decimal
+	TakerRate decimal.Decimal
+}
+
+// Server is a fake Coinbase Pro exchange
+type Server struct {
+	// URL is the base URL of the REST API
+	URL string
+
+	// WebsocketURL is the URL of the websocket feed
+	WebsocketURL string
+
+	config   Config
+	server   *httptest.Server
+	upgrader ws.Upgrader
+	stop     chan bool
+	once     sync.Once
+
+	mutex      sync.Mutex
+	sequence   int
+	tradeID    int
+	products   map[string]*product
+	currencies []cbp.Currency
+	accounts   map[string]*account
+	orders     map[string]*order
+	clientIDs  map[string]string
+
+	feedMtx sync.Mutex
+	conns   map[*feedConn]bool
+	paused  bool
+	queue   []queuedMessage
+}
+
+type product struct {
+	cbp.Product
+	price decimal.Decimal
+}
+
+type account struct {
+	id       string
+	currency string
+	balance  decimal.Decimal
+	hold     decimal.Decimal
+}
+
+type order struct {
+	id         string
+	clientOID  string
+	productID  string
+	side       string
+	orderType  string
+	postOnly   bool
+	price      decimal.Decimal
+	size       decimal.Decimal
+	funds      decimal.Decimal
+	status     string
+	doneReason string
+	filled     decimal.Decimal
+	executed   decimal.Decimal
+	fees       decimal.Decimal
+	hold       decimal.Decimal
+	taker      bool
+	created    time.Time
+}
+
+// NewServer starts a fake exchange with BTC-USD, ETH-USD and ETH-BTC markets and funded accounts
+func NewServer(config Config) *Server {
+	if config.TickInterval <= 0 {
+		config.TickInterval = 100 * time.Millisecond
+	}
+	if config.FillDelay <= 0 {
+		config.FillDelay = 50 * time.Millisecond
+	}
+
+	s := &Server{
+		config:    config,
+		stop:      make(chan bool),
+		products:  make(map[string]*product),
+		accounts:  make(map[string]*account),
+		orders:    make(map[string]*order),
+		clientIDs: make(map[string]string),
+		conns:     make(map[*feedConn]bool),
+	}
+
+	s.currencies = []cbp.Currency{
+		{ID: "USD", Name: "United States Dollar", MinSize: "0.01"},
+		{ID: "BTC", Name: "Bitcoin", MinSize: "0.00000001"},
+		{ID: "ETH", Name: "Ether", MinSize: "0.00000001"},
+	}
+	s.addProduct("BTC-USD", "BTC", "USD", "10000", "0.01", "0.001", "10", "10", "1000000")
+	s.addProduct("ETH-USD", "ETH", "USD", "300", "0.01", "0.01", "5000", "5", "1000000")
+	s.addProduct("ETH-BTC", "ETH", "BTC", "0.03", "0.00001", "0.01", "1000", "0.001", "80")
+	s.addAccount("USD", decimal.NewFromInt(100000))
+	s.addAccount("BTC", decimal.NewFromInt(10))
+	s.addAccount("ETH", decimal.NewFromInt(100))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleFeed)
+	mux.HandleFunc("/", s.handleREST)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	s.WebsocketURL = "ws" + strings.TrimPrefix(s.server.URL, "http") + "/ws"
+
+	go s.publishTickers()
+
+	return s
+}
+
+// Close shuts the server down and drops all feed connections
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.Disconnect()
+		s.server.Close()
+	})
+}
+
+// SetPrice moves the market price for the product and fills any resting orders it crosses
+func (s *Server) SetPrice(productID string, price decimal.Decimal) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prod, ok := s.products[productID]
+	if !ok {
+		return
+	}
+	prod.price = price
+
+	bid, ask := s.spread(prod)
+	for _, o := range s.orders {
+		if o.productID != productID || o.status != "open" {
+			continue
+		}
+		if (o.side == "buy" && ask.LessThanOrEqual(o.price)) || (o.side == "sell" && bid.GreaterThanOrEqual(o.price)) {
+			s.fill(o, o.size.Sub(o.filled), o.price)
+			s.finish(o, "filled")
+		}
+	}
+}
+
+// SetBalance sets the balance of the account for the currency
+func (s *Server) SetBalance(currency string, amount decimal.Decimal) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if acct, ok := s.accounts[currency]; ok {
+		acct.balance = amount
+	}
+}
+
+func (s *Server) addProduct(id, base, quote, price, quoteIncrement, minSize, maxSize, minFunds, maxFunds string) {
+	s.products[id] = &product{
+		Product: cbp.Product{
+			ID:             id,
+			BaseCurrency:   base,
+			QuoteCurrency:  quote,
+			BaseMinSize:    minSize,
+			BaseMaxSize:    maxSize,
+			QuoteIncrement: quoteIncrement,
+			BaseIncrement:  "0.00000001",
+			DisplayName:    base + "/" + quote,
+			MinMarketFunds: minFunds,
+			MaxMarketFunds: maxFunds,
+			Status:         "online",
+		},
+		price: decimal.RequireFromString(price),
+	}
+}
+
+func (s *Server) addAccount(currency string, balance decimal.Decimal) {
+	s.accounts[currency] = &account{
+		id:       uuid.New().String(),
+		currency: currency,
+		balance:  balance,
+		hold:     decimal.Zero,
+	}
+}
+
+func (s *Server) handleREST(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/products":
+		s.listProducts(w)
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "products" && parts[2] == "ticker":
+		s.getTicker(w, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "products" && parts[2] == "trades":
+		s.listTrades(w, parts[1])
+	case r.Method == http.MethodGet && len(parts) == 3 && parts[0] == "products" && parts[2] == "candles":
+		s.listCandles(w, r, parts[1])
+	case r.Method == http.MethodGet && r.URL.Path == "/currencies":
+		s.listCurrencies(w)
+	case r.Method == http.MethodGet && r.URL.Path == "/accounts":
+		s.listAccounts(w)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "accounts":
+		s.getAccount(w, parts[1])
+	case r.Method == http.MethodGet && r.URL.Path == "/fees":
+		s.getFees(w)
+	case r.Method == http.MethodGet && r.URL.Path == "/orders":
+		s.listOrders(w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/orders":
+		s.createOrder(w, r)
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[0] == "orders":
+		s.getOrder(w, parts[1])
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "orders":
+		s.cancelOrder(w, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "NotFound")
+	}
+}
+
+func (s *Server) listProducts(w http.ResponseWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	products := []cbp.Product{}
+	for _, id := range []string{"BTC-USD", "ETH-USD", "ETH-BTC"} {
+		if prod, ok := s.products[id]; ok {
+			products = append(products, prod.Product)
+		}
+	}
+	writeJSON(w, products)
+}
+
+func (s *Server) getTicker(w http.ResponseWriter, productID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prod, ok := s.products[productID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	bid, ask := s.spread(prod)
+	writeJSON(w, map[string]interface{}{
+		"trade_id": s.tradeID,
+		"price":    prod.price.String(),
+		"size":     "0.01",
+		"time":     timestamp(),
+		"bid":      bid.String(),
+		"ask":      ask.String(),
+		"volume":   "1000",
+	})
+}
+
+func (s *Server) listTrades(w http.ResponseWriter, productID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	prod, ok := s.products[productID]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	trades := []map[string]interface{}{}
+	for i, size := range []string{"0.01", "0.02", "0.03"} {
+		trades = append(trades, map[string]interface{}{
+			"trade_id": i + 1,
+			"price":    prod.price.String(),
+			"size":     size,
+			"time":     timestamp(),
+			"side":     "buy",
+		})
+	}
+	writeJSON(w, trades)
+}
+
+func (s *Server) listCandles(w http.ResponseWriter, r *http.Request, productID string) {
+	s.mutex.Lock()
+	prod, ok := s.products[productID]
+	var price float64
+	if ok {
+		price, _ = prod.price.Float64()
+	}
+	s.mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	query := r.URL.Query()
+	granularity, err := strconv.Atoi(query.Get("granularity"))
+	if err != nil || granularity <= 0 {
+		writeError(w, http.StatusBadRequest, "Unsupported granularity")
+		return
+	}
+	end := time.Now()
+	if v := query.Get("end"); v != "" {
+		end, _ = time.Parse(time.RFC3339, v)
+	}
+	start := end.Add(-300 * time.Duration(granularity) * time.Second)
+	if v := query.Get("start"); v != "" {
+		start, _ = time.Parse(time.RFC3339, v)
+	}
+
+	// Newest candles come first, same as the real API
+	step := time.Duration(granularity) * time.Second
+	candles := [][]float64{}
+	for ts := end.Truncate(step); !ts.Before(start) && len(candles) < 300; ts = ts.Add(-step) {
+		wobble := float64(ts.Unix()/int64(granularity)%7) / 1000
+		open := price * (1 - wobble)
+		close := price * (1 + wobble)
+		candles = append(candles, []float64{float64(ts.Unix()), open * 0.99, close * 1.01, open, close, 10})
+	}
+	writeJSON(w, candles)
+}
+
+func (s *Server) listCurrencies(w http.ResponseWriter) {
+	writeJSON(w, s.currencies)
+}
+
+func (s *Server) listAccounts(w http.ResponseWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	accounts := []cbp.Account{}
+	for _, cur := range s.currencies {
+		if acct, ok := s.accounts[cur.ID]; ok {
+			accounts = append(accounts, acct.toAccount())
+		}
+	}
+	writeJSON(w, accounts)
+}
+
+func (s *Server) getAccount(w http.ResponseWriter, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, acct := range s.accounts {
+		if acct.id == id {
+			writeJSON(w, acct.toAccount())
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "NotFound")
+}
+
+func (s *Server) getFees(w http.ResponseWriter) {
+	writeJSON(w, map[string]string{
+		"maker_fee_rate": s.config.MakerRate.String(),
+		"taker_fee_rate": s.config.TakerRate.String(),
+		"usd_volume":     "0",
+	})
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	var req cbp.Order
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prod, ok := s.products[req.ProductID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid product_id")
+		return
+	}
+	if req.Side != "buy" && req.Side != "sell" {
+		writeError(w, http.StatusBadRequest, "Invalid side")
+		return
+	}
+	if req.ClientOID != "" {
+		if _, ok := s.clientIDs[req.ClientOID]; ok {
+			writeError(w, http.StatusBadRequest, "duplicate client_oid")
+			return
+		}
+	}
+
+	o := &order{
+		id:        uuid.New().String(),
+		clientOID: req.ClientOID,
+		productID: req.ProductID,
+		side:      req.Side,
+		orderType: req.Type,
+		postOnly:  req.PostOnly,
+		status:    "pending",
+		filled:    decimal.Zero,
+		executed:  decimal.Zero,
+		fees:      decimal.Zero,
+		created:   time.Now().UTC(),
+	}
+	if o.orderType == "" {
+		o.orderType = "limit"
+	}
+	o.price, _ = decimal.NewFromString(req.Price)
+	o.size, _ = decimal.NewFromString(req.Size)
+	o.funds, _ = decimal.NewFromString(req.Funds)
+
+	bid, ask := s.spread(prod)
+	quoteInc := decimal.RequireFromString(prod.QuoteIncrement)
+	baseInc := decimal.RequireFromString(prod.BaseIncrement)
+
+	switch o.orderType {
+	case "limit":
+		if !o.price.IsPositive() || !o.size.IsPositive() {
+			writeError(w, http.StatusBadRequest, "Invalid price or size")
+			return
+		}
+		o.taker = (o.side == "buy" && o.price.GreaterThanOrEqual(ask)) || (o.side == "sell" && o.price.LessThanOrEqual(bid))
+		if o.taker && o.postOnly {
+			writeError(w, http.StatusBadRequest, "Post only mode would cross the book")
+			return
+		}
+	case "market":
+		if !o.size.IsPositive() && !o.funds.IsPositive() {
+			writeError(w, http.StatusBadRequest, "Invalid size or funds")
+			return
+		}
+		o.taker = true
+		o.price = ask
+		if o.side == "sell" {
+			o.price = bid
+		}
+		if !o.size.IsPositive() {
+			o.size = o.funds.Div(o.price.Mul(decimal.NewFromInt(1).Add(s.config.TakerRate))).Div(baseInc).Floor().Mul(baseInc)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "Invalid order type")
+		return
+	}
+
+	// Place a hold for the order
+	holdCurrency := prod.BaseCurrency
+	o.hold = o.size
+	if o.side == "buy" {
+		holdCurrency = prod.QuoteCurrency
+		rate := decimal.Max(s.config.MakerRate, s.config.TakerRate)
+		o.hold = o.size.Mul(o.price).Mul(decimal.NewFromInt(1).Add(rate)).Div(quoteInc).Ceil().Mul(quoteInc)
+		if o.orderType == "market" && o.funds.IsPositive() {
+			o.hold = o.funds
+		}
+	}
+	acct := s.accounts[holdCurrency]
+	if acct.balance.Sub(acct.hold).LessThan(o.hold) {
+		writeError(w, http.StatusBadRequest, "Insufficient funds")
+		return
+	}
+	acct.hold = acct.hold.Add(o.hold)
+
+	s.orders[o.id] = o
+	if o.clientOID != "" {
+		s.clientIDs[o.clientOID] = o.id
+	}
+	writeJSON(w, o.toOrder())
+
+	go s.work(o)
+}
+
+// work runs an accepted order through the feed the way the exchange would
+func (s *Server) work(o *order) {
+	select {
+	case <-s.stop:
+		return
+	case <-time.After(s.config.FillDelay):
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if o.status != "pending" {
+		return
+	}
+
+	o.status = "open"
+	s.publishOrder(o, map[string]interface{}{
+		"type":       "received",
+		"order_id":   o.id,
+		"client_oid": o.clientOID,
+		"order_type": o.orderType,
+		"size":       o.size.String(),
+		"price":      o.price.String(),
+		"funds":      o.funds.String(),
+		"side":       o.side,
+	})
+
+	if !o.taker {
+		s.publishOrder(o, map[string]interface{}{
+			"type":           "open",
+			"order_id":       o.id,
+			"remaining_size": o.size.String(),
+			"price":          o.price.String(),
+			"side":           o.side,
+		})
+		return
+	}
+
+	// Take liquidity in two steps
+	prod := s.products[o.productID]
+	baseInc := decimal.RequireFromString(prod.BaseIncrement)
+	half := o.size.Div(decimal.NewFromInt(2)).Div(baseInc).Floor().Mul(baseInc)
+	if half.IsPositive() {
+		s.fill(o, half, o.price)
+	}
+	s.fill(o, o.size.Sub(o.filled), o.price)
+	s.finish(o, "filled")
+}
+
+func (s *Server) fill(o *order, size decimal.Decimal, price decimal.Decimal) {
+	prod := s.products[o.productID]
+	base := s.accounts[prod.BaseCurrency]
+	quote := s.accounts[prod.QuoteCurrency]
+	quoteInc := decimal.RequireFromString(prod.QuoteIncrement)
+	precision := -quoteInc.Exponent()
+
+	rate := s.config.MakerRate
+	if o.taker {
+		rate = s.config.TakerRate
+	}
+	cost := size.Mul(price).Round(precision)
+	fee := cost.Mul(rate).Round(precision)
+
+	if o.side == "buy" {
+		charge := decimal.Min(cost.Add(fee), o.hold)
+		quote.balance = quote.balance.Sub(charge)
+		quote.hold = quote.hold.Sub(charge)
+		o.hold = o.hold.Sub(charge)
+		base.balance = base.balance.Add(size)
+	} else {
+		base.balance = base.balance.Sub(size)
+		base.hold = base.hold.Sub(size)
+		o.hold = o.hold.Sub(size)
+		quote.balance = quote.balance.Add(cost.Sub(fee))
+	}
+
+	o.filled = o.filled.Add(size)
+	o.executed = o.executed.Add(cost)
+	o.fees = o.fees.Add(fee)
+
+	s.tradeID++
+	maker, taker := uuid.New().String(), o.id
+	makerSide := "sell"
+	if o.side == "sell" {
+		makerSide = "buy"
+	}
+	if !o.taker {
+		maker, taker = o.id, uuid.New().String()
+		makerSide = o.side
+	}
+	s.publishOrder(o, map[string]interface{}{
+		"type":           "match",
+		"trade_id":       s.tradeID,
+		"maker_order_id": maker,
+		"taker_order_id": taker,
+		"side":           makerSide,
+		"size":           size.String(),
+		"price":          price.String(),
+	})
+}
+
+// finish closes out the order and releases whatever is left of its hold
+func (s *Server) finish(o *order, reason string) {
+	prod := s.products[o.productID]
+	holdCurrency := prod.BaseCurrency
+	if o.side == "buy" {
+		holdCurrency = prod.QuoteCurrency
+	}
+	acct := s.accounts[holdCurrency]
+	acct.hold = acct.hold.Sub(o.hold)
+	o.hold = decimal.Zero
+
+	o.status = "done"
+	o.doneReason = reason
+	s.publishOrder(o, map[string]interface{}{
+		"type":           "done",
+		"order_id":       o.id,
+		"reason":         reason,
+		"remaining_size": o.size.Sub(o.filled).String(),
+		"price":          o.price.String(),
+		"side":           o.side,
+	})
+}
+
+// listOrders lists the orders with any of the statuses asked for, newest first, in a single page. Like the real API
+// it lists the ones that aren't done when no status is given.
+func (s *Server) listOrders(w http.ResponseWriter, r *http.Request) {
+	statuses := map[string]bool{}
+	for _, status := range r.URL.Query()["status"] {
+		statuses[status] = true
+	}
+	if len(statuses) == 0 {
+		statuses = map[string]bool{"open": true, "pending": true, "active": true}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	found := []*order{}
+	for _, o := range s.orders {
+		if statuses[o.status] || statuses["all"] {
+			found = append(found, o)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].created.After(found[j].created) })
+
+	orders := make([]cbp.Order, 0, len(found))
+	for _, o := range found {
+		orders = append(orders, o.toOrder())
+	}
+	writeJSON(w, orders)
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.lookupOrder(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	writeJSON(w, o.toOrder())
+}
+
+func (s *Server) cancelOrder(w http.ResponseWriter, id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.lookupOrder(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	if o.status == "done" {
+		writeError(w, http.StatusBadRequest, "Order already done")
+		return
+	}
+
+	s.finish(o, "canceled")
+	writeJSON(w, []string{o.id})
+}
+
+func (s *Server) lookupOrder(id string) (*order, bool) {
+	if strings.HasPrefix(id, "client:") {
+		id = s.clientIDs[strings.TrimPrefix(id, "client:")]
+	}
+	o, ok := s.orders[id]
+	return o, ok
+}
+
+func (s *Server) spread(prod *product) (bid decimal.Decimal, ask decimal.Decimal) {
+	inc := decimal.RequireFromString(prod.QuoteIncrement)
+	return prod.price.Sub(inc), prod.price.Add(inc)
+}
+
+func (a *account) toAccount() cbp.Account {
+	return cbp.Account{
+		ID:        a.id,
+		Currency:  a.currency,
+		Balance:   a.balance.String(),
+		Hold:      a.hold.String(),
+		Available: a.balance.Sub(a.hold).String(),
+	}
+}
+
+func (o *order) toOrder() cbp.Order {
+	raw := cbp.Order{
+		ID:            o.id,
+		ClientOID:     o.clientOID,
+		ProductID:     o.productID,
+		Side:          o.side,
+		Type:          o.orderType,
+		PostOnly:      o.postOnly,
+		Size:          o.size.String(),
+		Status:        o.status,
+		DoneReason:    o.doneReason,
+		Settled:       o.status == "done",
+		CreatedAt:     cbp.Time(o.created),
+		FillFees:      o.fees.String(),
+		FilledSize:    o.filled.String(),
+		ExecutedValue: o.executed.String(),
+	}
+	if o.orderType == "limit" {
+		raw.Price = o.price.String()
+	}
+	if o.funds.IsPositive() {
+		raw.Funds = o.funds.String()
+	}
+	return raw
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -5,6 +5,7 @@ import "github.com/spf13/viper"
 func init() {
 	viper.SetDefault("coinbase.websocketURL", "wss://ws-feed.pro.coinbase.com")
 	viper.SetDefault("coinbase.websocket.workingOrderExpiration", "5m")
+	viper.SetDefault("coinbase.websocket.reconnectDelay", "1s")
 	viper.SetDefault("coinbase.websocket.incomingDataBufferSize", 1024)
 	viper.SetDefault("coinbase.websocket.incomingSubscriptionBufferSize", 8)
 
@@ -24,4 +25,9 @@ func init() {
 
 	viper.SetDefault("coinbase.streams.tickerStreamBufferSize", 64)
 	viper.SetDefault("coinbase.streams.orderStreamBufferSize", 8)
+
+	viper.SetDefault("coinbase.rateLimit.public.rate", 3)
+	viper.SetDefault("coinbase.rateLimit.public.burst", 6)
+	viper.SetDefault("coinbase.rateLimit.private.rate", 5)
+	viper.SetDefault("coinbase.rateLimit.private.burst", 10)
 }
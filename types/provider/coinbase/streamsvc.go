@@ -1,11 +1,14 @@
 package coinbase
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/go-playground/log/v7"
 	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
 	"github.com/spf13/viper"
 	"github.com/thoas/go-funk"
 )
@@ -20,14 +23,15 @@ type streamSvc struct {
 	orderMatchHandler    *orderMatchHandler
 	orderChangeHandler   *orderChangeHandler
 	stop                 <-chan bool
+	group                *lifecycle.Group
 
 	orderMtx      sync.RWMutex
-	orderStreams  map[<-chan bool]*orderStreamWrapper
+	orderStreams  map[*orderStreamWrapper]bool
 	workingOrders map[string]*workingOrder
 	idMapper      map[string]string
 
 	tickerMtx     sync.RWMutex
-	tickerStreams map[types.MarketDTO]chan types.TickerDTO
+	tickerStreams map[chan types.TickerDTO]types.MarketDTO
 }
 
 type workingOrder struct {
@@ -36,12 +40,13 @@ type workingOrder struct {
 	updates     []interface{}
 }
 
-func newStreamService(stop <-chan bool, wsSvc *websocketSvc) (svc *streamSvc) {
+func newStreamService(stop <-chan bool, group *lifecycle.Group, wsSvc *websocketSvc) (svc *streamSvc) {
 	svc = &streamSvc{
 		stop:          stop,
+		group:         group,
 		wsSvc:         wsSvc,
-		orderStreams:  make(map[<-chan bool]*orderStreamWrapper),
-		tickerStreams: make(map[types.MarketDTO]chan types.TickerDTO),
+		orderStreams:  make(map[*orderStreamWrapper]bool),
+		tickerStreams: make(map[chan types.TickerDTO]types.MarketDTO),
 		workingOrders: make(map[string]*workingOrder),
 		log:           log.WithField("source", "coinbase.streamSvc"),
 		idMapper:      map[string]string{},
@@ -94,112 +99,159 @@ func (svc *streamSvc) registerOrderChangeHandler() {
 	svc.wsSvc.RegisterMessageHandler(svc.orderChangeHandler)
 }
 
-func (svc *streamSvc) TickerStream(stop <-chan bool, market types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
+func (svc *streamSvc) TickerStream(ctx context.Context, market types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
 	// Create the stream
 	svc.log.Debugf("ticker stream request for %s", market.Name)
 	rawStream := make(chan types.TickerDTO, viper.GetInt("coinbase.streams.tickerStreamBufferSize"))
 	stream = rawStream
 	svc.tickerMtx.Lock()
-	svc.tickerStreams[market] = rawStream
+	svc.tickerStreams[rawStream] = market
 	svc.tickerMtx.Unlock()
 
 	// Update the subscriptions
-	svc.updateWebsocketSubscriptions()
+	svc.updateWebsocketSubscriptions(ctx)
 
 	// Handle stop
-	go func() {
+	svc.group.Go(func() {
 		select {
-		case <-stop:
-			svc.tickerMtx.Lock()
-			delete(svc.tickerStreams, market)
-			svc.tickerMtx.Unlock()
-
-			svc.updateWebsocketSubscriptions()
+		case <-ctx.Done():
+		case <-svc.stop:
 		}
-	}()
+
+		svc.tickerMtx.Lock()
+		delete(svc.tickerStreams, rawStream)
+		close(rawStream)
+		svc.tickerMtx.Unlock()
+
+		svc.updateWebsocketSubscriptions(context.Background())
+	})
 
 	return
 }
 
 type orderStreamWrapper struct {
+	id     string
+	market string
+
+	mutex  sync.Mutex
 	dto    types.OrderDTO
 	stream chan types.OrderDTO
+	closed bool
+}
+
+// send applies the update to the order and passes the result along to the stream. Updates
+// that arrive after the order is done are dropped and the stream is closed once it is done.
+func (w *orderStreamWrapper) send(update func(types.OrderDTO) types.OrderDTO) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+
+	dto, ok := mergeOrderUpdate(w.dto, update(w.dto))
+	if !ok {
+		return
+	}
+	w.dto = dto
+
+	select {
+	case w.stream <- dto:
+		log.WithField("dto", dto).Debugf("sending data for order %s", w.id)
+	default:
+		log.WithField("dto", dto).Warn("skipping blocked order stream")
+	}
+
+	if order.IsDone(dto.Status) {
+		w.closed = true
+		close(w.stream)
+	}
+}
+
+func (w *orderStreamWrapper) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.stream)
+	}
 }
 
-func (svc *streamSvc) OrderStream(stop <-chan bool, order types.OrderDTO) (stream <-chan types.OrderDTO, err error) {
+func (svc *streamSvc) OrderStream(ctx context.Context, order types.OrderDTO) (stream <-chan types.OrderDTO, err error) {
 	// Create the stream
 	wrapper := &orderStreamWrapper{
+		id:     order.ID,
+		market: order.Market.Name,
 		dto:    order,
 		stream: make(chan types.OrderDTO, viper.GetInt("coinbase.streams.orderStreamBufferSize")),
 	}
 	stream = wrapper.stream
 	svc.orderMtx.Lock()
-	svc.orderStreams[stop] = wrapper
+	svc.orderStreams[wrapper] = true
 	svc.orderMtx.Unlock()
 
 	// Update the subscriptions
-	svc.updateWebsocketSubscriptions()
-
-	// Handle updating the stream with working data if any
-	go func() {
-		svc.orderMtx.RLock()
-		defer svc.orderMtx.RUnlock()
-		if data, ok := svc.workingOrders[order.ID]; ok {
-			for _, d := range data.updates {
-				switch v := d.(type) {
-				case Received:
-					select {
-					case wrapper.stream <- v.ToDTO(wrapper.dto):
-					default:
-						log.Warn("received wrapper stream is blocked")
-					}
-				case Open:
-					select {
-					case wrapper.stream <- v.ToDTO(wrapper.dto):
-					default:
-						log.Warn("open wrapper stream is blocked")
-					}
-				case Done:
-					select {
-					case wrapper.stream <- v.ToDTO(wrapper.dto):
-					default:
-						log.Warn("done wrapper stream is blocked")
-					}
-				case Match:
-					select {
-					case wrapper.stream <- v.ToDTO(wrapper.dto):
-					default:
-						log.Warn("match wrapper stream is blocked")
-					}
-				case Change:
-					select {
-					case wrapper.stream <- v.ToDTO(wrapper.dto):
-					default:
-						log.Warn("change wrapper stream is blocked")
-					}
-				}
+	svc.updateWebsocketSubscriptions(ctx)
+
+	// Update the stream with working data if any
+	svc.orderMtx.RLock()
+	if data, ok := svc.workingOrders[order.ID]; ok {
+		for _, d := range data.updates {
+			switch v := d.(type) {
+			case Received:
+				wrapper.send(v.ToDTO)
+			case Open:
+				wrapper.send(v.ToDTO)
+			case Done:
+				wrapper.send(v.ToDTO)
+			case Match:
+				wrapper.send(v.ToDTO)
+			case Change:
+				wrapper.send(v.ToDTO)
 			}
 		}
-	}()
+	}
+	svc.orderMtx.RUnlock()
 
 	// Handle stop
-	go func() {
+	svc.group.Go(func() {
 		select {
-		case <-stop:
-			// Remove the stream from the list of streams
-			svc.orderMtx.Lock()
-			delete(svc.orderStreams, stop)
-			svc.orderMtx.Unlock()
-
-			// Update the subscriptions
-			svc.updateWebsocketSubscriptions()
+		case <-ctx.Done():
+		case <-svc.stop:
 		}
-	}()
+
+		// Remove the stream from the list of streams
+		svc.orderMtx.Lock()
+		delete(svc.orderStreams, wrapper)
+		svc.orderMtx.Unlock()
+		wrapper.close()
+
+		// Update the subscriptions
+		svc.updateWebsocketSubscriptions(context.Background())
+	})
 
 	return
 }
 
-func (svc *streamSvc) updateWebsocketSubscriptions() {
+// publishOrderSnapshot merges the latest known state of the order into its streams
+func (svc *streamSvc) publishOrderSnapshot(snapshot types.OrderDTO) {
+	svc.orderMtx.RLock()
+	defer svc.orderMtx.RUnlock()
+	for wrapper := range svc.orderStreams {
+		if wrapper.id == snapshot.ID {
+			wrapper.send(func(dto types.OrderDTO) types.OrderDTO {
+				dto.Status = snapshot.Status
+				dto.Filled = snapshot.Filled
+				dto.Fees = snapshot.Fees
+				dto.Paid = snapshot.Paid
+				return dto
+			})
+		}
+	}
+}
+
+// updateWebsocketSubscriptions subscribes to the channels the streams need and drops the rest, giving up on sending
+// the requests once the context is done
+func (svc *streamSvc) updateWebsocketSubscriptions(ctx context.Context) {
 	var tickerSubs, fullSubs []string
 	subs := svc.wsSvc.Subscriptions()
 
@@ -215,8 +267,8 @@ func (svc *streamSvc) updateWebsocketSubscriptions() {
 				var watched bool
 				// Check if the ID is being watched
 				svc.orderMtx.RLock()
-				for _, wrapper := range svc.orderStreams {
-					if wrapper.dto.Market.Name == id {
+				for wrapper := range svc.orderStreams {
+					if wrapper.market == id {
 						watched = true
 						break
 					}
@@ -225,7 +277,7 @@ func (svc *streamSvc) updateWebsocketSubscriptions() {
 
 				// If it's not watched, unsubscribe
 				if !watched {
-					svc.unsubscribe(channel.Name, id)
+					svc.unsubscribe(ctx, channel.Name, id)
 				}
 			}
 		case "ticker":
@@ -237,7 +289,7 @@ func (svc *streamSvc) updateWebsocketSubscriptions() {
 				var watched bool
 				// Check if the ID is being watched
 				svc.tickerMtx.RLock()
-				for market := range svc.tickerStreams {
+				for _, market := range svc.tickerStreams {
 					if market.Name == id {
 						watched = true
 						break
@@ -247,7 +299,7 @@ func (svc *streamSvc) updateWebsocketSubscriptions() {
 
 				// If it's not watched, unsubscribe
 				if !watched {
-					svc.unsubscribe(channel.Name, id)
+					svc.unsubscribe(ctx, channel.Name, id)
 				}
 			}
 		default:
@@ -257,24 +309,26 @@ func (svc *streamSvc) updateWebsocketSubscriptions() {
 
 	// Add any missing ticker subscriptions
 	svc.tickerMtx.RLock()
-	for market := range svc.tickerStreams {
+	for _, market := range svc.tickerStreams {
 		if !funk.Contains(tickerSubs, market.Name) {
-			svc.subscribe("ticker", market.Name)
+			svc.subscribe(ctx, "ticker", market.Name)
+			tickerSubs = append(tickerSubs, market.Name)
 		}
 	}
 	svc.tickerMtx.RUnlock()
 
 	// Add missing full subscriptions
 	svc.orderMtx.RLock()
-	for _, wrapper := range svc.orderStreams {
-		if !funk.Contains(fullSubs, wrapper.dto.Market.Name) {
-			svc.subscribe("full", wrapper.dto.Market.Name)
+	for wrapper := range svc.orderStreams {
+		if !funk.Contains(fullSubs, wrapper.market) {
+			svc.subscribe(ctx, "full", wrapper.market)
+			fullSubs = append(fullSubs, wrapper.market)
 		}
 	}
 	svc.orderMtx.RUnlock()
 }
 
-func (svc *streamSvc) unsubscribe(channel string, productID string) {
+func (svc *streamSvc) unsubscribe(ctx context.Context, channel string, productID string) {
 	// Build the unsubscribe request
 	req := Subscribe{Channels: []struct {
 		Name       string   `json:"name"`
@@ -285,10 +339,10 @@ func (svc *streamSvc) unsubscribe(channel string, productID string) {
 			ProductIDs: append([]string{}, productID),
 		},
 	}}
-	svc.wsSvc.Unsubscribe(req)
+	svc.wsSvc.Unsubscribe(ctx, req)
 }
 
-func (svc *streamSvc) subscribe(channel string, productID string) {
+func (svc *streamSvc) subscribe(ctx context.Context, channel string, productID string) {
 	// Build the subscribe request
 	req := Subscribe{Channels: []struct {
 		Name       string   `json:"name"`
@@ -299,7 +353,7 @@ func (svc *streamSvc) subscribe(channel string, productID string) {
 			ProductIDs: append([]string{}, productID),
 		},
 	}}
-	svc.wsSvc.Subscribe(req)
+	svc.wsSvc.Subscribe(ctx, req)
 }
 
 func (svc *streamSvc) tickerStreamSink() {
@@ -310,14 +364,18 @@ func (svc *streamSvc) tickerStreamSink() {
 		case ticker := <-svc.tickerHandler.Output():
 			svc.tickerMtx.RLock()
 			svc.log.Debug("sending ticker data to streams")
-			for market, stream := range svc.tickerStreams {
+			for stream, market := range svc.tickerStreams {
 				if market.Name == ticker.ProductID {
-					stream <- types.TickerDTO{
+					select {
+					case stream <- types.TickerDTO{
 						Ask:       ticker.BestAsk,
 						Bid:       ticker.BestBid,
 						Price:     ticker.Price,
 						Quantity:  ticker.LastSize,
 						Timestamp: ticker.Time,
+					}:
+					default:
+						svc.log.Warn("skipping blocked ticker stream")
 					}
 				}
 			}
@@ -373,14 +431,9 @@ func (svc *streamSvc) orderReceivedStreamSink() {
 
 			svc.orderMtx.RLock()
 			svc.log.Debug("sending order received data to streams")
-			for _, wrapper := range svc.orderStreams {
-				if wrapper.dto.ID == clientId {
-					select {
-					case wrapper.stream <- orderData.ToDTO(wrapper.dto):
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Debugf("sending data for order %s", wrapper.dto.ID)
-					default:
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Warn("skipping blocked order stream")
-					}
+			for wrapper := range svc.orderStreams {
+				if wrapper.id == clientId {
+					wrapper.send(orderData.ToDTO)
 				}
 			}
 			svc.orderMtx.RUnlock()
@@ -409,14 +462,9 @@ func (svc *streamSvc) orderOpenStreamSink() {
 			// Send the data
 			svc.orderMtx.RLock()
 			svc.log.Debug("sending order open data to streams")
-			for _, wrapper := range svc.orderStreams {
-				if wrapper.dto.ID == clientId {
-					select {
-					case wrapper.stream <- orderData.ToDTO(wrapper.dto):
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Debugf("sending data for order %s", wrapper.dto.ID)
-					default:
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Warn("skipping blocked order stream")
-					}
+			for wrapper := range svc.orderStreams {
+				if wrapper.id == clientId {
+					wrapper.send(orderData.ToDTO)
 				}
 			}
 			svc.orderMtx.RUnlock()
@@ -445,14 +493,9 @@ func (svc *streamSvc) orderDoneStreamSink() {
 			// Send the data
 			svc.orderMtx.RLock()
 			svc.log.Debug("sending order done data to streams")
-			for _, wrapper := range svc.orderStreams {
-				if wrapper.dto.ID == clientId {
-					select {
-					case wrapper.stream <- orderData.ToDTO(wrapper.dto):
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Debugf("sending data for order %s", wrapper.dto.ID)
-					default:
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Warn("skipping blocked order stream")
-					}
+			for wrapper := range svc.orderStreams {
+				if wrapper.id == clientId {
+					wrapper.send(orderData.ToDTO)
 				}
 			}
 			svc.orderMtx.RUnlock()
@@ -477,14 +520,9 @@ func (svc *streamSvc) orderMatchStreamSink() {
 			// Send the data
 			svc.orderMtx.RLock()
 			svc.log.Debug("sending order match data to streams")
-			for _, wrapper := range svc.orderStreams {
-				if wrapper.dto.ID == makerId || wrapper.dto.ID == takerId {
-					select {
-					case wrapper.stream <- orderData.ToDTO(wrapper.dto):
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Debugf("sending data for order %s", wrapper.dto.ID)
-					default:
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Warn("skipping blocked order stream")
-					}
+			for wrapper := range svc.orderStreams {
+				if wrapper.id == makerId || wrapper.id == takerId {
+					wrapper.send(orderData.ToDTO)
 				}
 			}
 			svc.orderMtx.RUnlock()
@@ -514,14 +552,9 @@ func (svc *streamSvc) orderChangeStreamSink() {
 			// Send the data
 			svc.orderMtx.RLock()
 			svc.log.Debug("sending order change data to streams")
-			for _, wrapper := range svc.orderStreams {
-				if wrapper.dto.ID == clientId {
-					select {
-					case wrapper.stream <- orderData.ToDTO(wrapper.dto):
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Debugf("sending data for order %s", wrapper.dto.ID)
-					default:
-						log.WithField("dto", orderData.ToDTO(wrapper.dto)).Warn("skipping blocked order stream")
-					}
+			for wrapper := range svc.orderStreams {
+				if wrapper.id == clientId {
+					wrapper.send(orderData.ToDTO)
 				}
 			}
 			svc.orderMtx.RUnlock()
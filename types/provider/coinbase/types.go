@@ -174,7 +174,7 @@ func (o *Open) ToDTO(order types.OrderDTO) types.OrderDTO {
 	return types.OrderDTO{
 		Market:       order.Market,
 		CreationTime: order.CreationTime,
-		Filled:       decimal.Zero, // We fill zero here since a match event will cover the actual amount(s)
+		Filled:       order.Filled, // Match events cover the actual amount(s)
 		ID:           order.ID,
 		Request:      order.Request,
 		Status:       status,
@@ -201,13 +201,19 @@ func (d *Done) ToDTO(order types.OrderDTO) types.OrderDTO {
 	switch d.Reason {
 	case "filled":
 		status = ord.Filled
-	case "canceled":
+	default:
 		status = ord.Canceled
 	}
+
+	// Orders placed with funds have no quantity to work from
+	filled := order.Filled
+	if order.Request.Quantity.IsPositive() {
+		filled = order.Request.Quantity.Sub(d.RemainingSize)
+	}
 	return types.OrderDTO{
 		Market:       order.Market,
 		CreationTime: order.CreationTime,
-		Filled:       order.Request.Quantity.Sub(d.RemainingSize),
+		Filled:       filled,
 		ID:           order.ID,
 		Request:      order.Request,
 		Status:       status,
@@ -1,15 +1,25 @@
 package coinbase
 
 import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"github.com/sinisterminister/currencytrader/types"
 	"github.com/sinisterminister/currencytrader/types/order"
+	providerclient "github.com/sinisterminister/currencytrader/types/provider/coinbase/client"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
 	cbp "github.com/sinisterminister/go-coinbasepro/v2"
 )
 
 func getStatus(ord cbp.Order) types.OrderStatus {
 	filled, _ := decimal.NewFromString(ord.FilledSize)
 	switch ord.Status {
+	case "pending":
+		return order.Pending
 	case "received":
 		return order.Pending
 	case "open":
@@ -37,10 +47,131 @@ func getType(ord cbp.Order) types.OrderType {
 }
 
 func getSide(ord cbp.Order) types.OrderSide {
-	switch ord.Type {
+	switch ord.Side {
 	case "buy":
 		return order.Buy
 	case "sell":
 	}
 	return order.Sell
 }
+
+// mergeOrderUpdate folds an update into the current order state. Feed messages are processed
+// by separate handlers and can arrive out of order, so updates never move an order backwards.
+func mergeOrderUpdate(current types.OrderDTO, next types.OrderDTO) (types.OrderDTO, bool) {
+	// Nothing changes once the order is done
+	if order.IsDone(current.Status) {
+		return current, false
+	}
+
+	if next.Filled.LessThan(current.Filled) {
+		next.Filled = current.Filled
+	}
+	if next.Status == order.Pending && next.Filled.IsPositive() {
+		next.Status = order.Partial
+	}
+	if next.Status == "" || next.Status == order.Unknown {
+		next.Status = current.Status
+	}
+
+	return next, true
+}
+
+// clientOrderID turns a request's client id into the UUID the API wants, deriving one from ids that aren't UUIDs
+// so the same request always gets the same id
+func clientOrderID(clientID string) uuid.UUID {
+	if clientID == "" {
+		return uuid.New()
+	}
+	if id, err := uuid.Parse(clientID); err == nil {
+		return id
+	}
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(clientID))
+}
+
+// mapError ties an API error to the kind of failure it is, leaving other errors alone
+func mapError(err error) error {
+	var cbErr cbp.Error
+	if !errors.As(err, &cbErr) {
+		return err
+	}
+	status := 0
+	var apiErr providerclient.Error
+	if errors.As(err, &apiErr) {
+		status = apiErr.StatusCode
+	}
+
+	var kind error
+	message := strings.ToLower(cbErr.Message)
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden || strings.HasPrefix(message, "invalid api key") ||
+		strings.HasPrefix(message, "invalid signature") || strings.HasPrefix(message, "invalid passphrase"):
+		kind = types.ErrAuthFailed
+	case status == http.StatusTooManyRequests || strings.Contains(message, "rate limit"):
+		kind = types.ErrRateLimited
+	case strings.Contains(message, "insufficient funds"):
+		kind = types.ErrInsufficientFunds
+	case strings.Contains(message, "would cross"):
+		kind = types.ErrPostOnlyWouldCross
+	case strings.Contains(message, "cancel only") || strings.Contains(message, "trading is disabled"):
+		kind = types.ErrMarketHalted
+	case status == http.StatusBadRequest || status == http.StatusNotFound || strings.HasPrefix(message, "invalid"):
+		kind = types.ErrInvalidRequest
+	default:
+		return err
+	}
+	return &types.ProviderError{Kind: kind, Err: err}
+}
+
+// orderError maps an error from a call about a single order, where not found means the order
+func orderError(err error) error {
+	var cbErr cbp.Error
+	if errors.As(err, &cbErr) && cbErr.Message == "NotFound" {
+		return &types.ProviderError{Kind: types.ErrOrderNotFound, Err: err}
+	}
+	return mapError(err)
+}
+
+// Endpoints that serve public market data; everything else needs the account's credentials
+var publicPaths = []string{"/products", "/currencies", "/time"}
+
+// budget charges market data requests to the public budget and the rest to the private one
+func budget(req *http.Request) ratelimit.Budget {
+	for _, path := range publicPaths {
+		if strings.HasPrefix(req.URL.Path, path) {
+			return ratelimit.Public
+		}
+	}
+	return ratelimit.Private
+}
+
+// orderDTO converts an order from the API, normalizing its price, size and funds
+func orderDTO(market types.MarketDTO, id string, raw cbp.Order) (ord types.OrderDTO) {
+	price, _ := decimal.NewFromString(raw.Price)
+	execVal, _ := decimal.NewFromString(raw.ExecutedValue)
+	size, _ := decimal.NewFromString(raw.Size)
+	funds, _ := decimal.NewFromString(raw.Funds)
+	filled, _ := decimal.NewFromString(raw.FilledSize)
+
+	// Set the price for market orders
+	if price.Equal(decimal.Zero) && !execVal.Equal(decimal.Zero) && !filled.Equal(decimal.Zero) {
+		price = execVal.Div(filled)
+	}
+
+	ord.CreationTime = time.Time(raw.CreatedAt)
+	ord.Filled = filled
+	ord.ID = id
+	ord.Status = getStatus(raw)
+	ord.Request = types.OrderRequestDTO{
+		ClientID: raw.ClientOID,
+		Market:   market,
+		Type:     getType(raw),
+		Side:     getSide(raw),
+		Price:    price,
+		Quantity: size,
+		Funds:    funds,
+	}
+	ord.Market = market
+	ord.Fees, _ = decimal.NewFromString(raw.FillFees)
+	ord.Paid = execVal
+	return
+}
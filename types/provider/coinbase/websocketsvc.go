@@ -1,18 +1,23 @@
 package coinbase
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/go-playground/log/v7"
 	ws "github.com/gorilla/websocket"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
 	"github.com/spf13/viper"
 )
 
 type websocketSvc struct {
 	log                   log.Entry
 	stop                  <-chan bool
+	monitor               *lifecycle.Monitor
 	incomingData          chan DataPackage
 	incomingSubscriptions chan DataPackage
 	messagesReceived      int
@@ -29,18 +34,19 @@ type websocketSvc struct {
 	messageHandlers map[string]MessageHandler
 }
 
-func newWebsocketSvc(stop <-chan bool) (svc *websocketSvc, err error) {
+func newWebsocketSvc(stop <-chan bool, group *lifecycle.Group) (svc *websocketSvc, err error) {
 	svc = &websocketSvc{
 		stop:                  stop,
+		monitor:               lifecycle.NewMonitor("feed"),
 		incomingData:          make(chan DataPackage, viper.GetInt("coinbase.websocket.incomingDataBufferSize")),
 		incomingSubscriptions: make(chan DataPackage, viper.GetInt("coinbase.websocket.incomingSubscriptionBufferSize")),
 		log:                   log.WithField("source", "coinbase.websocketSvc"),
 		messageHandlers:       make(map[string]MessageHandler),
 	}
 
-	// Initialize the connection
+	// Initialize the connection; the reader keeps retrying if this fails
 	if err = svc.initializeConnection(); err != nil {
-		return
+		svc.log.WithError(err).Error("could not connect to websocket")
 	}
 
 	// Register self as subscriptions handler
@@ -54,7 +60,17 @@ func newWebsocketSvc(stop <-chan bool) (svc *websocketSvc, err error) {
 	go svc.processMessages()
 
 	// Start connection reader
-	go svc.readConnection()
+	group.Go(svc.readConnection)
+
+	// Close the connection on stop so a read waiting on it returns
+	go func() {
+		<-stop
+		svc.connWMtx.Lock()
+		defer svc.connWMtx.Unlock()
+		if svc.connection != nil {
+			svc.connection.Close()
+		}
+	}()
 
 	return
 }
@@ -65,18 +81,18 @@ func (svc *websocketSvc) Subscriptions() Subscriptions {
 	return svc.subscriptions
 }
 
-func (svc *websocketSvc) Subscribe(req Subscribe) (err error) {
+func (svc *websocketSvc) Subscribe(ctx context.Context, req Subscribe) (err error) {
 	// Make sure the message type is correct
 	req.Type = "subscribe"
 
-	return svc.processSub(req)
+	return svc.processSub(ctx, req)
 }
 
-func (svc *websocketSvc) Unsubscribe(req Subscribe) (err error) {
+func (svc *websocketSvc) Unsubscribe(ctx context.Context, req Subscribe) (err error) {
 	// Make sure the message type is correct
 	req.Type = "unsubscribe"
 
-	return svc.processSub(req)
+	return svc.processSub(ctx, req)
 }
 
 func (svc *websocketSvc) Input() chan<- DataPackage {
@@ -100,10 +116,23 @@ func (svc *websocketSvc) RegisterMessageHandler(handler MessageHandler) (err err
 	return
 }
 
-func (svc *websocketSvc) processSub(sub Subscribe) (err error) {
+func (svc *websocketSvc) processSub(ctx context.Context, sub Subscribe) (err error) {
 	svc.connWMtx.Lock()
 	defer svc.connWMtx.Unlock()
 
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if svc.connection == nil {
+		return errors.New("websocket is not connected")
+	}
+
+	// Don't let the write outlast the context
+	if deadline, ok := ctx.Deadline(); ok {
+		svc.connection.SetWriteDeadline(deadline)
+		defer svc.connection.SetWriteDeadline(time.Time{})
+	}
+
 	svc.log.WithField("request", sub).Debug("sending subscription request")
 	return svc.connection.WriteJSON(sub)
 }
@@ -138,26 +167,60 @@ func (svc *websocketSvc) initializeConnection() (err error) {
 	url := viper.GetString("coinbase.websocketURL")
 	svc.log.Debugf("connecting to %s", url)
 
+	svc.monitor.SetState(types.WebsocketConnecting)
+	conn, _, err := ws.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		svc.monitor.SetState(types.WebsocketDisconnected)
+		return
+	}
+
+	// Swap in the new connection
 	svc.connRMtx.Lock()
 	svc.connWMtx.Lock()
 	if svc.connection != nil {
 		svc.connection.Close()
 	}
-	svc.connRMtx.Unlock()
+	svc.connection = conn
 	svc.connWMtx.Unlock()
-	svc.connection, _, err = ws.DefaultDialer.Dial(url, nil)
+	svc.connRMtx.Unlock()
+	svc.monitor.SetState(types.WebsocketConnected)
 
 	// Resubscribe to any previous subscriptions
-	if len(svc.subscriptions.Channels) > 0 {
+	subs := svc.Subscriptions()
+	if len(subs.Channels) > 0 {
 		// Build the subscribe request
-		req := Subscribe{Channels: svc.subscriptions.Channels}
-		err = svc.Subscribe(req)
+		req := Subscribe{Channels: subs.Channels}
+		err = svc.Subscribe(context.Background(), req)
 	}
 
 	return
 }
 
+func (svc *websocketSvc) reconnect() {
+	for {
+		select {
+		// Kill switch flipped
+		case <-svc.stop:
+			return
+		default:
+		}
+
+		err := svc.initializeConnection()
+		if err == nil {
+			return
+		}
+		svc.log.WithError(err).Error("could not reconnect to websocket; retrying")
+
+		select {
+		case <-svc.stop:
+			return
+		case <-time.After(viper.GetDuration("coinbase.websocket.reconnectDelay")):
+		}
+	}
+}
+
 func (svc *websocketSvc) readConnection() {
+	defer svc.monitor.SetState(types.WebsocketStopped)
 	for {
 		select {
 		// Time to stop
@@ -168,13 +231,26 @@ func (svc *websocketSvc) readConnection() {
 		default:
 			svc.log.Debug("reading message from websocket")
 			svc.connRMtx.Lock()
-			_, data, err := svc.connection.ReadMessage()
+			conn := svc.connection
+			if conn == nil {
+				svc.connRMtx.Unlock()
+				svc.reconnect()
+				continue
+			}
+			_, data, err := conn.ReadMessage()
 			svc.connRMtx.Unlock()
 			if err != nil {
+				select {
+				case <-svc.stop:
+					continue
+				default:
+				}
 				svc.log.WithError(err).WithTrace().Error("error readding message from socket. restarting connection")
-				svc.initializeConnection()
+				svc.monitor.SetState(types.WebsocketDisconnected)
+				svc.reconnect()
 				continue
 			}
+			svc.monitor.Received()
 
 			// Try to parse the data into a message
 			svc.log.Debug("parsing message from websocket")
@@ -0,0 +1,173 @@
+// Package contextual bridges providers and services built around stop channels with callers that use contexts
+package contextual
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+type provider struct {
+	types.Provider
+}
+
+// Wrap returns the context-aware calls of the provider. A provider that already implements them is returned as it
+// is. Any other has the context checked before each call, since a call can't be abandoned once it is under way, and
+// its streams are stopped once the context is done.
+func Wrap(p types.Provider) types.ContextProvider {
+	if cp, ok := p.(types.ContextProvider); ok {
+		return cp
+	}
+	return &provider{p}
+}
+
+// Unwrap returns the provider that Wrap was given, so callers can check it for other interfaces such as
+// types.HealthReporter
+func Unwrap(p types.ContextProvider) types.Provider {
+	if a, ok := p.(*provider); ok {
+		return a.Provider
+	}
+	return p
+}
+
+// OpenOrders lists the provider's open orders, returning types.ErrNotSupported if it can't list them. Providers
+// without a context-aware listing have the context checked before the call.
+func OpenOrders(ctx context.Context, p types.Provider) ([]types.OrderDTO, error) {
+	if a, ok := p.(*provider); ok {
+		p = a.Provider
+	}
+	switch lister := p.(type) {
+	case types.OpenOrderContextLister:
+		return lister.OpenOrdersContext(ctx)
+	case types.OpenOrderLister:
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return lister.OpenOrders()
+	}
+	return nil, types.ErrNotSupported
+}
+
+// Stop returns a channel that is closed once the context is done, for passing a context on as a stop channel. It
+// is never closed for a context that can't be cancelled.
+func Stop(ctx context.Context) <-chan bool {
+	stop := make(chan bool)
+	if ctx.Done() == nil {
+		return stop
+	}
+	go func() {
+		<-ctx.Done()
+		close(stop)
+	}()
+	return stop
+}
+
+// FromStop returns a context that is cancelled once the stop channel is closed
+func FromStop(stop <-chan bool) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	return ctx
+}
+
+func (p *provider) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return types.OrderDTO{}, err
+	}
+	return p.AttemptOrder(req)
+}
+
+func (p *provider) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (decimal.Decimal, error) {
+	if err := ctx.Err(); err != nil {
+		return decimal.Zero, err
+	}
+	return p.AverageTradeVolume(mkt)
+}
+
+func (p *provider) CancelOrderContext(ctx context.Context, ord types.OrderDTO) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.CancelOrder(ord)
+}
+
+func (p *provider) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) ([]types.CandleDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.Candles(mkt, interval, start, end)
+}
+
+func (p *provider) CurrenciesContext(ctx context.Context) ([]types.CurrencyDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.Currencies()
+}
+
+func (p *provider) FeesContext(ctx context.Context) (types.FeesDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return types.FeesDTO{}, err
+	}
+	return p.Fees()
+}
+
+func (p *provider) MarketsContext(ctx context.Context) ([]types.MarketDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.Markets()
+}
+
+func (p *provider) OrderContext(ctx context.Context, mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return types.OrderDTO{}, err
+	}
+	return p.Order(mkt, id)
+}
+
+func (p *provider) OrderStreamContext(ctx context.Context, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.OrderStream(Stop(ctx), ord)
+}
+
+func (p *provider) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return types.OrderDTO{}, err
+	}
+	return p.RefreshOrder(in)
+}
+
+func (p *provider) TickerContext(ctx context.Context, mkt types.MarketDTO) (types.TickerDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return types.TickerDTO{}, err
+	}
+	return p.Ticker(mkt)
+}
+
+func (p *provider) TickerStreamContext(ctx context.Context, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.TickerStream(Stop(ctx), mkt)
+}
+
+func (p *provider) WalletContext(ctx context.Context, cur types.CurrencyDTO) (types.WalletDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return types.WalletDTO{}, err
+	}
+	return p.Wallet(cur)
+}
+
+func (p *provider) WalletsContext(ctx context.Context) ([]types.WalletDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.Wallets()
+}
@@ -0,0 +1,495 @@
+// Package exchange is a local order matching and wallet engine shared by the simulated providers
+package exchange
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+// QuoteFunc returns the current ticker the engine should match orders against
+type QuoteFunc func(mkt types.MarketDTO) (types.TickerDTO, error)
+
+type Config struct {
+	// Balances seeds the wallets by currency symbol. Wallets not listed start empty.
+	Balances map[string]decimal.Decimal
+
+	// Fees is the fee schedule charged on fills. Defaults to no fees.
+	Fees types.FeesDTO
+
+	// Latency delays order placement and cancellation, as a round trip to an exchange would
+	Latency time.Duration
+
+	// TickInterval controls how often resting orders are matched. Defaults to 1s.
+	TickInterval time.Duration
+
+	// FeesInProceeds takes the fees out of what an order receives, as Binance does, instead of always charging
+	// them in the quote currency
+	FeesInProceeds bool
+
+	// OnFill is called with the order after each match it gets, outside the engine's lock, so fakes of real
+	// exchanges can report their trades
+	OnFill func(dto types.OrderDTO, fill Fill)
+}
+
+// Fill is a single match against an order
+type Fill struct {
+	Quantity decimal.Decimal
+	Price    decimal.Decimal
+	Cost     decimal.Decimal
+	Fee      decimal.Decimal
+	Taker    bool
+}
+
+type Exchange struct {
+	config Config
+	quote  QuoteFunc
+	log    log.Entry
+
+	mutex     sync.Mutex
+	wallets   map[string]types.WalletDTO
+	orders    map[string]*simOrder
+	clientIDs map[string]string
+}
+
+type simOrder struct {
+	dto     types.OrderDTO
+	price   decimal.Decimal
+	hold    decimal.Decimal
+	taker   bool
+	streams []*orderStream
+	cancel  chan bool
+}
+
+type orderStream struct {
+	once   sync.Once
+	stream chan types.OrderDTO
+}
+
+func (s *orderStream) close() {
+	s.once.Do(func() { close(s.stream) })
+}
+
+// last sends the order's final state, dropping the oldest updates still buffered to make room for it so the stream
+// never ends on a state the order has left. Only call it under the engine's lock, which keeps other senders out.
+func (s *orderStream) last(dto types.OrderDTO) {
+	for {
+		select {
+		case s.stream <- dto:
+			return
+		default:
+		}
+		select {
+		case <-s.stream:
+		default:
+		}
+	}
+}
+
+func New(config Config, quote QuoteFunc) *Exchange {
+	if config.TickInterval <= 0 {
+		config.TickInterval = time.Second
+	}
+
+	return &Exchange{
+		config:    config,
+		quote:     quote,
+		log:       log.WithField("source", "exchange"),
+		wallets:   make(map[string]types.WalletDTO),
+		orders:    make(map[string]*simOrder),
+		clientIDs: make(map[string]string),
+	}
+}
+
+func (e *Exchange) Fees() types.FeesDTO {
+	return e.config.Fees
+}
+
+// Wallet returns the wallet for the currency, opening it with its configured balance on first use
+func (e *Exchange) Wallet(cur types.CurrencyDTO) types.WalletDTO {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.wallet(cur)
+}
+
+// SetBalance sets the free balance of the currency's wallet, leaving what is held for orders alone
+func (e *Exchange) SetBalance(cur types.CurrencyDTO, free decimal.Decimal) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	wal := e.wallet(cur)
+	wal.Free = free
+	e.wallets[cur.Symbol] = wal
+}
+
+func (e *Exchange) Wallets(curs []types.CurrencyDTO) []types.WalletDTO {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	wals := []types.WalletDTO{}
+	for _, cur := range curs {
+		wals = append(wals, e.wallet(cur))
+	}
+	return wals
+}
+
+func (e *Exchange) wallet(cur types.CurrencyDTO) types.WalletDTO {
+	wal, ok := e.wallets[cur.Symbol]
+	if !ok {
+		free, ok := e.config.Balances[cur.Symbol]
+		if !ok {
+			free = decimal.Zero
+		}
+		wal = types.WalletDTO{
+			ID:       uuid.New().String(),
+			Currency: cur,
+			Free:     free,
+			Locked:   decimal.Zero,
+		}
+		e.wallets[cur.Symbol] = wal
+	}
+	return wal
+}
+
+func (e *Exchange) AttemptOrder(req types.OrderRequestDTO) (types.OrderDTO, error) {
+	time.Sleep(e.config.Latency)
+	mkt := req.Market
+
+	tkr, err := e.quote(mkt)
+	if err != nil {
+		return types.OrderDTO{}, fmt.Errorf("could not price order: %w", err)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	// A client ID that was seen before gets the order it placed
+	if id, ok := e.clientIDs[req.ClientID]; ok && req.ClientID != "" {
+		return e.orders[id].dto, nil
+	}
+	o := &simOrder{cancel: make(chan bool)}
+
+	// Figure out the price the order would execute at
+	switch req.Type {
+	case order.Limit:
+		if !req.Price.IsPositive() || !req.Quantity.IsPositive() {
+			return types.OrderDTO{}, fmt.Errorf("%w: limit orders require a price and quantity", types.ErrInvalidRequest)
+		}
+		o.price = req.Price
+		o.taker = (req.Side == order.Buy && req.Price.GreaterThanOrEqual(tkr.Ask)) ||
+			(req.Side == order.Sell && req.Price.LessThanOrEqual(tkr.Bid))
+		if o.taker && req.ForceMaker {
+			return types.OrderDTO{}, fmt.Errorf("%w the book", types.ErrPostOnlyWouldCross)
+		}
+	case order.Market:
+		if !req.Quantity.IsPositive() && !req.Funds.IsPositive() {
+			return types.OrderDTO{}, fmt.Errorf("%w: market orders require a quantity or funds", types.ErrInvalidRequest)
+		}
+		if req.Side == order.Buy {
+			o.price = tkr.Ask
+		} else {
+			o.price = tkr.Bid
+		}
+		o.taker = true
+		req.Price = o.price
+	default:
+		return types.OrderDTO{}, fmt.Errorf("%w: order type %s not implemented", types.ErrInvalidRequest, req.Type)
+	}
+
+	// Market orders placed with funds are converted to a quantity up front
+	rate := e.feeRate(o.taker)
+	if req.Quantity.IsZero() {
+		spendable := req.Funds.Sub(mkt.QuoteCurrency.Increment.Mul(decimal.NewFromInt(2)))
+		req.Quantity = floorToStep(spendable.Div(o.price.Mul(decimal.NewFromInt(1).Add(rate))), mkt.BaseCurrency.Increment)
+		if !req.Quantity.IsPositive() {
+			return types.OrderDTO{}, fmt.Errorf("%w: order funds are too small", types.ErrInvalidRequest)
+		}
+	}
+
+	// Hold the funds for the order
+	holdCurrency := mkt.BaseCurrency
+	o.hold = req.Quantity
+	if req.Side == order.Buy {
+		holdCurrency = mkt.QuoteCurrency
+		o.hold = roundUp(req.Quantity.Mul(o.price).Mul(decimal.NewFromInt(1).Add(decimal.Max(rate, e.feeRate(true)))), mkt.QuoteCurrency.Precision).
+			Add(mkt.QuoteCurrency.Increment.Mul(decimal.NewFromInt(2)))
+		if req.Funds.IsPositive() && req.Type == order.Market {
+			o.hold = req.Funds
+		}
+	}
+	wal := e.wallet(holdCurrency)
+	if wal.Free.LessThan(o.hold) {
+		return types.OrderDTO{}, fmt.Errorf("%w in %s wallet", types.ErrInsufficientFunds, holdCurrency.Symbol)
+	}
+	wal.Free = wal.Free.Sub(o.hold)
+	wal.Locked = wal.Locked.Add(o.hold)
+	e.wallets[holdCurrency.Symbol] = wal
+
+	o.dto = types.OrderDTO{
+		Market:       mkt,
+		CreationTime: time.Now(),
+		Filled:       decimal.Zero,
+		Fees:         decimal.Zero,
+		Paid:         decimal.Zero,
+		ID:           uuid.New().String(),
+		Request:      req,
+		Status:       order.Pending,
+	}
+	e.orders[o.dto.ID] = o
+	if req.ClientID != "" {
+		e.clientIDs[req.ClientID] = o.dto.ID
+	}
+
+	go e.processOrder(o)
+
+	return o.dto, nil
+}
+
+func (e *Exchange) processOrder(o *simOrder) {
+	ticker := time.NewTicker(e.config.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.cancel:
+			return
+		case <-ticker.C:
+			tkr, err := e.quote(o.dto.Market)
+			if err != nil {
+				e.log.WithError(err).Warn("could not get quote to match order against")
+				continue
+			}
+
+			e.mutex.Lock()
+			if order.IsDone(o.dto.Status) {
+				e.mutex.Unlock()
+				return
+			}
+			fill, matched := e.matchOrder(o, tkr)
+			dto := o.dto
+			e.mutex.Unlock()
+
+			if matched && e.config.OnFill != nil {
+				e.config.OnFill(dto, fill)
+			}
+		}
+	}
+}
+
+// matchOrder fills the order in two steps once the market reaches its price, reporting whether it matched
+func (e *Exchange) matchOrder(o *simOrder, tkr types.TickerDTO) (Fill, bool) {
+	mkt := o.dto.Market
+	req := o.dto.Request
+
+	if req.Type == order.Limit && !o.taker {
+		if req.Side == order.Buy && tkr.Ask.GreaterThan(o.price) {
+			return Fill{}, false
+		}
+		if req.Side == order.Sell && tkr.Bid.LessThan(o.price) {
+			return Fill{}, false
+		}
+	}
+
+	remaining := req.Quantity.Sub(o.dto.Filled)
+	qty := remaining
+	if o.dto.Filled.IsZero() {
+		half := floorToStep(remaining.Div(decimal.NewFromInt(2)), mkt.BaseCurrency.Increment)
+		if half.IsPositive() {
+			qty = half
+		}
+	}
+
+	fill := e.fill(o, qty)
+	if o.dto.Filled.Equal(req.Quantity) {
+		o.dto.Status = order.Filled
+		e.releaseHold(o)
+	} else {
+		o.dto.Status = order.Partial
+	}
+	e.broadcast(o)
+	return fill, true
+}
+
+func (e *Exchange) fill(o *simOrder, qty decimal.Decimal) Fill {
+	mkt := o.dto.Market
+	base := e.wallet(mkt.BaseCurrency)
+	quote := e.wallet(mkt.QuoteCurrency)
+
+	cost := qty.Mul(o.price).Round(int32(mkt.QuoteCurrency.Precision))
+	fee := cost.Mul(e.feeRate(o.taker)).Round(int32(mkt.QuoteCurrency.Precision))
+
+	switch {
+	case o.dto.Request.Side == order.Buy && e.config.FeesInProceeds:
+		// The fee comes out of the base currency bought
+		fee = qty.Mul(e.feeRate(o.taker)).Round(int32(mkt.BaseCurrency.Precision))
+		charge := decimal.Min(cost, o.hold)
+		quote.Locked = quote.Locked.Sub(charge)
+		base.Free = base.Free.Add(qty.Sub(fee))
+		o.hold = o.hold.Sub(charge)
+		o.dto.FeesSide = order.Buy
+	case o.dto.Request.Side == order.Buy:
+		charge := decimal.Min(cost.Add(fee), o.hold)
+		quote.Locked = quote.Locked.Sub(charge)
+		base.Free = base.Free.Add(qty)
+		o.hold = o.hold.Sub(charge)
+	default:
+		base.Locked = base.Locked.Sub(qty)
+		quote.Free = quote.Free.Add(cost.Sub(fee))
+		o.hold = o.hold.Sub(qty)
+	}
+
+	e.wallets[mkt.BaseCurrency.Symbol] = base
+	e.wallets[mkt.QuoteCurrency.Symbol] = quote
+
+	o.dto.Filled = o.dto.Filled.Add(qty)
+	o.dto.Paid = o.dto.Paid.Add(cost)
+	o.dto.Fees = o.dto.Fees.Add(fee)
+	return Fill{Quantity: qty, Price: o.price, Cost: cost, Fee: fee, Taker: o.taker}
+}
+
+// releaseHold returns any funds still held for the order to the wallet
+func (e *Exchange) releaseHold(o *simOrder) {
+	cur := o.dto.Market.BaseCurrency
+	if o.dto.Request.Side == order.Buy {
+		cur = o.dto.Market.QuoteCurrency
+	}
+
+	wal := e.wallet(cur)
+	wal.Locked = wal.Locked.Sub(o.hold)
+	wal.Free = wal.Free.Add(o.hold)
+	e.wallets[cur.Symbol] = wal
+	o.hold = decimal.Zero
+}
+
+func (e *Exchange) broadcast(o *simOrder) {
+	done := order.IsDone(o.dto.Status)
+	for _, s := range o.streams {
+		if done {
+			s.last(o.dto)
+			s.close()
+			continue
+		}
+		select {
+		case s.stream <- o.dto:
+		default:
+			e.log.Warn("skipping blocked order update channel")
+		}
+	}
+	if done {
+		o.streams = nil
+	}
+}
+
+func (e *Exchange) Order(id string) (types.OrderDTO, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	o, ok := e.orders[id]
+
+	if !ok {
+		return types.OrderDTO{}, fmt.Errorf("%w: %s", types.ErrOrderNotFound, id)
+	}
+
+	return o.dto, nil
+}
+
+// OpenOrders lists the orders that are still working, oldest first
+func (e *Exchange) OpenOrders() []types.OrderDTO {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	orders := []types.OrderDTO{}
+	for _, o := range e.orders {
+		if o.dto.Status == order.Pending || o.dto.Status == order.Partial {
+			orders = append(orders, o.dto)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreationTime.Before(orders[j].CreationTime) })
+	return orders
+}
+
+func (e *Exchange) RefreshOrder(in types.OrderDTO) (types.OrderDTO, error) {
+	out, err := e.Order(in.ID)
+	if err != nil {
+		// Unknown orders are treated as cancelled, same as the exchanges do
+		out = in
+		out.Status = order.Canceled
+	}
+	return out, nil
+}
+
+func (e *Exchange) OrderStream(stop <-chan bool, dto types.OrderDTO) (<-chan types.OrderDTO, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	o, ok := e.orders[dto.ID]
+	if !ok {
+		return nil, fmt.Errorf("cannot get update stream for order %s: %w", dto.ID, types.ErrOrderNotFound)
+	}
+
+	// Start the stream off with the current state of the order
+	s := &orderStream{stream: make(chan types.OrderDTO, 8)}
+	s.stream <- o.dto
+	if order.IsDone(o.dto.Status) {
+		s.close()
+		return s.stream, nil
+	}
+	o.streams = append(o.streams, s)
+
+	go func() {
+		<-stop
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+		filtered := o.streams[:0]
+		for _, c := range o.streams {
+			if c != s {
+				filtered = append(filtered, c)
+			}
+		}
+		o.streams = filtered
+		s.close()
+	}()
+
+	return s.stream, nil
+}
+
+func (e *Exchange) CancelOrder(dto types.OrderDTO) error {
+	time.Sleep(e.config.Latency)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	o, ok := e.orders[dto.ID]
+	if !ok {
+		return fmt.Errorf("could not cancel order %s: %w", dto.ID, types.ErrOrderNotFound)
+	}
+	if order.IsDone(o.dto.Status) {
+		return fmt.Errorf("%w: could not cancel order %s that is %s", types.ErrInvalidRequest, dto.ID, o.dto.Status)
+	}
+
+	o.dto.Status = order.Canceled
+	e.releaseHold(o)
+	e.broadcast(o)
+	close(o.cancel)
+	return nil
+}
+
+func (e *Exchange) feeRate(taker bool) decimal.Decimal {
+	if taker {
+		return e.config.Fees.TakerRate
+	}
+	return e.config.Fees.MakerRate
+}
+
+func floorToStep(amt decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if step.IsZero() {
+		return amt
+	}
+	return amt.Div(step).Floor().Mul(step)
+}
+
+func roundUp(amt decimal.Decimal, precision int) decimal.Decimal {
+	return amt.Shift(int32(precision)).Ceil().Shift(int32(-precision))
+}
@@ -0,0 +1,154 @@
+// Package socket is the reconnecting websocket connection shared by the exchange providers
+package socket
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	ws "github.com/gorilla/websocket"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/spf13/viper"
+)
+
+// Config sets what differs between the providers' sockets
+type Config struct {
+	// Source prefixes the source field of the socket's log entries, e.g. "kraken"
+	Source string
+	// ReconnectDelayKey is the viper key of the time to wait before redialing
+	ReconnectDelayKey string
+}
+
+// Socket keeps a websocket connection open, redialing and calling onConnect whenever it drops
+type Socket struct {
+	log       log.Entry
+	stop      <-chan bool
+	delayKey  string
+	url       func() (string, error)
+	onConnect func() error
+	onMessage func([]byte)
+	monitor   *lifecycle.Monitor
+
+	mutex      sync.Mutex
+	writeMtx   sync.Mutex
+	connection *ws.Conn
+}
+
+// New returns a socket that starts dialing url once Run is called
+func New(stop <-chan bool, name string, cfg Config, url func() (string, error), onConnect func() error, onMessage func([]byte)) *Socket {
+	return &Socket{
+		log:       log.WithField("source", cfg.Source+"."+name),
+		stop:      stop,
+		delayKey:  cfg.ReconnectDelayKey,
+		url:       url,
+		onConnect: onConnect,
+		onMessage: onMessage,
+		monitor:   lifecycle.NewMonitor(name),
+	}
+}
+
+// Run connects and reads until stop is closed
+func (s *Socket) Run() {
+	delay := viper.GetDuration(s.delayKey)
+	for {
+		s.monitor.SetState(types.WebsocketConnecting)
+		conn, err := s.connect()
+		if err != nil {
+			s.log.WithError(err).Warn("could not connect to websocket")
+		} else {
+			s.monitor.SetState(types.WebsocketConnected)
+			s.read(conn)
+		}
+		s.monitor.SetState(types.WebsocketDisconnected)
+
+		select {
+		case <-s.stop:
+			s.monitor.SetState(types.WebsocketStopped)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s *Socket) connect() (*ws.Conn, error) {
+	url, err := s.url()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := ws.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.connection = conn
+	s.mutex.Unlock()
+
+	if s.onConnect != nil {
+		if err := s.onConnect(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *Socket) read(conn *ws.Conn) {
+	// Close the connection on stop so the read below returns
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stop:
+			s.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-s.stop:
+			default:
+				s.log.WithError(err).Warn("websocket connection dropped")
+			}
+			s.Close()
+			return
+		}
+		s.monitor.Received()
+		s.onMessage(msg)
+	}
+}
+
+// Send writes a message to the current connection
+func (s *Socket) Send(msg interface{}) error {
+	s.mutex.Lock()
+	conn := s.connection
+	s.mutex.Unlock()
+	if conn == nil {
+		return errors.New("websocket is not connected")
+	}
+
+	s.writeMtx.Lock()
+	defer s.writeMtx.Unlock()
+	return conn.WriteJSON(msg)
+}
+
+// Close drops the current connection, which makes the socket reconnect unless it was stopped
+func (s *Socket) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.connection != nil {
+		s.connection.Close()
+		s.connection = nil
+	}
+}
+
+// Health reports the connection's state and when it last received a message
+func (s *Socket) Health() types.WebsocketHealth {
+	return s.monitor.Health()
+}
@@ -0,0 +1,419 @@
+package client
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// Error is an error reported by the Kraken API. Kraken reports errors as a list of
+// "<severity><category>:<message>" strings, e.g. "EOrder:Insufficient funds".
+type Error struct {
+	StatusCode int
+	Messages   []string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("kraken error: %s", strings.Join(e.Messages, ", "))
+}
+
+// Has reports whether the API returned the error message
+func (e Error) Has(message string) bool {
+	for _, m := range e.Messages {
+		if m == message || strings.HasPrefix(m, message+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Temporary reports whether the request may succeed if it is sent again
+func (e Error) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError || e.Has(ErrRateLimit) || e.Has(ErrUnavailable) ||
+		e.Has(ErrBusy) || e.Has(ErrInternal)
+}
+
+// Wrap ties the error to the kind of failure in types it is, so callers can branch on it with errors.Is. Errors
+// of no known kind are returned as they are.
+func (e Error) Wrap() error {
+	for _, kind := range kinds {
+		if e.is(kind) {
+			return &types.ProviderError{Kind: kind, Err: e}
+		}
+	}
+	return e
+}
+
+// Kinds of failure in the order Wrap tries them
+var kinds = []error{types.ErrAuthFailed, types.ErrRateLimited, types.ErrOrderNotFound, types.ErrInsufficientFunds,
+	types.ErrPostOnlyWouldCross, types.ErrMarketHalted, types.ErrInvalidRequest}
+
+func (e Error) is(kind error) bool {
+	switch kind {
+	case types.ErrAuthFailed:
+		return e.StatusCode == http.StatusUnauthorized || e.Has(ErrInvalidKey) || e.Has(ErrInvalidSignature) ||
+			e.Has(ErrInvalidNonce) || e.Has(ErrPermissionDenied)
+	case types.ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests || e.Has(ErrRateLimit) || e.Has(ErrOrderRateLimit)
+	case types.ErrOrderNotFound:
+		return e.Has(ErrUnknownOrder)
+	case types.ErrInsufficientFunds:
+		return e.Has(ErrInsufficientFunds)
+	case types.ErrPostOnlyWouldCross:
+		return e.Has(ErrPostOnly)
+	case types.ErrMarketHalted:
+		return e.Has(ErrMarketCancelOnly) || e.Has(ErrMarketPostOnly)
+	case types.ErrInvalidRequest:
+		return e.Has(ErrInvalidArguments) || e.Has(ErrUnknownAssetPair) || e.Has(ErrOrderMinimum) || e.Has(ErrCostMinimum) ||
+			e.Has(ErrInvalidPrice)
+	}
+	return false
+}
+
+// Error messages the provider acts on
+const (
+	ErrInvalidNonce      = "EAPI:Invalid nonce"
+	ErrInvalidKey        = "EAPI:Invalid key"
+	ErrInvalidSignature  = "EAPI:Invalid signature"
+	ErrRateLimit         = "EAPI:Rate limit exceeded"
+	ErrInvalidArguments  = "EGeneral:Invalid arguments"
+	ErrUnknownAssetPair  = "EQuery:Unknown asset pair"
+	ErrUnknownOrder      = "EOrder:Unknown order"
+	ErrInsufficientFunds = "EOrder:Insufficient funds"
+	ErrOrderMinimum      = "EOrder:Order minimum not met"
+	ErrCostMinimum       = "EOrder:Cost minimum not met"
+	ErrPostOnly          = "EOrder:Post only order"
+	ErrUnavailable       = "EService:Unavailable"
+	ErrBusy              = "EService:Busy"
+	ErrInternal          = "EGeneral:Internal error"
+	ErrPermissionDenied  = "EGeneral:Permission denied"
+	ErrOrderRateLimit    = "EOrder:Rate limit exceeded"
+	ErrInvalidPrice      = "EOrder:Invalid price"
+	ErrMarketCancelOnly  = "EService:Market in cancel_only mode"
+	ErrMarketPostOnly    = "EService:Market in post_only mode"
+)
+
+type ClientConfig struct {
+	BaseURL string
+	Key     string
+
+	// Secret is the base64 encoded private key
+	Secret string
+}
+
+type Client struct {
+	HTTPClient *http.Client
+
+	mutex  sync.RWMutex
+	config ClientConfig
+
+	// Private requests are sent one at a time so their nonces arrive in order
+	privateMtx sync.Mutex
+	nonce      int64
+
+	// Views made by WithContext make their requests with ctx and share the configuration and nonce of base
+	ctx  context.Context
+	base *Client
+}
+
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: 15 * time.Second},
+		config: ClientConfig{
+			BaseURL: "https://api.kraken.com",
+		},
+	}
+}
+
+// WithContext returns a view of the client whose requests are made with the context, so they are cut short once it is
+// done and wait on the rate limiter no longer than it allows
+func (c *Client) WithContext(ctx context.Context) *Client {
+	return &Client{HTTPClient: c.HTTPClient, ctx: ctx, base: c.root()}
+}
+
+func (c *Client) root() *Client {
+	if c.base != nil {
+		return c.base
+	}
+	return c
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+func (c *Client) UpdateConfig(config *ClientConfig) {
+	c = c.root()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if config.BaseURL != "" {
+		c.config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+	}
+	c.config.Key = config.Key
+	c.config.Secret = config.Secret
+}
+
+func (c *Client) Assets() (assets map[string]Asset, err error) {
+	err = c.public("Assets", nil, &assets)
+	return
+}
+
+func (c *Client) AssetPairs() (pairs map[string]AssetPair, err error) {
+	err = c.public("AssetPairs", nil, &pairs)
+	return
+}
+
+func (c *Client) Ticker(pair string) (tkr Ticker, err error) {
+	var result map[string]Ticker
+	if err = c.public("Ticker", url.Values{"pair": {pair}}, &result); err != nil {
+		return
+	}
+	for _, t := range result {
+		return t, nil
+	}
+	return tkr, Error{Messages: []string{ErrUnknownAssetPair}}.Wrap()
+}
+
+func (c *Client) Trades(pair string) (trades []Trade, err error) {
+	var result map[string]json.RawMessage
+	if err = c.public("Trades", url.Values{"pair": {pair}}, &result); err != nil {
+		return
+	}
+	for key, raw := range result {
+		if key == "last" {
+			continue
+		}
+		err = json.Unmarshal(raw, &trades)
+		return
+	}
+	return
+}
+
+// OHLC returns up to 720 candles of the interval in minutes, starting after since
+func (c *Client) OHLC(pair string, interval int, since time.Time) (candles []Candle, err error) {
+	params := url.Values{
+		"pair":     {pair},
+		"interval": {strconv.Itoa(interval)},
+		"since":    {strconv.FormatInt(since.Unix(), 10)},
+	}
+	var result map[string]json.RawMessage
+	if err = c.public("OHLC", params, &result); err != nil {
+		return
+	}
+	for key, raw := range result {
+		if key == "last" {
+			continue
+		}
+		err = json.Unmarshal(raw, &candles)
+		return
+	}
+	return
+}
+
+// BalanceEx returns the balances of the account keyed by asset, including the amounts held by orders
+func (c *Client) BalanceEx() (balances map[string]Balance, err error) {
+	err = c.private("BalanceEx", url.Values{}, &balances)
+	return
+}
+
+// TradeVolume returns the 30 day volume and fee tiers of the pair
+func (c *Client) TradeVolume(pair string) (vol TradeVolume, err error) {
+	err = c.private("TradeVolume", url.Values{"pair": {pair}}, &vol)
+	return
+}
+
+func (c *Client) AddOrder(req OrderRequest) (resp AddOrderResponse, err error) {
+	err = c.private("AddOrder", req.values(), &resp)
+	return
+}
+
+func (c *Client) CancelOrder(txid string) (err error) {
+	return c.private("CancelOrder", url.Values{"txid": {txid}}, nil)
+}
+
+func (c *Client) QueryOrders(txids ...string) (orders map[string]Order, err error) {
+	params := url.Values{"txid": {strings.Join(txids, ",")}, "trades": {"true"}}
+	err = c.private("QueryOrders", params, &orders)
+	return
+}
+
+// OpenOrders lists every open order on the account
+func (c *Client) OpenOrders() (orders map[string]Order, err error) {
+	var open struct {
+		Open map[string]Order `json:"open"`
+	}
+	err = c.private("OpenOrders", url.Values{"trades": {"true"}}, &open)
+	orders = open.Open
+	return
+}
+
+// OrdersByUserRef finds the open and closed orders placed with the user reference
+func (c *Client) OrdersByUserRef(userref int32) (orders map[string]Order, err error) {
+	params := url.Values{"userref": {strconv.FormatInt(int64(userref), 10)}, "trades": {"true"}}
+
+	var open struct {
+		Open map[string]Order `json:"open"`
+	}
+	if err = c.private("OpenOrders", params, &open); err != nil {
+		return
+	}
+	var closed struct {
+		Closed map[string]Order `json:"closed"`
+	}
+	if err = c.private("ClosedOrders", params, &closed); err != nil {
+		return
+	}
+
+	orders = map[string]Order{}
+	for id, o := range open.Open {
+		orders[id] = o
+	}
+	for id, o := range closed.Closed {
+		orders[id] = o
+	}
+	return
+}
+
+// GetWebSocketsToken returns a token for subscribing to private websocket feeds
+func (c *Client) GetWebSocketsToken() (token string, err error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err = c.private("GetWebSocketsToken", url.Values{}, &resp)
+	token = resp.Token
+	return
+}
+
+func (c *Client) public(method string, params url.Values, result interface{}) error {
+	root := c.root()
+	root.mutex.RLock()
+	config := root.config
+	root.mutex.RUnlock()
+
+	endpoint := config.BaseURL + "/0/public/" + method
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(c.context(), http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, result)
+}
+
+func (c *Client) private(method string, params url.Values, result interface{}) (err error) {
+	root := c.root()
+	root.privateMtx.Lock()
+	defer root.privateMtx.Unlock()
+
+	// A nonce can only be rejected before anything happened, so it is safe to retry once with
+	// a fresh one. That covers other clients sharing the key and racing this one.
+	for attempt := 0; attempt < 2; attempt++ {
+		err = c.signed(method, params, result)
+		var apiErr Error
+		if !errors.As(err, &apiErr) || !apiErr.Has(ErrInvalidNonce) {
+			return
+		}
+	}
+	return
+}
+
+func (c *Client) signed(method string, params url.Values, result interface{}) error {
+	root := c.root()
+	root.mutex.RLock()
+	config := root.config
+	root.mutex.RUnlock()
+
+	// Nonces have to keep increasing for the key, even when requests are made faster than the clock
+	nonce := time.Now().UnixNano() / int64(time.Microsecond)
+	if nonce <= root.nonce {
+		nonce = root.nonce + 1
+	}
+	root.nonce = nonce
+
+	body := url.Values{}
+	for k, v := range params {
+		body[k] = v
+	}
+	body.Set("nonce", strconv.FormatInt(nonce, 10))
+	encoded := body.Encode()
+
+	path := "/0/private/" + method
+	signature, err := Sign(config.Secret, path, strconv.FormatInt(nonce, 10), encoded)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, config.BaseURL+path, strings.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("API-Key", config.Key)
+	req.Header.Set("API-Sign", signature)
+	return c.do(req, result)
+}
+
+func (c *Client) do(req *http.Request, result interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Error  []string        `json:"error"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		if resp.StatusCode >= 300 {
+			return Error{StatusCode: resp.StatusCode, Messages: []string{http.StatusText(resp.StatusCode)}}.Wrap()
+		}
+		return err
+	}
+	if len(envelope.Error) > 0 {
+		return Error{StatusCode: resp.StatusCode, Messages: envelope.Error}.Wrap()
+	}
+
+	if result == nil || len(envelope.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// Sign computes the API-Sign header of a private request: the HMAC-SHA512 of the URI path
+// followed by the SHA256 of the nonce and the encoded body, keyed with the decoded secret
+func Sign(secret string, path string, nonce string, body string) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return "", fmt.Errorf("could not decode API secret: %w", err)
+	}
+
+	sha := sha256.Sum256([]byte(nonce + body))
+	mac := hmac.New(sha512.New, key)
+	mac.Write([]byte(path))
+	mac.Write(sha[:])
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type Asset struct {
+	AssetClass      string `json:"aclass"`
+	AltName         string `json:"altname"`
+	Decimals        int    `json:"decimals"`
+	DisplayDecimals int    `json:"display_decimals"`
+	Status          string `json:"status"`
+}
+
+type AssetPair struct {
+	AltName      string          `json:"altname"`
+	WSName       string          `json:"wsname"`
+	Base         string          `json:"base"`
+	Quote        string          `json:"quote"`
+	PairDecimals int             `json:"pair_decimals"`
+	CostDecimals int             `json:"cost_decimals"`
+	LotDecimals  int             `json:"lot_decimals"`
+	OrderMin     decimal.Decimal `json:"ordermin"`
+	CostMin      decimal.Decimal `json:"costmin"`
+	TickSize     decimal.Decimal `json:"tick_size"`
+	Status       string          `json:"status"`
+}
+
+// Ticker values are arrays: price followed by volumes, or today's value followed by the last 24 hours
+type Ticker struct {
+	Ask    []decimal.Decimal `json:"a"`
+	Bid    []decimal.Decimal `json:"b"`
+	Last   []decimal.Decimal `json:"c"`
+	Volume []decimal.Decimal `json:"v"`
+}
+
+// Trade is a public trade, which the API sends as an array
+type Trade struct {
+	Price  decimal.Decimal
+	Volume decimal.Decimal
+	Time   time.Time
+}
+
+func (t *Trade) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) < 3 {
+		return errors.New("trade has too few fields")
+	}
+
+	var ts Timestamp
+	if err := json.Unmarshal(raw[2], &ts); err != nil {
+		return err
+	}
+	t.Time = ts.Time()
+
+	for i, field := range []*decimal.Decimal{&t.Price, &t.Volume} {
+		if err := json.Unmarshal(raw[i], field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Candle is an OHLC entry, which the API sends as an array
+type Candle struct {
+	Time   time.Time
+	Open   decimal.Decimal
+	High   decimal.Decimal
+	Low    decimal.Decimal
+	Close  decimal.Decimal
+	VWAP   decimal.Decimal
+	Volume decimal.Decimal
+}
+
+func (c *Candle) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if len(raw) < 7 {
+		return errors.New("candle has too few fields")
+	}
+
+	var ts Timestamp
+	if err := json.Unmarshal(raw[0], &ts); err != nil {
+		return err
+	}
+	c.Time = ts.Time()
+
+	for i, field := range []*decimal.Decimal{&c.Open, &c.High, &c.Low, &c.Close, &c.VWAP, &c.Volume} {
+		if err := json.Unmarshal(raw[i+1], field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type Balance struct {
+	Balance   decimal.Decimal `json:"balance"`
+	HoldTrade decimal.Decimal `json:"hold_trade"`
+}
+
+type TradeVolume struct {
+	Currency  string                 `json:"currency"`
+	Volume    decimal.Decimal        `json:"volume"`
+	Fees      map[string]FeeTierInfo `json:"fees"`
+	FeesMaker map[string]FeeTierInfo `json:"fees_maker"`
+}
+
+// FeeTierInfo is the fee of a pair at the account's tier, in percent
+type FeeTierInfo struct {
+	Fee decimal.Decimal `json:"fee"`
+}
+
+type OrderRequest struct {
+	Pair      string
+	Type      string
+	OrderType string
+	Price     decimal.Decimal
+	Volume    decimal.Decimal
+	OFlags    []string
+	UserRef   int32
+}
+
+func (r OrderRequest) values() url.Values {
+	params := url.Values{
+		"pair":      {r.Pair},
+		"type":      {r.Type},
+		"ordertype": {r.OrderType},
+		"volume":    {r.Volume.String()},
+	}
+	if r.Price.IsPositive() {
+		params.Set("price", r.Price.String())
+	}
+	if len(r.OFlags) > 0 {
+		params.Set("oflags", strings.Join(r.OFlags, ","))
+	}
+	if r.UserRef != 0 {
+		params.Set("userref", strconv.FormatInt(int64(r.UserRef), 10))
+	}
+	return params
+}
+
+type AddOrderResponse struct {
+	Description struct {
+		Order string `json:"order"`
+	} `json:"descr"`
+	TxIDs []string `json:"txid"`
+}
+
+type Order struct {
+	UserRef     int32            `json:"userref"`
+	Status      string           `json:"status"`
+	OpenTime    Timestamp        `json:"opentm"`
+	CloseTime   Timestamp        `json:"closetm"`
+	Description OrderDescription `json:"descr"`
+	Volume      decimal.Decimal  `json:"vol"`
+	VolumeExec  decimal.Decimal  `json:"vol_exec"`
+	Cost        decimal.Decimal  `json:"cost"`
+	Fee         decimal.Decimal  `json:"fee"`
+	Price       decimal.Decimal  `json:"price"`
+	OFlags      string           `json:"oflags"`
+	Trades      []string         `json:"trades"`
+}
+
+type OrderDescription struct {
+	Pair      string          `json:"pair"`
+	Type      string          `json:"type"`
+	OrderType string          `json:"ordertype"`
+	Price     decimal.Decimal `json:"price"`
+}
+
+// Timestamp is a unix time in fractional seconds, sent either as a number or a string
+type Timestamp float64
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*t = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*t = Timestamp(f)
+	return nil
+}
+
+func (t Timestamp) Time() time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(float64(t))
+	return time.Unix(int64(sec), int64(math.Round(frac*1e6))*int64(time.Microsecond))
+}
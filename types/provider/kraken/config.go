@@ -0,0 +1,16 @@
+package kraken
+
+import "github.com/spf13/viper"
+
+func init() {
+	viper.SetDefault("kraken.websocketURL", "wss://ws.kraken.com")
+	viper.SetDefault("kraken.authWebsocketURL", "wss://ws-auth.kraken.com")
+	viper.SetDefault("kraken.websocket.reconnectDelay", "1s")
+	viper.SetDefault("kraken.streams.tickerStreamBufferSize", 64)
+	viper.SetDefault("kraken.streams.orderStreamBufferSize", 8)
+
+	viper.SetDefault("kraken.rateLimit.public.rate", 1)
+	viper.SetDefault("kraken.rateLimit.public.burst", 1)
+	viper.SetDefault("kraken.rateLimit.private.rate", 0.33)
+	viper.SetDefault("kraken.rateLimit.private.burst", 15)
+}
@@ -0,0 +1,549 @@
+package kraken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken/client"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+type provider struct {
+	streamSvc *streamSvc
+	client    *client.Client
+	lifecycle *lifecycle.Switch
+	limiter   ratelimit.Limiter
+	pairs     *pairCache
+
+	// The client ids of the orders sent most recently, oldest first, so a retry checks whether the first attempt
+	// placed its order
+	mutex    sync.Mutex
+	sent     map[string]bool
+	sentList []string
+}
+
+// How many client ids a provider remembers sending
+const maxSent = 1024
+
+// New returns a provider for the client. Its REST calls are held to the limiter's budgets, or to the ones configured
+// under kraken.rateLimit when the limiter is nil.
+func New(stop <-chan bool, c *client.Client, limiter ratelimit.Limiter) types.ContextProvider {
+	if limiter == nil {
+		limiter = ratelimit.New(ratelimit.ConfigFromViper("kraken"))
+	}
+	c.HTTPClient.Transport = ratelimit.NewTransport(limiter, ratelimit.TransportConfig{
+		Budget:    budget,
+		Throttled: throttled,
+		Base:      c.HTTPClient.Transport,
+	})
+
+	sw := lifecycle.NewSwitch(stop)
+	p := &provider{
+		client:    c,
+		lifecycle: sw,
+		limiter:   limiter,
+		sent:      make(map[string]bool),
+	}
+	p.pairs = newPairCache(c)
+	p.streamSvc = newStreamSvc(sw.Stop(), &sw.Group, c, p.snapshot)
+
+	return p
+}
+
+func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	return p.AttemptOrderContext(context.Background(), req)
+}
+
+func (p *provider) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	// Make sure order updates are flowing before the order exists
+	p.streamSvc.startUserStream()
+
+	pr, err := p.pairs.pair(ctx, req.Market.Name)
+	if err != nil {
+		return
+	}
+
+	// Tag the order with a user reference derived from the client id so it can be found if the response is lost
+	userref := userRef(req.ClientID)
+	orderRequest := client.OrderRequest{
+		Pair:    pr.altname,
+		Type:    strings.ToLower(string(req.Side)),
+		UserRef: userref,
+	}
+	switch req.Type {
+	case order.Limit:
+		orderRequest.OrderType = "limit"
+		orderRequest.Price = req.Price
+		orderRequest.Volume = req.Quantity
+		if req.ForceMaker {
+			orderRequest.OFlags = append(orderRequest.OFlags, "post")
+		}
+	case order.Market:
+		orderRequest.OrderType = "market"
+		orderRequest.Volume = req.Quantity
+		if req.Quantity.IsZero() {
+			// The volume is given in the quote currency instead
+			orderRequest.Volume = req.Funds
+			orderRequest.OFlags = append(orderRequest.OFlags, "viqc")
+		}
+	default:
+		return types.OrderDTO{}, fmt.Errorf("%w: order type %s not implemented", types.ErrInvalidRequest, req.Type)
+	}
+
+	// A request that was sent before may have placed its order already. Placing it again when that can't be checked
+	// risks a second order, so the check's error is returned instead.
+	if p.markSent(req.ClientID) {
+		txid, ok, err := p.placedOrder(ctx, orderRequest)
+		if err != nil {
+			return types.OrderDTO{}, fmt.Errorf("could not check whether order %s was already placed: %w", req.ClientID, err)
+		}
+		if ok {
+			return pendingOrder(req, txid), nil
+		}
+	}
+
+	// Place the order
+	resp, err := p.client.WithContext(ctx).AddOrder(orderRequest)
+	if err != nil {
+		var apiErr client.Error
+		if errors.As(err, &apiErr) && !apiErr.Temporary() {
+			return
+		}
+
+		// Make sure the order didn't manage to make it there somehow
+		log.WithError(err).Debugf("error creating order %d checking if it posted", userref)
+		txid, ok, lookupErr := p.placedOrder(ctx, orderRequest)
+		if lookupErr != nil || !ok {
+			return
+		}
+		resp.TxIDs = []string{txid}
+		err = nil
+	}
+	if len(resp.TxIDs) == 0 {
+		return types.OrderDTO{}, errors.New("kraken did not return an id for the order")
+	}
+
+	return pendingOrder(req, resp.TxIDs[0]), nil
+}
+
+// markSent remembers sending the client id, reporting whether it was sent before. Requests without one are never
+// retries.
+func (p *provider) markSent(clientID string) (resent bool) {
+	if clientID == "" {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.sent[clientID] {
+		return true
+	}
+	p.sent[clientID] = true
+	p.sentList = append(p.sentList, clientID)
+	if len(p.sentList) > maxSent {
+		delete(p.sent, p.sentList[0])
+		p.sentList = p.sentList[1:]
+	}
+	return false
+}
+
+// placedOrder looks for the order the request placed. User references are only 31 bits of the client id and the
+// API doesn't keep them unique, so the order must also match the request's pair, side, type and volume.
+func (p *provider) placedOrder(ctx context.Context, req client.OrderRequest) (txid string, ok bool, err error) {
+	orders, err := p.client.WithContext(ctx).OrdersByUserRef(req.UserRef)
+	if err != nil {
+		return "", false, err
+	}
+	for id, o := range orders {
+		desc := o.Description
+		if desc.Pair != req.Pair || desc.Type != req.Type || desc.OrderType != req.OrderType {
+			continue
+		}
+
+		// An order given in the quote currency reports its volume in the base currency
+		if !quoteVolume(req) && !o.Volume.Equal(req.Volume) {
+			continue
+		}
+		return id, true, nil
+	}
+	return "", false, nil
+}
+
+func quoteVolume(req client.OrderRequest) bool {
+	for _, flag := range req.OFlags {
+		if flag == "viqc" {
+			return true
+		}
+	}
+	return false
+}
+
+func pendingOrder(req types.OrderRequestDTO, txid string) types.OrderDTO {
+	return types.OrderDTO{
+		Market:       req.Market,
+		CreationTime: time.Now(),
+		Fees:         decimal.Zero,
+		Filled:       decimal.Zero,
+		ID:           txid,
+		Paid:         decimal.Zero,
+		Request:      req,
+		Status:       order.Pending,
+	}
+}
+
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, error) {
+	return p.AverageTradeVolumeContext(context.Background(), mkt)
+}
+
+func (p *provider) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (decimal.Decimal, error) {
+	pr, err := p.pairs.pair(ctx, mkt.Name)
+	if err != nil {
+		return decimal.Zero, err
+	}
+
+	trades, err := p.client.WithContext(ctx).Trades(pr.key)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	if len(trades) == 0 {
+		return decimal.Zero, nil
+	}
+
+	total := decimal.Zero
+	for _, t := range trades {
+		total = total.Add(t.Volume)
+	}
+	return total.Div(decimal.NewFromInt(int64(len(trades)))), nil
+}
+
+func (p *provider) CancelOrder(ord types.OrderDTO) error {
+	return p.CancelOrderContext(context.Background(), ord)
+}
+
+func (p *provider) CancelOrderContext(ctx context.Context, ord types.OrderDTO) error {
+	return p.client.WithContext(ctx).CancelOrder(ord.ID)
+}
+
+func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	return p.CandlesContext(context.Background(), mkt, interval, start, end)
+}
+
+func (p *provider) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	minutes, _, err := getInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := p.pairs.pair(ctx, mkt.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// The API only serves the most recent 720 candles and has no end time, so trim the rest
+	raw, err := p.client.WithContext(ctx).OHLC(pr.key, minutes, start)
+	if err != nil {
+		return nil, err
+	}
+
+	candles = []types.CandleDTO{}
+	for _, c := range raw {
+		if c.Time.Before(start) || c.Time.After(end) {
+			continue
+		}
+		candles = append(candles, types.CandleDTO{
+			Open:      c.Open,
+			Close:     c.Close,
+			High:      c.High,
+			Low:       c.Low,
+			Volume:    c.Volume,
+			Timestamp: c.Time,
+		})
+	}
+
+	sort.Slice(candles, func(i, j int) bool {
+		return candles[i].Timestamp.Before(candles[j].Timestamp)
+	})
+	return
+}
+
+func (p *provider) Currencies() ([]types.CurrencyDTO, error) {
+	return p.CurrenciesContext(context.Background())
+}
+
+func (p *provider) CurrenciesContext(ctx context.Context) ([]types.CurrencyDTO, error) {
+	if err := p.pairs.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return p.pairs.allCurrencies(), nil
+}
+
+func (p *provider) Fees() (fees types.FeesDTO, err error) {
+	return p.FeesContext(context.Background())
+}
+
+func (p *provider) FeesContext(ctx context.Context) (fees types.FeesDTO, err error) {
+	mkts, err := p.MarketsContext(ctx)
+	if err != nil {
+		return
+	}
+	if len(mkts) == 0 {
+		return fees, errors.New("kraken has no markets to look up fees for")
+	}
+
+	// Fees follow the same volume tiers on every pair, so any pair will do
+	pr, err := p.pairs.pair(ctx, mkts[0].Name)
+	if err != nil {
+		return
+	}
+
+	vol, err := p.client.WithContext(ctx).TradeVolume(pr.key)
+	if err != nil {
+		return
+	}
+
+	// Fees are given in percent
+	taker := vol.Fees[pr.key].Fee
+	maker := taker
+	if tier, ok := vol.FeesMaker[pr.key]; ok {
+		maker = tier.Fee
+	}
+	fees = types.FeesDTO{
+		MakerRate: maker.Div(decimal.NewFromInt(100)),
+		TakerRate: taker.Div(decimal.NewFromInt(100)),
+		Volume:    vol.Volume,
+	}
+	return
+}
+
+// Health reports on the market and user data websockets and the REST budgets
+func (p *provider) Health() []types.ProviderHealth {
+	return []types.ProviderHealth{{
+		Websockets: []types.WebsocketHealth{p.streamSvc.market.Health(), p.streamSvc.user.Health()},
+		RateLimits: ratelimit.Health(p.limiter),
+	}}
+}
+
+func (p *provider) Markets() ([]types.MarketDTO, error) {
+	return p.MarketsContext(context.Background())
+}
+
+func (p *provider) MarketsContext(ctx context.Context) ([]types.MarketDTO, error) {
+	if err := p.pairs.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return p.pairs.allMarkets(), nil
+}
+
+// OpenOrders lists the account's open orders, including the ones placed outside the trader, by their transaction ids
+func (p *provider) OpenOrders() (orders []types.OrderDTO, err error) {
+	return p.OpenOrdersContext(context.Background())
+}
+
+func (p *provider) OpenOrdersContext(ctx context.Context) (orders []types.OrderDTO, err error) {
+	raws, err := p.client.WithContext(ctx).OpenOrders()
+	if err != nil {
+		return
+	}
+
+	orders = []types.OrderDTO{}
+	for txid, raw := range raws {
+		pr, err := p.pairs.pair(ctx, raw.Description.Pair)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, toDTO(pr.market, txid, raw))
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreationTime.Before(orders[j].CreationTime) })
+	return
+}
+
+func (p *provider) Order(mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	return p.OrderContext(context.Background(), mkt, id)
+}
+
+func (p *provider) OrderContext(ctx context.Context, mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	return p.snapshotContext(ctx, types.OrderDTO{Market: mkt, ID: id})
+}
+
+func (p *provider) OrderStream(stop <-chan bool, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	return p.streamSvc.OrderStream(stop, ord), nil
+}
+
+func (p *provider) OrderStreamContext(ctx context.Context, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.OrderStream(contextual.Stop(ctx), ord)
+}
+
+func (p *provider) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err error) {
+	return p.RefreshOrderContext(context.Background(), in)
+}
+
+func (p *provider) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (out types.OrderDTO, err error) {
+	out, err = p.OrderContext(ctx, in.Market, in.ID)
+	if errors.Is(err, types.ErrOrderNotFound) {
+		log.Debugf("could not find order %s in API; assuming it was cancelled", in.ID)
+		out = in
+		out.Status = order.Canceled
+		err = nil
+	}
+	return
+}
+
+// Shutdown stops the provider as the kill switch would and waits for its streams to close
+func (p *provider) Shutdown(ctx context.Context) error {
+	return p.lifecycle.Shutdown(ctx)
+}
+
+func (p *provider) Ticker(mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	return p.TickerContext(context.Background(), mkt)
+}
+
+func (p *provider) TickerContext(ctx context.Context, mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	pr, err := p.pairs.pair(ctx, mkt.Name)
+	if err != nil {
+		return
+	}
+
+	raw, err := p.client.WithContext(ctx).Ticker(pr.key)
+	if err != nil {
+		return
+	}
+	if len(raw.Ask) == 0 || len(raw.Bid) == 0 || len(raw.Last) < 2 || len(raw.Volume) < 2 {
+		return tkr, fmt.Errorf("incomplete ticker for %s", mkt.Name)
+	}
+
+	tkr = types.TickerDTO{
+		Ask:       raw.Ask[0],
+		Bid:       raw.Bid[0],
+		Price:     raw.Last[0],
+		Quantity:  raw.Last[1],
+		Timestamp: time.Now(),
+		Volume:    raw.Volume[1],
+	}
+	return
+}
+
+func (p *provider) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	pr, err := p.pairs.pair(context.Background(), mkt.Name)
+	if err != nil {
+		return nil, err
+	}
+	return p.streamSvc.TickerStream(stop, pr.wsname), nil
+}
+
+func (p *provider) TickerStreamContext(ctx context.Context, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.TickerStream(contextual.Stop(ctx), mkt)
+}
+
+func (p *provider) Wallet(cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	return p.WalletContext(context.Background(), cur)
+}
+
+func (p *provider) WalletContext(ctx context.Context, cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	wals, err := p.WalletsContext(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, w := range wals {
+		if w.Currency.Symbol == cur.Symbol {
+			return w, nil
+		}
+	}
+
+	// Assets that were never held don't show up in the balances
+	return types.WalletDTO{ID: cur.Symbol, Currency: cur, Free: decimal.Zero, Locked: decimal.Zero}, nil
+}
+
+func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
+	return p.WalletsContext(context.Background())
+}
+
+func (p *provider) WalletsContext(ctx context.Context) (wals []types.WalletDTO, err error) {
+	balances, err := p.client.WithContext(ctx).BalanceEx()
+	if err != nil {
+		return
+	}
+
+	wals = []types.WalletDTO{}
+	for asset, bal := range balances {
+		cur, err := p.pairs.currency(ctx, asset)
+		if err != nil {
+			return nil, err
+		}
+		wals = append(wals, types.WalletDTO{
+			ID:       cur.Symbol,
+			Currency: cur,
+			Free:     bal.Balance.Sub(bal.HoldTrade),
+			Locked:   bal.HoldTrade,
+		})
+	}
+	sort.Slice(wals, func(i, j int) bool { return wals[i].ID < wals[j].ID })
+	return
+}
+
+// snapshot fetches the current state of an order
+func (p *provider) snapshot(in types.OrderDTO) (types.OrderDTO, error) {
+	return p.snapshotContext(context.Background(), in)
+}
+
+func (p *provider) snapshotContext(ctx context.Context, in types.OrderDTO) (types.OrderDTO, error) {
+	orders, err := p.client.WithContext(ctx).QueryOrders(in.ID)
+	if err != nil {
+		return types.OrderDTO{}, err
+	}
+	raw, ok := orders[in.ID]
+	if !ok {
+		return types.OrderDTO{}, client.Error{Messages: []string{client.ErrUnknownOrder}}.Wrap()
+	}
+	return toDTO(in.Market, in.ID, raw), nil
+}
+
+func toDTO(mkt types.MarketDTO, id string, raw client.Order) types.OrderDTO {
+	flags := strings.Split(raw.OFlags, ",")
+	dto := types.OrderDTO{
+		Market:       mkt,
+		CreationTime: raw.OpenTime.Time(),
+		Fees:         raw.Fee,
+		FeesSide:     getFeesSide(raw.OFlags),
+		Filled:       raw.VolumeExec,
+		ID:           id,
+		Paid:         raw.Cost,
+		Status:       getStatus(raw.Status, raw.VolumeExec),
+		Request: types.OrderRequestDTO{
+			Market:   mkt,
+			Type:     getType(raw.Description.OrderType),
+			Side:     getSide(raw.Description.Type),
+			Price:    raw.Description.Price,
+			Quantity: raw.Volume,
+		},
+	}
+
+	for _, flag := range flags {
+		switch flag {
+		case "post":
+			dto.Request.ForceMaker = true
+		case "viqc":
+			dto.Request.Funds, dto.Request.Quantity = raw.Volume, decimal.Zero
+		}
+	}
+	if dto.Request.Type == order.Market {
+		// Market orders report the average price they executed at
+		dto.Request.Price = raw.Price
+	}
+	return dto
+}
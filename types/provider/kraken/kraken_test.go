@@ -0,0 +1,370 @@
+package kraken_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken/client"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken/krakentest"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/spf13/viper"
+)
+
+var (
+	srv    *krakentest.Server
+	secret = base64.StdEncoding.EncodeToString([]byte("secret"))
+)
+
+func TestMain(m *testing.M) {
+	providertest.Main(m, func() {
+		srv = krakentest.NewServer(krakentest.Config{
+			Key:          "key",
+			Secret:       secret,
+			TickInterval: 20 * time.Millisecond,
+		})
+
+		// Viper is global, so configure it once before any provider is reading from it
+		viper.Set("kraken.websocketURL", srv.WebsocketURL)
+		viper.Set("kraken.authWebsocketURL", srv.AuthWebsocketURL)
+		viper.Set("kraken.websocket.reconnectDelay", "20ms")
+	}, func() { srv.Close() })
+}
+
+func newProvider(t *testing.T, secret string) types.ContextProvider {
+	c := client.NewClient()
+	c.UpdateConfig(&client.ClientConfig{
+		BaseURL: srv.URL,
+		Key:     "key",
+		Secret:  secret,
+	})
+
+	return kraken.New(providertest.Stop(t), c, providertest.Limiter())
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			return newProvider(t, secret)
+		},
+		Market:  "BTC/USD",
+		Timeout: 5 * time.Second,
+	})
+}
+
+func TestNormalizeAsset(t *testing.T) {
+	for asset, expected := range map[string]string{
+		"XXBT":   "BTC",
+		"XBT":    "BTC",
+		"XXDG":   "DOGE",
+		"XETH":   "ETH",
+		"ZUSD":   "USD",
+		"ZEUR":   "EUR",
+		"DOT":    "DOT",
+		"USDT":   "USDT",
+		"XBT.M":  "BTC.M",
+		"ETH2.S": "ETH2.S",
+	} {
+		if actual := kraken.NormalizeAsset(asset); actual != expected {
+			t.Errorf("NormalizeAsset(%q) is %q; expected %q", asset, actual, expected)
+		}
+	}
+}
+
+func TestNormalizePair(t *testing.T) {
+	for wsname, expected := range map[string]string{
+		"XBT/USD":  "BTC/USD",
+		"ETH/XBT":  "ETH/BTC",
+		"XDG/EUR":  "DOGE/EUR",
+		"DOT/USD":  "DOT/USD",
+		"USDT/USD": "USDT/USD",
+	} {
+		if actual := kraken.NormalizePair(wsname); actual != expected {
+			t.Errorf("NormalizePair(%q) is %q; expected %q", wsname, actual, expected)
+		}
+	}
+}
+
+func TestMarketsNormalized(t *testing.T) {
+	p := newProvider(t, secret)
+	mkt := providertest.Market(t, p, "ETH/BTC")
+
+	expect := map[string][2]decimal.Decimal{
+		"MinPrice":         {mkt.MinPrice, decimal.RequireFromString("0.00001")},
+		"PriceIncrement":   {mkt.PriceIncrement, decimal.RequireFromString("0.00001")},
+		"MinQuantity":      {mkt.MinQuantity, decimal.RequireFromString("0.002")},
+		"QuantityStepSize": {mkt.QuantityStepSize, decimal.RequireFromString("0.00000001")},
+		"MinFunds":         {mkt.MinFunds, decimal.RequireFromString("0.00002")},
+	}
+	for field, values := range expect {
+		if !values[0].Equal(values[1]) {
+			t.Errorf("%s is %s; expected %s", field, values[0], values[1])
+		}
+	}
+	if mkt.BaseCurrency.Symbol != "ETH" || mkt.QuoteCurrency.Symbol != "BTC" {
+		t.Errorf("market currencies are %s/%s; expected ETH/BTC", mkt.BaseCurrency.Symbol, mkt.QuoteCurrency.Symbol)
+	}
+
+	curs, err := p.Currencies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols := map[string]bool{}
+	for _, cur := range curs {
+		symbols[cur.Symbol] = true
+	}
+	for _, symbol := range []string{"BTC", "ETH", "USD", "DOT"} {
+		if !symbols[symbol] {
+			t.Errorf("currency %s is missing from %v", symbol, symbols)
+		}
+	}
+
+	// Kraken's own names for a pair resolve to the same market
+	for _, name := range []string{"XXBTZUSD", "XBTUSD", "XBT/USD"} {
+		if _, err := p.Ticker(types.MarketDTO{Name: name}); err != nil {
+			t.Errorf("could not get ticker by kraken pair name %s: %s", name, err)
+		}
+	}
+}
+
+func TestWalletsNormalized(t *testing.T) {
+	p := newProvider(t, secret)
+	wals, err := p.Wallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]types.WalletDTO{}
+	for _, wal := range wals {
+		ids[wal.ID] = wal
+	}
+	for _, id := range []string{"BTC", "USD", "ETH", "DOT", "BTC.M"} {
+		if _, ok := ids[id]; !ok {
+			t.Errorf("wallet %s is missing", id)
+		}
+	}
+	for _, id := range []string{"XXBT", "ZUSD", "XBT.M"} {
+		if _, ok := ids[id]; ok {
+			t.Errorf("wallet %s was not normalized", id)
+		}
+	}
+	if btc := ids["BTC"]; btc.Currency.Precision != 10 {
+		t.Errorf("BTC wallet precision is %d; expected the asset's 10 decimals", btc.Currency.Precision)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	_, err := newProvider(t, base64.StdEncoding.EncodeToString([]byte("wrong"))).Wallets()
+
+	var apiErr client.Error
+	if !errors.As(err, &apiErr) || !apiErr.Has(client.ErrInvalidSignature) {
+		t.Fatalf("expected a signature error; got %v", err)
+	}
+	var provErr *types.ProviderError
+	if !errors.As(err, &provErr) || provErr.Kind != types.ErrAuthFailed {
+		t.Errorf("signature error %v is not %s", err, types.ErrAuthFailed)
+	}
+}
+
+func TestCancelUnknownOrder(t *testing.T) {
+	p := newProvider(t, secret)
+	mkt := providertest.Market(t, p, "ETH/BTC")
+
+	err := p.CancelOrder(types.OrderDTO{Market: mkt, ID: "OUNKNO-WN000-000000"})
+	var provErr *types.ProviderError
+	if !errors.As(err, &provErr) || provErr.Kind != types.ErrOrderNotFound {
+		t.Fatalf("expected %s; got %v", types.ErrOrderNotFound, err)
+	}
+}
+
+func TestTickerStreamSurvivesDisconnect(t *testing.T) {
+	p := newProvider(t, secret)
+	mkt := providertest.Market(t, p, "ETH/BTC")
+
+	stop := make(chan bool)
+	defer close(stop)
+	stream, err := p.TickerStream(stop, mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stream
+
+	for i := 0; i < 2; i++ {
+		srv.Disconnect()
+		providertest.WaitFor(t, "resubscription", func() bool { return srv.Subscribed("ETH/XBT") })
+
+		select {
+		case <-stream:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ticker stream did not resume after disconnect")
+		}
+	}
+}
+
+func TestOrderStreamAfterReconnect(t *testing.T) {
+	p := newProvider(t, secret)
+	mkt := providertest.Market(t, p, "BTC/USD")
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto, err := p.AttemptOrder(providertest.RestingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := p.OrderStream(make(chan bool), dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providertest.WaitFor(t, "private feeds", func() bool { return srv.PrivateConnects() > 0 })
+
+	// The old token is no good, so the feeds only come back with a fresh one
+	connects := srv.PrivateConnects()
+	srv.ExpireTokens()
+	srv.Disconnect()
+	providertest.WaitFor(t, "private feed reconnect", func() bool { return srv.PrivateConnects() > connects })
+	srv.SetPrice("XBTUSD", dto.Request.Price.Sub(mkt.PriceIncrement))
+	defer srv.SetPrice("XBTUSD", tkr.Price)
+
+	var last types.OrderDTO
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case dto, ok := <-stream:
+			if !ok {
+				done = true
+				break
+			}
+			last = dto
+		case <-timeout:
+			t.Fatalf("order stream did not finish; last saw %s", last.Status)
+		}
+	}
+	if last.Status != order.Filled || !last.Filled.Equal(dto.Request.Quantity) {
+		t.Fatalf("order finished as %s with %s filled; expected %s with %s", last.Status, last.Filled, order.Filled, dto.Request.Quantity)
+	}
+
+	// Resting orders pay the maker fee in the quote currency
+	fees := last.Paid.Mul(decimal.RequireFromString("0.0016"))
+	if last.FeesSide != "" || !last.Fees.Equal(fees) {
+		t.Fatalf("fees are %s on the %q side; expected %s on the quote currency", last.Fees, last.FeesSide, fees)
+	}
+}
+
+func TestOpenOrdersIncludeOutsideOrders(t *testing.T) {
+	p := newProvider(t, secret)
+	mkt := providertest.Market(t, p, "BTC/USD")
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placed, err := p.AttemptOrder(providertest.RestingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CancelOrder(placed)
+
+	// An order placed on the website has no user reference
+	c := client.NewClient()
+	c.UpdateConfig(&client.ClientConfig{BaseURL: srv.URL, Key: "key", Secret: secret})
+	resp, err := c.AddOrder(client.OrderRequest{
+		Pair:      "XBTUSD",
+		Type:      "buy",
+		OrderType: "limit",
+		Price:     placed.Request.Price,
+		Volume:    placed.Request.Quantity,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := resp.TxIDs[0]
+	defer c.CancelOrder(outside)
+
+	orders, err := p.(types.OpenOrderLister).OpenOrders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]types.OrderDTO{}
+	for _, dto := range orders {
+		found[dto.ID] = dto
+	}
+	if dto, ok := found[placed.ID]; !ok || dto.Market.Name != "BTC/USD" || dto.Status != order.Pending {
+		t.Errorf("open orders %v don't include the placed order %s", orders, placed.ID)
+	}
+	if _, ok := found[outside]; !ok {
+		t.Fatalf("open orders %v don't include the outside order %s", orders, outside)
+	}
+
+	// The outside order can be looked up by the id it was listed under
+	if dto, err := p.Order(mkt, outside); err != nil || dto.ID != outside {
+		t.Errorf("Order() returned %+v, %v for the outside order", dto, err)
+	}
+}
+
+func TestContextCancelsRequests(t *testing.T) {
+	p := newProvider(t, secret)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.WalletsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled context's error, got %v", err)
+	}
+	if _, err := p.WalletsContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetryFindsItsOwnOrder(t *testing.T) {
+	p := newProvider(t, secret)
+	mkt := providertest.Market(t, p, "BTC/USD")
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := providertest.RestingLimitBuy(mkt, tkr)
+	req.ClientID = "7fffffff-0000-4000-8000-000000000001"
+
+	// Another order already carries the user reference the client id maps to
+	c := client.NewClient()
+	c.UpdateConfig(&client.ClientConfig{BaseURL: srv.URL, Key: "key", Secret: secret})
+	resp, err := c.AddOrder(client.OrderRequest{
+		Pair:      "XBTUSD",
+		Type:      "buy",
+		OrderType: "limit",
+		Price:     req.Price,
+		Volume:    req.Quantity.Mul(decimal.NewFromInt(2)),
+		UserRef:   0x3fffffff,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := resp.TxIDs[0]
+	defer c.CancelOrder(other)
+
+	placed, err := p.AttemptOrder(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.CancelOrder(placed)
+	if placed.ID == other {
+		t.Fatalf("first attempt returned the other order %s", other)
+	}
+
+	// The retry finds the order it placed rather than the other one with its user reference
+	again, err := p.AttemptOrder(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != placed.ID {
+		t.Errorf("retry returned order %s; expected %s", again.ID, placed.ID)
+	}
+}
@@ -0,0 +1,893 @@
+// Package krakentest runs an in-process fake of the Kraken spot REST API and websocket feeds
+// so the kraken provider can be exercised without touching the real exchange.
+//
+// The server speaks the endpoints the provider uses: assets, asset pairs, tickers, trades, OHLC,
+// extended balances, trade volume, orders and websocket tokens, plus the public ticker feed and
+// the private openOrders and ownTrades feeds. Private requests must carry increasing nonces and
+// valid signatures. Assets use Kraken's own codes, such as XXBT and ZUSD, so callers have to
+// normalize them. Holds and matching are left to the simulated exchange engine: orders that cross
+// the book fill in two trades, and orders that rest fill once SetPrice moves the market through
+// them. Fees are charged in the quote currency.
+package krakentest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	ws "github.com/gorilla/websocket"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	ord "github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/internal/exchange"
+)
+
+// Config tunes the fake server
+type Config struct {
+	// Key and Secret are the API credentials the server accepts. The secret is base64 encoded,
+	// as Kraken hands it out. Signatures aren't checked when it is empty.
+	Key    string
+	Secret string
+
+	// TickInterval controls how often ticker messages are published. Defaults to 100ms.
+	TickInterval time.Duration
+
+	// FillDelay is how often working orders are matched against the market. Defaults to 50ms.
+	FillDelay time.Duration
+
+	// MakerFee and TakerFee are the fees in percent. They default to 0.16 and 0.26.
+	MakerFee decimal.Decimal
+	TakerFee decimal.Decimal
+}
+
+// Server is a fake Kraken exchange
+type Server struct {
+	// URL is the base URL of the REST API
+	URL string
+
+	// WebsocketURL and AuthWebsocketURL are the URLs of the public and private feeds
+	WebsocketURL     string
+	AuthWebsocketURL string
+
+	config   Config
+	server   *httptest.Server
+	upgrader ws.Upgrader
+	exchange *exchange.Exchange
+	stop     chan bool
+	once     sync.Once
+
+	// Assets and pairs don't change once the server is up, apart from the prices of the pairs
+	assets    map[string]*asset
+	pairs     map[string]*pair
+	balances  []string
+	channelID int
+	priceMtx  sync.RWMutex
+
+	mutex     sync.Mutex
+	nonce     int64
+	orders    map[string]*order
+	engineIDs map[string]*order
+	trades    map[string]*trade
+	tradeLog  []string
+	tokens    map[string]bool
+
+	streamMtx       sync.Mutex
+	conns           map[*streamConn]bool
+	privateConnects int
+}
+
+type asset struct {
+	code     string
+	altname  string
+	decimals int
+}
+
+type pair struct {
+	key          string
+	altname      string
+	wsname       string
+	base         string
+	quote        string
+	pairDecimals int
+	lotDecimals  int
+	price        decimal.Decimal
+	tickSize     decimal.Decimal
+	orderMin     decimal.Decimal
+	costMin      decimal.Decimal
+	channelID    int
+}
+
+// order is what the exchange knows of an order beyond what the engine keeps: its ids, flags and trades
+type order struct {
+	txid      string
+	engineID  string
+	userref   int32
+	pair      string
+	side      string
+	orderType string
+	oflags    string
+	price     decimal.Decimal
+	volume    decimal.Decimal
+	opened    time.Time
+	closed    time.Time
+	announced bool
+	trades    []string
+}
+
+type trade struct {
+	id        string
+	orderTxID string
+	pair      string
+	side      string
+	orderType string
+	price     decimal.Decimal
+	volume    decimal.Decimal
+	cost      decimal.Decimal
+	fee       decimal.Decimal
+	time      time.Time
+}
+
+// NewServer starts a fake exchange with XBT/USD, ETH/XBT and DOT/USD pairs and funded balances
+func NewServer(config Config) *Server {
+	if config.TickInterval <= 0 {
+		config.TickInterval = 100 * time.Millisecond
+	}
+	if config.FillDelay <= 0 {
+		config.FillDelay = 50 * time.Millisecond
+	}
+	if config.MakerFee.IsZero() && config.TakerFee.IsZero() {
+		config.MakerFee = decimal.RequireFromString("0.16")
+		config.TakerFee = decimal.RequireFromString("0.26")
+	}
+
+	s := &Server{
+		config:    config,
+		stop:      make(chan bool),
+		assets:    make(map[string]*asset),
+		pairs:     make(map[string]*pair),
+		balances:  []string{"ZUSD", "XXBT", "XETH", "DOT", "XBT.M"},
+		orders:    make(map[string]*order),
+		engineIDs: make(map[string]*order),
+		trades:    make(map[string]*trade),
+		tokens:    make(map[string]bool),
+		conns:     make(map[*streamConn]bool),
+	}
+
+	s.addAsset("XXBT", "XBT", 10)
+	s.addAsset("XETH", "ETH", 10)
+	s.addAsset("ZUSD", "USD", 4)
+	s.addAsset("DOT", "DOT", 10)
+	s.addPair("XXBTZUSD", "XBTUSD", "XBT/USD", "XXBT", "ZUSD", 1, 8, "10000", "0.1", "0.0001", "0.5")
+	s.addPair("XETHXXBT", "ETHXBT", "ETH/XBT", "XETH", "XXBT", 5, 8, "0.03", "0.00001", "0.002", "0.00002")
+	s.addPair("DOTUSD", "DOTUSD", "DOT/USD", "DOT", "ZUSD", 4, 8, "5", "0.0001", "0.5", "0.5")
+	s.exchange = exchange.New(exchange.Config{
+		Balances: map[string]decimal.Decimal{
+			"ZUSD":  decimal.NewFromInt(100000),
+			"XXBT":  decimal.NewFromInt(10),
+			"XETH":  decimal.NewFromInt(100),
+			"DOT":   decimal.NewFromInt(1000),
+			"XBT.M": decimal.RequireFromString("0.5"),
+		},
+		Fees: types.FeesDTO{
+			MakerRate: config.MakerFee.Div(decimalHundred),
+			TakerRate: config.TakerFee.Div(decimalHundred),
+		},
+		TickInterval: config.FillDelay,
+		OnFill:       s.onFill,
+	}, s.quote)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handlePublicStream)
+	mux.HandleFunc("/ws-auth", s.handlePrivateStream)
+	mux.HandleFunc("/0/public/", s.handlePublic)
+	mux.HandleFunc("/0/private/", s.handlePrivate)
+	s.server = httptest.NewServer(mux)
+	s.URL = s.server.URL
+	s.WebsocketURL = "ws" + strings.TrimPrefix(s.server.URL, "http") + "/ws"
+	s.AuthWebsocketURL = "ws" + strings.TrimPrefix(s.server.URL, "http") + "/ws-auth"
+
+	go s.publishTickers()
+
+	return s
+}
+
+// Close shuts the server down and drops all stream connections
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.stop)
+		s.Disconnect()
+		s.server.Close()
+	})
+}
+
+// SetPrice moves the price of the pair, given by any of its names. Resting orders it crosses fill the next time they
+// are matched.
+func (s *Server) SetPrice(name string, price decimal.Decimal) {
+	p := s.findPair(name)
+	if p == nil {
+		return
+	}
+	s.priceMtx.Lock()
+	defer s.priceMtx.Unlock()
+	p.price = price
+}
+
+// SetBalance sets the total balance of the asset, given by its Kraken code
+func (s *Server) SetBalance(code string, amount decimal.Decimal) {
+	cur := currency(code)
+	s.exchange.SetBalance(cur, amount.Sub(s.exchange.Wallet(cur).Locked))
+}
+
+func (s *Server) addAsset(code, altname string, decimals int) {
+	s.assets[code] = &asset{code: code, altname: altname, decimals: decimals}
+}
+
+func (s *Server) addPair(key, altname, wsname, base, quote string, pairDecimals, lotDecimals int, price, tickSize, orderMin, costMin string) {
+	s.channelID++
+	s.pairs[key] = &pair{
+		key:          key,
+		altname:      altname,
+		wsname:       wsname,
+		base:         base,
+		quote:        quote,
+		pairDecimals: pairDecimals,
+		lotDecimals:  lotDecimals,
+		price:        decimal.RequireFromString(price),
+		tickSize:     decimal.RequireFromString(tickSize),
+		orderMin:     decimal.RequireFromString(orderMin),
+		costMin:      decimal.RequireFromString(costMin),
+		channelID:    s.channelID,
+	}
+}
+
+// findPair looks a pair up by key, alternate name or websocket name
+func (s *Server) findPair(name string) *pair {
+	for _, p := range s.pairs {
+		if p.key == name || p.altname == name || p.wsname == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Server) handlePublic(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	switch strings.TrimPrefix(r.URL.Path, "/0/public/") {
+	case "Assets":
+		s.assetInfo(w)
+	case "AssetPairs":
+		s.assetPairs(w)
+	case "Ticker":
+		s.ticker(w, r)
+	case "Trades":
+		s.publicTrades(w, r)
+	case "OHLC":
+		s.ohlc(w, r)
+	default:
+		writeError(w, "EGeneral:Unknown method")
+	}
+}
+
+func (s *Server) handlePrivate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, "EGeneral:Invalid arguments")
+		return
+	}
+
+	// Signatures cover the body as sent, so keep it before parsing
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, "EGeneral:Invalid arguments")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ParseForm()
+	if !s.authorized(w, r, string(body)) {
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, "/0/private/") {
+	case "BalanceEx":
+		s.balanceEx(w)
+	case "TradeVolume":
+		s.tradeVolume(w, r)
+	case "AddOrder":
+		s.addOrder(w, r)
+	case "CancelOrder":
+		s.cancelOrder(w, r)
+	case "QueryOrders":
+		s.queryOrders(w, r)
+	case "OpenOrders":
+		s.listOrders(w, r, "open")
+	case "ClosedOrders":
+		s.listOrders(w, r, "closed")
+	case "GetWebSocketsToken":
+		s.webSocketsToken(w)
+	default:
+		writeError(w, "EGeneral:Unknown method")
+	}
+}
+
+// authorized checks the key, nonce and signature of a private request, writing the error if they are bad
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request, body string) bool {
+	if s.config.Secret == "" {
+		return true
+	}
+	if r.Header.Get("API-Key") != s.config.Key {
+		writeError(w, "EAPI:Invalid key")
+		return false
+	}
+
+	nonce, err := strconv.ParseInt(r.PostForm.Get("nonce"), 10, 64)
+	if err != nil {
+		writeError(w, "EAPI:Invalid nonce")
+		return false
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(s.config.Secret)
+	if err != nil {
+		writeError(w, "EAPI:Invalid key")
+		return false
+	}
+	sha := sha256.Sum256([]byte(r.PostForm.Get("nonce") + body))
+	mac := hmac.New(sha512.New, secret)
+	mac.Write([]byte(r.URL.Path))
+	mac.Write(sha[:])
+	if base64.StdEncoding.EncodeToString(mac.Sum(nil)) != r.Header.Get("API-Sign") {
+		writeError(w, "EAPI:Invalid signature")
+		return false
+	}
+
+	// Nonces must always increase for the key
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if nonce <= s.nonce {
+		writeError(w, "EAPI:Invalid nonce")
+		return false
+	}
+	s.nonce = nonce
+	return true
+}
+
+func (s *Server) assetInfo(w http.ResponseWriter) {
+	result := map[string]interface{}{}
+	for code, a := range s.assets {
+		result[code] = map[string]interface{}{
+			"aclass":           "currency",
+			"altname":          a.altname,
+			"decimals":         a.decimals,
+			"display_decimals": 5,
+			"status":           "enabled",
+		}
+	}
+	writeResult(w, result)
+}
+
+func (s *Server) assetPairs(w http.ResponseWriter) {
+	result := map[string]interface{}{}
+	for key, p := range s.pairs {
+		result[key] = map[string]interface{}{
+			"altname":       p.altname,
+			"wsname":        p.wsname,
+			"aclass_base":   "currency",
+			"base":          p.base,
+			"aclass_quote":  "currency",
+			"quote":         p.quote,
+			"pair_decimals": p.pairDecimals,
+			"cost_decimals": 5,
+			"lot_decimals":  p.lotDecimals,
+			"ordermin":      p.orderMin.String(),
+			"costmin":       p.costMin.String(),
+			"tick_size":     p.tickSize.String(),
+			"status":        "online",
+		}
+	}
+	writeResult(w, result)
+}
+
+func (s *Server) ticker(w http.ResponseWriter, r *http.Request) {
+	p := s.findPair(r.Form.Get("pair"))
+	if p == nil {
+		writeError(w, "EQuery:Unknown asset pair")
+		return
+	}
+	writeResult(w, map[string]interface{}{p.key: s.tickerData(p, false)})
+}
+
+func (s *Server) publicTrades(w http.ResponseWriter, r *http.Request) {
+	p := s.findPair(r.Form.Get("pair"))
+	if p == nil {
+		writeError(w, "EQuery:Unknown asset pair")
+		return
+	}
+	price, _, _ := s.spread(p)
+
+	now := float64(time.Now().UnixNano()) / 1e9
+	trades := [][]interface{}{}
+	for i, vol := range []string{"0.01", "0.02", "0.03"} {
+		trades = append(trades, []interface{}{price.String(), vol, now, "b", "l", "", i + 1})
+	}
+	writeResult(w, map[string]interface{}{p.key: trades, "last": strconv.FormatInt(time.Now().UnixNano(), 10)})
+}
+
+func (s *Server) ohlc(w http.ResponseWriter, r *http.Request) {
+	p := s.findPair(r.Form.Get("pair"))
+	if p == nil {
+		writeError(w, "EQuery:Unknown asset pair")
+		return
+	}
+	key := p.key
+	last, _, _ := s.spread(p)
+	price, _ := last.Float64()
+
+	minutes := 1
+	if r.Form.Get("interval") != "" {
+		var err error
+		if minutes, err = strconv.Atoi(r.Form.Get("interval")); err != nil {
+			writeError(w, "EGeneral:Invalid arguments:interval")
+			return
+		}
+	}
+	step := time.Duration(minutes) * time.Minute
+	now := time.Now()
+
+	// Only the most recent 720 candles are served, oldest first
+	start := now.Add(-720 * step)
+	if since, err := strconv.ParseInt(r.Form.Get("since"), 10, 64); err == nil && time.Unix(since, 0).After(start) {
+		start = time.Unix(since, 0)
+	}
+	ts := start.Truncate(step)
+	if ts.Before(start) {
+		ts = ts.Add(step)
+	}
+
+	candles := [][]interface{}{}
+	for ; !ts.After(now); ts = ts.Add(step) {
+		wobble := float64(ts.Unix()/int64(step.Seconds())%7) / 1000
+		open := price * (1 - wobble)
+		close := price * (1 + wobble)
+		candles = append(candles, []interface{}{
+			ts.Unix(), format(open), format(close * 1.01), format(open * 0.99), format(close), format(price), "10", 1,
+		})
+	}
+	writeResult(w, map[string]interface{}{key: candles, "last": ts.Add(-step).Unix()})
+}
+
+func (s *Server) balanceEx(w http.ResponseWriter) {
+	curs := []types.CurrencyDTO{}
+	for _, code := range s.balances {
+		curs = append(curs, currency(code))
+	}
+
+	// The balance includes what open orders hold
+	result := map[string]interface{}{}
+	for _, wal := range s.exchange.Wallets(curs) {
+		result[wal.Currency.Symbol] = map[string]string{
+			"balance":    wal.Free.Add(wal.Locked).String(),
+			"hold_trade": wal.Locked.String(),
+		}
+	}
+	writeResult(w, result)
+}
+
+func (s *Server) tradeVolume(w http.ResponseWriter, r *http.Request) {
+	fees, makerFees := map[string]interface{}{}, map[string]interface{}{}
+	for _, name := range strings.Split(r.PostForm.Get("pair"), ",") {
+		p := s.findPair(name)
+		if p == nil {
+			continue
+		}
+		fees[p.key] = map[string]string{"fee": s.config.TakerFee.String()}
+		makerFees[p.key] = map[string]string{"fee": s.config.MakerFee.String()}
+	}
+	writeResult(w, map[string]interface{}{
+		"currency":   "ZUSD",
+		"volume":     "0.0000",
+		"fees":       fees,
+		"fees_maker": makerFees,
+	})
+}
+
+func (s *Server) addOrder(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p := s.findPair(r.PostForm.Get("pair"))
+	if p == nil {
+		writeError(w, "EQuery:Unknown asset pair")
+		return
+	}
+
+	o := &order{
+		pair:      p.key,
+		side:      r.PostForm.Get("type"),
+		orderType: r.PostForm.Get("ordertype"),
+		oflags:    r.PostForm.Get("oflags"),
+		opened:    time.Now(),
+	}
+	if o.side != "buy" && o.side != "sell" {
+		writeError(w, "EGeneral:Invalid arguments:type")
+		return
+	}
+	if userref, err := strconv.ParseInt(r.PostForm.Get("userref"), 10, 32); err == nil {
+		o.userref = int32(userref)
+	}
+	var err error
+	if o.volume, err = decimal.NewFromString(r.PostForm.Get("volume")); err != nil || !o.volume.IsPositive() {
+		writeError(w, "EGeneral:Invalid arguments:volume")
+		return
+	}
+
+	req := types.OrderRequestDTO{
+		Market:     s.market(p),
+		Type:       ord.Limit,
+		Side:       ord.Sell,
+		ForceMaker: hasFlag(o.oflags, "post"),
+	}
+	if o.side == "buy" {
+		req.Side = ord.Buy
+	}
+
+	_, bid, ask := s.spread(p)
+	price := o.price
+	switch o.orderType {
+	case "limit":
+		if o.price, err = decimal.NewFromString(r.PostForm.Get("price")); err != nil || !o.price.IsPositive() {
+			writeError(w, "EGeneral:Invalid arguments:price")
+			return
+		}
+		if !o.price.Mod(p.tickSize).IsZero() {
+			writeError(w, fmt.Sprintf("EOrder:Invalid price:%s price can only be specified up to %d decimals.", p.altname, p.pairDecimals))
+			return
+		}
+		price = o.price
+	case "market":
+		price = ask
+		if o.side == "sell" {
+			price = bid
+		}
+		if hasFlag(o.oflags, "viqc") {
+			// The volume was given in the quote currency
+			o.volume = o.volume.Div(price).Truncate(int32(p.lotDecimals))
+		}
+		req.Type = ord.Market
+	default:
+		writeError(w, "EGeneral:Invalid arguments:ordertype")
+		return
+	}
+	req.Price = o.price
+	req.Quantity = o.volume
+
+	// Check the order against the minimums
+	if o.volume.LessThan(p.orderMin) {
+		writeError(w, "EOrder:Order minimum not met")
+		return
+	}
+	if o.volume.Mul(price).LessThan(p.costMin) {
+		writeError(w, "EOrder:Cost minimum not met")
+		return
+	}
+
+	placed, err := s.exchange.AttemptOrder(req)
+	switch {
+	case errors.Is(err, types.ErrPostOnlyWouldCross):
+		writeError(w, "EOrder:Post only order")
+		return
+	case errors.Is(err, types.ErrInsufficientFunds):
+		writeError(w, "EOrder:Insufficient funds")
+		return
+	case err != nil:
+		writeError(w, "EGeneral:Invalid arguments")
+		return
+	}
+
+	o.txid = newID("O")
+	o.engineID = placed.ID
+	s.orders[o.txid] = o
+	s.engineIDs[o.engineID] = o
+	writeResult(w, map[string]interface{}{
+		"descr": map[string]string{"order": fmt.Sprintf("%s %s %s @ %s %s", o.side, o.volume, p.altname, o.orderType, o.price)},
+		"txid":  []string{o.txid},
+	})
+
+	go func() {
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.config.FillDelay / 2):
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.announce(o)
+	}()
+}
+
+// announce reports a new order as open on the private feeds, unless it was already announced
+func (s *Server) announce(o *order) {
+	if o.announced {
+		return
+	}
+	o.announced = true
+	s.reportOrder(o, map[string]interface{}{"status": "open"})
+}
+
+// onFill records a match the engine made as a trade and reports it on the private feeds
+func (s *Server) onFill(dto types.OrderDTO, f exchange.Fill) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.engineIDs[dto.ID]
+	if !ok {
+		return
+	}
+	s.announce(o)
+
+	t := &trade{
+		id:        newID("T"),
+		orderTxID: o.txid,
+		pair:      s.pairs[o.pair].wsname,
+		side:      o.side,
+		orderType: o.orderType,
+		price:     f.Price,
+		volume:    f.Quantity,
+		cost:      f.Cost,
+		fee:       f.Fee,
+		time:      time.Now(),
+	}
+	s.trades[t.id] = t
+	s.tradeLog = append(s.tradeLog, t.id)
+	o.trades = append(o.trades, t.id)
+
+	s.reportTrade(t)
+	if dto.Status == ord.Filled {
+		s.finish(o, dto)
+		return
+	}
+	s.reportOrder(o, map[string]interface{}{
+		"vol_exec":  dto.Filled.String(),
+		"cost":      dto.Paid.String(),
+		"fee":       dto.Fees.String(),
+		"avg_price": averagePrice(dto).String(),
+	})
+}
+
+// finish reports the order as closed or canceled
+func (s *Server) finish(o *order, dto types.OrderDTO) {
+	o.closed = time.Now()
+	update := map[string]interface{}{
+		"status":      status(o, dto),
+		"vol_exec":    dto.Filled.String(),
+		"cost":        dto.Paid.String(),
+		"fee":         dto.Fees.String(),
+		"avg_price":   averagePrice(dto).String(),
+		"lastupdated": timestamp(o.closed),
+	}
+	if dto.Status == ord.Canceled {
+		update["cancel_reason"] = "User requested"
+	}
+	s.reportOrder(o, update)
+}
+
+func (s *Server) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	o, ok := s.orders[r.PostForm.Get("txid")]
+	if !ok || s.exchange.CancelOrder(types.OrderDTO{ID: o.engineID}) != nil {
+		writeError(w, "EOrder:Unknown order")
+		return
+	}
+
+	s.announce(o)
+	s.finish(o, s.state(o))
+	writeResult(w, map[string]interface{}{"count": 1})
+}
+
+func (s *Server) queryOrders(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := map[string]interface{}{}
+	for _, txid := range strings.Split(r.PostForm.Get("txid"), ",") {
+		o, ok := s.orders[txid]
+		if !ok {
+			writeError(w, "EOrder:Unknown order")
+			return
+		}
+		result[txid] = s.orderInfo(o, s.state(o))
+	}
+	writeResult(w, result)
+}
+
+func (s *Server) listOrders(w http.ResponseWriter, r *http.Request, state string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	orders := map[string]interface{}{}
+	for txid, o := range s.orders {
+		dto := s.state(o)
+		if ord.IsDone(dto.Status) == (state == "open") {
+			continue
+		}
+		if ref := r.PostForm.Get("userref"); ref != "" && ref != strconv.FormatInt(int64(o.userref), 10) {
+			continue
+		}
+		orders[txid] = s.orderInfo(o, dto)
+	}
+	result := map[string]interface{}{state: orders}
+	if state == "closed" {
+		result["count"] = len(orders)
+	}
+	writeResult(w, result)
+}
+
+func (s *Server) webSocketsToken(w http.ResponseWriter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token := base64.StdEncoding.EncodeToString([]byte(uuid.New().String()))
+	s.tokens[token] = true
+	writeResult(w, map[string]interface{}{"token": token, "expires": 900})
+}
+
+// state is the engine's view of the order
+func (s *Server) state(o *order) types.OrderDTO {
+	dto, _ := s.exchange.Order(o.engineID)
+	return dto
+}
+
+func (s *Server) orderInfo(o *order, dto types.OrderDTO) map[string]interface{} {
+	p := s.pairs[o.pair]
+	price := "0"
+	if o.orderType == "limit" {
+		price = o.price.String()
+	}
+	info := map[string]interface{}{
+		"refid":   nil,
+		"userref": o.userref,
+		"status":  status(o, dto),
+		"opentm":  timestamp(o.opened),
+		"descr": map[string]string{
+			"pair":      p.altname,
+			"type":      o.side,
+			"ordertype": o.orderType,
+			"price":     price,
+			"price2":    "0",
+			"leverage":  "none",
+			"order":     fmt.Sprintf("%s %s %s @ %s %s", o.side, o.volume, p.altname, o.orderType, price),
+		},
+		"vol":      o.volume.String(),
+		"vol_exec": dto.Filled.String(),
+		"cost":     dto.Paid.String(),
+		"fee":      dto.Fees.String(),
+		"price":    averagePrice(dto).String(),
+		"oflags":   o.oflags,
+		"trades":   o.trades,
+	}
+	if !o.closed.IsZero() {
+		info["closetm"] = timestamp(o.closed)
+	}
+	return info
+}
+
+// status is the API's name for the order status. Orders stay pending until they are announced on the feeds.
+func status(o *order, dto types.OrderDTO) string {
+	switch {
+	case dto.Status == ord.Filled:
+		return "closed"
+	case dto.Status == ord.Canceled:
+		return "canceled"
+	case o.announced:
+		return "open"
+	}
+	return "pending"
+}
+
+func averagePrice(dto types.OrderDTO) decimal.Decimal {
+	if dto.Filled.IsZero() {
+		return decimal.Zero
+	}
+	return dto.Paid.Div(dto.Filled).Round(8)
+}
+
+// spread is the last price of the pair and the best bid and ask around it
+func (s *Server) spread(p *pair) (price decimal.Decimal, bid decimal.Decimal, ask decimal.Decimal) {
+	s.priceMtx.RLock()
+	defer s.priceMtx.RUnlock()
+	return p.price, p.price.Sub(p.tickSize), p.price.Add(p.tickSize)
+}
+
+// quote is the ticker the engine matches orders against
+func (s *Server) quote(mkt types.MarketDTO) (types.TickerDTO, error) {
+	p, ok := s.pairs[mkt.Name]
+	if !ok {
+		return types.TickerDTO{}, types.ErrInvalidRequest
+	}
+	price, bid, ask := s.spread(p)
+	return types.TickerDTO{Ask: ask, Bid: bid, Price: price, Timestamp: time.Now()}, nil
+}
+
+// market describes the pair to the engine
+func (s *Server) market(p *pair) types.MarketDTO {
+	base := currency(p.base)
+	base.Increment = decimal.New(1, int32(-p.lotDecimals))
+	return types.MarketDTO{Name: p.key, BaseCurrency: base, QuoteCurrency: currency(p.quote)}
+}
+
+func currency(code string) types.CurrencyDTO {
+	return types.CurrencyDTO{Name: code, Symbol: code, Precision: 8, Increment: decimal.New(1, -8)}
+}
+
+// tickerData is the ticker of the pair as the REST API sends it, or the websocket feed if streamed
+func (s *Server) tickerData(p *pair, streamed bool) map[string]interface{} {
+	price, bid, ask := s.spread(p)
+	var lot interface{} = "1"
+	if streamed {
+		// The feed sends whole lot volumes as numbers
+		lot = 1
+	}
+	return map[string]interface{}{
+		"a": []interface{}{ask.String(), lot, "1.00000000"},
+		"b": []interface{}{bid.String(), lot, "1.00000000"},
+		"c": []interface{}{price.String(), "0.01000000"},
+		"v": []interface{}{"100.00000000", "1000.00000000"},
+		"p": []interface{}{price.String(), price.String()},
+		"t": []interface{}{10, 100},
+		"l": []interface{}{price.String(), price.String()},
+		"h": []interface{}{price.String(), price.String()},
+		"o": []interface{}{price.String(), price.String()},
+	}
+}
+
+var decimalHundred = decimal.NewFromInt(100)
+
+func hasFlag(oflags string, flag string) bool {
+	for _, f := range strings.Split(oflags, ",") {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// newID makes an id in Kraken's style, e.g. OQCLML-BW3P3-BUCMWZ
+func newID(prefix string) string {
+	raw := strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", ""))
+	return prefix + raw[:5] + "-" + raw[5:10] + "-" + raw[10:16]
+}
+
+func timestamp(t time.Time) float64 {
+	return math.Round(float64(t.UnixNano())/1e3) / 1e6
+}
+
+// timestampString is a timestamp the way the feeds send it
+func timestampString(t time.Time) string {
+	return strconv.FormatFloat(timestamp(t), 'f', 6, 64)
+}
+
+func format(f float64) string {
+	return strconv.FormatFloat(f, 'f', 8, 64)
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": []string{}, "result": result})
+}
+
+// writeError reports an error the way Kraken does, with a successful status and an error list
+func writeError(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": []string{message}})
+}
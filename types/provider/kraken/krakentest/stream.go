@@ -0,0 +1,334 @@
+package krakentest
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	ws "github.com/gorilla/websocket"
+	"github.com/sinisterminister/currencytrader/types"
+	ord "github.com/sinisterminister/currencytrader/types/order"
+)
+
+type streamConn struct {
+	conn    *ws.Conn
+	private bool
+
+	mutex    sync.Mutex
+	pairs    map[string]bool
+	channels map[string]bool
+	sequence map[string]int
+}
+
+type streamRequest struct {
+	Event        string   `json:"event"`
+	RequestID    int64    `json:"reqid"`
+	Pairs        []string `json:"pair"`
+	Subscription struct {
+		Name  string `json:"name"`
+		Token string `json:"token"`
+	} `json:"subscription"`
+}
+
+// Disconnect drops every feed connection, as if the exchange had hung up
+func (s *Server) Disconnect() {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		conn.conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// Subscribed reports whether any public connection is subscribed to the ticker of the pair, given by its websocket name
+func (s *Server) Subscribed(wsname string) bool {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		if conn.subscribed(wsname) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrivateConnects reports how many times a private connection has subscribed to openOrders
+func (s *Server) PrivateConnects() int {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	return s.privateConnects
+}
+
+// ExpireTokens invalidates every websocket token. Connections that are already subscribed stay up.
+func (s *Server) ExpireTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = make(map[string]bool)
+}
+
+func (s *Server) handlePublicStream(w http.ResponseWriter, r *http.Request) {
+	s.handleStream(w, r, false)
+}
+
+func (s *Server) handlePrivateStream(w http.ResponseWriter, r *http.Request) {
+	s.handleStream(w, r, true)
+}
+
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request, private bool) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	sc := &streamConn{
+		conn:     conn,
+		private:  private,
+		pairs:    make(map[string]bool),
+		channels: make(map[string]bool),
+		sequence: make(map[string]int),
+	}
+	s.register(sc)
+	defer s.unregister(sc)
+
+	sc.write(map[string]interface{}{"event": "systemStatus", "status": "online", "version": "1.9.0"})
+	for {
+		var req streamRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+
+		switch {
+		case req.Event == "ping":
+			sc.write(map[string]interface{}{"event": "pong", "reqid": req.RequestID})
+		case (req.Event == "subscribe" || req.Event == "unsubscribe") && private:
+			s.handlePrivateSubscription(sc, req)
+		case req.Event == "subscribe" || req.Event == "unsubscribe":
+			s.handleTickerSubscription(sc, req)
+		default:
+			sc.write(map[string]interface{}{"event": "error", "errorMessage": "Unsupported event", "reqid": req.RequestID})
+		}
+	}
+}
+
+func (s *Server) handleTickerSubscription(sc *streamConn, req streamRequest) {
+	status := req.Event + "d"
+	for _, wsname := range req.Pairs {
+		p := s.findPair(wsname)
+
+		msg := map[string]interface{}{
+			"event":        "subscriptionStatus",
+			"reqid":        req.RequestID,
+			"pair":         wsname,
+			"subscription": map[string]string{"name": req.Subscription.Name},
+		}
+		if p == nil || p.wsname != wsname || req.Subscription.Name != "ticker" {
+			msg["status"] = "error"
+			msg["errorMessage"] = "Currency pair not supported " + wsname
+			sc.write(msg)
+			continue
+		}
+
+		sc.mutex.Lock()
+		if req.Event == "subscribe" {
+			sc.pairs[wsname] = true
+		} else {
+			delete(sc.pairs, wsname)
+		}
+		sc.mutex.Unlock()
+
+		msg["status"] = status
+		msg["channelID"] = p.channelID
+		msg["channelName"] = "ticker"
+		sc.write(msg)
+	}
+}
+
+func (s *Server) handlePrivateSubscription(sc *streamConn, req streamRequest) {
+	name := req.Subscription.Name
+	msg := map[string]interface{}{
+		"event":        "subscriptionStatus",
+		"reqid":        req.RequestID,
+		"channelName":  name,
+		"subscription": map[string]string{"name": name},
+	}
+
+	s.mutex.Lock()
+	valid := s.tokens[req.Subscription.Token]
+	s.mutex.Unlock()
+	if !valid {
+		msg["status"] = "error"
+		msg["errorMessage"] = "ESession:Invalid session"
+		sc.write(msg)
+		return
+	}
+	if name != "openOrders" && name != "ownTrades" {
+		msg["status"] = "error"
+		msg["errorMessage"] = "Subscription name invalid"
+		sc.write(msg)
+		return
+	}
+
+	if req.Event == "unsubscribe" {
+		sc.mutex.Lock()
+		delete(sc.channels, name)
+		sc.mutex.Unlock()
+		msg["status"] = "unsubscribed"
+		sc.write(msg)
+		return
+	}
+
+	// Hold the exchange while subscribing so the snapshot and the updates after it line up
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sc.mutex.Lock()
+	sc.channels[name] = true
+	sc.mutex.Unlock()
+	msg["status"] = "subscribed"
+	sc.write(msg)
+
+	// Both feeds start with a snapshot: the open orders, or the most recent trades
+	items := []map[string]interface{}{}
+	if name == "openOrders" {
+		for txid, o := range s.orders {
+			if dto := s.state(o); !ord.IsDone(dto.Status) {
+				items = append(items, map[string]interface{}{txid: s.streamOrderInfo(o, dto)})
+			}
+		}
+
+		s.streamMtx.Lock()
+		s.privateConnects++
+		s.streamMtx.Unlock()
+	} else {
+		start := len(s.tradeLog) - 50
+		if start < 0 {
+			start = 0
+		}
+		for _, id := range s.tradeLog[start:] {
+			items = append(items, map[string]interface{}{id: s.trades[id].info()})
+		}
+	}
+	sc.publish(name, items)
+}
+
+func (s *Server) register(sc *streamConn) {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	s.conns[sc] = true
+}
+
+func (s *Server) unregister(sc *streamConn) {
+	s.streamMtx.Lock()
+	delete(s.conns, sc)
+	s.streamMtx.Unlock()
+	sc.conn.Close()
+}
+
+func (sc *streamConn) subscribed(wsname string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.pairs[wsname]
+}
+
+func (sc *streamConn) hasChannel(name string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.channels[name]
+}
+
+// publish sends private channel data as [data, channelName, {sequence}]
+func (sc *streamConn) publish(channel string, items []map[string]interface{}) {
+	sc.mutex.Lock()
+	sc.sequence[channel]++
+	seq := sc.sequence[channel]
+	sc.mutex.Unlock()
+	sc.write([]interface{}{items, channel, map[string]int{"sequence": seq}})
+}
+
+func (sc *streamConn) write(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	sc.conn.WriteMessage(ws.TextMessage, data)
+}
+
+// reportOrder sends an openOrders update to every private connection
+func (s *Server) reportOrder(o *order, update map[string]interface{}) {
+	s.publishPrivate("openOrders", map[string]interface{}{o.txid: update})
+}
+
+// reportTrade sends an ownTrades update to every private connection
+func (s *Server) reportTrade(t *trade) {
+	s.publishPrivate("ownTrades", map[string]interface{}{t.id: t.info()})
+}
+
+func (s *Server) publishPrivate(channel string, item map[string]interface{}) {
+	s.streamMtx.Lock()
+	defer s.streamMtx.Unlock()
+	for conn := range s.conns {
+		if conn.private && conn.hasChannel(channel) {
+			conn.publish(channel, []map[string]interface{}{item})
+		}
+	}
+}
+
+// streamOrderInfo is the full order as the openOrders snapshot sends it
+func (s *Server) streamOrderInfo(o *order, dto types.OrderDTO) map[string]interface{} {
+	info := s.orderInfo(o, dto)
+	p := s.pairs[o.pair]
+	info["descr"].(map[string]string)["pair"] = p.wsname
+	info["avg_price"] = info["price"]
+	delete(info, "price")
+	delete(info, "trades")
+	return info
+}
+
+func (t *trade) info() map[string]interface{} {
+	return map[string]interface{}{
+		"ordertxid": t.orderTxID,
+		"postxid":   newID("T"),
+		"pair":      t.pair,
+		"time":      timestampString(t.time),
+		"type":      t.side,
+		"ordertype": t.orderType,
+		"price":     t.price.String(),
+		"cost":      t.cost.String(),
+		"fee":       t.fee.String(),
+		"vol":       t.volume.String(),
+		"margin":    "0.00000",
+	}
+}
+
+func (s *Server) publishTickers() {
+	ticker := time.NewTicker(s.config.TickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		msgs := map[string]interface{}{}
+		for _, p := range s.pairs {
+			msgs[p.wsname] = []interface{}{p.channelID, s.tickerData(p, true), "ticker", p.wsname}
+		}
+
+		s.streamMtx.Lock()
+		for conn := range s.conns {
+			for wsname, msg := range msgs {
+				if conn.subscribed(wsname) {
+					conn.write(msg)
+				}
+			}
+		}
+		s.streamMtx.Unlock()
+	}
+}
@@ -0,0 +1,215 @@
+package kraken
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken/client"
+)
+
+// Kraken still lists its oldest assets with a class prefix, X for crypto and Z for fiat, and
+// calls a couple of them by names nobody else uses. These map onto the common symbols.
+var legacyAssets = map[string]string{
+	"XXBT": "BTC", "XBT": "BTC",
+	"XXDG": "DOGE", "XDG": "DOGE",
+	"XETC": "ETC", "XETH": "ETH", "XLTC": "LTC", "XMLN": "MLN", "XREP": "REP",
+	"XXLM": "XLM", "XXMR": "XMR", "XXRP": "XRP", "XZEC": "ZEC",
+	"ZAUD": "AUD", "ZCAD": "CAD", "ZCHF": "CHF", "ZEUR": "EUR", "ZGBP": "GBP", "ZJPY": "JPY", "ZUSD": "USD",
+}
+
+// NormalizeAsset returns the common symbol for a Kraken asset code, e.g. XXBT and XBT become BTC.
+// Suffixes Kraken uses for staked and opt-in reward balances are kept, so XBT.M becomes BTC.M.
+func NormalizeAsset(asset string) string {
+	asset = strings.ToUpper(asset)
+	suffix := ""
+	if i := strings.Index(asset, "."); i >= 0 {
+		asset, suffix = asset[:i], asset[i:]
+	}
+	if symbol, ok := legacyAssets[asset]; ok {
+		asset = symbol
+	}
+	return asset + suffix
+}
+
+// NormalizePair returns the common name for a pair in the BASE/QUOTE form Kraken uses on its
+// websockets, e.g. XBT/USD becomes BTC/USD. Market names use this form.
+func NormalizePair(wsname string) string {
+	parts := strings.SplitN(wsname, "/", 2)
+	if len(parts) != 2 {
+		return strings.ToUpper(wsname)
+	}
+	return NormalizeAsset(parts[0]) + "/" + NormalizeAsset(parts[1])
+}
+
+// pair is a tradable asset pair along with the names the API knows it by
+type pair struct {
+	key     string
+	altname string
+	wsname  string
+	market  types.MarketDTO
+}
+
+// pairCache holds the assets and pairs of the exchange so any name for a pair, Kraken's or
+// the normalized one, can be turned into the names each API call expects
+type pairCache struct {
+	client *client.Client
+
+	mutex      sync.RWMutex
+	loaded     bool
+	currencies []types.CurrencyDTO
+	assets     map[string]types.CurrencyDTO
+	markets    []types.MarketDTO
+	pairs      map[string]pair
+}
+
+func newPairCache(c *client.Client) *pairCache {
+	return &pairCache{client: c}
+}
+
+// refresh reloads the assets and pairs from the API
+func (c *pairCache) refresh(ctx context.Context) error {
+	rawAssets, err := c.client.WithContext(ctx).Assets()
+	if err != nil {
+		return err
+	}
+
+	rawPairs, err := c.client.WithContext(ctx).AssetPairs()
+	if err != nil {
+		return err
+	}
+
+	assets := map[string]types.CurrencyDTO{}
+	currencies := []types.CurrencyDTO{}
+	for code, asset := range rawAssets {
+		cur := getCurrency(code, asset.Decimals)
+		assets[code] = cur
+		assets[asset.AltName] = cur
+		currencies = append(currencies, cur)
+	}
+	sort.Slice(currencies, func(i, j int) bool { return currencies[i].Symbol < currencies[j].Symbol })
+
+	pairs := map[string]pair{}
+	markets := []types.MarketDTO{}
+	for key, raw := range rawPairs {
+		if raw.Status != "" && raw.Status != "online" {
+			continue
+		}
+		base, ok := assets[raw.Base]
+		if !ok {
+			base = getCurrency(raw.Base, raw.LotDecimals)
+		}
+		quote, ok := assets[raw.Quote]
+		if !ok {
+			quote = getCurrency(raw.Quote, raw.PairDecimals)
+		}
+
+		p := pair{key: key, altname: raw.AltName, wsname: raw.WSName, market: getMarket(raw, base, quote)}
+		for _, name := range []string{p.market.Name, key, raw.AltName, raw.WSName} {
+			if name != "" {
+				pairs[name] = p
+			}
+		}
+		markets = append(markets, p.market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i].Name < markets[j].Name })
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.loaded = true
+	c.assets = assets
+	c.currencies = currencies
+	c.markets = markets
+	c.pairs = pairs
+	return nil
+}
+
+func (c *pairCache) ensureLoaded(ctx context.Context) error {
+	c.mutex.RLock()
+	loaded := c.loaded
+	c.mutex.RUnlock()
+	if loaded {
+		return nil
+	}
+	return c.refresh(ctx)
+}
+
+// pair finds a pair by any of its names
+func (c *pairCache) pair(ctx context.Context, name string) (pair, error) {
+	if err := c.ensureLoaded(ctx); err != nil {
+		return pair{}, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	p, ok := c.pairs[name]
+	if !ok {
+		p, ok = c.pairs[NormalizePair(name)]
+	}
+	if !ok {
+		return pair{}, fmt.Errorf("%w: unknown kraken pair %s", types.ErrInvalidRequest, name)
+	}
+	return p, nil
+}
+
+// currency finds an asset by its code or alternate name
+func (c *pairCache) currency(ctx context.Context, asset string) (types.CurrencyDTO, error) {
+	if err := c.ensureLoaded(ctx); err != nil {
+		return types.CurrencyDTO{}, err
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if cur, ok := c.assets[asset]; ok {
+		return cur, nil
+	}
+
+	// Balances can hold variants of an asset, like staked ones, that aren't listed on their own
+	return getCurrency(asset, 8), nil
+}
+
+func (c *pairCache) allCurrencies() []types.CurrencyDTO {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return append([]types.CurrencyDTO{}, c.currencies...)
+}
+
+func (c *pairCache) allMarkets() []types.MarketDTO {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return append([]types.MarketDTO{}, c.markets...)
+}
+
+func getCurrency(asset string, decimals int) types.CurrencyDTO {
+	symbol := NormalizeAsset(asset)
+	return types.CurrencyDTO{
+		Name:      symbol,
+		Symbol:    symbol,
+		Precision: decimals,
+		Increment: decimal.New(1, int32(-decimals)),
+	}
+}
+
+// getMarket maps an asset pair and its order minimums onto a market named BASE/QUOTE
+func getMarket(raw client.AssetPair, base types.CurrencyDTO, quote types.CurrencyDTO) types.MarketDTO {
+	tick := raw.TickSize
+	if !tick.IsPositive() {
+		tick = decimal.New(1, int32(-raw.PairDecimals))
+	}
+
+	// Kraken has no price or size ceilings, so those are left unset
+	return types.MarketDTO{
+		Name:             base.Symbol + "/" + quote.Symbol,
+		BaseCurrency:     base,
+		QuoteCurrency:    quote,
+		MinPrice:         tick,
+		PriceIncrement:   tick,
+		MinQuantity:      raw.OrderMin,
+		QuantityStepSize: decimal.New(1, int32(-raw.LotDecimals)),
+		MinFunds:         raw.CostMin,
+	}
+}
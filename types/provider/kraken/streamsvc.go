@@ -0,0 +1,520 @@
+package kraken
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/internal/socket"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken/client"
+	"github.com/spf13/viper"
+)
+
+// snapshotFunc fetches the current state of an order
+type snapshotFunc func(types.OrderDTO) (types.OrderDTO, error)
+
+type streamSvc struct {
+	log      log.Entry
+	stop     <-chan bool
+	group    *lifecycle.Group
+	client   *client.Client
+	snapshot snapshotFunc
+
+	market    *socket.Socket
+	requestID int64
+
+	// Ticker streams are keyed by the websocket name of their pair
+	tickerMtx     sync.Mutex
+	tickerStreams map[string]map[chan types.TickerDTO]bool
+
+	user     *socket.Socket
+	userOnce sync.Once
+	tokenMtx sync.Mutex
+	token    string
+
+	orderMtx sync.Mutex
+	orders   map[string]*orderState
+}
+
+type orderState struct {
+	mutex   sync.Mutex
+	dto     types.OrderDTO
+	fills   map[string]fill
+	streams []*orderStream
+}
+
+type orderStream struct {
+	once   sync.Once
+	stream chan types.OrderDTO
+}
+
+func (s *orderStream) close() {
+	s.once.Do(func() { close(s.stream) })
+}
+
+// fill is a single trade against an order, keyed by trade id so it is only counted once
+type fill struct {
+	volume decimal.Decimal
+	cost   decimal.Decimal
+	fee    decimal.Decimal
+}
+
+type subscribeRequest struct {
+	Event        string       `json:"event"`
+	RequestID    int64        `json:"reqid"`
+	Pairs        []string     `json:"pair,omitempty"`
+	Subscription subscription `json:"subscription"`
+}
+
+type subscription struct {
+	Name  string `json:"name"`
+	Token string `json:"token,omitempty"`
+}
+
+// event is any message sent as an object rather than channel data
+type event struct {
+	Event        string       `json:"event"`
+	Status       string       `json:"status"`
+	Pair         string       `json:"pair"`
+	ErrorMessage string       `json:"errorMessage"`
+	Subscription subscription `json:"subscription"`
+}
+
+// tickerData values are arrays: price followed by volumes, or today's value followed by the last 24 hours
+type tickerData struct {
+	Ask    []decimal.Decimal `json:"a"`
+	Bid    []decimal.Decimal `json:"b"`
+	Last   []decimal.Decimal `json:"c"`
+	Volume []decimal.Decimal `json:"v"`
+}
+
+// openOrder is an order on the openOrders feed. Updates only carry the fields that changed.
+type openOrder struct {
+	Status     string              `json:"status"`
+	VolumeExec decimal.NullDecimal `json:"vol_exec"`
+	Cost       decimal.NullDecimal `json:"cost"`
+	Fee        decimal.NullDecimal `json:"fee"`
+}
+
+type ownTrade struct {
+	OrderTxID string          `json:"ordertxid"`
+	Volume    decimal.Decimal `json:"vol"`
+	Cost      decimal.Decimal `json:"cost"`
+	Fee       decimal.Decimal `json:"fee"`
+}
+
+// socketConfig sets up the market and user sockets
+var socketConfig = socket.Config{Source: "kraken", ReconnectDelayKey: "kraken.websocket.reconnectDelay"}
+
+func newStreamSvc(stop <-chan bool, group *lifecycle.Group, c *client.Client, snapshot snapshotFunc) *streamSvc {
+	svc := &streamSvc{
+		log:           log.WithField("source", "kraken.streamSvc"),
+		stop:          stop,
+		group:         group,
+		client:        c,
+		snapshot:      snapshot,
+		tickerStreams: make(map[string]map[chan types.TickerDTO]bool),
+		orders:        make(map[string]*orderState),
+	}
+
+	svc.market = socket.New(stop, "marketSocket", socketConfig, func() (string, error) {
+		return viper.GetString("kraken.websocketURL"), nil
+	}, svc.resubscribe, svc.handleMarketMessage)
+	svc.group.Go(svc.market.Run)
+
+	svc.user = socket.New(stop, "userSocket", socketConfig, svc.userStreamURL, svc.subscribeUser, svc.handleUserMessage)
+
+	return svc
+}
+
+func (svc *streamSvc) TickerStream(stop <-chan bool, wsname string) <-chan types.TickerDTO {
+	stream := make(chan types.TickerDTO, viper.GetInt("kraken.streams.tickerStreamBufferSize"))
+
+	svc.tickerMtx.Lock()
+	streams, ok := svc.tickerStreams[wsname]
+	if !ok {
+		streams = make(map[chan types.TickerDTO]bool)
+		svc.tickerStreams[wsname] = streams
+
+		// The subscription is retried on reconnect if the socket isn't up yet
+		if err := svc.subscribe("subscribe", wsname); err != nil {
+			svc.log.WithError(err).Debugf("deferring ticker subscription for %s", wsname)
+		}
+	}
+	streams[stream] = true
+	svc.tickerMtx.Unlock()
+
+	svc.group.Go(func() {
+		select {
+		case <-stop:
+		case <-svc.stop:
+		}
+
+		svc.tickerMtx.Lock()
+		defer svc.tickerMtx.Unlock()
+		delete(streams, stream)
+		close(stream)
+
+		if len(streams) == 0 {
+			delete(svc.tickerStreams, wsname)
+			svc.subscribe("unsubscribe", wsname)
+		}
+	})
+
+	return stream
+}
+
+func (svc *streamSvc) subscribe(evt string, pairs ...string) error {
+	return svc.market.Send(subscribeRequest{
+		Event:        evt,
+		RequestID:    atomic.AddInt64(&svc.requestID, 1),
+		Pairs:        pairs,
+		Subscription: subscription{Name: "ticker"},
+	})
+}
+
+// resubscribe restores the ticker subscriptions on a fresh connection
+func (svc *streamSvc) resubscribe() error {
+	svc.tickerMtx.Lock()
+	defer svc.tickerMtx.Unlock()
+
+	pairs := []string{}
+	for wsname := range svc.tickerStreams {
+		pairs = append(pairs, wsname)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	return svc.subscribe("subscribe", pairs...)
+}
+
+func (svc *streamSvc) handleMarketMessage(msg []byte) {
+	// Channel data comes as [channelID, data, channelName, pair]; anything else is an event
+	var fields []json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		var evt event
+		if err := json.Unmarshal(msg, &evt); err == nil && evt.Status == "error" {
+			svc.log.Warnf("ticker subscription for %s failed: %s", evt.Pair, evt.ErrorMessage)
+		}
+		return
+	}
+	if len(fields) < 4 {
+		return
+	}
+
+	var channel, wsname string
+	if json.Unmarshal(fields[len(fields)-2], &channel) != nil || channel != "ticker" {
+		return
+	}
+	if err := json.Unmarshal(fields[len(fields)-1], &wsname); err != nil {
+		return
+	}
+
+	var raw tickerData
+	if err := json.Unmarshal(fields[1], &raw); err != nil || len(raw.Ask) == 0 || len(raw.Bid) == 0 || len(raw.Last) < 2 || len(raw.Volume) < 2 {
+		svc.log.WithError(err).Warn("could not parse ticker message")
+		return
+	}
+	tkr := types.TickerDTO{
+		Ask:       raw.Ask[0],
+		Bid:       raw.Bid[0],
+		Price:     raw.Last[0],
+		Quantity:  raw.Last[1],
+		Timestamp: time.Now(),
+		Volume:    raw.Volume[1],
+	}
+
+	svc.tickerMtx.Lock()
+	defer svc.tickerMtx.Unlock()
+	for stream := range svc.tickerStreams[wsname] {
+		select {
+		case stream <- tkr:
+		default:
+			svc.log.Warnf("skipping blocked ticker stream for %s", wsname)
+		}
+	}
+}
+
+// startUserStream connects to the private feeds the first time orders are involved
+func (svc *streamSvc) startUserStream() {
+	svc.userOnce.Do(func() {
+		svc.group.Go(svc.user.Run)
+	})
+}
+
+// userStreamURL fetches a fresh token for every connection since tokens expire if unused
+func (svc *streamSvc) userStreamURL() (string, error) {
+	token, err := svc.client.GetWebSocketsToken()
+	if err != nil {
+		return "", err
+	}
+
+	svc.tokenMtx.Lock()
+	svc.token = token
+	svc.tokenMtx.Unlock()
+	return viper.GetString("kraken.authWebsocketURL"), nil
+}
+
+func (svc *streamSvc) subscribeUser() error {
+	svc.tokenMtx.Lock()
+	token := svc.token
+	svc.tokenMtx.Unlock()
+
+	for _, name := range []string{"ownTrades", "openOrders"} {
+		err := svc.user.Send(subscribeRequest{
+			Event:        "subscribe",
+			RequestID:    atomic.AddInt64(&svc.requestID, 1),
+			Subscription: subscription{Name: name, Token: token},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Catch every tracked order up on anything missed while disconnected
+	svc.orderMtx.Lock()
+	defer svc.orderMtx.Unlock()
+	for _, state := range svc.orders {
+		go svc.refreshOrder(state)
+	}
+	return nil
+}
+
+func (svc *streamSvc) handleUserMessage(msg []byte) {
+	// Channel data comes as [data, channelName, {sequence}]; anything else is an event
+	var fields []json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		var evt event
+		if err := json.Unmarshal(msg, &evt); err == nil && evt.Status == "error" {
+			// Reconnecting fetches a new token
+			svc.log.Warnf("%s subscription failed: %s; reconnecting", evt.Subscription.Name, evt.ErrorMessage)
+			svc.user.Close()
+		}
+		return
+	}
+	if len(fields) < 2 {
+		return
+	}
+
+	var channel string
+	if err := json.Unmarshal(fields[1], &channel); err != nil {
+		return
+	}
+
+	switch channel {
+	case "openOrders":
+		var updates []map[string]openOrder
+		if err := json.Unmarshal(fields[0], &updates); err != nil {
+			svc.log.WithError(err).Warn("could not parse openOrders message")
+			return
+		}
+		for _, update := range updates {
+			for txid, o := range update {
+				svc.handleOpenOrder(txid, o)
+			}
+		}
+	case "ownTrades":
+		var trades []map[string]ownTrade
+		if err := json.Unmarshal(fields[0], &trades); err != nil {
+			svc.log.WithError(err).Warn("could not parse ownTrades message")
+			return
+		}
+		for _, trade := range trades {
+			for id, t := range trade {
+				svc.handleOwnTrade(id, t)
+			}
+		}
+	}
+}
+
+func (svc *streamSvc) handleOpenOrder(txid string, o openOrder) {
+	state := svc.state(txid)
+	if state == nil {
+		return
+	}
+
+	state.apply(func(dto types.OrderDTO) types.OrderDTO {
+		if o.VolumeExec.Valid {
+			dto.Filled = o.VolumeExec.Decimal
+		}
+		if o.Cost.Valid {
+			dto.Paid = o.Cost.Decimal
+		}
+		if o.Fee.Valid {
+			dto.Fees = o.Fee.Decimal
+		}
+		if o.Status != "" {
+			dto.Status = getStatus(o.Status, dto.Filled)
+		}
+		return dto
+	}, nil)
+	svc.forgetIfDone(txid, state)
+}
+
+func (svc *streamSvc) handleOwnTrade(id string, t ownTrade) {
+	state := svc.state(t.OrderTxID)
+	if state == nil {
+		return
+	}
+
+	state.apply(func(dto types.OrderDTO) types.OrderDTO { return dto }, map[string]fill{
+		id: {volume: t.Volume, cost: t.Cost, fee: t.Fee},
+	})
+}
+
+func (svc *streamSvc) state(txid string) *orderState {
+	svc.orderMtx.Lock()
+	defer svc.orderMtx.Unlock()
+	return svc.orders[txid]
+}
+
+func (svc *streamSvc) OrderStream(stop <-chan bool, dto types.OrderDTO) <-chan types.OrderDTO {
+	svc.startUserStream()
+
+	svc.orderMtx.Lock()
+	state, ok := svc.orders[dto.ID]
+	if !ok {
+		state = &orderState{dto: dto, fills: make(map[string]fill)}
+		svc.orders[dto.ID] = state
+	}
+	svc.orderMtx.Unlock()
+
+	s := &orderStream{stream: make(chan types.OrderDTO, viper.GetInt("kraken.streams.orderStreamBufferSize"))}
+	state.mutex.Lock()
+	s.stream <- state.dto
+	if order.IsDone(state.dto.Status) {
+		s.close()
+	} else {
+		state.streams = append(state.streams, s)
+	}
+	state.mutex.Unlock()
+
+	svc.group.Go(func() {
+		select {
+		case <-stop:
+		case <-svc.stop:
+		}
+		state.mutex.Lock()
+		filtered := state.streams[:0]
+		for _, c := range state.streams {
+			if c != s {
+				filtered = append(filtered, c)
+			}
+		}
+		state.streams = filtered
+		remaining := len(filtered)
+		state.mutex.Unlock()
+		s.close()
+
+		if remaining == 0 {
+			svc.orderMtx.Lock()
+			if svc.orders[dto.ID] == state {
+				delete(svc.orders, dto.ID)
+			}
+			svc.orderMtx.Unlock()
+		}
+	})
+
+	// Catch the stream up on anything that happened before it was tracked
+	go svc.refreshOrder(state)
+
+	return s.stream
+}
+
+func (svc *streamSvc) refreshOrder(state *orderState) {
+	state.mutex.Lock()
+	dto := state.dto
+	state.mutex.Unlock()
+
+	snapshot, err := svc.snapshot(dto)
+	if err != nil {
+		svc.log.WithError(err).Warnf("could not get snapshot for order %s", dto.ID)
+		return
+	}
+
+	state.apply(func(types.OrderDTO) types.OrderDTO { return snapshot }, nil)
+	svc.forgetIfDone(dto.ID, state)
+}
+
+func (svc *streamSvc) forgetIfDone(id string, state *orderState) {
+	state.mutex.Lock()
+	done := order.IsDone(state.dto.Status)
+	state.mutex.Unlock()
+	if !done {
+		return
+	}
+
+	svc.orderMtx.Lock()
+	defer svc.orderMtx.Unlock()
+	if svc.orders[id] == state {
+		delete(svc.orders, id)
+	}
+}
+
+// apply folds an update into the order and publishes it if anything changed. Snapshots and
+// both feeds can cross, so an update never moves the order backwards.
+func (state *orderState) apply(update func(types.OrderDTO) types.OrderDTO, fills map[string]fill) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	current := state.dto
+	if order.IsDone(current.Status) {
+		return
+	}
+
+	next := update(current)
+	next.ID = current.ID
+	next.Market = current.Market
+
+	// Trades can arrive ahead of the order update that counts them
+	for id, f := range fills {
+		state.fills[id] = f
+	}
+	volume, cost, fees := decimal.Zero, decimal.Zero, decimal.Zero
+	for _, f := range state.fills {
+		volume = volume.Add(f.volume)
+		cost = cost.Add(f.cost)
+		fees = fees.Add(f.fee)
+	}
+	if volume.GreaterThan(next.Filled) {
+		next.Filled, next.Paid = volume, cost
+	}
+	if next.Filled.LessThan(current.Filled) {
+		next.Filled, next.Paid = current.Filled, current.Paid
+	}
+	next.Fees = decimal.Max(next.Fees, current.Fees, fees)
+
+	if !order.IsDone(next.Status) {
+		next.Status = current.Status
+		if next.Filled.IsPositive() {
+			next.Status = order.Partial
+		}
+	}
+
+	changed := next.Status != current.Status || !next.Filled.Equal(current.Filled) || !next.Fees.Equal(current.Fees)
+	state.dto = next
+	if !changed {
+		return
+	}
+
+	done := order.IsDone(next.Status)
+	for _, s := range state.streams {
+		select {
+		case s.stream <- next:
+		default:
+			log.Warn("skipping blocked order update channel")
+		}
+		if done {
+			s.close()
+		}
+	}
+	if done {
+		state.streams = nil
+	}
+}
@@ -0,0 +1,123 @@
+package kraken
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/kraken/client"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+// OHLC intervals supported by the API, in minutes
+var intervals = map[time.Duration]int{
+	time.Minute:         1,
+	5 * time.Minute:     5,
+	15 * time.Minute:    15,
+	30 * time.Minute:    30,
+	time.Hour:           60,
+	4 * time.Hour:       240,
+	24 * time.Hour:      1440,
+	7 * 24 * time.Hour:  10080,
+	15 * 24 * time.Hour: 21600,
+}
+
+func getInterval(interval types.CandleInterval) (int, time.Duration, error) {
+	granularity, err := time.ParseDuration(string(interval))
+	if err != nil {
+		return 0, 0, err
+	}
+	minutes, ok := intervals[granularity]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: candle interval %s is not supported", types.ErrInvalidRequest, interval)
+	}
+	return minutes, granularity, nil
+}
+
+func getStatus(status string, filled decimal.Decimal) types.OrderStatus {
+	switch status {
+	case "pending", "open":
+		if filled.IsPositive() {
+			return order.Partial
+		}
+		return order.Pending
+	case "closed":
+		return order.Filled
+	case "canceled":
+		return order.Canceled
+	case "expired":
+		return order.Expired
+	}
+	return order.Unknown
+}
+
+func getType(typ string) types.OrderType {
+	if typ == "market" {
+		return order.Market
+	}
+	return order.Limit
+}
+
+func getSide(side string) types.OrderSide {
+	if side == "buy" {
+		return order.Buy
+	}
+	return order.Sell
+}
+
+// getFeesSide reads where fees are charged from the order flags. Kraken charges the quote
+// currency unless the order asked for fees in the base currency.
+func getFeesSide(oflags string) types.OrderSide {
+	for _, flag := range strings.Split(oflags, ",") {
+		if flag == "fcib" {
+			return order.Buy
+		}
+	}
+	return ""
+}
+
+// userRef derives the positive 32 bit user reference for an order from its client id, so the same request always
+// gets the same reference
+func userRef(clientID string) int32 {
+	id := uuid.New()
+	if clientID != "" {
+		if parsed, err := uuid.Parse(clientID); err == nil {
+			id = parsed
+		} else {
+			id = uuid.NewSHA1(uuid.NameSpaceOID, []byte(clientID))
+		}
+	}
+	return int32(binary.BigEndian.Uint32(id[:4]) >> 1)
+}
+
+// budget charges private endpoints to the private budget and the rest to the public one
+func budget(req *http.Request) ratelimit.Budget {
+	if strings.Contains(req.URL.Path, "/private/") {
+		return ratelimit.Private
+	}
+	return ratelimit.Public
+}
+
+// throttled spots rate limit errors, which Kraken reports in the body of a successful response. The body is read
+// ahead and put back for the client.
+func throttled(resp *http.Response) (bool, time.Duration) {
+	if ok, pause := ratelimit.ThrottledStatus(resp); ok {
+		return ok, pause
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+	return bytes.Contains(body, []byte(client.ErrRateLimit)) || bytes.Contains(body, []byte(client.ErrOrderRateLimit)), 0
+}
@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+// ErrCircuitOpen is returned without calling the provider while a circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Logging logs every call at debug level and every failed call as a warning
+func Logging() Interceptor {
+	logger := log.WithField("source", "middleware.logging")
+	return func(call *Call, next func() error) error {
+		start := time.Now()
+		err := next()
+		if err != nil {
+			logger.WithError(err).Warnf("%s failed after %s", call.Method, time.Since(start))
+		} else {
+			logger.Debugf("%s took %s", call.Method, time.Since(start))
+		}
+		return err
+	}
+}
+
+type RetryConfig struct {
+	// Attempts is how many times a call is tried in all. Defaults to 3.
+	Attempts int
+
+	// Delay is the wait before the first retry, which doubles for each retry after it. Defaults to 100ms.
+	Delay time.Duration
+
+	// MaxDelay caps the wait between retries. Zero leaves it uncapped.
+	MaxDelay time.Duration
+
+	// Retryable decides whether a failed call is tried again. By default calls that failed with an error
+	// IsRetryable accepts are, except for order requests without a client ID, since only those with one can be
+	// placed again without placing the order twice.
+	Retryable func(call *Call, err error) bool
+}
+
+// IsRetryable reports whether an error is likely to go away if the call is made again: rate limits, API errors that
+// say they are temporary, timeouts and dropped connections
+func IsRetryable(err error) bool {
+	if errors.Is(err, types.ErrRateLimited) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.As(err, &timeout) && timeout.Timeout() {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// Retry tries failed calls again with an exponential backoff
+func Retry(config RetryConfig) Interceptor {
+	if config.Attempts <= 0 {
+		config.Attempts = 3
+	}
+	if config.Delay <= 0 {
+		config.Delay = 100 * time.Millisecond
+	}
+	if config.Retryable == nil {
+		config.Retryable = func(call *Call, err error) bool {
+			if req, ok := call.Request.(types.OrderRequestDTO); ok && call.Method == MethodAttemptOrder && req.ClientID == "" {
+				return false
+			}
+			return IsRetryable(err)
+		}
+	}
+
+	logger := log.WithField("source", "middleware.retry")
+	return func(call *Call, next func() error) (err error) {
+		delay := config.Delay
+		for attempt := 1; ; attempt++ {
+			err = next()
+			if err == nil || attempt >= config.Attempts || !config.Retryable(call, err) {
+				return
+			}
+
+			logger.WithError(err).Debugf("retrying %s in %s", call.Method, delay)
+			if e := sleep(call.Context, delay); e != nil {
+				return e
+			}
+			delay *= 2
+			if config.MaxDelay > 0 && delay > config.MaxDelay {
+				delay = config.MaxDelay
+			}
+		}
+	}
+}
+
+// RateLimit waits on the limiter's public or private budget before each call, and tells it when the provider turns
+// a call away for going too fast. Providers that already limit their own requests don't need it.
+func RateLimit(limiter ratelimit.Limiter) Interceptor {
+	return func(call *Call, next func() error) error {
+		budget := ratelimit.Public
+		if call.Private {
+			budget = ratelimit.Private
+		}
+		if err := limiter.Wait(call.Context, budget); err != nil {
+			return err
+		}
+
+		err := next()
+		if errors.Is(err, types.ErrRateLimited) {
+			limiter.Throttled(budget, 0)
+		}
+		return err
+	}
+}
+
+// sleep waits for the duration, or until the context is done and returns its error
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type CircuitBreakerConfig struct {
+	// Failures is how many calls in a row have to fail to open the circuit. Defaults to 5.
+	Failures int
+
+	// Cooldown is how long the circuit stays open before a single call is let through to test the provider. Defaults to 30s.
+	Cooldown time.Duration
+
+	// Failure decides whether a failed call counts against the provider. By default only errors that say the
+	// provider is unwell do: those IsRetryable accepts and network errors. A request the provider turned down, such
+	// as one for more than the wallet holds or for an order it doesn't know, leaves the count as it was.
+	Failure func(err error) bool
+}
+
+// isUnhealthy reports whether an error comes from the provider or the connection to it rather than the request
+func isUnhealthy(err error) bool {
+	var netErr net.Error
+	return IsRetryable(err) || errors.As(err, &netErr)
+}
+
+// CircuitBreaker stops calling a provider that keeps failing, returning ErrCircuitOpen until the cooldown passes and
+// a test call succeeds
+func CircuitBreaker(config CircuitBreakerConfig) Interceptor {
+	if config.Failures <= 0 {
+		config.Failures = 5
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = 30 * time.Second
+	}
+	if config.Failure == nil {
+		config.Failure = isUnhealthy
+	}
+
+	logger := log.WithField("source", "middleware.circuitbreaker")
+	var (
+		mutex     sync.Mutex
+		failures  int
+		openUntil time.Time
+		probing   bool
+	)
+	return func(call *Call, next func() error) error {
+		mutex.Lock()
+		probe := false
+		if failures >= config.Failures {
+			if probing || time.Now().Before(openUntil) {
+				mutex.Unlock()
+				return ErrCircuitOpen
+			}
+			probing, probe = true, true
+		}
+		mutex.Unlock()
+
+		err := next()
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if probe {
+			probing = false
+		}
+
+		// A call the caller gave up on, or a request the provider turned down, says nothing about its health
+		if err != nil && (errors.Is(err, context.Canceled) || !config.Failure(err)) {
+			return err
+		}
+		if err == nil {
+			if failures >= config.Failures {
+				logger.Infof("closing circuit after %s succeeded", call.Method)
+			}
+			failures = 0
+			return nil
+		}
+
+		failures++
+		if failures >= config.Failures {
+			logger.WithError(err).Warnf("opening circuit for %s after %d failures", config.Cooldown, failures)
+			openUntil = time.Now().Add(config.Cooldown)
+		}
+		return err
+	}
+}
+
+// AuditEntry is a line of the audit log
+type AuditEntry struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Request  interface{}   `json:"request,omitempty"`
+	Response interface{}   `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Audit writes a JSON line to out for every call that places or cancels an order, whether it succeeds or not
+func Audit(out io.Writer) Interceptor {
+	var mutex sync.Mutex
+	encoder := json.NewEncoder(out)
+	logger := log.WithField("source", "middleware.audit")
+
+	return func(call *Call, next func() error) error {
+		if call.Method != MethodAttemptOrder && call.Method != MethodCancelOrder {
+			return next()
+		}
+
+		start := time.Now()
+		err := next()
+		entry := AuditEntry{
+			Time:     start,
+			Method:   call.Method,
+			Request:  call.Request,
+			Response: call.Response,
+			Duration: time.Since(start),
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		if e := encoder.Encode(entry); e != nil {
+			logger.WithError(e).Errorf("could not write audit entry for %s", call.Method)
+		}
+		return err
+	}
+}
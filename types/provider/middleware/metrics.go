@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics counts calls, errors and latency per method
+type Metrics struct {
+	mutex   sync.Mutex
+	methods map[string]MethodStats
+}
+
+type MethodStats struct {
+	Calls   int64
+	Errors  int64
+	Total   time.Duration
+	Slowest time.Duration
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{methods: make(map[string]MethodStats)}
+}
+
+// Average is the mean latency of the calls
+func (s MethodStats) Average() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Calls)
+}
+
+// Interceptor records every call that passes through it
+func (m *Metrics) Interceptor() Interceptor {
+	return func(call *Call, next func() error) error {
+		start := time.Now()
+		err := next()
+		elapsed := time.Since(start)
+
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		stats := m.methods[call.Method]
+		stats.Calls++
+		if err != nil {
+			stats.Errors++
+		}
+		stats.Total += elapsed
+		if elapsed > stats.Slowest {
+			stats.Slowest = elapsed
+		}
+		m.methods[call.Method] = stats
+		return err
+	}
+}
+
+// Stats returns a copy of the numbers so far, keyed by method
+func (m *Metrics) Stats() map[string]MethodStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats := make(map[string]MethodStats, len(m.methods))
+	for method, s := range m.methods {
+		stats[method] = s
+	}
+	return stats
+}
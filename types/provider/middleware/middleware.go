@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+)
+
+const (
+	MethodAttemptOrder       = "AttemptOrder"
+	MethodAverageTradeVolume = "AverageTradeVolume"
+	MethodCancelOrder        = "CancelOrder"
+	MethodCandles            = "Candles"
+	MethodCurrencies         = "Currencies"
+	MethodFees               = "Fees"
+	MethodMarkets            = "Markets"
+	MethodOpenOrders         = "OpenOrders"
+	MethodOrder              = "Order"
+	MethodOrderStream        = "OrderStream"
+	MethodRefreshOrder       = "RefreshOrder"
+	MethodTicker             = "Ticker"
+	MethodTickerStream       = "TickerStream"
+	MethodWallet             = "Wallet"
+	MethodWallets            = "Wallets"
+)
+
+// Call describes a single provider call as it passes through the interceptors
+type Call struct {
+	Method string
+
+	// Context is the context the call was made with. It is never nil.
+	Context context.Context
+
+	// Private calls need the account's credentials: orders, wallets and fees
+	Private bool
+
+	// Request is the main argument of the call, such as the market, order or order request. It is nil when there is none.
+	Request interface{}
+
+	// Response is the result of the call once next has returned
+	Response interface{}
+}
+
+// Interceptor runs around a provider call. It lets the call through by calling next, which may be called again to
+// retry, and returns the error the caller should see.
+type Interceptor func(call *Call, next func() error) error
+
+type provider struct {
+	provider     types.ContextProvider
+	interceptors []Interceptor
+}
+
+// Wrap runs every call to the provider through the interceptors. The first interceptor is the outermost one, so it
+// sees the call first and its error last. Streams are intercepted when they are opened. Contexts are passed on to the
+// provider, through contextual.Wrap if it doesn't take them itself.
+func Wrap(p types.Provider, interceptors ...Interceptor) types.ContextProvider {
+	return &provider{
+		provider:     contextual.Wrap(p),
+		interceptors: append([]Interceptor{}, interceptors...),
+	}
+}
+
+func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	return p.AttemptOrderContext(context.Background(), req)
+}
+
+func (p *provider) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	call := &Call{Method: MethodAttemptOrder, Context: ctx, Private: true, Request: req}
+	err = p.invoke(call, func() (err error) {
+		dto, err = p.provider.AttemptOrderContext(ctx, req)
+		call.Response = dto
+		return
+	})
+	return
+}
+
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (vol decimal.Decimal, err error) {
+	return p.AverageTradeVolumeContext(context.Background(), mkt)
+}
+
+func (p *provider) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (vol decimal.Decimal, err error) {
+	call := &Call{Method: MethodAverageTradeVolume, Context: ctx, Request: mkt}
+	err = p.invoke(call, func() (err error) {
+		vol, err = p.provider.AverageTradeVolumeContext(ctx, mkt)
+		call.Response = vol
+		return
+	})
+	return
+}
+
+func (p *provider) CancelOrder(ord types.OrderDTO) error {
+	return p.CancelOrderContext(context.Background(), ord)
+}
+
+func (p *provider) CancelOrderContext(ctx context.Context, ord types.OrderDTO) error {
+	call := &Call{Method: MethodCancelOrder, Context: ctx, Private: true, Request: ord}
+	return p.invoke(call, func() error {
+		return p.provider.CancelOrderContext(ctx, ord)
+	})
+}
+
+func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	return p.CandlesContext(context.Background(), mkt, interval, start, end)
+}
+
+func (p *provider) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	call := &Call{Method: MethodCandles, Context: ctx, Request: mkt}
+	err = p.invoke(call, func() (err error) {
+		candles, err = p.provider.CandlesContext(ctx, mkt, interval, start, end)
+		call.Response = candles
+		return
+	})
+	return
+}
+
+func (p *provider) Currencies() (curs []types.CurrencyDTO, err error) {
+	return p.CurrenciesContext(context.Background())
+}
+
+func (p *provider) CurrenciesContext(ctx context.Context) (curs []types.CurrencyDTO, err error) {
+	call := &Call{Method: MethodCurrencies, Context: ctx}
+	err = p.invoke(call, func() (err error) {
+		curs, err = p.provider.CurrenciesContext(ctx)
+		call.Response = curs
+		return
+	})
+	return
+}
+
+func (p *provider) Fees() (fees types.FeesDTO, err error) {
+	return p.FeesContext(context.Background())
+}
+
+func (p *provider) FeesContext(ctx context.Context) (fees types.FeesDTO, err error) {
+	call := &Call{Method: MethodFees, Context: ctx, Private: true}
+	err = p.invoke(call, func() (err error) {
+		fees, err = p.provider.FeesContext(ctx)
+		call.Response = fees
+		return
+	})
+	return
+}
+
+// Health passes on the provider's report, if it has one
+func (p *provider) Health() []types.ProviderHealth {
+	if reporter, ok := contextual.Unwrap(p.provider).(types.HealthReporter); ok {
+		return reporter.Health()
+	}
+	return nil
+}
+
+func (p *provider) Markets() (mkts []types.MarketDTO, err error) {
+	return p.MarketsContext(context.Background())
+}
+
+func (p *provider) MarketsContext(ctx context.Context) (mkts []types.MarketDTO, err error) {
+	call := &Call{Method: MethodMarkets, Context: ctx}
+	err = p.invoke(call, func() (err error) {
+		mkts, err = p.provider.MarketsContext(ctx)
+		call.Response = mkts
+		return
+	})
+	return
+}
+
+// OpenOrders lists the provider's open orders if it can, returning types.ErrNotSupported if it can't
+func (p *provider) OpenOrders() (orders []types.OrderDTO, err error) {
+	return p.OpenOrdersContext(context.Background())
+}
+
+func (p *provider) OpenOrdersContext(ctx context.Context) (orders []types.OrderDTO, err error) {
+	if _, ok := contextual.Unwrap(p.provider).(types.OpenOrderLister); !ok {
+		return nil, types.ErrNotSupported
+	}
+	call := &Call{Method: MethodOpenOrders, Context: ctx, Private: true}
+	err = p.invoke(call, func() (err error) {
+		orders, err = contextual.OpenOrders(ctx, p.provider)
+		call.Response = orders
+		return
+	})
+	return
+}
+
+func (p *provider) Order(mkt types.MarketDTO, id string) (dto types.OrderDTO, err error) {
+	return p.OrderContext(context.Background(), mkt, id)
+}
+
+func (p *provider) OrderContext(ctx context.Context, mkt types.MarketDTO, id string) (dto types.OrderDTO, err error) {
+	call := &Call{Method: MethodOrder, Context: ctx, Private: true, Request: types.OrderDTO{Market: mkt, ID: id}}
+	err = p.invoke(call, func() (err error) {
+		dto, err = p.provider.OrderContext(ctx, mkt, id)
+		call.Response = dto
+		return
+	})
+	return
+}
+
+func (p *provider) OrderStream(stop <-chan bool, ord types.OrderDTO) (stream <-chan types.OrderDTO, err error) {
+	return p.OrderStreamContext(contextual.FromStop(stop), ord)
+}
+
+func (p *provider) OrderStreamContext(ctx context.Context, ord types.OrderDTO) (stream <-chan types.OrderDTO, err error) {
+	call := &Call{Method: MethodOrderStream, Context: ctx, Private: true, Request: ord}
+	err = p.invoke(call, func() (err error) {
+		stream, err = p.provider.OrderStreamContext(ctx, ord)
+		return
+	})
+	return
+}
+
+func (p *provider) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err error) {
+	return p.RefreshOrderContext(context.Background(), in)
+}
+
+func (p *provider) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (out types.OrderDTO, err error) {
+	call := &Call{Method: MethodRefreshOrder, Context: ctx, Private: true, Request: in}
+	err = p.invoke(call, func() (err error) {
+		out, err = p.provider.RefreshOrderContext(ctx, in)
+		call.Response = out
+		return
+	})
+	return
+}
+
+// Shutdown shuts the provider down if it can be. It isn't run through the interceptors.
+func (p *provider) Shutdown(ctx context.Context) error {
+	if stoppable, ok := contextual.Unwrap(p.provider).(types.Stoppable); ok {
+		return stoppable.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (p *provider) Ticker(mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	return p.TickerContext(context.Background(), mkt)
+}
+
+func (p *provider) TickerContext(ctx context.Context, mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	call := &Call{Method: MethodTicker, Context: ctx, Request: mkt}
+	err = p.invoke(call, func() (err error) {
+		tkr, err = p.provider.TickerContext(ctx, mkt)
+		call.Response = tkr
+		return
+	})
+	return
+}
+
+func (p *provider) TickerStream(stop <-chan bool, mkt types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
+	return p.TickerStreamContext(contextual.FromStop(stop), mkt)
+}
+
+func (p *provider) TickerStreamContext(ctx context.Context, mkt types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
+	call := &Call{Method: MethodTickerStream, Context: ctx, Request: mkt}
+	err = p.invoke(call, func() (err error) {
+		stream, err = p.provider.TickerStreamContext(ctx, mkt)
+		return
+	})
+	return
+}
+
+func (p *provider) Wallet(cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	return p.WalletContext(context.Background(), cur)
+}
+
+func (p *provider) WalletContext(ctx context.Context, cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	call := &Call{Method: MethodWallet, Context: ctx, Private: true, Request: cur}
+	err = p.invoke(call, func() (err error) {
+		wal, err = p.provider.WalletContext(ctx, cur)
+		call.Response = wal
+		return
+	})
+	return
+}
+
+func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
+	return p.WalletsContext(context.Background())
+}
+
+func (p *provider) WalletsContext(ctx context.Context) (wals []types.WalletDTO, err error) {
+	call := &Call{Method: MethodWallets, Context: ctx, Private: true}
+	err = p.invoke(call, func() (err error) {
+		wals, err = p.provider.WalletsContext(ctx)
+		call.Response = wals
+		return
+	})
+	return
+}
+
+// invoke runs the call through the interceptors, innermost last
+func (p *provider) invoke(call *Call, fn func() error) error {
+	next := fn
+	for i := len(p.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := p.interceptors[i], next
+		next = func() error { return interceptor(call, inner) }
+	}
+	return next()
+}
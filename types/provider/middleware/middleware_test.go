@@ -0,0 +1,328 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/middleware"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+// temporary is an error the provider says will go away
+type temporary string
+
+func (e temporary) Error() string   { return string(e) }
+func (e temporary) Temporary() bool { return true }
+
+var errFlaky = temporary("flaky")
+
+// flaky fails the next few ticker calls, with errFlaky unless it is given an error of its own
+type flaky struct {
+	types.Provider
+
+	mutex    sync.Mutex
+	failures int
+	calls    int
+	err      error
+}
+
+func (p *flaky) Ticker(mkt types.MarketDTO) (types.TickerDTO, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.calls++
+	if p.failures > 0 {
+		p.failures--
+		if p.err != nil {
+			return types.TickerDTO{}, p.err
+		}
+		return types.TickerDTO{}, errFlaky
+	}
+	return p.Provider.Ticker(mkt)
+}
+
+func newSimulated() types.Provider {
+	return simulated.New(simulated.ProviderConfig{
+		Balances: map[string]decimal.Decimal{
+			"BTC": decimal.NewFromInt(10),
+			"ETH": decimal.NewFromInt(100),
+		},
+		TickInterval: 20 * time.Millisecond,
+	})
+}
+
+func market(t *testing.T, p types.Provider) types.MarketDTO {
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mkt := range mkts {
+		if mkt.Name == "BTCETH" {
+			return mkt
+		}
+	}
+	t.Fatal("market BTCETH not found")
+	return types.MarketDTO{}
+}
+
+func TestConformance(t *testing.T) {
+	metrics := middleware.NewMetrics()
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			return middleware.Wrap(newSimulated(),
+				middleware.Logging(),
+				metrics.Interceptor(),
+				middleware.Retry(middleware.RetryConfig{Delay: time.Millisecond}),
+				middleware.RateLimit(ratelimit.New(ratelimit.Config{Public: ratelimit.BudgetConfig{Rate: 1000, Burst: 100}, Private: ratelimit.BudgetConfig{Rate: 1000, Burst: 100}})),
+				middleware.CircuitBreaker(middleware.CircuitBreakerConfig{}),
+				middleware.Audit(&bytes.Buffer{}),
+			)
+		},
+		Market:  "BTCETH",
+		Timeout: 5 * time.Second,
+	})
+
+	if stats := metrics.Stats()[middleware.MethodAttemptOrder]; stats.Calls == 0 {
+		t.Error("metrics did not see any orders")
+	}
+}
+
+func TestInterceptorOrder(t *testing.T) {
+	seen := []string{}
+	named := func(name string) middleware.Interceptor {
+		return func(call *middleware.Call, next func() error) error {
+			seen = append(seen, name+">")
+			err := next()
+			seen = append(seen, "<"+name)
+			return err
+		}
+	}
+
+	p := middleware.Wrap(newSimulated(), named("outer"), named("inner"))
+	if _, err := p.Currencies(); err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(seen, " "); s != "outer> inner> <inner <outer" {
+		t.Errorf("interceptors ran as %s; expected outer> inner> <inner <outer", s)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	stub := &flaky{Provider: newSimulated(), failures: 2}
+	p := middleware.Wrap(stub, middleware.Retry(middleware.RetryConfig{Attempts: 3, Delay: time.Millisecond}))
+	mkt := market(t, p)
+
+	if _, err := p.Ticker(mkt); err != nil {
+		t.Fatalf("ticker failed after retries: %s", err)
+	}
+	if stub.calls != 3 {
+		t.Errorf("ticker was called %d times; expected 3", stub.calls)
+	}
+
+	stub.failures, stub.calls = 5, 0
+	if _, err := p.Ticker(mkt); !errors.Is(err, errFlaky) {
+		t.Errorf("expected the provider error once retries ran out; got %v", err)
+	}
+	if stub.calls != 3 {
+		t.Errorf("ticker was called %d times; expected 3", stub.calls)
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	stub := &flaky{Provider: newSimulated(), failures: 5}
+	p := middleware.Wrap(stub, middleware.Retry(middleware.RetryConfig{Attempts: 5, Delay: time.Hour}))
+	mkt := market(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := p.TickerContext(ctx, mkt); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context's error while waiting to retry; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry waited %s past the deadline", elapsed)
+	}
+	if stub.calls != 1 {
+		t.Errorf("ticker was called %d times; expected 1", stub.calls)
+	}
+}
+
+func TestRetrySkipsOrders(t *testing.T) {
+	attempts := 0
+	failing := func(call *middleware.Call, next func() error) error {
+		attempts++
+		return errFlaky
+	}
+	p := middleware.Wrap(newSimulated(), middleware.Retry(middleware.RetryConfig{Delay: time.Millisecond}), failing)
+
+	if _, err := p.AttemptOrder(types.OrderRequestDTO{}); err == nil {
+		t.Fatal("expected the order to fail")
+	}
+	if attempts != 1 {
+		t.Errorf("order was attempted %d times; expected 1", attempts)
+	}
+}
+
+func TestRetryResendsOrdersWithClientID(t *testing.T) {
+	// The first order makes it to the provider but its response is lost
+	attempts, placed := 0, ""
+	loseFirst := func(call *middleware.Call, next func() error) error {
+		if call.Method != middleware.MethodAttemptOrder {
+			return next()
+		}
+		attempts++
+		err := next()
+		if attempts == 1 {
+			placed = call.Response.(types.OrderDTO).ID
+			return errFlaky
+		}
+		return err
+	}
+	p := middleware.Wrap(newSimulated(), middleware.Retry(middleware.RetryConfig{Delay: time.Millisecond}), loseFirst)
+	mkt := market(t, p)
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := providertest.RestingLimitBuy(mkt, tkr)
+	req.ClientID = "resend"
+	dto, err := p.AttemptOrder(req)
+	if err != nil {
+		t.Fatalf("order failed after retries: %s", err)
+	}
+	if attempts != 2 {
+		t.Errorf("order was attempted %d times; expected 2", attempts)
+	}
+	if dto.ID != placed {
+		t.Errorf("retry placed order %s; expected the first attempt's %s", dto.ID, placed)
+	}
+	if err := p.CancelOrder(dto); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		err       error
+		retryable bool
+	}{
+		{errFlaky, true},
+		{fmt.Errorf("wrapped: %w", errFlaky), true},
+		{io.ErrUnexpectedEOF, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&types.ProviderError{Kind: types.ErrRateLimited, Err: errors.New("slow down")}, true},
+		{types.ErrInsufficientFunds, false},
+		{middleware.ErrCircuitOpen, false},
+	}
+	for _, c := range cases {
+		if got := middleware.IsRetryable(c.err); got != c.retryable {
+			t.Errorf("IsRetryable(%v) = %t; expected %t", c.err, got, c.retryable)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	stub := &flaky{Provider: newSimulated(), failures: 2}
+	p := middleware.Wrap(stub, middleware.CircuitBreaker(middleware.CircuitBreakerConfig{Failures: 2, Cooldown: 50 * time.Millisecond}))
+	mkt := market(t, p)
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.Ticker(mkt); !errors.Is(err, errFlaky) {
+			t.Fatalf("expected the provider error; got %v", err)
+		}
+	}
+	if _, err := p.Ticker(mkt); !errors.Is(err, middleware.ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to be open; got %v", err)
+	}
+	if stub.calls != 2 {
+		t.Errorf("provider was called %d times while the circuit was open; expected 2", stub.calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := p.Ticker(mkt); err != nil {
+		t.Fatalf("expected the circuit to close after the cooldown; got %v", err)
+	}
+	if _, err := p.Ticker(mkt); err != nil {
+		t.Fatalf("expected the circuit to stay closed; got %v", err)
+	}
+}
+
+func TestCircuitBreakerIgnoresRejectedRequests(t *testing.T) {
+	rejected := &types.ProviderError{Kind: types.ErrInvalidRequest, Err: errors.New("bad request")}
+	stub := &flaky{Provider: newSimulated(), failures: 5, err: rejected}
+	p := middleware.Wrap(stub, middleware.CircuitBreaker(middleware.CircuitBreakerConfig{Failures: 2, Cooldown: time.Minute}))
+	mkt := market(t, p)
+
+	for i := 0; i < 5; i++ {
+		if _, err := p.Ticker(mkt); !errors.Is(err, types.ErrInvalidRequest) {
+			t.Fatalf("expected the rejection; got %v", err)
+		}
+	}
+	if _, err := p.Ticker(mkt); err != nil {
+		t.Fatalf("expected rejected requests to leave the circuit closed; got %v", err)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{Public: ratelimit.BudgetConfig{Rate: 50, Burst: 5}})
+	p := middleware.Wrap(newSimulated(), middleware.RateLimit(limiter))
+
+	// The burst goes straight through and the rest are spaced 20ms apart
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if _, err := p.Currencies(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("10 calls took %s; expected at least 100ms less one interval at 50/s with a burst of 5", elapsed)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := middleware.Wrap(newSimulated(), middleware.Audit(out))
+	mkt := market(t, p)
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto, err := p.AttemptOrder(providertest.RestingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CancelOrder(dto); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the order calls are audited
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d lines; expected 2:\n%s", len(lines), out)
+	}
+	var entry struct {
+		Method   string
+		Response types.OrderDTO
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Method != middleware.MethodAttemptOrder || entry.Response.ID != dto.ID {
+		t.Errorf("first audit entry is %s of %s; expected %s of %s", entry.Method, entry.Response.ID, middleware.MethodAttemptOrder, dto.ID)
+	}
+}
@@ -0,0 +1,394 @@
+package multi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+)
+
+type provider struct {
+	venues    []string
+	providers map[string]types.ContextProvider
+}
+
+// New combines named providers, or venues, into one. Markets and wallets are tagged with the venue
+// they come from, wallets are summed across venues, and every market or order call is sent to the
+// provider of the market's venue. Contexts are passed on to the venues, through contextual.Wrap for
+// those that don't take them themselves.
+func New(venues map[string]types.Provider) types.ContextProvider {
+	p := &provider{
+		providers: make(map[string]types.ContextProvider, len(venues)),
+	}
+	for name, prov := range venues {
+		p.venues = append(p.venues, name)
+		p.providers[name] = contextual.Wrap(prov)
+	}
+	sort.Strings(p.venues)
+
+	return p
+}
+
+func (p *provider) AttemptOrder(req types.OrderRequestDTO) (types.OrderDTO, error) {
+	return p.AttemptOrderContext(context.Background(), req)
+}
+
+func (p *provider) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (types.OrderDTO, error) {
+	venue, prov, err := p.route(req.Market)
+	if err != nil {
+		return types.OrderDTO{}, err
+	}
+	dto, err := prov.AttemptOrderContext(ctx, req)
+	return tagOrder(venue, dto), wrapErr(venue, err)
+}
+
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, error) {
+	return p.AverageTradeVolumeContext(context.Background(), mkt)
+}
+
+func (p *provider) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (decimal.Decimal, error) {
+	venue, prov, err := p.route(mkt)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	vol, err := prov.AverageTradeVolumeContext(ctx, mkt)
+	return vol, wrapErr(venue, err)
+}
+
+func (p *provider) CancelOrder(ord types.OrderDTO) error {
+	return p.CancelOrderContext(context.Background(), ord)
+}
+
+func (p *provider) CancelOrderContext(ctx context.Context, ord types.OrderDTO) error {
+	venue, prov, err := p.route(ord.Market)
+	if err != nil {
+		return err
+	}
+	return wrapErr(venue, prov.CancelOrderContext(ctx, ord))
+}
+
+func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) ([]types.CandleDTO, error) {
+	return p.CandlesContext(context.Background(), mkt, interval, start, end)
+}
+
+func (p *provider) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) ([]types.CandleDTO, error) {
+	venue, prov, err := p.route(mkt)
+	if err != nil {
+		return nil, err
+	}
+	candles, err := prov.CandlesContext(ctx, mkt, interval, start, end)
+	return candles, wrapErr(venue, err)
+}
+
+func (p *provider) Currencies() ([]types.CurrencyDTO, error) {
+	return p.CurrenciesContext(context.Background())
+}
+
+func (p *provider) CurrenciesContext(ctx context.Context) ([]types.CurrencyDTO, error) {
+	// The same currency is listed once, as the first venue describes it
+	seen := map[string]bool{}
+	curs := []types.CurrencyDTO{}
+	for _, venue := range p.venues {
+		dtos, err := p.providers[venue].CurrenciesContext(ctx)
+		if err != nil {
+			return nil, wrapErr(venue, err)
+		}
+		for _, cur := range dtos {
+			if !seen[cur.Symbol] {
+				seen[cur.Symbol] = true
+				curs = append(curs, cur)
+			}
+		}
+	}
+	return curs, nil
+}
+
+// Fees reports the highest rates charged by any venue along with the combined volume. The fees of
+// each venue are kept in the breakdown.
+func (p *provider) Fees() (fees types.FeesDTO, err error) {
+	return p.FeesContext(context.Background())
+}
+
+func (p *provider) FeesContext(ctx context.Context) (fees types.FeesDTO, err error) {
+	fees = types.FeesDTO{MakerRate: decimal.Zero, TakerRate: decimal.Zero, Volume: decimal.Zero, Breakdown: []types.FeesDTO{}}
+	for _, venue := range p.venues {
+		dto, err := p.providers[venue].FeesContext(ctx)
+		if err != nil {
+			return types.FeesDTO{}, wrapErr(venue, err)
+		}
+		if dto.MakerRate.GreaterThan(fees.MakerRate) {
+			fees.MakerRate = dto.MakerRate
+		}
+		if dto.TakerRate.GreaterThan(fees.TakerRate) {
+			fees.TakerRate = dto.TakerRate
+		}
+		fees.Volume = fees.Volume.Add(dto.Volume)
+
+		dto.Venue = venue
+		fees.Breakdown = append(fees.Breakdown, dto)
+	}
+	return
+}
+
+// Health collects the reports of the venues, tagged with the venue they come from
+func (p *provider) Health() []types.ProviderHealth {
+	reports := []types.ProviderHealth{}
+	for _, venue := range p.venues {
+		reporter, ok := contextual.Unwrap(p.providers[venue]).(types.HealthReporter)
+		if !ok {
+			continue
+		}
+		for _, report := range reporter.Health() {
+			report.Venue = venue
+			reports = append(reports, report)
+		}
+	}
+	return reports
+}
+
+func (p *provider) Markets() ([]types.MarketDTO, error) {
+	return p.MarketsContext(context.Background())
+}
+
+func (p *provider) MarketsContext(ctx context.Context) ([]types.MarketDTO, error) {
+	mkts := []types.MarketDTO{}
+	for _, venue := range p.venues {
+		dtos, err := p.providers[venue].MarketsContext(ctx)
+		if err != nil {
+			return nil, wrapErr(venue, err)
+		}
+		for _, mkt := range dtos {
+			mkt.Venue = venue
+			mkts = append(mkts, mkt)
+		}
+	}
+	return mkts, nil
+}
+
+// OpenOrders lists the open orders of every venue. It returns types.ErrNotSupported if any venue can't list its own.
+func (p *provider) OpenOrders() ([]types.OrderDTO, error) {
+	return p.OpenOrdersContext(context.Background())
+}
+
+func (p *provider) OpenOrdersContext(ctx context.Context) ([]types.OrderDTO, error) {
+	orders := []types.OrderDTO{}
+	for _, venue := range p.venues {
+		dtos, err := contextual.OpenOrders(ctx, p.providers[venue])
+		if err != nil {
+			return nil, wrapErr(venue, err)
+		}
+		for _, dto := range dtos {
+			orders = append(orders, tagOrder(venue, dto))
+		}
+	}
+	return orders, nil
+}
+
+func (p *provider) Order(mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	return p.OrderContext(context.Background(), mkt, id)
+}
+
+func (p *provider) OrderContext(ctx context.Context, mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	venue, prov, err := p.route(mkt)
+	if err != nil {
+		return types.OrderDTO{}, err
+	}
+	dto, err := prov.OrderContext(ctx, mkt, id)
+	return tagOrder(venue, dto), wrapErr(venue, err)
+}
+
+func (p *provider) OrderStream(stop <-chan bool, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	return p.OrderStreamContext(contextual.FromStop(stop), ord)
+}
+
+func (p *provider) OrderStreamContext(ctx context.Context, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	venue, prov, err := p.route(ord.Market)
+	if err != nil {
+		return nil, err
+	}
+	in, err := prov.OrderStreamContext(ctx, ord)
+	if err != nil {
+		return nil, wrapErr(venue, err)
+	}
+
+	out := make(chan types.OrderDTO, cap(in))
+	go func() {
+		defer close(out)
+
+		// Keep draining after stop so the venue can close its stream
+		for dto := range in {
+			select {
+			case out <- tagOrder(venue, dto):
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (p *provider) RefreshOrder(in types.OrderDTO) (types.OrderDTO, error) {
+	return p.RefreshOrderContext(context.Background(), in)
+}
+
+func (p *provider) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (types.OrderDTO, error) {
+	venue, prov, err := p.route(in.Market)
+	if err != nil {
+		return types.OrderDTO{}, err
+	}
+	dto, err := prov.RefreshOrderContext(ctx, in)
+	return tagOrder(venue, dto), wrapErr(venue, err)
+}
+
+// Shutdown shuts down every venue that can be, returning the first error
+func (p *provider) Shutdown(ctx context.Context) (err error) {
+	for _, venue := range p.venues {
+		stoppable, ok := contextual.Unwrap(p.providers[venue]).(types.Stoppable)
+		if !ok {
+			continue
+		}
+		if e := stoppable.Shutdown(ctx); e != nil && err == nil {
+			err = wrapErr(venue, e)
+		}
+	}
+	return
+}
+
+func (p *provider) Ticker(mkt types.MarketDTO) (types.TickerDTO, error) {
+	return p.TickerContext(context.Background(), mkt)
+}
+
+func (p *provider) TickerContext(ctx context.Context, mkt types.MarketDTO) (types.TickerDTO, error) {
+	venue, prov, err := p.route(mkt)
+	if err != nil {
+		return types.TickerDTO{}, err
+	}
+	tkr, err := prov.TickerContext(ctx, mkt)
+	return tkr, wrapErr(venue, err)
+}
+
+func (p *provider) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	return p.TickerStreamContext(contextual.FromStop(stop), mkt)
+}
+
+func (p *provider) TickerStreamContext(ctx context.Context, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	venue, prov, err := p.route(mkt)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := prov.TickerStreamContext(ctx, mkt)
+	return stream, wrapErr(venue, err)
+}
+
+func (p *provider) Wallet(cur types.CurrencyDTO) (types.WalletDTO, error) {
+	return p.WalletContext(context.Background(), cur)
+}
+
+func (p *provider) WalletContext(ctx context.Context, cur types.CurrencyDTO) (types.WalletDTO, error) {
+	wals, err := p.WalletsContext(ctx)
+	if err != nil {
+		return types.WalletDTO{}, err
+	}
+
+	for _, wal := range wals {
+		if wal.Currency.Symbol == cur.Symbol {
+			return wal, nil
+		}
+	}
+
+	// None of the venues hold the currency
+	return types.WalletDTO{
+		ID:        cur.Symbol,
+		Currency:  cur,
+		Free:      decimal.Zero,
+		Locked:    decimal.Zero,
+		Reserved:  decimal.Zero,
+		Breakdown: []types.WalletDTO{},
+	}, nil
+}
+
+// Wallets sums the wallets of every venue by currency. The venue wallets are kept in the breakdown.
+func (p *provider) Wallets() ([]types.WalletDTO, error) {
+	return p.WalletsContext(context.Background())
+}
+
+func (p *provider) WalletsContext(ctx context.Context) ([]types.WalletDTO, error) {
+	index := map[string]int{}
+	wals := []types.WalletDTO{}
+	for _, venue := range p.venues {
+		dtos, err := p.providers[venue].WalletsContext(ctx)
+		if err != nil {
+			return nil, wrapErr(venue, err)
+		}
+
+		for _, wal := range dtos {
+			wal.Venue = venue
+			i, ok := index[wal.Currency.Symbol]
+			if !ok {
+				i = len(wals)
+				index[wal.Currency.Symbol] = i
+				wals = append(wals, types.WalletDTO{
+					ID:        wal.Currency.Symbol,
+					Currency:  wal.Currency,
+					Free:      decimal.Zero,
+					Locked:    decimal.Zero,
+					Reserved:  decimal.Zero,
+					Breakdown: []types.WalletDTO{},
+				})
+			}
+
+			agg := &wals[i]
+			agg.Free = agg.Free.Add(wal.Free)
+			agg.Locked = agg.Locked.Add(wal.Locked)
+			agg.Breakdown = append(agg.Breakdown, wal)
+		}
+	}
+
+	sort.Slice(wals, func(i, j int) bool { return wals[i].ID < wals[j].ID })
+	return wals, nil
+}
+
+// route picks the provider for the market's venue. Markets without a venue are only accepted
+// when there is a single venue they could belong to.
+func (p *provider) route(mkt types.MarketDTO) (string, types.ContextProvider, error) {
+	venue := mkt.Venue
+	if venue == "" {
+		if len(p.venues) != 1 {
+			return "", nil, fmt.Errorf("%w: market %s has no venue", types.ErrInvalidRequest, mkt.Name)
+		}
+		venue = p.venues[0]
+	}
+
+	prov, ok := p.providers[venue]
+	if !ok {
+		return "", nil, fmt.Errorf("%w: market %s is on unknown venue %s", types.ErrInvalidRequest, mkt.Name, venue)
+	}
+	return venue, prov, nil
+}
+
+// tagOrder makes sure the markets of an order a venue hands back still point at the venue
+func tagOrder(venue string, dto types.OrderDTO) types.OrderDTO {
+	dto.Market.Venue = venue
+	dto.Request.Market.Venue = venue
+	return dto
+}
+
+func wrapErr(venue string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &VenueError{Venue: venue, Err: err}
+}
+
+// VenueError is an error returned by the provider of a venue
+type VenueError struct {
+	Venue string
+	Err   error
+}
+
+func (e *VenueError) Error() string { return e.Venue + ": " + e.Err.Error() }
+
+func (e *VenueError) Unwrap() error { return e.Err }
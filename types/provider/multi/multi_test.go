@@ -0,0 +1,139 @@
+package multi_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/multi"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+func newVenue(btc int64, eth int64) types.Provider {
+	return simulated.New(simulated.ProviderConfig{
+		Balances: map[string]decimal.Decimal{
+			"BTC": decimal.NewFromInt(btc),
+			"ETH": decimal.NewFromInt(eth),
+		},
+		TickInterval: 20 * time.Millisecond,
+	})
+}
+
+func newProvider() (types.Provider, map[string]types.Provider) {
+	venues := map[string]types.Provider{
+		"alpha": newVenue(1, 10),
+		"beta":  newVenue(2, 20),
+	}
+	return multi.New(venues), venues
+}
+
+func market(t *testing.T, p types.Provider, venue string, name string) types.MarketDTO {
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mkt := range mkts {
+		if mkt.Venue == venue && mkt.Name == name {
+			return mkt
+		}
+	}
+	t.Fatalf("market %s not found on %s", name, venue)
+	return types.MarketDTO{}
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			p, _ := newProvider()
+			return p
+		},
+		Market:  "BTCETH",
+		Timeout: 5 * time.Second,
+	})
+}
+
+func TestWalletsAggregated(t *testing.T) {
+	p, venues := newProvider()
+	wals, err := p.Wallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, wal := range wals {
+		expected := decimal.Zero
+		for _, venue := range []string{"alpha", "beta"} {
+			w, err := venues[venue].Wallet(wal.Currency)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected = expected.Add(w.Free.Add(w.Locked))
+		}
+		if total := wal.Free.Add(wal.Locked); !total.Equal(expected) {
+			t.Errorf("%s total is %s; expected %s across venues", wal.ID, total, expected)
+		}
+		if len(wal.Breakdown) != 2 {
+			t.Fatalf("%s breakdown has %d wallets; expected 2", wal.ID, len(wal.Breakdown))
+		}
+		if wal.Venue != "" || wal.Breakdown[0].Venue != "alpha" || wal.Breakdown[1].Venue != "beta" {
+			t.Errorf("%s venues are %q, %q, %q; expected an aggregate of alpha and beta", wal.ID, wal.Venue, wal.Breakdown[0].Venue, wal.Breakdown[1].Venue)
+		}
+	}
+}
+
+func TestOrdersRouteToVenue(t *testing.T) {
+	p, venues := newProvider()
+	mkt := market(t, p, "beta", "BTCETH")
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto, err := p.AttemptOrder(providertest.RestingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dto.Market.Venue != "beta" {
+		t.Errorf("order market venue is %q; expected beta", dto.Market.Venue)
+	}
+
+	// The order only exists on the venue it was routed to
+	if _, err := venues["beta"].Order(dto.Market, dto.ID); err != nil {
+		t.Errorf("order is missing from beta: %s", err)
+	}
+	if _, err := venues["alpha"].Order(dto.Market, dto.ID); err == nil {
+		t.Error("order was found on alpha")
+	}
+
+	if err := p.CancelOrder(dto); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownVenue(t *testing.T) {
+	p, _ := newProvider()
+	mkt := market(t, p, "alpha", "BTCETH")
+
+	mkt.Venue = ""
+	if _, err := p.Ticker(mkt); err == nil {
+		t.Error("market without a venue was routed")
+	}
+
+	mkt.Venue = "gamma"
+	if _, err := p.Ticker(mkt); err == nil {
+		t.Error("market on an unknown venue was routed")
+	}
+}
+
+func TestVenueErrors(t *testing.T) {
+	p, _ := newProvider()
+	mkt := market(t, p, "alpha", "BTCETH")
+
+	_, err := p.Candles(mkt, "bogus", time.Now().Add(-time.Hour), time.Now())
+	var venueErr *multi.VenueError
+	if !errors.As(err, &venueErr) || venueErr.Venue != "alpha" {
+		t.Fatalf("expected an error from alpha; got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Package paper trades against live market data from another provider without touching its account
+package paper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/internal/exchange"
+)
+
+type provider struct {
+	live     types.Provider
+	stop     <-chan bool
+	exchange *exchange.Exchange
+	log      log.Entry
+
+	mutex    sync.Mutex
+	tickers  map[string]types.TickerDTO
+	watching map[string]bool
+}
+
+type ProviderConfig struct {
+	// Balances seeds the paper wallets by currency symbol. Wallets not listed start empty.
+	Balances map[string]decimal.Decimal
+
+	// Fees is the fee schedule charged on paper fills. Defaults to no fees.
+	Fees types.FeesDTO
+
+	// Latency delays order placement and cancellation to mimic a round trip to the exchange
+	Latency time.Duration
+
+	// TickInterval controls how often resting orders are matched against live prices. Defaults to 1s.
+	TickInterval time.Duration
+}
+
+// New wraps the live provider, passing market data through and simulating orders and wallets locally
+func New(stop <-chan bool, live types.Provider, config ProviderConfig) types.Provider {
+	p := &provider{
+		live:     live,
+		stop:     stop,
+		log:      log.WithField("source", "paper.provider"),
+		tickers:  make(map[string]types.TickerDTO),
+		watching: make(map[string]bool),
+	}
+	p.exchange = exchange.New(exchange.Config{
+		Balances:     config.Balances,
+		Fees:         config.Fees,
+		Latency:      config.Latency,
+		TickInterval: config.TickInterval,
+	}, p.quote)
+	return p
+}
+
+func (p *provider) AttemptOrder(req types.OrderRequestDTO) (types.OrderDTO, error) {
+	return p.exchange.AttemptOrder(req)
+}
+
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, error) {
+	return p.live.AverageTradeVolume(mkt)
+}
+
+func (p *provider) CancelOrder(ord types.OrderDTO) error {
+	return p.exchange.CancelOrder(ord)
+}
+
+func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) ([]types.CandleDTO, error) {
+	return p.live.Candles(mkt, interval, start, end)
+}
+
+func (p *provider) Currencies() ([]types.CurrencyDTO, error) {
+	return p.live.Currencies()
+}
+
+func (p *provider) Fees() (types.FeesDTO, error) {
+	return p.exchange.Fees(), nil
+}
+
+// Health passes on the live provider's report, if it has one
+func (p *provider) Health() []types.ProviderHealth {
+	if reporter, ok := p.live.(types.HealthReporter); ok {
+		return reporter.Health()
+	}
+	return nil
+}
+
+func (p *provider) Markets() ([]types.MarketDTO, error) {
+	return p.live.Markets()
+}
+
+func (p *provider) OpenOrders() ([]types.OrderDTO, error) {
+	return p.exchange.OpenOrders(), nil
+}
+
+func (p *provider) Order(mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	return p.exchange.Order(id)
+}
+
+func (p *provider) OrderStream(stop <-chan bool, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	return p.exchange.OrderStream(stop, ord)
+}
+
+func (p *provider) RefreshOrder(in types.OrderDTO) (types.OrderDTO, error) {
+	return p.exchange.RefreshOrder(in)
+}
+
+// Shutdown shuts the live provider down if it can be
+func (p *provider) Shutdown(ctx context.Context) error {
+	if stoppable, ok := p.live.(types.Stoppable); ok {
+		return stoppable.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (p *provider) Ticker(mkt types.MarketDTO) (types.TickerDTO, error) {
+	return p.live.Ticker(mkt)
+}
+
+func (p *provider) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	return p.live.TickerStream(stop, mkt)
+}
+
+func (p *provider) Wallet(cur types.CurrencyDTO) (types.WalletDTO, error) {
+	return p.exchange.Wallet(cur), nil
+}
+
+func (p *provider) Wallets() ([]types.WalletDTO, error) {
+	curs, err := p.live.Currencies()
+	if err != nil {
+		return nil, err
+	}
+	return p.exchange.Wallets(curs), nil
+}
+
+// quote returns the latest live ticker for the market, subscribing to its stream on first use
+func (p *provider) quote(mkt types.MarketDTO) (types.TickerDTO, error) {
+	p.mutex.Lock()
+	tkr, ok := p.tickers[mkt.Name]
+	if !ok && !p.watching[mkt.Name] {
+		p.watching[mkt.Name] = true
+		go p.watch(mkt)
+	}
+	p.mutex.Unlock()
+
+	if ok {
+		return tkr, nil
+	}
+
+	// Fall back to polling until the stream delivers its first ticker
+	return p.live.Ticker(mkt)
+}
+
+func (p *provider) watch(mkt types.MarketDTO) {
+	defer func() {
+		// Forget the cached price so the next quote polls and resubscribes
+		p.mutex.Lock()
+		delete(p.tickers, mkt.Name)
+		delete(p.watching, mkt.Name)
+		p.mutex.Unlock()
+	}()
+
+	stream, err := p.live.TickerStream(p.stop, mkt)
+	if err != nil {
+		p.log.WithError(err).Warnf("could not stream live tickers for %s", mkt.Name)
+		return
+	}
+
+	for tkr := range stream {
+		p.mutex.Lock()
+		p.tickers[mkt.Name] = tkr
+		p.mutex.Unlock()
+	}
+}
@@ -0,0 +1,98 @@
+package paper_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/paper"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+func newLive() types.Provider {
+	return simulated.New(simulated.ProviderConfig{
+		Balances: map[string]decimal.Decimal{
+			"BTC": decimal.NewFromInt(1),
+			"ETH": decimal.NewFromInt(1),
+		},
+		TickInterval: 20 * time.Millisecond,
+	})
+}
+
+func newPaper(t *testing.T, live types.Provider) types.Provider {
+	stop := make(chan bool)
+	t.Cleanup(func() { close(stop) })
+	return paper.New(stop, live, paper.ProviderConfig{
+		Balances: map[string]decimal.Decimal{
+			"BTC": decimal.NewFromInt(10),
+			"ETH": decimal.NewFromInt(100),
+		},
+		Fees: types.FeesDTO{
+			MakerRate: decimal.NewFromFloat(0.005),
+			TakerRate: decimal.NewFromFloat(0.005),
+		},
+		Latency:      5 * time.Millisecond,
+		TickInterval: 20 * time.Millisecond,
+	})
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			return newPaper(t, newLive())
+		},
+		Market:  "BTCETH",
+		Timeout: 5 * time.Second,
+	})
+}
+
+func TestLiveAccountUntouched(t *testing.T) {
+	live := newLive()
+	p := newPaper(t, live)
+
+	before, err := live.Wallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mkt types.MarketDTO
+	for _, m := range mkts {
+		if m.Name == "BTCETH" {
+			mkt = m
+		}
+	}
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ord, err := p.AttemptOrder(providertest.FillingLimitBuy(mkt, tkr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := p.OrderStream(make(chan bool), ord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ord = range stream {
+	}
+	if ord.Filled.IsZero() {
+		t.Fatalf("paper order did not fill: %+v", ord)
+	}
+
+	after, err := live.Wallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range before {
+		if !before[i].Free.Equal(after[i].Free) || !before[i].Locked.Equal(after[i].Locked) {
+			t.Fatalf("live %s wallet changed from %s to %s", before[i].Currency.Symbol, before[i].Free, after[i].Free)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package providertest
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+// Main runs a package's tests against a fake exchange and exits with their result. Viper is global, so setup starts
+// the fake and configures the provider once, before any provider is reading from it.
+//
+//	func TestMain(m *testing.M) {
+//		providertest.Main(m, func() { srv = fake.NewServer(fake.Config{}) }, func() { srv.Close() })
+//	}
+func Main(m *testing.M, setup func(), teardown func()) {
+	setup()
+	code := m.Run()
+	teardown()
+	os.Exit(code)
+}
+
+// Stop returns a stop channel that is closed once the test is done
+func Stop(t *testing.T) <-chan bool {
+	stop := make(chan bool)
+	t.Cleanup(func() { close(stop) })
+	return stop
+}
+
+// Limiter returns budgets generous enough that tests against a fake exchange don't wait on them
+func Limiter() ratelimit.Limiter {
+	return ratelimit.New(ratelimit.Config{
+		Public:  ratelimit.BudgetConfig{Rate: 50, Burst: 100},
+		Private: ratelimit.BudgetConfig{Rate: 50, Burst: 100},
+	})
+}
+
+// Market looks up the provider's market by name, failing the test when there is none
+func Market(t *testing.T, p types.Provider, name string) types.MarketDTO {
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mkt := range mkts {
+		if mkt.Name == name {
+			return mkt
+		}
+	}
+	t.Fatalf("market %s not found", name)
+	return types.MarketDTO{}
+}
+
+// WaitFor polls until check passes, failing the test if it hasn't within five seconds
+func WaitFor(t *testing.T, what string, check func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
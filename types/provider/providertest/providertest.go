@@ -0,0 +1,598 @@
+// Package providertest implements a conformance suite that any types.Provider
+// implementation can run from its own tests.
+//
+//	func TestConformance(t *testing.T) {
+//		providertest.Run(t, providertest.Harness{
+//			NewProvider: func(t *testing.T) types.Provider { return myprovider.New() },
+//		})
+//	}
+package providertest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/candle"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+)
+
+// RequestBuilder builds an order request for the market from its current ticker
+type RequestBuilder func(mkt types.MarketDTO, tkr types.TickerDTO) types.OrderRequestDTO
+
+// Harness configures the suite for a provider
+type Harness struct {
+	// NewProvider returns a fresh provider for each test
+	NewProvider func(t *testing.T) types.Provider
+
+	// Market is the name of the market orders are placed on. The first market is used when empty.
+	Market string
+
+	// FillingRequest builds a request that is expected to fill completely. Defaults to FillingLimitBuy.
+	FillingRequest RequestBuilder
+
+	// RestingRequest builds a request that is expected to rest until cancelled. Defaults to RestingLimitBuy.
+	RestingRequest RequestBuilder
+
+	// Timeout bounds how long to wait on streams and order transitions. Defaults to 10s.
+	Timeout time.Duration
+}
+
+// Run runs the full conformance suite against the provider
+func Run(t *testing.T, h Harness) {
+	if h.NewProvider == nil {
+		t.Fatal("providertest: harness requires NewProvider")
+	}
+	if h.FillingRequest == nil {
+		h.FillingRequest = FillingLimitBuy
+	}
+	if h.RestingRequest == nil {
+		h.RestingRequest = RestingLimitBuy
+	}
+	if h.Timeout <= 0 {
+		h.Timeout = 10 * time.Second
+	}
+
+	t.Run("Markets", h.testMarkets)
+	t.Run("Ticker", h.testTicker)
+	t.Run("TickerStreamStop", h.testTickerStreamStop)
+	t.Run("Candles", h.testCandles)
+	t.Run("OrderFill", h.testOrderFill)
+	t.Run("OrderCancel", h.testOrderCancel)
+	t.Run("IdempotentOrder", h.testIdempotentOrder)
+	t.Run("OrderStreamStop", h.testOrderStreamStop)
+	t.Run("UnknownOrder", h.testUnknownOrder)
+	t.Run("ErrorKinds", h.testErrorKinds)
+	t.Run("Context", h.testContext)
+}
+
+// FillingLimitBuy is a limit buy priced 1% through the ask
+func FillingLimitBuy(mkt types.MarketDTO, tkr types.TickerDTO) types.OrderRequestDTO {
+	price := tkr.Ask
+	if !price.IsPositive() {
+		price = tkr.Price
+	}
+	return types.OrderRequestDTO{
+		Market:   mkt,
+		Type:     order.Limit,
+		Side:     order.Buy,
+		Price:    roundToIncrement(price.Mul(decimal.NewFromFloat(1.01)), mkt.PriceIncrement, true),
+		Quantity: testQuantity(mkt),
+	}
+}
+
+// RestingLimitBuy is a limit buy priced at half the bid
+func RestingLimitBuy(mkt types.MarketDTO, tkr types.TickerDTO) types.OrderRequestDTO {
+	price := tkr.Bid
+	if !price.IsPositive() {
+		price = tkr.Price
+	}
+	price = roundToIncrement(price.Div(decimal.NewFromInt(2)), mkt.PriceIncrement, false)
+	if price.LessThan(mkt.MinPrice) {
+		price = mkt.MinPrice
+	}
+	return types.OrderRequestDTO{
+		Market:   mkt,
+		Type:     order.Limit,
+		Side:     order.Buy,
+		Price:    price,
+		Quantity: testQuantity(mkt),
+	}
+}
+
+func (h Harness) market(t *testing.T, p types.Provider) types.MarketDTO {
+	t.Helper()
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatalf("Markets() returned error: %s", err)
+	}
+	if len(mkts) == 0 {
+		t.Fatal("Markets() returned no markets")
+	}
+	if h.Market == "" {
+		return mkts[0]
+	}
+	for _, mkt := range mkts {
+		if mkt.Name == h.Market {
+			return mkt
+		}
+	}
+	t.Fatalf("market %s not found", h.Market)
+	return types.MarketDTO{}
+}
+
+func (h Harness) testMarkets(t *testing.T) {
+	p := h.NewProvider(t)
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatalf("Markets() returned error: %s", err)
+	}
+	curs, err := p.Currencies()
+	if err != nil {
+		t.Fatalf("Currencies() returned error: %s", err)
+	}
+
+	symbols := map[string]bool{}
+	for _, cur := range curs {
+		if cur.Symbol == "" {
+			t.Errorf("currency %+v has no symbol", cur)
+		}
+		symbols[cur.Symbol] = true
+	}
+
+	for _, mkt := range mkts {
+		if mkt.Name == "" {
+			t.Errorf("market %+v has no name", mkt)
+		}
+		if !symbols[mkt.BaseCurrency.Symbol] {
+			t.Errorf("market %s base currency %q is not listed in Currencies()", mkt.Name, mkt.BaseCurrency.Symbol)
+		}
+		if !symbols[mkt.QuoteCurrency.Symbol] {
+			t.Errorf("market %s quote currency %q is not listed in Currencies()", mkt.Name, mkt.QuoteCurrency.Symbol)
+		}
+	}
+}
+
+func (h Harness) testTicker(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatalf("Ticker() returned error: %s", err)
+	}
+	if !tkr.Price.IsPositive() {
+		t.Errorf("ticker price %s is not positive", tkr.Price)
+	}
+	if tkr.Ask.IsPositive() && tkr.Bid.IsPositive() && tkr.Ask.LessThan(tkr.Bid) {
+		t.Errorf("ticker ask %s is below bid %s", tkr.Ask, tkr.Bid)
+	}
+}
+
+func (h Harness) testTickerStreamStop(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	stop := make(chan bool)
+	stream, err := p.TickerStream(stop, mkt)
+	if err != nil {
+		t.Fatalf("TickerStream() returned error: %s", err)
+	}
+
+	select {
+	case tkr, ok := <-stream:
+		if !ok {
+			t.Fatal("ticker stream closed before stop")
+		}
+		if !tkr.Price.IsPositive() {
+			t.Errorf("streamed ticker price %s is not positive", tkr.Price)
+		}
+	case <-time.After(h.Timeout):
+		t.Fatal("timed out waiting for ticker data")
+	}
+
+	close(stop)
+	h.drain(t, func() bool {
+		_, ok := <-stream
+		return ok
+	})
+}
+
+func (h Harness) testCandles(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	end := time.Now()
+	start := end.Add(-24 * time.Hour)
+	candles, err := p.Candles(mkt, candle.OneHour, start, end)
+	if err != nil {
+		t.Fatalf("Candles() returned error: %s", err)
+	}
+	if len(candles) == 0 {
+		t.Fatal("Candles() returned no candles")
+	}
+
+	for i, c := range candles {
+		if c.Timestamp.Before(start.Add(-time.Hour)) || c.Timestamp.After(end) {
+			t.Errorf("candle %d timestamp %s is outside of %s - %s", i, c.Timestamp, start, end)
+		}
+		if i > 0 && !c.Timestamp.After(candles[i-1].Timestamp) {
+			t.Errorf("candle %d timestamp %s is not after %s", i, c.Timestamp, candles[i-1].Timestamp)
+		}
+		if c.High.LessThan(c.Low) || c.High.LessThan(c.Open) || c.High.LessThan(c.Close) ||
+			c.Low.GreaterThan(c.Open) || c.Low.GreaterThan(c.Close) {
+			t.Errorf("candle %d has inconsistent prices %+v", i, c)
+		}
+	}
+}
+
+func (h Harness) testOrderFill(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+	base, quote := h.wallets(t, p, mkt)
+
+	req := h.request(t, p, mkt, h.FillingRequest)
+	dto, err := p.AttemptOrder(req)
+	if err != nil {
+		t.Fatalf("AttemptOrder() returned error: %s", err)
+	}
+	if dto.ID == "" {
+		t.Fatal("AttemptOrder() returned an order without an ID")
+	}
+	if dto.Status == order.Canceled || dto.Status == order.Rejected || dto.Status == order.Expired {
+		t.Fatalf("AttemptOrder() returned order with status %s", dto.Status)
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	stream, err := p.OrderStream(stop, dto)
+	if err != nil {
+		t.Fatalf("OrderStream() returned error: %s", err)
+	}
+	last := h.followOrder(t, dto, stream)
+	if last.Status != order.Filled {
+		t.Fatalf("order stream ended with status %s; expected %s", last.Status, order.Filled)
+	}
+
+	refreshed, err := p.RefreshOrder(dto)
+	if err != nil {
+		t.Fatalf("RefreshOrder() returned error: %s", err)
+	}
+	if refreshed.Status != order.Filled {
+		t.Errorf("RefreshOrder() status is %s; expected %s", refreshed.Status, order.Filled)
+	}
+	if !refreshed.Filled.Equal(req.Quantity) {
+		t.Errorf("RefreshOrder() filled is %s; expected %s", refreshed.Filled, req.Quantity)
+	}
+
+	fetched, err := p.Order(mkt, dto.ID)
+	if err != nil {
+		t.Fatalf("Order() returned error: %s", err)
+	}
+	if fetched.ID != dto.ID || fetched.Status != order.Filled {
+		t.Errorf("Order() returned %s with status %s; expected %s with status %s", fetched.ID, fetched.Status, dto.ID, order.Filled)
+	}
+
+	// Wallets should reflect the fill once all holds are released
+	baseDelta, quoteDelta := refreshed.Filled, refreshed.Paid.Neg()
+	if req.Side == order.Sell {
+		baseDelta, quoteDelta = refreshed.Filled.Neg(), refreshed.Paid
+	}
+	if refreshed.FeesSide == order.Buy {
+		baseDelta = baseDelta.Sub(refreshed.Fees)
+	} else {
+		quoteDelta = quoteDelta.Sub(refreshed.Fees)
+	}
+	h.eventually(t, func() error {
+		b, q := h.wallets(t, p, mkt)
+		if err := expectBalance(b, base.Free.Add(base.Locked).Add(baseDelta), base.Locked); err != nil {
+			return err
+		}
+		return expectBalance(q, quote.Free.Add(quote.Locked).Add(quoteDelta), quote.Locked)
+	})
+}
+
+func (h Harness) testOrderCancel(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+	base, quote := h.wallets(t, p, mkt)
+
+	dto, err := p.AttemptOrder(h.request(t, p, mkt, h.RestingRequest))
+	if err != nil {
+		t.Fatalf("AttemptOrder() returned error: %s", err)
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	stream, err := p.OrderStream(stop, dto)
+	if err != nil {
+		t.Fatalf("OrderStream() returned error: %s", err)
+	}
+
+	if err := p.CancelOrder(dto); err != nil {
+		t.Fatalf("CancelOrder() returned error: %s", err)
+	}
+	last := h.followOrder(t, dto, stream)
+	if last.Status != order.Canceled {
+		t.Fatalf("order stream ended with status %s; expected %s", last.Status, order.Canceled)
+	}
+
+	refreshed, err := p.RefreshOrder(dto)
+	if err != nil {
+		t.Fatalf("RefreshOrder() returned error: %s", err)
+	}
+	if refreshed.Status != order.Canceled {
+		t.Errorf("RefreshOrder() status is %s; expected %s", refreshed.Status, order.Canceled)
+	}
+
+	// Cancelled orders release their holds
+	h.eventually(t, func() error {
+		b, q := h.wallets(t, p, mkt)
+		if err := expectBalance(b, base.Free.Add(base.Locked), base.Locked); err != nil {
+			return err
+		}
+		return expectBalance(q, quote.Free.Add(quote.Locked), quote.Locked)
+	})
+}
+
+func (h Harness) testIdempotentOrder(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	// Placing a request twice with the same client ID places a single order
+	req := h.request(t, p, mkt, h.RestingRequest)
+	req.ClientID = "providertest-idempotent-order"
+	first, err := p.AttemptOrder(req)
+	if err != nil {
+		t.Fatalf("AttemptOrder() returned error: %s", err)
+	}
+	defer p.CancelOrder(first)
+	if first.Request.ClientID != req.ClientID {
+		t.Errorf("order request has client ID %q; expected %q", first.Request.ClientID, req.ClientID)
+	}
+
+	second, err := p.AttemptOrder(req)
+	if err != nil {
+		t.Fatalf("AttemptOrder() returned error for a repeated client ID: %s", err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("repeated client ID placed order %s; expected the first order %s", second.ID, first.ID)
+	}
+}
+
+func (h Harness) testOrderStreamStop(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	dto, err := p.AttemptOrder(h.request(t, p, mkt, h.RestingRequest))
+	if err != nil {
+		t.Fatalf("AttemptOrder() returned error: %s", err)
+	}
+	defer p.CancelOrder(dto)
+
+	stop := make(chan bool)
+	stream, err := p.OrderStream(stop, dto)
+	if err != nil {
+		t.Fatalf("OrderStream() returned error: %s", err)
+	}
+
+	close(stop)
+	h.drain(t, func() bool {
+		_, ok := <-stream
+		return ok
+	})
+}
+
+func (h Harness) testUnknownOrder(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	if _, err := p.Order(mkt, "providertest-unknown-order"); err == nil {
+		t.Error("Order() returned no error for an unknown order")
+	}
+
+	dto := types.OrderDTO{Market: mkt, ID: "providertest-unknown-order", Status: order.Pending}
+	refreshed, err := p.RefreshOrder(dto)
+	if err != nil {
+		t.Fatalf("RefreshOrder() returned error for an unknown order: %s", err)
+	}
+	if refreshed.Status != order.Canceled {
+		t.Errorf("RefreshOrder() status is %s for an unknown order; expected %s", refreshed.Status, order.Canceled)
+	}
+}
+
+func (h Harness) testErrorKinds(t *testing.T) {
+	p := h.NewProvider(t)
+	mkt := h.market(t, p)
+
+	if _, err := p.Order(mkt, "providertest-unknown-order"); !errors.Is(err, types.ErrOrderNotFound) {
+		t.Errorf("Order() returned %v for an unknown order; expected %s", err, types.ErrOrderNotFound)
+	}
+
+	// A buy for twice what the quote wallet holds
+	_, quote := h.wallets(t, p, mkt)
+	req := h.request(t, p, mkt, h.RestingRequest)
+	step := mkt.QuantityStepSize
+	if !step.IsPositive() {
+		step = mkt.BaseCurrency.Increment
+	}
+	req.Quantity = roundToIncrement(quote.Free.Add(quote.Locked).Mul(decimal.NewFromInt(2)).Div(req.Price), step, true)
+	if dto, err := p.AttemptOrder(req); !errors.Is(err, types.ErrInsufficientFunds) {
+		if err == nil {
+			p.CancelOrder(dto)
+		}
+		t.Errorf("AttemptOrder() returned %v for an order the wallet can't cover; expected %s", err, types.ErrInsufficientFunds)
+	}
+
+	// A maker only order priced through the book
+	req = h.request(t, p, mkt, FillingLimitBuy)
+	req.ForceMaker = true
+	if dto, err := p.AttemptOrder(req); !errors.Is(err, types.ErrPostOnlyWouldCross) {
+		if err == nil {
+			p.CancelOrder(dto)
+		}
+		t.Errorf("AttemptOrder() returned %v for a crossing maker order; expected %s", err, types.ErrPostOnlyWouldCross)
+	}
+}
+
+func (h Harness) testContext(t *testing.T) {
+	p := contextual.Wrap(h.NewProvider(t))
+	mkt := h.market(t, p)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.TickerContext(cancelled, mkt); !errors.Is(err, context.Canceled) {
+		t.Errorf("TickerContext() with a cancelled context returned %v; expected %s", err, context.Canceled)
+	}
+	if _, err := p.WalletsContext(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("WalletsContext() with a cancelled context returned %v; expected %s", err, context.Canceled)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := p.TickerStreamContext(ctx, mkt)
+	if err != nil {
+		t.Fatalf("TickerStreamContext() returned error: %s", err)
+	}
+
+	select {
+	case _, ok := <-stream:
+		if !ok {
+			t.Fatal("ticker stream closed before the context was cancelled")
+		}
+	case <-time.After(h.Timeout):
+		t.Fatal("timed out waiting for ticker data")
+	}
+
+	cancel()
+	h.drain(t, func() bool {
+		_, ok := <-stream
+		return ok
+	})
+}
+
+func (h Harness) request(t *testing.T, p types.Provider, mkt types.MarketDTO, build RequestBuilder) types.OrderRequestDTO {
+	t.Helper()
+	tkr, err := p.Ticker(mkt)
+	if err != nil {
+		t.Fatalf("Ticker() returned error: %s", err)
+	}
+	return build(mkt, tkr)
+}
+
+func (h Harness) wallets(t *testing.T, p types.Provider, mkt types.MarketDTO) (base types.WalletDTO, quote types.WalletDTO) {
+	t.Helper()
+	base, err := p.Wallet(mkt.BaseCurrency)
+	if err != nil {
+		t.Fatalf("Wallet(%s) returned error: %s", mkt.BaseCurrency.Symbol, err)
+	}
+	quote, err = p.Wallet(mkt.QuoteCurrency)
+	if err != nil {
+		t.Fatalf("Wallet(%s) returned error: %s", mkt.QuoteCurrency.Symbol, err)
+	}
+	return
+}
+
+// followOrder reads the stream until the order is done and the stream closes,
+// checking every status transition along the way
+func (h Harness) followOrder(t *testing.T, initial types.OrderDTO, stream <-chan types.OrderDTO) types.OrderDTO {
+	t.Helper()
+	last := initial
+	timeout := time.After(h.Timeout)
+	for {
+		select {
+		case dto, ok := <-stream:
+			if !ok {
+				if !order.IsDone(last.Status) {
+					t.Fatalf("order stream closed while order was %s", last.Status)
+				}
+				return last
+			}
+			if dto.ID != initial.ID {
+				t.Errorf("order stream for %s delivered order %s", initial.ID, dto.ID)
+			}
+			if !ValidTransition(last.Status, dto.Status) {
+				t.Errorf("invalid order transition %s -> %s", last.Status, dto.Status)
+			}
+			if dto.Filled.LessThan(last.Filled) {
+				t.Errorf("order filled amount decreased from %s to %s", last.Filled, dto.Filled)
+			}
+			last = dto
+		case <-timeout:
+			if order.IsDone(last.Status) {
+				t.Fatalf("order stream was not closed after order reached %s", last.Status)
+			}
+			t.Fatalf("timed out waiting for order to finish; last status %s", last.Status)
+		}
+	}
+}
+
+// drain keeps receiving until the stream closes, failing if it stays open
+func (h Harness) drain(t *testing.T, recv func() bool) {
+	t.Helper()
+	closed := make(chan bool)
+	go func() {
+		for recv() {
+		}
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(h.Timeout):
+		t.Fatal("stream was not closed after stop")
+	}
+}
+
+func (h Harness) eventually(t *testing.T, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(h.Timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func expectBalance(wal types.WalletDTO, total decimal.Decimal, locked decimal.Decimal) error {
+	tolerance := wal.Currency.Increment
+	if diff := wal.Free.Add(wal.Locked).Sub(total).Abs(); diff.GreaterThan(tolerance) {
+		return fmt.Errorf("%s wallet total is %s; expected %s", wal.Currency.Symbol, wal.Free.Add(wal.Locked), total)
+	}
+	if diff := wal.Locked.Sub(locked).Abs(); diff.GreaterThan(tolerance) {
+		return fmt.Errorf("%s wallet locked is %s; expected %s", wal.Currency.Symbol, wal.Locked, locked)
+	}
+	return nil
+}
+
+func testQuantity(mkt types.MarketDTO) decimal.Decimal {
+	qty := mkt.MinQuantity
+	if !qty.IsPositive() {
+		qty = mkt.QuantityStepSize
+	}
+	if !qty.IsPositive() {
+		qty = decimal.New(1, -2)
+	}
+	return qty.Mul(decimal.NewFromInt(10))
+}
+
+func roundToIncrement(price decimal.Decimal, inc decimal.Decimal, up bool) decimal.Decimal {
+	if !inc.IsPositive() {
+		return price
+	}
+	steps := price.Div(inc)
+	if up {
+		return steps.Ceil().Mul(inc)
+	}
+	return steps.Floor().Mul(inc)
+}
@@ -0,0 +1,25 @@
+package providertest
+
+import (
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+// ValidTransition reports whether a provider may move an order from one status to the next.
+// Repeated statuses are allowed since streams may replay updates.
+func ValidTransition(from types.OrderStatus, to types.OrderStatus) bool {
+	if from == to {
+		return true
+	}
+	if order.IsDone(from) {
+		return false
+	}
+
+	switch to {
+	case order.Pending:
+		return from == order.Unknown || from == ""
+	case order.Unknown:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Share of the configured rate a slowed down bucket wins back each second
+const recoveryPerSecond = 0.1
+
+type BudgetConfig struct {
+	// Rate is how many calls a second the budget refills by. A rate that isn't positive leaves calls unlimited.
+	Rate float64
+
+	// Burst is how many calls can be saved up and made at once. Defaults to 1.
+	Burst int
+}
+
+// Stats describes a budget at a point in time
+type Stats struct {
+	// Rate is the current refill rate, which is below the configured one while recovering from a slowdown
+	Rate  float64
+	Burst int
+
+	// Remaining is how many calls can be made right now without waiting
+	Remaining float64
+
+	// Waiting is how many calls are blocked on the budget
+	Waiting int
+
+	// Throttled counts the times the API asked for fewer calls
+	Throttled int64
+}
+
+// bucket is a token bucket that halves its rate when throttled and gradually recovers
+type bucket struct {
+	config BudgetConfig
+
+	mutex     sync.Mutex
+	rate      float64
+	tokens    float64
+	last      time.Time
+	waiting   int
+	throttled int64
+}
+
+func newBucket(config BudgetConfig) *bucket {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	return &bucket{
+		config: config,
+		rate:   config.Rate,
+		tokens: float64(config.Burst),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, blocking until one is available or the context is done
+func (b *bucket) wait(ctx context.Context) error {
+	if b.config.Rate <= 0 {
+		return ctx.Err()
+	}
+
+	b.mutex.Lock()
+	b.waiting++
+	defer func() {
+		b.mutex.Lock()
+		b.waiting--
+		b.mutex.Unlock()
+	}()
+
+	for {
+		now := time.Now()
+		b.refill(now)
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mutex.Unlock()
+			return nil
+		}
+
+		// Sleep until the next token is due, which may be after a pause asked for by the API
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		if b.last.After(now) {
+			delay += b.last.Sub(now)
+		}
+		b.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		b.mutex.Lock()
+	}
+}
+
+// throttle empties the bucket, halves its rate and pauses it for the given time
+func (b *bucket) throttle(pause time.Duration) {
+	if b.config.Rate <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.refill(now)
+	b.throttled++
+	b.rate = math.Max(b.rate/2, b.config.Rate*recoveryPerSecond)
+	b.tokens = 0
+	if pause <= 0 {
+		pause = time.Duration(float64(time.Second) / b.rate)
+	}
+	if until := now.Add(pause); until.After(b.last) {
+		b.last = until
+	}
+}
+
+func (b *bucket) stats() Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.config.Rate > 0 {
+		b.refill(time.Now())
+	}
+	return Stats{
+		Rate:      b.rate,
+		Burst:     b.config.Burst,
+		Remaining: b.tokens,
+		Waiting:   b.waiting,
+		Throttled: b.throttled,
+	}
+}
+
+// refill adds the tokens earned since the last refill and lets the rate recover. It must be called with the mutex held.
+func (b *bucket) refill(now time.Time) {
+	if !now.After(b.last) {
+		return
+	}
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(b.config.Burst), b.tokens+elapsed*b.rate)
+	b.rate = math.Min(b.config.Rate, b.rate+elapsed*b.config.Rate*recoveryPerSecond)
+	b.last = now
+}
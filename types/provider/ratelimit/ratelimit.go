@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/spf13/viper"
+)
+
+// Budget is a pool of calls that is limited on its own. Exchanges usually count calls that need the account's
+// credentials separately from public market data.
+type Budget string
+
+const (
+	Public  Budget = "public"
+	Private Budget = "private"
+)
+
+type Config struct {
+	Public  BudgetConfig
+	Private BudgetConfig
+}
+
+// Limiter keeps calls to an API within its budgets
+type Limiter interface {
+	// Wait blocks until a call can be made on the budget, or returns the context's error if it is done first
+	Wait(ctx context.Context, budget Budget) error
+
+	// Throttled tells the limiter the API turned a call away for going too fast. The budget is paused for the given
+	// time, or until its next call is due if it is zero, and refills at half the rate until it recovers.
+	Throttled(budget Budget, pause time.Duration)
+
+	// Stats returns the state of each budget
+	Stats() map[Budget]Stats
+}
+
+type limiter struct {
+	buckets map[Budget]*bucket
+}
+
+func New(config Config) Limiter {
+	return &limiter{
+		buckets: map[Budget]*bucket{
+			Public:  newBucket(config.Public),
+			Private: newBucket(config.Private),
+		},
+	}
+}
+
+// ConfigFromViper reads the budgets from the rateLimit.public and rateLimit.private keys under the prefix
+func ConfigFromViper(prefix string) Config {
+	budget := func(name string) BudgetConfig {
+		return BudgetConfig{
+			Rate:  viper.GetFloat64(prefix + ".rateLimit." + name + ".rate"),
+			Burst: viper.GetInt(prefix + ".rateLimit." + name + ".burst"),
+		}
+	}
+	return Config{
+		Public:  budget("public"),
+		Private: budget("private"),
+	}
+}
+
+func (l *limiter) Wait(ctx context.Context, budget Budget) error {
+	return l.bucket(budget).wait(ctx)
+}
+
+func (l *limiter) Throttled(budget Budget, pause time.Duration) {
+	l.bucket(budget).throttle(pause)
+}
+
+func (l *limiter) Stats() map[Budget]Stats {
+	stats := make(map[Budget]Stats, len(l.buckets))
+	for budget, b := range l.buckets {
+		stats[budget] = b.stats()
+	}
+	return stats
+}
+
+// Health reports the state of the limiter's budgets, ordered by name
+func Health(l Limiter) []types.RateLimitHealth {
+	health := []types.RateLimitHealth{}
+	for budget, stats := range l.Stats() {
+		health = append(health, types.RateLimitHealth{
+			Budget:    string(budget),
+			Rate:      stats.Rate,
+			Burst:     stats.Burst,
+			Remaining: stats.Remaining,
+			Waiting:   stats.Waiting,
+			Throttled: stats.Throttled,
+		})
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Budget < health[j].Budget })
+	return health
+}
+
+// bucket returns the bucket for the budget, charging unknown budgets to the public one
+func (l *limiter) bucket(budget Budget) *bucket {
+	if b, ok := l.buckets[budget]; ok {
+		return b
+	}
+	return l.buckets[Public]
+}
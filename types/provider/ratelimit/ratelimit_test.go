@@ -0,0 +1,153 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types/provider/ratelimit"
+)
+
+func newLimiter(rate float64, burst int) ratelimit.Limiter {
+	return ratelimit.New(ratelimit.Config{
+		Public:  ratelimit.BudgetConfig{Rate: rate, Burst: burst},
+		Private: ratelimit.BudgetConfig{Rate: rate, Burst: burst},
+	})
+}
+
+func TestBurstThenRate(t *testing.T) {
+	limiter := newLimiter(50, 5)
+
+	// The burst goes straight through and the rest are spaced 20ms apart
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := limiter.Wait(context.Background(), ratelimit.Public); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("10 calls took %s; expected at least 100ms less one interval at 50/s with a burst of 5", elapsed)
+	}
+}
+
+func TestWaitHonorsContext(t *testing.T) {
+	limiter := newLimiter(1, 1)
+	if err := limiter.Wait(context.Background(), ratelimit.Public); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := limiter.Wait(ctx, ratelimit.Public); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context's deadline; got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("wait gave up after %s; expected it to stop at the 20ms deadline", elapsed)
+	}
+	if waiting := limiter.Stats()[ratelimit.Public].Waiting; waiting != 0 {
+		t.Errorf("%d calls still waiting after giving up; expected none", waiting)
+	}
+}
+
+func TestBudgetsAreSeparate(t *testing.T) {
+	limiter := newLimiter(1, 1)
+	if err := limiter.Wait(context.Background(), ratelimit.Private); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, ratelimit.Public); err != nil {
+		t.Fatalf("public call waited on the private budget: %s", err)
+	}
+
+	stats := limiter.Stats()
+	if stats[ratelimit.Private].Remaining >= 1 || stats[ratelimit.Public].Remaining >= 1 {
+		t.Errorf("budgets have %.2f private and %.2f public calls left; expected both spent", stats[ratelimit.Private].Remaining, stats[ratelimit.Public].Remaining)
+	}
+}
+
+func TestThrottledSlowsDown(t *testing.T) {
+	limiter := newLimiter(100, 10)
+	limiter.Throttled(ratelimit.Public, 50*time.Millisecond)
+
+	stats := limiter.Stats()[ratelimit.Public]
+	if stats.Throttled != 1 || stats.Rate != 50 || stats.Remaining != 0 {
+		t.Errorf("throttled budget has rate %.2f with %.2f left after %d throttles; expected 50 with none left after 1", stats.Rate, stats.Remaining, stats.Throttled)
+	}
+
+	start := time.Now()
+	if err := limiter.Wait(context.Background(), ratelimit.Public); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("call went through %s after being throttled; expected the 50ms pause", elapsed)
+	}
+	if private := limiter.Stats()[ratelimit.Private]; private.Throttled != 0 || private.Rate != 100 {
+		t.Error("throttling the public budget slowed the private one")
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Config{})
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		if err := limiter.Wait(context.Background(), ratelimit.Private); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("1000 unlimited calls took %s", elapsed)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	limiter := newLimiter(100, 10)
+	client := &http.Client{Transport: ratelimit.NewTransport(limiter, ratelimit.TransportConfig{
+		Budget: func(req *http.Request) ratelimit.Budget {
+			if req.URL.Path == "/private" {
+				return ratelimit.Private
+			}
+			return ratelimit.Public
+		},
+	})}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/private")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	stats := limiter.Stats()
+	if stats[ratelimit.Private].Throttled != 1 || stats[ratelimit.Public].Throttled != 0 {
+		t.Errorf("budgets were throttled %d private and %d public times; expected 1 and 0", stats[ratelimit.Private].Throttled, stats[ratelimit.Public].Throttled)
+	}
+	if stats[ratelimit.Public].Remaining != 10 {
+		t.Errorf("public budget has %.2f calls left; expected all 10", stats[ratelimit.Public].Remaining)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, err := client.Do(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled request to fail with the context's error; got %v", err)
+	}
+}
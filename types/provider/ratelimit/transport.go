@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type TransportConfig struct {
+	// Budget picks the budget a request is charged to. Defaults to the public budget for every request.
+	Budget func(req *http.Request) Budget
+
+	// Throttled reports whether a response turned the request away for going too fast and how long the API asked
+	// to wait. Defaults to ThrottledStatus.
+	Throttled func(resp *http.Response) (bool, time.Duration)
+
+	// Base makes the requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+}
+
+type transport struct {
+	limiter Limiter
+	config  TransportConfig
+}
+
+// NewTransport returns a round tripper that waits on the limiter before each request, giving up when the request's
+// context is done, and slows the limiter down when the API pushes back
+func NewTransport(limiter Limiter, config TransportConfig) http.RoundTripper {
+	if config.Budget == nil {
+		config.Budget = func(req *http.Request) Budget { return Public }
+	}
+	if config.Throttled == nil {
+		config.Throttled = ThrottledStatus
+	}
+	if config.Base == nil {
+		config.Base = http.DefaultTransport
+	}
+	return &transport{limiter: limiter, config: config}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	budget := t.config.Budget(req)
+	if err := t.limiter.Wait(req.Context(), budget); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.config.Base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if throttled, pause := t.config.Throttled(resp); throttled {
+		t.limiter.Throttled(budget, pause)
+	}
+	return resp, nil
+}
+
+// ThrottledStatus treats 429 and 418 responses as throttled, pausing for as many seconds as their Retry-After
+// header asks
+func ThrottledStatus(resp *http.Response) (bool, time.Duration) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusTeapot {
+		return false, 0
+	}
+	seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return true, time.Duration(seconds) * time.Second
+}
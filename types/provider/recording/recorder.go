@@ -0,0 +1,276 @@
+package recording
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+)
+
+type recorder struct {
+	provider types.ContextProvider
+
+	mutex    sync.Mutex
+	encoder  *json.Encoder
+	sequence int64
+	log      log.Entry
+}
+
+// NewRecorder wraps the provider and writes every call and stream message it sees to out. Contexts are passed on to
+// providers with context-aware calls.
+func NewRecorder(provider types.Provider, out io.Writer) types.ContextProvider {
+	return &recorder{
+		provider: contextual.Wrap(provider),
+		encoder:  json.NewEncoder(out),
+		log:      log.WithField("source", "recording.recorder"),
+	}
+}
+
+func (r *recorder) AttemptOrder(req types.OrderRequestDTO) (types.OrderDTO, error) {
+	return r.AttemptOrderContext(context.Background(), req)
+}
+
+func (r *recorder) AttemptOrderContext(ctx context.Context, req types.OrderRequestDTO) (types.OrderDTO, error) {
+	dto, err := r.provider.AttemptOrderContext(ctx, req)
+	r.record(methodAttemptOrder, requestKey(req), req, dto, err)
+	return dto, err
+}
+
+func (r *recorder) AverageTradeVolume(mkt types.MarketDTO) (decimal.Decimal, error) {
+	return r.AverageTradeVolumeContext(context.Background(), mkt)
+}
+
+func (r *recorder) AverageTradeVolumeContext(ctx context.Context, mkt types.MarketDTO) (decimal.Decimal, error) {
+	vol, err := r.provider.AverageTradeVolumeContext(ctx, mkt)
+	r.record(methodAverageTradeVolume, mkt.Name, mkt.Name, vol, err)
+	return vol, err
+}
+
+func (r *recorder) CancelOrder(ord types.OrderDTO) error {
+	return r.CancelOrderContext(context.Background(), ord)
+}
+
+func (r *recorder) CancelOrderContext(ctx context.Context, ord types.OrderDTO) error {
+	err := r.provider.CancelOrderContext(ctx, ord)
+	r.record(methodCancelOrder, ord.ID, ord, nil, err)
+	return err
+}
+
+func (r *recorder) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) ([]types.CandleDTO, error) {
+	return r.CandlesContext(context.Background(), mkt, interval, start, end)
+}
+
+func (r *recorder) CandlesContext(ctx context.Context, mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) ([]types.CandleDTO, error) {
+	candles, err := r.provider.CandlesContext(ctx, mkt, interval, start, end)
+	args := candleArgs{Market: mkt.Name, Interval: interval, Start: start, End: end}
+	r.record(methodCandles, candleKey(args), args, candles, err)
+	return candles, err
+}
+
+func (r *recorder) Currencies() ([]types.CurrencyDTO, error) {
+	return r.CurrenciesContext(context.Background())
+}
+
+func (r *recorder) CurrenciesContext(ctx context.Context) ([]types.CurrencyDTO, error) {
+	curs, err := r.provider.CurrenciesContext(ctx)
+	r.record(methodCurrencies, "", nil, curs, err)
+	return curs, err
+}
+
+func (r *recorder) Fees() (types.FeesDTO, error) {
+	return r.FeesContext(context.Background())
+}
+
+func (r *recorder) FeesContext(ctx context.Context) (types.FeesDTO, error) {
+	fees, err := r.provider.FeesContext(ctx)
+	r.record(methodFees, "", nil, fees, err)
+	return fees, err
+}
+
+// Health passes on the recorded provider's report, if it has one
+func (r *recorder) Health() []types.ProviderHealth {
+	if reporter, ok := contextual.Unwrap(r.provider).(types.HealthReporter); ok {
+		return reporter.Health()
+	}
+	return nil
+}
+
+func (r *recorder) Markets() ([]types.MarketDTO, error) {
+	return r.MarketsContext(context.Background())
+}
+
+func (r *recorder) MarketsContext(ctx context.Context) ([]types.MarketDTO, error) {
+	mkts, err := r.provider.MarketsContext(ctx)
+	r.record(methodMarkets, "", nil, mkts, err)
+	return mkts, err
+}
+
+func (r *recorder) Order(mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	return r.OrderContext(context.Background(), mkt, id)
+}
+
+func (r *recorder) OrderContext(ctx context.Context, mkt types.MarketDTO, id string) (types.OrderDTO, error) {
+	ord, err := r.provider.OrderContext(ctx, mkt, id)
+	r.record(methodOrder, id, orderArgs{Market: mkt.Name, ID: id}, ord, err)
+	return ord, err
+}
+
+func (r *recorder) OrderStream(stop <-chan bool, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	source, err := r.provider.OrderStream(stop, ord)
+	id := r.record(methodOrderStream, ord.ID, ord, nil, err)
+	if err != nil {
+		return source, err
+	}
+
+	stream := make(chan types.OrderDTO, cap(source))
+	go func() {
+		defer close(stream)
+		start := time.Now()
+		for data := range source {
+			r.recordStream(Stream, methodOrderStream, id, time.Since(start), data)
+			select {
+			case stream <- data:
+			case <-stop:
+			}
+		}
+		r.recordStream(Close, methodOrderStream, id, time.Since(start), nil)
+	}()
+
+	return stream, nil
+}
+
+func (r *recorder) OrderStreamContext(ctx context.Context, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.OrderStream(contextual.Stop(ctx), ord)
+}
+
+func (r *recorder) RefreshOrder(in types.OrderDTO) (types.OrderDTO, error) {
+	return r.RefreshOrderContext(context.Background(), in)
+}
+
+func (r *recorder) RefreshOrderContext(ctx context.Context, in types.OrderDTO) (types.OrderDTO, error) {
+	out, err := r.provider.RefreshOrderContext(ctx, in)
+	r.record(methodRefreshOrder, in.ID, in, out, err)
+	return out, err
+}
+
+// Shutdown shuts the recorded provider down if it can be
+func (r *recorder) Shutdown(ctx context.Context) error {
+	if stoppable, ok := contextual.Unwrap(r.provider).(types.Stoppable); ok {
+		return stoppable.Shutdown(ctx)
+	}
+	return nil
+}
+
+func (r *recorder) Ticker(mkt types.MarketDTO) (types.TickerDTO, error) {
+	return r.TickerContext(context.Background(), mkt)
+}
+
+func (r *recorder) TickerContext(ctx context.Context, mkt types.MarketDTO) (types.TickerDTO, error) {
+	tkr, err := r.provider.TickerContext(ctx, mkt)
+	r.record(methodTicker, mkt.Name, mkt.Name, tkr, err)
+	return tkr, err
+}
+
+func (r *recorder) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	source, err := r.provider.TickerStream(stop, mkt)
+	id := r.record(methodTickerStream, mkt.Name, mkt.Name, nil, err)
+	if err != nil {
+		return source, err
+	}
+
+	stream := make(chan types.TickerDTO, cap(source))
+	go func() {
+		defer close(stream)
+		start := time.Now()
+		for data := range source {
+			r.recordStream(Stream, methodTickerStream, id, time.Since(start), data)
+			select {
+			case stream <- data:
+			case <-stop:
+			}
+		}
+		r.recordStream(Close, methodTickerStream, id, time.Since(start), nil)
+	}()
+
+	return stream, nil
+}
+
+func (r *recorder) TickerStreamContext(ctx context.Context, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.TickerStream(contextual.Stop(ctx), mkt)
+}
+
+func (r *recorder) Wallet(cur types.CurrencyDTO) (types.WalletDTO, error) {
+	return r.WalletContext(context.Background(), cur)
+}
+
+func (r *recorder) WalletContext(ctx context.Context, cur types.CurrencyDTO) (types.WalletDTO, error) {
+	wal, err := r.provider.WalletContext(ctx, cur)
+	r.record(methodWallet, cur.Symbol, cur.Symbol, wal, err)
+	return wal, err
+}
+
+func (r *recorder) Wallets() ([]types.WalletDTO, error) {
+	return r.WalletsContext(context.Background())
+}
+
+func (r *recorder) WalletsContext(ctx context.Context) ([]types.WalletDTO, error) {
+	wals, err := r.provider.WalletsContext(ctx)
+	r.record(methodWallets, "", nil, wals, err)
+	return wals, err
+}
+
+// record writes a call entry and returns its sequence number, which doubles as the stream id
+func (r *recorder) record(method string, key string, args interface{}, result interface{}, err error) int64 {
+	entry := Entry{Kind: Call, Method: method, Key: key}
+	if args != nil {
+		entry.Args = r.marshal(args)
+	}
+	if result != nil {
+		entry.Result = r.marshal(result)
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.ErrorKind = errorKind(err)
+	}
+	return r.write(entry)
+}
+
+func (r *recorder) recordStream(kind string, method string, id int64, offset time.Duration, data interface{}) {
+	entry := Entry{Kind: kind, Method: method, StreamID: id, Offset: offset}
+	if data != nil {
+		entry.Result = r.marshal(data)
+	}
+	r.write(entry)
+}
+
+func (r *recorder) write(entry Entry) int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sequence++
+	entry.Sequence = r.sequence
+	if err := r.encoder.Encode(entry); err != nil {
+		r.log.WithError(err).Error("could not write recording entry")
+	}
+	return entry.Sequence
+}
+
+func (r *recorder) marshal(v interface{}) json.RawMessage {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		r.log.WithError(err).Error("could not marshal recording data")
+		return nil
+	}
+	return raw
+}
@@ -0,0 +1,114 @@
+// Package recording captures a provider session to a file and serves it back deterministically
+package recording
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// Entry kinds in a recording
+const (
+	Call   = "call"
+	Stream = "stream"
+	Close  = "close"
+)
+
+// Entry is a single line of a recording
+type Entry struct {
+	Sequence int64           `json:"sequence"`
+	Kind     string          `json:"kind"`
+	Method   string          `json:"method"`
+	Key      string          `json:"key,omitempty"`
+	StreamID int64           `json:"streamId,omitempty"`
+	Offset   time.Duration   `json:"offset,omitempty"`
+	Args     json.RawMessage `json:"args,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+
+	// ErrorKind is the message of the types error kind the error matched, if any, so replays can match it too
+	ErrorKind string `json:"errorKind,omitempty"`
+}
+
+// Provider method names used in recordings
+const (
+	methodAttemptOrder       = "AttemptOrder"
+	methodAverageTradeVolume = "AverageTradeVolume"
+	methodCancelOrder        = "CancelOrder"
+	methodCandles            = "Candles"
+	methodCurrencies         = "Currencies"
+	methodFees               = "Fees"
+	methodMarkets            = "Markets"
+	methodOrder              = "Order"
+	methodOrderStream        = "OrderStream"
+	methodRefreshOrder       = "RefreshOrder"
+	methodTicker             = "Ticker"
+	methodTickerStream       = "TickerStream"
+	methodWallet             = "Wallet"
+	methodWallets            = "Wallets"
+)
+
+// Error kinds a recording keeps, so errors.Is still tells replayed errors apart
+var errorKinds = []error{
+	types.ErrAuthFailed,
+	types.ErrInsufficientFunds,
+	types.ErrInvalidRequest,
+	types.ErrMarketHalted,
+	types.ErrNotSupported,
+	types.ErrOrderNotFound,
+	types.ErrPostOnlyWouldCross,
+	types.ErrRateLimited,
+}
+
+// errorKind returns the message of the kind the error matches, or an empty string if it matches none
+func errorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind) {
+			return kind.Error()
+		}
+	}
+	return ""
+}
+
+// replayedError rebuilds a recorded error, as a types.ProviderError of its kind if it had one. The kind is trimmed
+// from the recorded message so it isn't repeated.
+func replayedError(entry Entry) error {
+	if entry.Error == "" {
+		return nil
+	}
+	for _, kind := range errorKinds {
+		if kind.Error() != entry.ErrorKind {
+			continue
+		}
+		msg := strings.TrimPrefix(entry.Error, entry.ErrorKind+": ")
+		msg = strings.TrimSuffix(msg, ": "+entry.ErrorKind)
+		return &types.ProviderError{Kind: kind, Err: errors.New(msg)}
+	}
+	return errors.New(entry.Error)
+}
+
+type candleArgs struct {
+	Market   string               `json:"market"`
+	Interval types.CandleInterval `json:"interval"`
+	Start    time.Time            `json:"start"`
+	End      time.Time            `json:"end"`
+}
+
+type orderArgs struct {
+	Market string `json:"market"`
+	ID     string `json:"id"`
+}
+
+// requestKey identifies an order request without the volatile market details
+func requestKey(req types.OrderRequestDTO) string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%t", req.Market.Name, req.Side, req.Type,
+		req.Price.String(), req.Quantity.String(), req.Funds.String(), req.ForceMaker)
+}
+
+func candleKey(args candleArgs) string {
+	return fmt.Sprintf("%s|%s|%d|%d", args.Market, args.Interval, args.Start.Unix(), args.End.Unix())
+}
@@ -0,0 +1,182 @@
+package recording_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/recording"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+// session is the transcript of what a consumer saw from a provider
+type session struct {
+	Markets []types.MarketDTO
+	Ticker  types.TickerDTO
+	Ticks   []types.TickerDTO
+	Order   types.OrderDTO
+	Updates []types.OrderDTO
+	Wallets []types.WalletDTO
+	Missing string
+	// NotFound is whether the missing order's error is still types.ErrOrderNotFound
+	NotFound bool
+}
+
+func runSession(t *testing.T, p types.Provider) session {
+	var s session
+	var err error
+
+	if s.Markets, err = p.Markets(); err != nil {
+		t.Fatal(err)
+	}
+	var mkt types.MarketDTO
+	for _, m := range s.Markets {
+		if m.Name == "BTCETH" {
+			mkt = m
+		}
+	}
+
+	if s.Ticker, err = p.Ticker(mkt); err != nil {
+		t.Fatal(err)
+	}
+
+	// Take a few ticks from the stream
+	stop := make(chan bool)
+	ticks, err := p.TickerStream(stop, mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(s.Ticks) < 3 {
+		s.Ticks = append(s.Ticks, <-ticks)
+	}
+	close(stop)
+	for range ticks {
+	}
+
+	// Follow a filling order until the stream closes
+	s.Order, err = p.AttemptOrder(types.OrderRequestDTO{
+		Market:   mkt,
+		Side:     order.Buy,
+		Type:     order.Limit,
+		Price:    s.Ticker.Ask.Mul(decimal.NewFromInt(2)),
+		Quantity: decimal.NewFromInt(1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates, err := p.OrderStream(make(chan bool), s.Order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for update := range updates {
+		s.Updates = append(s.Updates, update)
+	}
+
+	if s.Wallets, err = p.Wallets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Order(mkt, "missing"); err != nil {
+		s.Missing = err.Error()
+		s.NotFound = errors.Is(err, types.ErrOrderNotFound)
+	}
+	return s
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	sim := simulated.New(simulated.ProviderConfig{
+		Balances: map[string]decimal.Decimal{
+			"BTC": decimal.NewFromInt(10),
+			"ETH": decimal.NewFromInt(1000),
+		},
+		TickInterval: 10 * time.Millisecond,
+	})
+
+	var buf bytes.Buffer
+	recorded := runSession(t, recording.NewRecorder(sim, &buf))
+
+	replayer, err := recording.NewReplayer(bytes.NewReader(buf.Bytes()), recording.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := runSession(t, replayer)
+
+	want, _ := json.Marshal(recorded)
+	got, _ := json.Marshal(replayed)
+	if !bytes.Equal(want, got) {
+		t.Fatalf("replayed session differs from recording\nwant: %s\ngot:  %s", want, got)
+	}
+	if !recorded.NotFound {
+		t.Fatalf("expected an order not found error for the missing order, got %q", recorded.Missing)
+	}
+
+	// Once the recording is used up calls fail rather than inventing data
+	if _, err := replayer.Fees(); err == nil {
+		t.Fatal("expected an error for a call that was never recorded")
+	}
+}
+
+func TestReplayHonorsContext(t *testing.T) {
+	sim := simulated.New(simulated.ProviderConfig{})
+
+	var buf bytes.Buffer
+	recorder := recording.NewRecorder(sim, &buf)
+	if _, err := recorder.MarketsContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	replayer, err := recording.NewReplayer(bytes.NewReader(buf.Bytes()), recording.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := replayer.MarketsContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled context's error, got %v", err)
+	}
+
+	// The cancelled call left the recorded one to be replayed
+	if _, err := replayer.MarketsContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayFallback(t *testing.T) {
+	sim := simulated.New(simulated.ProviderConfig{})
+	mkts, err := sim.Markets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := recording.NewRecorder(sim, &buf).Ticker(mkts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// A call for another market doesn't match the recording
+	strict, err := recording.NewReplayer(bytes.NewReader(buf.Bytes()), recording.ReplayConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.Ticker(mkts[1]); err == nil {
+		t.Fatal("expected an error for a call that doesn't match the recording")
+	}
+	if _, err := strict.Ticker(mkts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unless the replayer is told to fall back on the method's next call
+	loose, err := recording.NewReplayer(bytes.NewReader(buf.Bytes()), recording.ReplayConfig{Fallback: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loose.Ticker(mkts[1]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,260 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+)
+
+// ReplayConfig controls how a recording is served back
+type ReplayConfig struct {
+	// Speed scales the recorded delays between stream messages; zero sends them as fast as possible
+	Speed float64
+
+	// Fallback lets a call that matches no recorded one take the first unused recorded call of its method instead of
+	// failing, for sessions whose requests can't be reproduced exactly
+	Fallback bool
+}
+
+type recordedCall struct {
+	entry Entry
+	used  bool
+}
+
+type replayer struct {
+	config ReplayConfig
+
+	mutex   sync.Mutex
+	calls   []*recordedCall
+	streams map[int64][]Entry
+}
+
+// NewReplayer reads a recording and returns a provider that serves it back. Nothing is replayed for a context that
+// is already done, and streams stop once their context is.
+func NewReplayer(in io.Reader, config ReplayConfig) (types.ContextProvider, error) {
+	r := &replayer{
+		config:  config,
+		streams: make(map[int64][]Entry),
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("could not parse recording entry: %w", err)
+		}
+
+		switch entry.Kind {
+		case Call:
+			r.calls = append(r.calls, &recordedCall{entry: entry})
+		case Stream, Close:
+			r.streams[entry.StreamID] = append(r.streams[entry.StreamID], entry)
+		default:
+			return nil, fmt.Errorf("unknown recording entry kind %s", entry.Kind)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return contextual.Wrap(r), nil
+}
+
+func (r *replayer) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO, err error) {
+	err = r.replay(methodAttemptOrder, requestKey(req), &dto)
+	return
+}
+
+func (r *replayer) AverageTradeVolume(mkt types.MarketDTO) (vol decimal.Decimal, err error) {
+	err = r.replay(methodAverageTradeVolume, mkt.Name, &vol)
+	return
+}
+
+func (r *replayer) CancelOrder(ord types.OrderDTO) error {
+	return r.replay(methodCancelOrder, ord.ID, nil)
+}
+
+func (r *replayer) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
+	key := candleKey(candleArgs{Market: mkt.Name, Interval: interval, Start: start, End: end})
+	err = r.replay(methodCandles, key, &candles)
+	return
+}
+
+func (r *replayer) Currencies() (curs []types.CurrencyDTO, err error) {
+	err = r.replay(methodCurrencies, "", &curs)
+	return
+}
+
+func (r *replayer) Fees() (fees types.FeesDTO, err error) {
+	err = r.replay(methodFees, "", &fees)
+	return
+}
+
+func (r *replayer) Markets() (mkts []types.MarketDTO, err error) {
+	err = r.replay(methodMarkets, "", &mkts)
+	return
+}
+
+func (r *replayer) Order(mkt types.MarketDTO, id string) (ord types.OrderDTO, err error) {
+	err = r.replay(methodOrder, id, &ord)
+	return
+}
+
+func (r *replayer) OrderStream(stop <-chan bool, ord types.OrderDTO) (<-chan types.OrderDTO, error) {
+	call, err := r.next(methodOrderStream, ord.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := replayedError(call); err != nil {
+		return nil, err
+	}
+
+	entries := r.streams[call.Sequence]
+	stream := make(chan types.OrderDTO, len(entries))
+	go r.serve(stop, entries, func(raw json.RawMessage) bool {
+		var data types.OrderDTO
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return true
+		}
+		select {
+		case stream <- data:
+			return true
+		case <-stop:
+			return false
+		}
+	}, func() { close(stream) })
+
+	return stream, nil
+}
+
+func (r *replayer) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err error) {
+	err = r.replay(methodRefreshOrder, in.ID, &out)
+	return
+}
+
+func (r *replayer) Ticker(mkt types.MarketDTO) (tkr types.TickerDTO, err error) {
+	err = r.replay(methodTicker, mkt.Name, &tkr)
+	return
+}
+
+func (r *replayer) TickerStream(stop <-chan bool, mkt types.MarketDTO) (<-chan types.TickerDTO, error) {
+	call, err := r.next(methodTickerStream, mkt.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := replayedError(call); err != nil {
+		return nil, err
+	}
+
+	entries := r.streams[call.Sequence]
+	stream := make(chan types.TickerDTO, len(entries))
+	go r.serve(stop, entries, func(raw json.RawMessage) bool {
+		var data types.TickerDTO
+		if err := json.Unmarshal(raw, &data); err != nil {
+			return true
+		}
+		select {
+		case stream <- data:
+			return true
+		case <-stop:
+			return false
+		}
+	}, func() { close(stream) })
+
+	return stream, nil
+}
+
+func (r *replayer) Wallet(cur types.CurrencyDTO) (wal types.WalletDTO, err error) {
+	err = r.replay(methodWallet, cur.Symbol, &wal)
+	return
+}
+
+func (r *replayer) Wallets() (wals []types.WalletDTO, err error) {
+	err = r.replay(methodWallets, "", &wals)
+	return
+}
+
+// replay finds the next recorded call and decodes its result into out
+func (r *replayer) replay(method string, key string, out interface{}) error {
+	call, err := r.next(method, key)
+	if err != nil {
+		return err
+	}
+
+	if out != nil && len(call.Result) > 0 {
+		if err := json.Unmarshal(call.Result, out); err != nil {
+			return fmt.Errorf("could not decode recorded %s result: %w", method, err)
+		}
+	}
+	return replayedError(call)
+}
+
+// next claims the first unused call with a matching key, or with Fallback the first unused call of the method
+func (r *replayer) next(method string, key string) (Entry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var fallback *recordedCall
+	for _, call := range r.calls {
+		if call.used || call.entry.Method != method {
+			continue
+		}
+		if call.entry.Key == key {
+			call.used = true
+			return call.entry, nil
+		}
+		if fallback == nil {
+			fallback = call
+		}
+	}
+
+	switch {
+	case fallback == nil:
+		return Entry{}, fmt.Errorf("no recorded %s call left to replay", method)
+	case !r.config.Fallback:
+		return Entry{}, fmt.Errorf("no recorded %s call for %q left to replay", method, key)
+	}
+	fallback.used = true
+	return fallback.entry, nil
+}
+
+// serve plays back the stream entries, closing the stream where the recording closed it or on stop
+func (r *replayer) serve(stop <-chan bool, entries []Entry, send func(json.RawMessage) bool, done func()) {
+	defer done()
+	start := time.Now()
+
+	for _, entry := range entries {
+		if r.config.Speed > 0 {
+			wait := time.Duration(float64(entry.Offset)/r.config.Speed) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return
+				}
+			}
+		}
+
+		if entry.Kind == Close {
+			return
+		}
+		if !send(entry.Result) {
+			return
+		}
+	}
+
+	// The recording ended with the stream still open
+	<-stop
+}
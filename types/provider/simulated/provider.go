@@ -1,19 +1,50 @@
 package simulated
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/internal/exchange"
 )
 
 type provider struct {
+	config   ProviderConfig
+	exchange *exchange.Exchange
+
+	mutex  sync.Mutex
+	prices map[string]decimal.Decimal
 }
 
 type ProviderConfig struct {
+	// Balances seeds the wallets by currency symbol. Random balances are used when empty.
+	Balances map[string]decimal.Decimal
+
+	// Fees is the fee schedule charged on fills. Defaults to no fees.
+	Fees types.FeesDTO
+
+	// TickInterval controls how often prices move and orders are matched. Defaults to 1s.
+	TickInterval time.Duration
 }
 
 func New(config ProviderConfig) types.Provider {
-	p := &provider{}
+	if config.TickInterval <= 0 {
+		config.TickInterval = time.Second
+	}
+
+	p := &provider{
+		config: config,
+		prices: make(map[string]decimal.Decimal),
+	}
+	p.exchange = exchange.New(exchange.Config{
+		Balances:     buildBalances(config.Balances),
+		Fees:         config.Fees,
+		TickInterval: config.TickInterval,
+	}, func(mkt types.MarketDTO) (types.TickerDTO, error) {
+		return p.getTicker(mkt), nil
+	})
 	return p
 }
 
@@ -27,48 +58,66 @@ func (p *provider) Currencies() (currencies []types.CurrencyDTO, err error) {
 	return
 }
 
-func (p *provider) Ticker(market types.MarketDTO) (ticker types.TickerDTO, err error) {
-	ticker = getTicker(market)
+func (p *provider) Fees() (fees types.FeesDTO, err error) {
+	fees = p.exchange.Fees()
 	return
 }
 
-func (p *provider) TickerStream(stop <-chan bool, market types.MarketDTO) (dataChan <-chan types.TickerDTO, err error) {
-	dataChan = getTickerStream(stop, market)
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (vol decimal.Decimal, err error) {
+	vol = p.getTicker(mkt).Quantity
 	return
 }
 
-func (p *provider) Wallets() (wallets []types.WalletDTO, err error) {
-	wallets = getWallets()
+func (p *provider) Ticker(market types.MarketDTO) (ticker types.TickerDTO, err error) {
+	ticker = p.getTicker(market)
 	return
 }
 
-func (p *provider) Wallet(id string) (wallet types.WalletDTO, err error) {
-	wallet = getWallet(id)
+func (p *provider) TickerStream(stop <-chan bool, market types.MarketDTO) (dataChan <-chan types.TickerDTO, err error) {
+	dataChan = p.getTickerStream(stop, market)
 	return
 }
 
-func (p *provider) WalletStream(stop <-chan bool, wal types.WalletDTO) (stream <-chan types.WalletDTO, err error) {
-	stream = getWalletStream(stop, wal)
+func (p *provider) Wallets() (wallets []types.WalletDTO, err error) {
+	wallets = p.exchange.Wallets(getCurrencies())
+	return
+}
+
+func (p *provider) Wallet(currency types.CurrencyDTO) (wallet types.WalletDTO, err error) {
+	for _, cur := range getCurrencies() {
+		if cur.Symbol == currency.Symbol {
+			wallet = p.exchange.Wallet(cur)
+			return
+		}
+	}
+	err = fmt.Errorf("%w: could not find wallet for currency %s", types.ErrInvalidRequest, currency.Symbol)
 	return
 }
 
 func (p *provider) AttemptOrder(ord types.OrderRequestDTO) (types.OrderDTO, error) {
-	return attemptOrder(ord.Market, ord)
+	return p.exchange.AttemptOrder(ord)
 }
 
 func (p *provider) CancelOrder(order types.OrderDTO) error {
-	return cancelOrder(order)
+	return p.exchange.CancelOrder(order)
+}
+
+func (p *provider) OpenOrders() ([]types.OrderDTO, error) {
+	return p.exchange.OpenOrders(), nil
 }
 
 func (p *provider) Order(mkt types.MarketDTO, id string) (types.OrderDTO, error) {
-	return getOrder(mkt, id)
+	return p.exchange.Order(id)
+}
+
+func (p *provider) RefreshOrder(in types.OrderDTO) (types.OrderDTO, error) {
+	return p.exchange.RefreshOrder(in)
 }
 
 func (p *provider) OrderStream(stop <-chan bool, order types.OrderDTO) (ch <-chan types.OrderDTO, err error) {
-	return getOrderStream(stop, order)
+	return p.exchange.OrderStream(stop, order)
 }
 
 func (p *provider) Candles(mkt types.MarketDTO, interval types.CandleInterval, start time.Time, end time.Time) (candles []types.CandleDTO, err error) {
-	candles = getCandles(mkt, interval, start, end)
-	return
+	return p.getCandles(mkt, interval, start, end)
 }
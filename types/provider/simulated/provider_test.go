@@ -0,0 +1,33 @@
+package simulated_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/providertest"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, providertest.Harness{
+		NewProvider: func(t *testing.T) types.Provider {
+			return simulated.New(simulated.ProviderConfig{
+				Balances: map[string]decimal.Decimal{
+					"USD": decimal.NewFromInt(100000),
+					"BTC": decimal.NewFromInt(10),
+					"ETH": decimal.NewFromInt(100),
+					"XRP": decimal.NewFromInt(100000),
+				},
+				Fees: types.FeesDTO{
+					MakerRate: decimal.NewFromFloat(0.005),
+					TakerRate: decimal.NewFromFloat(0.005),
+				},
+				TickInterval: 20 * time.Millisecond,
+			})
+		},
+		Market:  "BTCETH",
+		Timeout: 5 * time.Second,
+	})
+}
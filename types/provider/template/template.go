@@ -3,6 +3,7 @@ package template
 import (
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/sinisterminister/currencytrader/types"
 )
 
@@ -18,6 +19,10 @@ func (p *provider) AttemptOrder(req types.OrderRequestDTO) (dto types.OrderDTO,
 	return
 }
 
+func (p *provider) AverageTradeVolume(mkt types.MarketDTO) (vol decimal.Decimal, err error) {
+	return
+}
+
 func (p *provider) CancelOrder(ord types.OrderDTO) (err error) {
 	return
 }
@@ -30,6 +35,10 @@ func (p *provider) Currencies() (curs []types.CurrencyDTO, err error) {
 	return
 }
 
+func (p *provider) Fees() (fees types.FeesDTO, err error) {
+	return
+}
+
 func (p *provider) Markets() (mkts []types.MarketDTO, err error) {
 	return
 }
@@ -42,22 +51,22 @@ func (p *provider) OrderStream(stop <-chan bool, order types.OrderDTO) (stream <
 	return
 }
 
-func (p *provider) Ticker(market types.MarketDTO) (tkr types.TickerDTO, err error) {
+func (p *provider) RefreshOrder(in types.OrderDTO) (out types.OrderDTO, err error) {
 	return
 }
 
-func (p *provider) TickerStream(stop <-chan bool, market types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
+func (p *provider) Ticker(market types.MarketDTO) (tkr types.TickerDTO, err error) {
 	return
 }
 
-func (p *provider) Wallet(id string) (wal types.WalletDTO, err error) {
+func (p *provider) TickerStream(stop <-chan bool, market types.MarketDTO) (stream <-chan types.TickerDTO, err error) {
 	return
 }
 
-func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
+func (p *provider) Wallet(currency types.CurrencyDTO) (wal types.WalletDTO, err error) {
 	return
 }
 
-func (p *provider) WalletStream(stop <-chan bool, wal types.WalletDTO) (stream <-chan types.WalletDTO, err error) {
+func (p *provider) Wallets() (wals []types.WalletDTO, err error) {
 	return
 }
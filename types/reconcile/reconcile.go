@@ -0,0 +1,276 @@
+// Package reconcile compares what a trader knows about its orders and funds with what its provider reports, so a
+// restart after a crash picks up where the trader left off
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
+)
+
+// Policies for open orders on the provider the journal doesn't know about
+const (
+	// Alert only reports the orders
+	Alert Policy = "alert"
+
+	// Adopt journals the orders so the trader picks them up as its own
+	Adopt Policy = "adopt"
+
+	// Cancel cancels the orders
+	Cancel Policy = "cancel"
+)
+
+type Policy string
+
+type Config struct {
+	// UnknownOrders is what happens to open orders on the provider that aren't in the journal. Defaults to Alert.
+	UnknownOrders Policy
+
+	// BalanceTolerance is how far a wallet's locked balance may stray from what the known open orders hold, as a
+	// fraction of that, before it is reported. It leaves room for the fees providers hold on top of an order.
+	// Defaults to 0.05.
+	BalanceTolerance decimal.Decimal
+
+	// OnReport is called with the report once reconciliation is done
+	OnReport func(report Report)
+}
+
+// Report lists where the journal and the provider disagree
+type Report struct {
+	// Unknown lists the open orders on the provider that weren't in the journal
+	Unknown []types.OrderDTO
+
+	// Listed reports whether the provider could list its open orders. Unknown orders can't be found without it,
+	// though the funds they hold still show up as balance mismatches.
+	Listed bool
+
+	// Closed lists the orders the journal had as open that are done on the provider
+	Closed []OrderDiff
+
+	// Missing lists the orders the journal had as open that the provider doesn't know. Providers forget cancelled
+	// orders that never filled, so they are journaled as cancelled.
+	Missing []types.OrderDTO
+
+	// Filled lists the orders that filled further than the journal knew, whether they are done or not
+	Filled []OrderDiff
+
+	// Balances lists the wallets whose locked funds don't match what the known open orders hold
+	Balances []BalanceMismatch
+}
+
+// Clean reports whether the journal and the provider agree
+func (r Report) Clean() bool {
+	return len(r.Unknown) == 0 && len(r.Closed) == 0 && len(r.Missing) == 0 && len(r.Filled) == 0 && len(r.Balances) == 0
+}
+
+// OrderDiff is an order as the journal last recorded it and as the provider reports it now
+type OrderDiff struct {
+	Journal  types.OrderDTO
+	Provider types.OrderDTO
+}
+
+type BalanceMismatch struct {
+	Venue    string
+	Currency string
+
+	// Expected is what the known open orders hold
+	Expected decimal.Decimal
+
+	// Locked is what the provider holds
+	Locked decimal.Decimal
+}
+
+// Run reconciles the journal with the provider. Orders the journal has as open are looked up on the provider and
+// their latest state journaled, unknown orders are dealt with as the config says, and the report is logged and
+// passed to OnReport. It returns an error if the provider can't be reached, leaving the journal as far as it got.
+func Run(ctx context.Context, provider types.Provider, journal types.OrderJournal, config Config) (report Report, err error) {
+	logger := log.WithField("source", "reconcile")
+	if config.UnknownOrders == "" {
+		config.UnknownOrders = Alert
+	}
+	if config.BalanceTolerance.IsZero() {
+		config.BalanceTolerance = decimal.NewFromFloat(0.05)
+	}
+	cp := contextual.Wrap(provider)
+
+	open, err := journal.Open()
+	if err != nil {
+		return report, fmt.Errorf("could not read the journal: %w", err)
+	}
+
+	// Bring the journal up to date with the provider
+	known := map[string]bool{}
+	working := []types.OrderDTO{}
+	for _, local := range open {
+		known[key(local)] = true
+		remote, err := cp.OrderContext(ctx, local.Market, local.ID)
+		switch {
+		case errors.Is(err, types.ErrOrderNotFound):
+			report.Missing = append(report.Missing, local)
+			remote = local
+			remote.Status = order.Canceled
+		case err != nil:
+			return report, fmt.Errorf("could not look up order %s: %w", local.ID, err)
+		default:
+			// Keep the venue of the journal, which a single provider leaves off
+			remote.Market.Venue = local.Market.Venue
+			if remote.Filled.GreaterThan(local.Filled) {
+				report.Filled = append(report.Filled, OrderDiff{Journal: local, Provider: remote})
+			}
+			if order.IsDone(remote.Status) {
+				report.Closed = append(report.Closed, OrderDiff{Journal: local, Provider: remote})
+			} else {
+				working = append(working, remote)
+			}
+		}
+
+		if remote.Status != local.Status || !remote.Filled.Equal(local.Filled) {
+			if err := journal.Record(remote); err != nil {
+				return report, fmt.Errorf("could not journal order %s: %w", local.ID, err)
+			}
+		}
+	}
+
+	// Look for orders placed outside the journal
+	if _, ok := provider.(types.OpenOrderLister); ok {
+		listed, err := contextual.OpenOrders(ctx, provider)
+		switch {
+		case errors.Is(err, types.ErrNotSupported):
+		case err != nil:
+			return report, fmt.Errorf("could not list open orders: %w", err)
+		default:
+			report.Listed = true
+			for _, remote := range listed {
+				if known[key(remote)] {
+					continue
+				}
+				report.Unknown = append(report.Unknown, remote)
+				switch config.UnknownOrders {
+				case Adopt:
+					if err := journal.Record(remote); err != nil {
+						return report, fmt.Errorf("could not journal order %s: %w", remote.ID, err)
+					}
+					working = append(working, remote)
+				case Cancel:
+					if err := cp.CancelOrderContext(ctx, remote); err != nil {
+						logger.WithError(err).Errorf("could not cancel unknown order %s", remote.ID)
+						working = append(working, remote)
+					}
+				default:
+					working = append(working, remote)
+				}
+			}
+		}
+	}
+
+	// Compare the funds the provider holds with what the open orders need
+	wallets, err := cp.WalletsContext(ctx)
+	if err != nil {
+		return report, fmt.Errorf("could not get wallets: %w", err)
+	}
+	report.Balances = balances(wallets, working, config.BalanceTolerance)
+
+	logReport(logger, report, config.UnknownOrders)
+	if config.OnReport != nil {
+		config.OnReport(report)
+	}
+	return report, nil
+}
+
+// balances finds the wallets that lock more or less than the orders should
+func balances(wallets []types.WalletDTO, working []types.OrderDTO, tolerance decimal.Decimal) []BalanceMismatch {
+	expected := map[string]decimal.Decimal{}
+	for _, dto := range working {
+		cur, amount := hold(dto)
+		k := dto.Market.Venue + "/" + cur
+		expected[k] = expected[k].Add(amount)
+	}
+
+	mismatches := []BalanceMismatch{}
+	for _, wal := range flatten(wallets) {
+		want := expected[wal.Venue+"/"+wal.Currency.Symbol]
+		slack := want.Mul(tolerance)
+		if wal.Locked.LessThan(want.Sub(slack)) || wal.Locked.GreaterThan(want.Add(slack)) {
+			mismatches = append(mismatches, BalanceMismatch{
+				Venue:    wal.Venue,
+				Currency: wal.Currency.Symbol,
+				Expected: want,
+				Locked:   wal.Locked,
+			})
+		}
+	}
+	return mismatches
+}
+
+// hold is what an open order keeps locked: the quote currency still to be spent on a buy, or the base currency
+// still to be sold
+func hold(dto types.OrderDTO) (string, decimal.Decimal) {
+	req := dto.Request
+	if req.Side != order.Buy {
+		return dto.Market.BaseCurrency.Symbol, req.Quantity.Sub(dto.Filled)
+	}
+	if req.Type == order.Market && req.Funds.IsPositive() {
+		return dto.Market.QuoteCurrency.Symbol, req.Funds.Sub(dto.Paid)
+	}
+	return dto.Market.QuoteCurrency.Symbol, req.Quantity.Sub(dto.Filled).Mul(req.Price)
+}
+
+// flatten swaps wallets aggregated across venues for the venue wallets they were summed from
+func flatten(wallets []types.WalletDTO) []types.WalletDTO {
+	flat := []types.WalletDTO{}
+	for _, wal := range wallets {
+		if len(wal.Breakdown) > 0 {
+			flat = append(flat, wal.Breakdown...)
+		} else {
+			flat = append(flat, wal)
+		}
+	}
+	return flat
+}
+
+func logReport(logger log.Entry, report Report, policy Policy) {
+	if report.Clean() {
+		logger.Info("journal and provider agree")
+		return
+	}
+	for _, dto := range report.Unknown {
+		logger.Warnf("order %s on %s is open but not in the journal; policy is to %s", dto.ID, name(dto.Market), policy)
+	}
+	for _, diff := range report.Closed {
+		logger.Warnf("order %s on %s was %s while the trader was down", diff.Journal.ID, name(diff.Journal.Market), diff.Provider.Status)
+	}
+	for _, dto := range report.Missing {
+		logger.Warnf("order %s on %s is unknown to the provider; journaling it as cancelled", dto.ID, name(dto.Market))
+	}
+	for _, diff := range report.Filled {
+		logger.Warnf("order %s on %s filled %s while the trader was down", diff.Journal.ID, name(diff.Journal.Market), diff.Provider.Filled.Sub(diff.Journal.Filled))
+	}
+	for _, m := range report.Balances {
+		logger.Warnf("%s wallet%s locks %s where the open orders hold %s", m.Currency, venue(m.Venue), m.Locked, m.Expected)
+	}
+	if !report.Listed {
+		logger.Warn("provider can't list its open orders; orders placed outside the journal weren't looked for")
+	}
+}
+
+func key(dto types.OrderDTO) string {
+	return dto.Market.Venue + "/" + dto.ID
+}
+
+func name(mkt types.MarketDTO) string {
+	return strings.TrimPrefix(mkt.Venue+":"+mkt.Name, ":")
+}
+
+func venue(name string) string {
+	if name == "" {
+		return ""
+	}
+	return " on " + name
+}
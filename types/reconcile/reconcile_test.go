@@ -0,0 +1,151 @@
+package reconcile_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/journal"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+	"github.com/sinisterminister/currencytrader/types/reconcile"
+)
+
+// unlisted hides the provider's open orders, like a provider that can't list them
+type unlisted struct {
+	types.Provider
+}
+
+func newProvider(t *testing.T) types.Provider {
+	return simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(100000), "USD": decimal.NewFromInt(100000)},
+		TickInterval: 20 * time.Millisecond,
+	})
+}
+
+// rest places a buy well under the market so it stays open
+func rest(t *testing.T, p types.Provider) types.OrderDTO {
+	mkts, err := p.Markets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mkt := range mkts {
+		if mkt.BaseCurrency.Symbol+mkt.QuoteCurrency.Symbol != "BTCUSD" && mkt.BaseCurrency.Symbol+mkt.QuoteCurrency.Symbol != "USDBTC" {
+			continue
+		}
+		tkr, err := p.Ticker(mkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dto, err := p.AttemptOrder(types.OrderRequestDTO{
+			Market:   mkt,
+			Type:     order.Limit,
+			Side:     order.Buy,
+			Price:    tkr.Bid.Div(decimal.NewFromInt(2)).Round(2),
+			Quantity: decimal.NewFromInt(1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dto
+	}
+	t.Fatal("no market between BTC and USD")
+	return types.OrderDTO{}
+}
+
+func run(t *testing.T, p types.Provider, j types.OrderJournal, policy reconcile.Policy) reconcile.Report {
+	reported := false
+	report, err := reconcile.Run(context.Background(), p, j, reconcile.Config{
+		UnknownOrders: policy,
+		OnReport:      func(reconcile.Report) { reported = true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reported {
+		t.Error("OnReport was not called")
+	}
+	return report
+}
+
+func TestCleanRun(t *testing.T) {
+	p := newProvider(t)
+	j := journal.NewMemory()
+	j.Record(rest(t, p))
+
+	if report := run(t, p, j, reconcile.Alert); !report.Clean() || !report.Listed {
+		t.Errorf("reconciling a journal that matches the provider reported %+v", report)
+	}
+}
+
+func TestUnknownOrderPolicies(t *testing.T) {
+	for _, policy := range []reconcile.Policy{reconcile.Alert, reconcile.Adopt, reconcile.Cancel} {
+		t.Run(string(policy), func(t *testing.T) {
+			p := newProvider(t)
+			j := journal.NewMemory()
+			placed := rest(t, p)
+
+			report := run(t, p, j, policy)
+			if len(report.Unknown) != 1 || report.Unknown[0].ID != placed.ID {
+				t.Fatalf("report listed unknown orders %v; expected %s", report.Unknown, placed.ID)
+			}
+			if len(report.Balances) != 0 {
+				t.Errorf("report listed balance mismatches %+v", report.Balances)
+			}
+
+			open, _ := j.Open()
+			if adopted := len(open) == 1; adopted != (policy == reconcile.Adopt) {
+				t.Errorf("journal has %d open orders under the %s policy", len(open), policy)
+			}
+			current, err := p.Order(placed.Market, placed.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cancelled := current.Status == order.Canceled; cancelled != (policy == reconcile.Cancel) {
+				t.Errorf("order is %s under the %s policy", current.Status, policy)
+			}
+		})
+	}
+}
+
+func TestJournalCaughtUp(t *testing.T) {
+	p := newProvider(t)
+	j := journal.NewMemory()
+
+	cancelled := rest(t, p)
+	j.Record(cancelled)
+	if err := p.CancelOrder(cancelled); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := cancelled
+	missing.ID = "forgotten"
+	j.Record(missing)
+
+	report := run(t, p, j, reconcile.Alert)
+	if len(report.Closed) != 1 || report.Closed[0].Provider.Status != order.Canceled {
+		t.Errorf("report listed closed orders %+v; expected the cancelled one", report.Closed)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].ID != "forgotten" {
+		t.Errorf("report listed missing orders %+v; expected the forgotten one", report.Missing)
+	}
+	if open, _ := j.Open(); len(open) != 0 {
+		t.Errorf("journal still has %d open orders after reconciling", len(open))
+	}
+}
+
+func TestBalanceMismatch(t *testing.T) {
+	p := newProvider(t)
+	placed := rest(t, p)
+
+	// Without a list of open orders, the funds an unknown order holds are all that gives it away
+	report := run(t, unlisted{p}, journal.NewMemory(), reconcile.Alert)
+	if report.Listed {
+		t.Error("report claims a provider that can't list its orders listed them")
+	}
+	if len(report.Balances) != 1 || report.Balances[0].Currency != placed.Market.QuoteCurrency.Symbol || !report.Balances[0].Expected.IsZero() {
+		t.Errorf("report listed balance mismatches %+v; expected the quote currency locked by the unknown order", report.Balances)
+	}
+}
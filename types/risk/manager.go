@@ -0,0 +1,378 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/algo"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type manager struct {
+	log    log.Entry
+	trader types.Trader
+	orders types.OrderSvc
+	config Config
+
+	// killed is set atomically, so the kill switch never waits on an order being checked or placed
+	killed int32
+
+	// mutex is held while an order is checked. The order is placed without it, with its slot reserved so the limits
+	// still see it.
+	mutex     sync.Mutex
+	reserved  int
+	placed    []time.Time
+	positions map[string]*position
+	day       time.Time
+	opening   map[string]decimal.Decimal
+
+	priceMutex sync.RWMutex
+	prices     map[string]decimal.Decimal
+}
+
+// position is what the orders placed through the manager did on a market. Orders are folded into the totals once
+// they are done.
+type position struct {
+	market types.Market
+	base   decimal.Decimal
+	quote  decimal.Decimal
+	orders []types.Order
+
+	// reserved is the base currency of the buys checked but not yet placed
+	reserved decimal.Decimal
+}
+
+// New wraps the trader's order service with the limits in the config. Prices are taken from the trader's ticker
+// events, and from the provider for the market of each order checked.
+func New(trader types.Trader, orders types.OrderSvc, config Config) Manager {
+	if config.MaxOrders > 0 && config.OrderWindow <= 0 {
+		config.OrderWindow = time.Second
+	}
+	m := &manager{
+		log:       log.WithField("source", "risk.manager"),
+		trader:    trader,
+		orders:    orders,
+		config:    config,
+		positions: make(map[string]*position),
+		opening:   make(map[string]decimal.Decimal),
+		prices:    make(map[string]decimal.Decimal),
+	}
+
+	// Subscribe for as long as the trader lives
+	tickers := trader.Events().Subscribe(make(chan bool), types.EventFilter{Types: []types.EventType{types.EventTicker}})
+	go func() {
+		for event := range tickers {
+			m.setPrice(event.Market.Venue+":"+event.Market.Name, price(event.Ticker.Price, event.Ticker.Bid, event.Ticker.Ask))
+		}
+	}()
+	return m
+}
+
+func (m *manager) AttemptOrder(mkt types.Market, req types.OrderRequest) (types.Order, error) {
+	return m.AttemptOrderContext(context.Background(), mkt, req)
+}
+
+func (m *manager) AttemptOrderContext(ctx context.Context, mkt types.Market, req types.OrderRequest) (types.Order, error) {
+	if m.Killed() {
+		return nil, &Violation{Rule: ErrKilled, Market: marketKey(mkt)}
+	}
+
+	// The price is fetched before taking the lock, so a slow provider doesn't hold up the orders on other markets
+	tkr, err := mkt.TickerContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the price to check the order against: %w", err)
+	}
+
+	m.mutex.Lock()
+	buying, err := m.check(mkt, req, tkr)
+	if err != nil {
+		m.mutex.Unlock()
+		m.log.WithError(err).Warn("order rejected")
+		if errors.Is(err, ErrDailyLoss) {
+			m.Kill(err.Error())
+		}
+		return nil, err
+	}
+	pos := m.position(mkt)
+	pos.reserved = pos.reserved.Add(buying)
+	m.reserved++
+	m.mutex.Unlock()
+
+	o, err := m.orders.AttemptOrderContext(ctx, mkt, req)
+
+	// An execution's children come through on their own, so only they are tracked
+	m.mutex.Lock()
+	pos.reserved = pos.reserved.Sub(buying)
+	m.reserved--
+	if _, ok := o.(algo.Execution); err == nil && !ok {
+		pos.orders = append(pos.orders, o)
+	}
+	m.mutex.Unlock()
+
+	// The kill switch may have gone on while the order was placed, after it cancelled the open orders
+	if err == nil && m.Killed() {
+		if err := m.orders.CancelOrderContext(ctx, o); err != nil {
+			m.log.WithError(err).Errorf("could not cancel order %s placed as the kill switch went on", o.ID())
+		}
+	}
+	return o, err
+}
+
+// check runs the request past every rule at the ticker's prices, counting it against the order rate if it passes,
+// and returns the base currency it buys. The caller holds the lock.
+func (m *manager) check(mkt types.Market, req types.OrderRequest, tkr types.Ticker) (decimal.Decimal, error) {
+	violation := func(rule error, value decimal.Decimal, limit decimal.Decimal) error {
+		return &Violation{Rule: rule, Market: marketKey(mkt), Value: value, Limit: limit}
+	}
+	if m.Killed() {
+		return decimal.Zero, violation(ErrKilled, decimal.Zero, decimal.Zero)
+	}
+
+	now := time.Now()
+	if m.config.MaxOrders > 0 {
+		recent := m.placed[:0]
+		for _, t := range m.placed {
+			if now.Sub(t) < m.config.OrderWindow {
+				recent = append(recent, t)
+			}
+		}
+		m.placed = recent
+		if len(m.placed) >= m.config.MaxOrders {
+			return decimal.Zero, violation(ErrOrderRate, decimal.NewFromInt(int64(len(m.placed)+1)), decimal.NewFromInt(int64(m.config.MaxOrders)))
+		}
+	}
+
+	if m.config.MaxOpenOrders > 0 {
+		if open := len(m.orders.Orders()) + m.reserved; open >= m.config.MaxOpenOrders {
+			return decimal.Zero, violation(ErrMaxOpenOrders, decimal.NewFromInt(int64(open+1)), decimal.NewFromInt(int64(m.config.MaxOpenOrders)))
+		}
+	}
+
+	last := price(tkr.Price(), tkr.Bid(), tkr.Ask())
+	m.setPrice(marketKey(mkt), last)
+
+	// Market orders are valued at the side of the book they take
+	limits := m.config.limits(mkt)
+	fill := req.Price()
+	if req.Type() == order.Market || !fill.IsPositive() {
+		fill = tkr.Bid()
+		if req.Side() == order.Buy {
+			fill = tkr.Ask()
+		}
+	}
+	quantity := req.Quantity()
+	if !quantity.IsPositive() && fill.IsPositive() {
+		quantity = req.Funds().Div(fill)
+	}
+	notional := quantity.Mul(fill)
+	if req.Funds().IsPositive() && req.Type() == order.Market {
+		notional = req.Funds()
+	}
+
+	if limits.MaxNotional.IsPositive() && notional.GreaterThan(limits.MaxNotional) {
+		return decimal.Zero, violation(ErrMaxNotional, notional, limits.MaxNotional)
+	}
+
+	if limits.PriceBand.IsPositive() && req.Type() != order.Market && last.IsPositive() {
+		band := req.Price().Sub(last).Abs().Div(last)
+		if band.GreaterThan(limits.PriceBand) {
+			return decimal.Zero, violation(ErrPriceBand, band, limits.PriceBand)
+		}
+	}
+
+	if limits.MaxPosition.IsPositive() && req.Side() == order.Buy {
+		held, buying := m.position(mkt).exposure(fill)
+		if after := held.Add(buying).Add(quantity); after.GreaterThan(limits.MaxPosition) {
+			return decimal.Zero, violation(ErrMaxPosition, after, limits.MaxPosition)
+		}
+	}
+
+	if m.config.MaxDailyLoss.IsPositive() {
+		quote := mkt.QuoteCurrency().Symbol()
+		if loss := m.loss(quote, now); loss.GreaterThanOrEqual(m.config.MaxDailyLoss) {
+			return decimal.Zero, violation(ErrDailyLoss, loss, m.config.MaxDailyLoss)
+		}
+	}
+
+	if m.config.MaxOrders > 0 {
+		m.placed = append(m.placed, now)
+	}
+	if req.Side() != order.Buy {
+		return decimal.Zero, nil
+	}
+	return quantity, nil
+}
+
+// loss is how much the positions in the quote currency lost since the start of the UTC day. The caller holds the
+// lock.
+func (m *manager) loss(quote string, now time.Time) decimal.Decimal {
+	value := decimal.Zero
+	for key, pos := range m.positions {
+		if pos.market.QuoteCurrency().Symbol() != quote {
+			continue
+		}
+		base, cash := pos.settle()
+		value = value.Add(cash).Add(base.Mul(m.price(key)))
+	}
+
+	// The day opens at what the positions were worth when it was first checked
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !day.Equal(m.day) {
+		m.day = day
+		m.opening = make(map[string]decimal.Decimal)
+	}
+	opening, ok := m.opening[quote]
+	if !ok {
+		m.opening[quote] = value
+		opening = value
+	}
+	return opening.Sub(value)
+}
+
+// position returns the position on the market. The caller holds the lock.
+func (m *manager) position(mkt types.Market) *position {
+	key := marketKey(mkt)
+	pos, ok := m.positions[key]
+	if !ok {
+		pos = &position{market: mkt}
+		m.positions[key] = pos
+	}
+	return pos
+}
+
+func (m *manager) Kill(reason string) error {
+	atomic.StoreInt32(&m.killed, 1)
+
+	err := fmt.Errorf("kill switch turned on: %s", reason)
+	m.log.Error(err.Error())
+	m.trader.Events().Publish(types.Event{Type: types.EventError, Err: err})
+
+	var first error
+	for _, o := range m.orders.Orders() {
+		if err := m.orders.CancelOrder(o); err != nil {
+			m.log.WithError(err).Errorf("could not cancel order %s", o.ID())
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (m *manager) Killed() bool {
+	return atomic.LoadInt32(&m.killed) == 1
+}
+
+func (m *manager) Resume() {
+	atomic.StoreInt32(&m.killed, 0)
+	m.log.Info("kill switch turned off")
+}
+
+func (m *manager) CancelOrder(o types.Order) error {
+	return m.orders.CancelOrder(o)
+}
+
+func (m *manager) CancelOrderContext(ctx context.Context, o types.Order) error {
+	return m.orders.CancelOrderContext(ctx, o)
+}
+
+func (m *manager) Order(mkt types.Market, id string) (types.Order, error) {
+	return m.orders.Order(mkt, id)
+}
+
+func (m *manager) OrderContext(ctx context.Context, mkt types.Market, id string) (types.Order, error) {
+	return m.orders.OrderContext(ctx, mkt, id)
+}
+
+func (m *manager) OrderFromDTO(dto types.OrderDTO) types.Order {
+	return m.orders.OrderFromDTO(dto)
+}
+
+func (m *manager) Orders() []types.Order {
+	return m.orders.Orders()
+}
+
+func (m *manager) price(key string) decimal.Decimal {
+	m.priceMutex.RLock()
+	defer m.priceMutex.RUnlock()
+	return m.prices[key]
+}
+
+func (m *manager) setPrice(key string, p decimal.Decimal) {
+	if !p.IsPositive() {
+		return
+	}
+	m.priceMutex.Lock()
+	defer m.priceMutex.Unlock()
+	m.prices[key] = p
+}
+
+// settle folds the orders that are done into the totals and returns the base and quote currency the position holds
+func (p *position) settle() (base decimal.Decimal, quote decimal.Decimal) {
+	base, quote = p.base, p.quote
+	open := p.orders[:0]
+	for _, o := range p.orders {
+		b, q := change(o)
+		if o.IsDone() {
+			p.base, p.quote = p.base.Add(b), p.quote.Add(q)
+		} else {
+			open = append(open, o)
+		}
+		base, quote = base.Add(b), quote.Add(q)
+	}
+	p.orders = open
+	return
+}
+
+// exposure returns the base currency held and what the open and reserved buys would add, valuing buys by funds at
+// the price
+func (p *position) exposure(at decimal.Decimal) (held decimal.Decimal, buying decimal.Decimal) {
+	held, _ = p.settle()
+	buying = p.reserved
+	for _, o := range p.orders {
+		req := o.Request()
+		if req.Side() != order.Buy {
+			continue
+		}
+		if req.Quantity().IsPositive() {
+			buying = buying.Add(req.Quantity().Sub(o.Filled()))
+		} else if at.IsPositive() {
+			buying = buying.Add(req.Funds().Sub(o.Paid()).Div(at))
+		}
+	}
+	return
+}
+
+// change is what the order did to the base and quote currency held, fees included
+func change(o types.Order) (base decimal.Decimal, quote decimal.Decimal) {
+	base, quote = o.Filled(), o.Paid().Neg()
+	if o.Request().Side() != order.Buy {
+		base, quote = base.Neg(), quote.Neg()
+	}
+	side, fees := o.Fees()
+	if side == order.Buy {
+		base = base.Sub(fees)
+	} else {
+		quote = quote.Sub(fees)
+	}
+	return
+}
+
+// price is the last trade price, or the middle of the book without one
+func price(last decimal.Decimal, bid decimal.Decimal, ask decimal.Decimal) decimal.Decimal {
+	if last.IsPositive() {
+		return last
+	}
+	return bid.Add(ask).Div(decimal.NewFromInt(2))
+}
+
+func marketKey(mkt types.Market) string {
+	return mkt.Venue() + ":" + mkt.Name()
+}
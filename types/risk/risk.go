@@ -0,0 +1,99 @@
+// Package risk checks orders against limits before they are placed and keeps a kill switch that cancels every open
+// order and blocks new ones
+package risk
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// Rules an order can break. A rejected order's error matches its rule with errors.Is.
+var (
+	ErrDailyLoss     = errors.New("daily loss limit reached")
+	ErrKilled        = errors.New("kill switch is on")
+	ErrMaxNotional   = errors.New("order notional over limit")
+	ErrMaxOpenOrders = errors.New("too many open orders")
+	ErrMaxPosition   = errors.New("position over limit")
+	ErrOrderRate     = errors.New("order rate over limit")
+	ErrPriceBand     = errors.New("price outside band")
+)
+
+// Manager is an order service that checks every order against the limits before passing it on
+type Manager interface {
+	types.OrderSvc
+
+	// Kill rejects every new order and cancels the open ones, returning the first error cancelling them
+	Kill(reason string) error
+
+	// Killed reports whether the kill switch is on
+	Killed() bool
+
+	// Resume lets orders through again after Kill
+	Resume()
+}
+
+// Limits are the limits an order is checked against on a market. Limits left at zero aren't checked.
+type Limits struct {
+	// MaxNotional caps an order's value in the quote currency: its price times its quantity, or its funds
+	MaxNotional decimal.Decimal
+
+	// MaxPosition caps the base currency bought on the market, less what was sold, since the manager was created.
+	// Open buys count as if they filled.
+	MaxPosition decimal.Decimal
+
+	// PriceBand caps how far a limit order's price may be from the last price, as a fraction of the last price
+	PriceBand decimal.Decimal
+}
+
+type Config struct {
+	// Limits apply to every market that isn't in Markets
+	Limits
+
+	// Markets holds the limits of particular markets by name, in place of the default ones
+	Markets map[string]Limits
+
+	// MaxOpenOrders caps the orders open on the trader at once
+	MaxOpenOrders int
+
+	// MaxOrders caps the orders placed in any OrderWindow
+	MaxOrders   int
+	OrderWindow time.Duration
+
+	// MaxDailyLoss caps what the orders placed through the manager may lose in a quote currency in a UTC day,
+	// with positions valued at the last price. It is checked with each order, and the first order to find it
+	// reached turns the kill switch on.
+	MaxDailyLoss decimal.Decimal
+}
+
+// Violation is the error an order that breaks a rule is rejected with
+type Violation struct {
+	Rule   error
+	Market string
+
+	// Value is what the order came to and Limit what it may come to. Both are zero for the kill switch.
+	Value decimal.Decimal
+	Limit decimal.Decimal
+}
+
+func (v *Violation) Error() string {
+	if v.Limit.IsZero() && v.Value.IsZero() {
+		return fmt.Sprintf("order on %s rejected: %s", v.Market, v.Rule)
+	}
+	return fmt.Sprintf("order on %s rejected: %s (%s over %s)", v.Market, v.Rule, v.Value, v.Limit)
+}
+
+func (v *Violation) Is(target error) bool {
+	return target == v.Rule
+}
+
+// limits returns the limits of the market
+func (c Config) limits(mkt types.Market) Limits {
+	if limits, ok := c.Markets[mkt.Name()]; ok {
+		return limits
+	}
+	return c.Limits
+}
@@ -0,0 +1,205 @@
+package risk_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/algo"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+	"github.com/sinisterminister/currencytrader/types/risk"
+	"github.com/sinisterminister/currencytrader/types/trader/tradertest"
+)
+
+// setup starts a trader behind a risk manager and returns a resting buy on its BTC market to place
+func setup(t *testing.T, config risk.Config) (types.Trader, risk.Manager, types.Market, types.OrderRequest) {
+	trader, mkt := tradertest.StartWithConfig(t, currencytrader.TraderConfig{Risk: &config})
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	price := tkr.Bid().Mul(decimal.NewFromFloat(0.95)).Round(2)
+	req := order.NewRequest(mkt, order.Limit, order.Buy, decimal.NewFromFloat(0.01), price, decimal.Zero, false)
+	return trader, trader.OrderSvc().(risk.Manager), mkt, req
+}
+
+func TestRulesRejectOrders(t *testing.T) {
+	tests := []struct {
+		name   string
+		config risk.Config
+		rule   error
+	}{
+		{"notional", risk.Config{Limits: risk.Limits{MaxNotional: decimal.NewFromFloat(0.000001)}}, risk.ErrMaxNotional},
+		{"price band", risk.Config{Limits: risk.Limits{PriceBand: decimal.NewFromFloat(0.01)}}, risk.ErrPriceBand},
+		{"position", risk.Config{Limits: risk.Limits{MaxPosition: decimal.NewFromFloat(0.015)}}, risk.ErrMaxPosition},
+		{"open orders", risk.Config{MaxOpenOrders: 1}, risk.ErrMaxOpenOrders},
+		{"order rate", risk.Config{MaxOrders: 1, OrderWindow: time.Minute}, risk.ErrOrderRate},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trader, _, mkt, req := setup(t, test.config)
+
+			// The limits that count orders let the first one through
+			_, err := trader.OrderSvc().AttemptOrder(mkt, req)
+			if test.rule == risk.ErrMaxNotional || test.rule == risk.ErrPriceBand {
+				if !errors.Is(err, test.rule) {
+					t.Fatalf("first order returned %v; expected %v", err, test.rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("first order returned %v", err)
+			}
+
+			_, err = trader.OrderSvc().AttemptOrder(mkt, req)
+			var violation *risk.Violation
+			if !errors.Is(err, test.rule) || !errors.As(err, &violation) || violation.Market != ":"+mkt.Name() {
+				t.Fatalf("second order returned %v; expected %v", err, test.rule)
+			}
+		})
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	trader, manager, mkt, req := setup(t, risk.Config{})
+
+	placed, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Kill("test"); err != nil {
+		t.Fatalf("Kill() returned %v", err)
+	}
+	select {
+	case <-placed.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("open order was not cancelled; last saw %s", placed.Status())
+	}
+
+	if _, err := mkt.AttemptOrder(req); !errors.Is(err, risk.ErrKilled) || !manager.Killed() {
+		t.Fatalf("order returned %v with the kill switch on; expected %v", err, risk.ErrKilled)
+	}
+
+	manager.Resume()
+	if _, err := mkt.AttemptOrder(req); err != nil {
+		t.Fatalf("order returned %v after resuming", err)
+	}
+}
+
+// blocking holds every order at the provider until it is released
+type blocking struct {
+	types.OrderSvc
+	entered chan bool
+	release chan bool
+}
+
+func (b *blocking) AttemptOrderContext(ctx context.Context, mkt types.Market, req types.OrderRequest) (types.Order, error) {
+	b.entered <- true
+	<-b.release
+	return b.OrderSvc.AttemptOrderContext(ctx, mkt, req)
+}
+
+func TestPlacingDoesNotHoldTheLimits(t *testing.T) {
+	trader, orders, mkt, req := setup(t, risk.Config{})
+	svc := &blocking{OrderSvc: orders, entered: make(chan bool, 1), release: make(chan bool)}
+	manager := risk.New(trader, svc, risk.Config{MaxOpenOrders: 1})
+
+	type result struct {
+		order types.Order
+		err   error
+	}
+	first := make(chan result, 1)
+	go func() {
+		o, err := manager.AttemptOrder(mkt, req)
+		first <- result{o, err}
+	}()
+	<-svc.entered
+
+	// The order being placed holds its slot, and neither the limits nor the kill switch wait on it
+	checked := make(chan error, 1)
+	go func() {
+		_, err := manager.AttemptOrder(mkt, req)
+		checked <- err
+	}()
+	select {
+	case err := <-checked:
+		if !errors.Is(err, risk.ErrMaxOpenOrders) {
+			t.Fatalf("second order returned %v; expected %v", err, risk.ErrMaxOpenOrders)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second order waited on the first one being placed")
+	}
+
+	killed := make(chan error, 1)
+	go func() { killed <- manager.Kill("test") }()
+	select {
+	case <-killed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("kill switch waited on the order being placed")
+	}
+
+	// The order placed as the kill switch went on is cancelled once it is
+	close(svc.release)
+	res := <-first
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	select {
+	case <-res.order.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("order placed during the kill was not cancelled; last saw %s", res.order.Status())
+	}
+}
+
+func TestRoutedTraderKeepsTheKillSwitch(t *testing.T) {
+	prov := simulated.New(simulated.ProviderConfig{})
+	trader := currencytrader.NewRoutedWithConfig(map[string]types.Provider{"alpha": prov}, currencytrader.TraderConfig{
+		Risk: &risk.Config{},
+	})
+
+	manager, ok := trader.OrderSvc().(risk.Manager)
+	if !ok {
+		t.Fatal("routed trader's OrderSvc is not a risk.Manager")
+	}
+	manager.Kill("test")
+	if !manager.Killed() {
+		t.Fatal("kill switch is off after Kill")
+	}
+}
+
+func TestKillSwitchEndsIcebergs(t *testing.T) {
+	trader, manager, mkt, req := setup(t, risk.Config{})
+
+	dto := req.ToDTO()
+	dto.DisplayQuantity = dto.Quantity.Div(decimal.NewFromInt(4))
+	o, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequestFromDTO(mkt, dto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ice := o.(algo.Execution)
+
+	// Icebergs aren't listed themselves, but the kill switch cancels their slices, which ends them
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ice.Children()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("iceberg didn't show its first slice")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := manager.Kill("test"); err != nil {
+		t.Fatalf("Kill() returned %v", err)
+	}
+	select {
+	case <-ice.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("iceberg is still %s with the kill switch on", ice.Status())
+	}
+	if ice.Status() != order.Canceled {
+		t.Errorf("iceberg is %s after the kill; expected %s", ice.Status(), order.Canceled)
+	}
+}
@@ -0,0 +1,58 @@
+package strategy
+
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// builder turns a market's tickers into candles of an interval. Candles are bucketed by the time of the tickers
+// rather than the clock, so replayed data makes the same candles it did live. A candle closes when the first
+// ticker of a later one arrives.
+type builder struct {
+	interval types.CandleInterval
+	length   time.Duration
+	current  *types.CandleDTO
+}
+
+// add folds the ticker into the current candle and returns the candle it closed, if any. Tickers older than the
+// current candle are dropped.
+func (b *builder) add(tkr types.Ticker) (closed types.CandleDTO, ok bool) {
+	price := tkr.Price()
+	if !price.IsPositive() {
+		price = tkr.Bid().Add(tkr.Ask()).Div(decimal.NewFromInt(2))
+	}
+	if !price.IsPositive() {
+		return
+	}
+	ts := tkr.Timestamp()
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	bucket := ts.Truncate(b.length)
+
+	switch {
+	case b.current == nil:
+	case bucket.After(b.current.Timestamp):
+		closed, ok = *b.current, true
+	case bucket.Before(b.current.Timestamp):
+		return
+	default:
+		b.current.High = decimal.Max(b.current.High, price)
+		b.current.Low = decimal.Min(b.current.Low, price)
+		b.current.Close = price
+		b.current.Volume = b.current.Volume.Add(tkr.Quantity())
+		return
+	}
+
+	b.current = &types.CandleDTO{
+		Open:      price,
+		High:      price,
+		Low:       price,
+		Close:     price,
+		Volume:    tkr.Quantity(),
+		Timestamp: bucket,
+	}
+	return
+}
@@ -0,0 +1,7 @@
+package strategy
+
+import "github.com/spf13/viper"
+
+func init() {
+	viper.SetDefault("currencytrader.strategy.streamBufferSize", 64)
+}
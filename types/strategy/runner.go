@@ -0,0 +1,290 @@
+package strategy
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/candle"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+type runner struct {
+	log      log.Entry
+	trader   types.Trader
+	strategy Strategy
+	config   Config
+	session  *session
+
+	mutex   sync.Mutex
+	running bool
+	stop    chan bool
+	done    chan bool
+	err     error
+}
+
+// tick is a ticker along with the market it is for
+type tick struct {
+	market types.Market
+	ticker types.Ticker
+}
+
+// session hands the strategy the trader. It is only used from the runner's loop, so it needs no locking.
+type session struct {
+	runner *runner
+	owned  map[string]types.Order
+}
+
+// New creates a runner that feeds the strategy from the trader
+func New(trader types.Trader, strategy Strategy, config Config) Runner {
+	r := &runner{
+		log:      log.WithField("source", "strategy").WithField("strategy", config.Name),
+		trader:   trader,
+		strategy: strategy,
+		config:   config,
+	}
+	r.session = &session{runner: r, owned: make(map[string]types.Order)}
+	return r
+}
+
+func (r *runner) Start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.running {
+		return
+	}
+
+	builders := map[string][]*builder{}
+	for _, interval := range r.config.Candles {
+		length, err := time.ParseDuration(string(interval))
+		if err != nil || length <= 0 {
+			r.err = fmt.Errorf("strategy %s has an invalid candle interval %q", r.config.Name, interval)
+			r.log.WithError(r.err).Error("not starting")
+			return
+		}
+		for _, mkt := range r.config.Markets {
+			builders[marketKey(mkt)] = append(builders[marketKey(mkt)], &builder{interval: interval, length: length})
+		}
+	}
+
+	r.stop = make(chan bool)
+	r.done = make(chan bool)
+	r.running = true
+	r.err = nil
+	go r.run(r.stop, r.done, builders)
+}
+
+// Stop stops feeding the strategy and waits for OnStop to return. It must not be called from a hook.
+func (r *runner) Stop() {
+	r.mutex.Lock()
+	if !r.running {
+		r.mutex.Unlock()
+		return
+	}
+	close(r.stop)
+	done := r.done
+	r.mutex.Unlock()
+	<-done
+}
+
+func (r *runner) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *runner) Running() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.running
+}
+
+// run is the loop that calls the strategy's hooks. It ends when the runner is stopped, a hook panics or the trader
+// shuts down.
+func (r *runner) run(stop <-chan bool, done chan bool, builders map[string][]*builder) {
+	defer func() {
+		r.mutex.Lock()
+		r.running = false
+		r.mutex.Unlock()
+		close(done)
+	}()
+
+	// Feeds run until the loop ends, whatever ended it
+	var feeds lifecycle.Group
+	feedStop := make(chan bool)
+	defer func() {
+		close(feedStop)
+		feeds.Wait(context.Background())
+	}()
+
+	events := r.trader.Events().Subscribe(feedStop, types.EventFilter{Types: []types.EventType{
+		types.EventFill,
+		types.EventOrderCanceled,
+		types.EventOrderFilled,
+		types.EventOrderUpdated,
+	}})
+	ticks := make(chan tick, viper.GetInt("currencytrader.strategy.streamBufferSize"))
+	for _, mkt := range r.config.Markets {
+		mkt, stream := mkt, mkt.TickerStream(feedStop)
+		feeds.Go(func() {
+			for tkr := range stream {
+				select {
+				case ticks <- tick{market: mkt, ticker: tkr}:
+				case <-feedStop:
+					return
+				}
+			}
+		})
+	}
+	var timer <-chan time.Time
+	if r.config.TimerInterval > 0 {
+		ticker := time.NewTicker(r.config.TimerInterval)
+		defer ticker.Stop()
+		timer = ticker.C
+	}
+
+	var err error
+	if !r.call("OnStart", func() { err = r.strategy.OnStart(r.session) }) {
+		return
+	}
+	if err != nil {
+		r.fail(fmt.Errorf("strategy %s could not start: %w", r.config.Name, err))
+		return
+	}
+
+	ok := true
+	for ok {
+		select {
+		case <-stop:
+			ok = false
+		case t := <-ticks:
+			ok = r.handleTick(t, builders[marketKey(t.market)])
+		case event, open := <-events:
+			if !open {
+				r.log.Info("trader shut down; stopping")
+				ok = false
+				break
+			}
+			ok = r.handleEvent(event)
+		case now := <-timer:
+			ok = r.call("OnTimer", func() { r.strategy.OnTimer(r.session, now) })
+		}
+	}
+
+	r.call("OnStop", func() { r.strategy.OnStop(r.session) })
+	if r.config.CancelOnStop {
+		for _, o := range r.session.Orders() {
+			if err := r.trader.OrderSvc().CancelOrder(o); err != nil {
+				r.log.WithError(err).Errorf("could not cancel order %s", o.ID())
+			}
+		}
+	}
+}
+
+func (r *runner) handleTick(t tick, builders []*builder) bool {
+	if !r.call("OnTicker", func() { r.strategy.OnTicker(r.session, t.market, t.ticker) }) {
+		return false
+	}
+	for _, b := range builders {
+		dto, closed := b.add(t.ticker)
+		if !closed {
+			continue
+		}
+		if !r.call("OnCandle", func() { r.strategy.OnCandle(r.session, t.market, b.interval, candle.New(dto)) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// handleEvent passes on the updates of the orders the strategy placed
+func (r *runner) handleEvent(event types.Event) bool {
+	if event.Order == nil {
+		return true
+	}
+	key := orderKey(event.Order.Market.Venue, event.Order.ID)
+	o, ok := r.session.owned[key]
+	if !ok {
+		return true
+	}
+
+	if event.Type == types.EventFill {
+		return r.call("OnFill", func() { r.strategy.OnFill(r.session, o, *event.Fill) })
+	}
+	if order.IsDone(event.Order.Status) {
+		delete(r.session.owned, key)
+	}
+	return r.call("OnOrderUpdate", func() { r.strategy.OnOrderUpdate(r.session, o) })
+}
+
+// call runs a hook, turning a panic into the runner's error
+func (r *runner) call(hook string, fn func()) (ok bool) {
+	defer func() {
+		if value := recover(); value != nil {
+			r.fail(&PanicError{Hook: hook, Value: value, Stack: debug.Stack()})
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+func (r *runner) fail(err error) {
+	r.log.WithError(err).Error("strategy stopped")
+	r.mutex.Lock()
+	r.err = err
+	r.mutex.Unlock()
+	r.trader.Events().Publish(types.Event{Type: types.EventError, Err: err})
+}
+
+func (s *session) AttemptOrder(req types.OrderRequest) (types.Order, error) {
+	o, err := s.runner.trader.OrderSvc().AttemptOrder(req.Market(), req)
+	if err != nil {
+		return nil, err
+	}
+	s.owned[orderKey(o.Market().Venue(), o.ID())] = o
+	return o, nil
+}
+
+func (s *session) CancelOrder(o types.Order) error {
+	return s.runner.trader.OrderSvc().CancelOrder(o)
+}
+
+func (s *session) Log() log.Entry {
+	return s.runner.log
+}
+
+func (s *session) Markets() []types.Market {
+	return append([]types.Market{}, s.runner.config.Markets...)
+}
+
+// Orders lists the open orders oldest first. Done orders are forgotten once their last update reaches the strategy.
+func (s *session) Orders() []types.Order {
+	orders := []types.Order{}
+	for _, o := range s.owned {
+		if !o.IsDone() {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreationTime().Before(orders[j].CreationTime()) })
+	return orders
+}
+
+func (s *session) Trader() types.Trader {
+	return s.runner.trader
+}
+
+func marketKey(mkt types.Market) string {
+	return mkt.Venue() + ":" + mkt.Name()
+}
+
+func orderKey(venue string, id string) string {
+	return venue + "/" + id
+}
@@ -0,0 +1,108 @@
+// Package strategy runs a trading bot's logic against a trader, feeding it market data and the updates of the orders
+// it placed. A strategy runs the same way against live, paper, simulated and replayed providers.
+package strategy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/sinisterminister/currencytrader/types"
+)
+
+// Strategy is a trading bot's logic. The runner calls its hooks one at a time, so a strategy needs no locking of
+// its own. Embed Base to only implement the hooks the strategy needs.
+type Strategy interface {
+	// OnStart is called each time the runner starts, before any other hook. Returning an error stops the runner.
+	OnStart(s Session) error
+
+	// OnStop is called when the runner stops, after every other hook
+	OnStop(s Session)
+
+	OnTicker(s Session, mkt types.Market, tkr types.Ticker)
+
+	// OnCandle is called with each candle of the configured intervals once it closes
+	OnCandle(s Session, mkt types.Market, interval types.CandleInterval, c types.Candle)
+
+	// OnOrderUpdate is called when an order the strategy placed changes state
+	OnOrderUpdate(s Session, o types.Order)
+
+	// OnFill is called for every fill of an order the strategy placed, before the order update for it
+	OnFill(s Session, o types.Order, fill types.FillDTO)
+
+	// OnTimer is called every TimerInterval
+	OnTimer(s Session, now time.Time)
+}
+
+// Base implements every hook of a strategy by doing nothing
+type Base struct{}
+
+func (Base) OnStart(s Session) error { return nil }
+
+func (Base) OnStop(s Session) {}
+
+func (Base) OnTicker(s Session, mkt types.Market, tkr types.Ticker) {}
+
+func (Base) OnCandle(s Session, mkt types.Market, interval types.CandleInterval, c types.Candle) {}
+
+func (Base) OnOrderUpdate(s Session, o types.Order) {}
+
+func (Base) OnFill(s Session, o types.Order, fill types.FillDTO) {}
+
+func (Base) OnTimer(s Session, now time.Time) {}
+
+// Session is what a strategy trades through. It is only meant to be used from the strategy's hooks.
+type Session interface {
+	// AttemptOrder places the request through the trader and watches the order for the strategy
+	AttemptOrder(req types.OrderRequest) (types.Order, error)
+	CancelOrder(o types.Order) error
+
+	Log() log.Entry
+	Markets() []types.Market
+
+	// Orders returns the orders the strategy placed that are still open
+	Orders() []types.Order
+
+	Trader() types.Trader
+}
+
+// Runner runs a strategy against a trader. The trader needs to be started for market data and order updates to
+// flow.
+type Runner interface {
+	types.Administerable
+
+	// Err returns why the runner last stopped on its own, such as OnStart failing or a hook panicking
+	Err() error
+
+	// Running reports whether the runner is feeding the strategy
+	Running() bool
+}
+
+type Config struct {
+	// Name tells strategies apart in the logs and in the errors they publish
+	Name string
+
+	// Markets are the markets whose tickers and candles the strategy gets
+	Markets []types.Market
+
+	// Candles are the intervals to build candles of from the tickers, such as candle.OneMinute
+	Candles []types.CandleInterval
+
+	// TimerInterval is how often OnTimer is called. The timer is off when it is zero.
+	TimerInterval time.Duration
+
+	// CancelOnStop cancels the orders the strategy still has open when the runner stops
+	CancelOnStop bool
+}
+
+// PanicError is returned by Err when a hook panicked. The runner stops since the strategy's state can't be trusted
+// after a panic.
+type PanicError struct {
+	Hook  string
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("strategy panicked in %s: %v", e.Hook, e.Value)
+}
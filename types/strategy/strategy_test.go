@@ -0,0 +1,140 @@
+package strategy_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/strategy"
+	"github.com/sinisterminister/currencytrader/types/trader/tradertest"
+)
+
+// buyer buys once on the first ticker and counts the hooks it gets
+type buyer struct {
+	strategy.Base
+
+	mutex   sync.Mutex
+	placed  types.Order
+	calls   map[string]int
+	stopped bool
+}
+
+func (b *buyer) count(hook string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.calls[hook]++
+}
+
+func (b *buyer) seen(hooks ...string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, hook := range hooks {
+		if b.calls[hook] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *buyer) OnTicker(s strategy.Session, mkt types.Market, tkr types.Ticker) {
+	b.count("OnTicker")
+	if b.placed != nil {
+		return
+	}
+	o, err := s.AttemptOrder(order.NewRequest(mkt, order.Market, order.Buy, decimal.NewFromFloat(0.01), decimal.Zero, decimal.Zero, false))
+	if err != nil {
+		panic(err)
+	}
+	b.placed = o
+}
+
+func (b *buyer) OnCandle(s strategy.Session, mkt types.Market, interval types.CandleInterval, c types.Candle) {
+	if c.High().LessThan(c.Low()) {
+		panic("candle high is under its low")
+	}
+	b.count("OnCandle")
+}
+
+func (b *buyer) OnOrderUpdate(s strategy.Session, o types.Order) {
+	if o != b.placed {
+		panic("update for an order the strategy didn't place")
+	}
+	b.count("OnOrderUpdate")
+}
+
+func (b *buyer) OnFill(s strategy.Session, o types.Order, fill types.FillDTO) {
+	b.count("OnFill")
+}
+
+func (b *buyer) OnTimer(s strategy.Session, now time.Time) {
+	b.count("OnTimer")
+}
+
+func (b *buyer) OnStop(s strategy.Session) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stopped = true
+}
+
+// panicker panics on its first ticker
+type panicker struct {
+	strategy.Base
+}
+
+func (panicker) OnTicker(s strategy.Session, mkt types.Market, tkr types.Ticker) {
+	panic("boom")
+}
+
+func TestRunnerFeedsStrategy(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+
+	b := &buyer{calls: map[string]int{}}
+	runner := strategy.New(trader, b, strategy.Config{
+		Name:          "buyer",
+		Markets:       []types.Market{mkt},
+		Candles:       []types.CandleInterval{"100ms"},
+		TimerInterval: 50 * time.Millisecond,
+	})
+	runner.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.seen("OnTicker", "OnCandle", "OnOrderUpdate", "OnFill", "OnTimer") {
+		if time.Now().After(deadline) {
+			b.mutex.Lock()
+			t.Fatalf("strategy only got hooks %v", b.calls)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	runner.Stop()
+	if runner.Running() || !b.stopped {
+		t.Error("runner is still running or didn't call OnStop")
+	}
+	if err := runner.Err(); err != nil {
+		t.Errorf("runner stopped with %v", err)
+	}
+}
+
+func TestRunnerStopsOnPanic(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+
+	runner := strategy.New(trader, panicker{}, strategy.Config{Name: "panicker", Markets: []types.Market{mkt}})
+	runner.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runner.Running() {
+		if time.Now().After(deadline) {
+			t.Fatal("runner is still running after the strategy panicked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var panicErr *strategy.PanicError
+	if err := runner.Err(); !errors.As(err, &panicErr) || panicErr.Hook != "OnTicker" {
+		t.Errorf("runner stopped with %v; expected a panic in OnTicker", err)
+	}
+}
@@ -1,6 +1,7 @@
 package svc
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 
 	"github.com/sinisterminister/currencytrader/types"
 	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
 )
 
 type accountSvc struct {
@@ -18,16 +20,24 @@ type accountSvc struct {
 	mutex    sync.Mutex
 	feeCache types.Fees
 	feeValid time.Time
+
+	walletMutex sync.Mutex
+	wallets     map[string]types.WalletDTO
 }
 
 func NewAccount(trader internal.Trader) internal.AccountSvc {
 	return &accountSvc{
-		trader: trader,
+		trader:  trader,
+		wallets: make(map[string]types.WalletDTO),
 	}
 }
 
-func (svc *accountSvc) Currency(name string) (currency types.Currency, err error) {
-	currencies, err := svc.Currencies()
+func (svc *accountSvc) Currency(name string) (types.Currency, error) {
+	return svc.CurrencyContext(context.Background(), name)
+}
+
+func (svc *accountSvc) CurrencyContext(ctx context.Context, name string) (currency types.Currency, err error) {
+	currencies, err := svc.CurrenciesContext(ctx)
 	if err != nil {
 		return
 	}
@@ -40,8 +50,12 @@ func (svc *accountSvc) Currency(name string) (currency types.Currency, err error
 	return
 }
 
-func (svc *accountSvc) Currencies() (currencies []types.Currency, err error) {
-	dtos, err := svc.trader.Provider().Currencies()
+func (svc *accountSvc) Currencies() ([]types.Currency, error) {
+	return svc.CurrenciesContext(context.Background())
+}
+
+func (svc *accountSvc) CurrenciesContext(ctx context.Context) (currencies []types.Currency, err error) {
+	dtos, err := contextual.Wrap(svc.trader.Provider()).CurrenciesContext(ctx)
 	if err != nil {
 		return
 	}
@@ -56,10 +70,14 @@ func (svc *accountSvc) Currencies() (currencies []types.Currency, err error) {
 }
 
 func (svc *accountSvc) Fees() (types.Fees, error) {
+	return svc.FeesContext(context.Background())
+}
+
+func (svc *accountSvc) FeesContext(ctx context.Context) (types.Fees, error) {
 	svc.mutex.Lock()
 	defer svc.mutex.Unlock()
 	if svc.feeCache == nil || time.Now().After(svc.feeValid) {
-		dto, err := svc.trader.Provider().Fees()
+		dto, err := contextual.Wrap(svc.trader.Provider()).FeesContext(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -72,25 +90,60 @@ func (svc *accountSvc) Fees() (types.Fees, error) {
 	return svc.feeCache, nil
 }
 
-func (svc *accountSvc) Wallet(currency types.Currency) (wal types.Wallet, err error) {
-	dto, err := svc.trader.Provider().Wallet(currency.ToDTO())
+func (svc *accountSvc) Wallet(currency types.Currency) (types.Wallet, error) {
+	return svc.WalletContext(context.Background(), currency)
+}
+
+func (svc *accountSvc) WalletContext(ctx context.Context, currency types.Currency) (wal types.Wallet, err error) {
+	dto, err := contextual.Wrap(svc.trader.Provider()).WalletContext(ctx, currency.ToDTO())
 	if err != nil {
 		return
 	}
+	svc.observe(dto)
 
 	return wallet.New(svc.trader, dto), err
 }
 
-func (svc *accountSvc) Wallets() (wallets []types.Wallet, err error) {
-	dtos, err := svc.trader.Provider().Wallets()
+func (svc *accountSvc) Wallets() ([]types.Wallet, error) {
+	return svc.WalletsContext(context.Background())
+}
+
+func (svc *accountSvc) WalletsContext(ctx context.Context) (wallets []types.Wallet, err error) {
+	dtos, err := contextual.Wrap(svc.trader.Provider()).WalletsContext(ctx)
 	if err != nil {
 		return
 	}
 
 	wallets = []types.Wallet{}
 	for _, dto := range dtos {
+		svc.observe(dto)
 		wallets = append(wallets, wallet.New(svc.trader, dto))
 	}
 
 	return
 }
+
+// observe publishes a wallet event for each venue wallet that changed since it was last seen. Aggregate wallets are
+// taken apart into the venue wallets they were summed from.
+func (svc *accountSvc) observe(dto types.WalletDTO) {
+	venueWallets := dto.Breakdown
+	if len(venueWallets) == 0 {
+		venueWallets = []types.WalletDTO{dto}
+	}
+
+	svc.walletMutex.Lock()
+	changed := []types.WalletDTO{}
+	for _, wal := range venueWallets {
+		key := wal.Venue + "/" + wal.Currency.Symbol
+		last, seen := svc.wallets[key]
+		svc.wallets[key] = wal
+		if seen && (!last.Free.Equal(wal.Free) || !last.Locked.Equal(wal.Locked)) {
+			changed = append(changed, wal)
+		}
+	}
+	svc.walletMutex.Unlock()
+
+	for i := range changed {
+		svc.trader.Events().Publish(types.Event{Type: types.EventWallet, Wallet: &changed[i]})
+	}
+}
@@ -0,0 +1,7 @@
+package svc
+
+import "github.com/spf13/viper"
+
+func init() {
+	viper.SetDefault("currencytrader.router.fundsMargin", 0.005)
+}
@@ -0,0 +1,35 @@
+package svc
+
+import (
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal"
+	ord "github.com/sinisterminister/currencytrader/types/order"
+)
+
+// publishOrder publishes the events for an order moving from prev to dto: a fill if more of it filled, then the
+// order event for its new state
+func publishOrder(trader internal.Trader, prev types.OrderDTO, dto types.OrderDTO) {
+	if filled := dto.Filled.Sub(prev.Filled); filled.IsPositive() {
+		fill := &types.FillDTO{
+			OrderID:  dto.ID,
+			Side:     dto.Request.Side,
+			Quantity: filled,
+			Price:    dto.Paid.Sub(prev.Paid).Div(filled),
+			Fees:     dto.Fees.Sub(prev.Fees),
+		}
+		trader.Events().Publish(types.Event{Type: types.EventFill, Market: dto.Market, Order: &dto, Fill: fill})
+	}
+
+	kind := types.EventOrderUpdated
+	switch dto.Status {
+	case ord.Filled:
+		kind = types.EventOrderFilled
+	case ord.Canceled:
+		kind = types.EventOrderCanceled
+	}
+	trader.Events().Publish(types.Event{Type: kind, Market: dto.Market, Order: &dto})
+}
+
+func publishError(trader internal.Trader, mkt types.MarketDTO, err error) {
+	trader.Events().Publish(types.Event{Type: types.EventError, Market: mkt, Err: err})
+}
@@ -2,6 +2,7 @@ package svc
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -29,18 +30,9 @@ func NewMarket(trader internal.Trader) internal.MarketSvc {
 }
 
 func (m *Market) Market(cur0 types.Currency, cur1 types.Currency) (market types.Market, err error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-	m.updateMarkets()
-	for _, mkt := range m.markets {
-		if mkt.BaseCurrency().Name() == cur0.Name() && mkt.QuoteCurrency().Name() == cur1.Name() {
-			market = mkt
-			return
-		}
-
-		if mkt.BaseCurrency() == cur1 && mkt.QuoteCurrency() == cur0 {
-			market = mkt
-			return
+	for _, mkt := range m.Markets() {
+		if matchesCurrencies(mkt, cur0, cur1) {
+			return mkt, nil
 		}
 	}
 
@@ -54,6 +46,40 @@ func (m *Market) Markets() []types.Market {
 	return m.markets
 }
 
+// VenueMarket finds the market for the currencies on the named venue. An empty venue gives the pair across every
+// venue, which a routing order service splits orders for.
+func (m *Market) VenueMarket(venue string, cur0 types.Currency, cur1 types.Currency) (types.Market, error) {
+	for _, mkt := range m.Markets() {
+		if !matchesCurrencies(mkt, cur0, cur1) {
+			continue
+		}
+		if venue == "" && mkt.Venue() != "" {
+			dto := mkt.ToDTO()
+			dto.Venue = ""
+			return market.New(m.trader, dto), nil
+		}
+		if mkt.Venue() == venue {
+			return mkt, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Could not find market for currencies '%s', '%s' on venue '%s'", cur0.Name(), cur1.Name(), venue)
+}
+
+// Venues lists the venues markets are traded on, in order. It is empty for a single-provider trader.
+func (m *Market) Venues() []string {
+	seen := map[string]bool{}
+	venues := []string{}
+	for _, mkt := range m.Markets() {
+		if venue := mkt.Venue(); venue != "" && !seen[venue] {
+			seen[venue] = true
+			venues = append(venues, venue)
+		}
+	}
+	sort.Strings(venues)
+	return venues
+}
+
 func (m *Market) updateMarkets() {
 	if m.marketsRefresh != nil {
 		select {
@@ -77,3 +103,8 @@ func (m *Market) updateMarkets() {
 
 	m.markets = markets
 }
+
+func matchesCurrencies(mkt types.Market, cur0 types.Currency, cur1 types.Currency) bool {
+	base, quote := mkt.BaseCurrency().Symbol(), mkt.QuoteCurrency().Symbol()
+	return (base == cur0.Symbol() && quote == cur1.Symbol()) || (base == cur1.Symbol() && quote == cur0.Symbol())
+}
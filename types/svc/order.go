@@ -1,34 +1,58 @@
 package svc
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/go-playground/log/v7"
+	"github.com/google/uuid"
 
 	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/algo"
 	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
 	ord "github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
 )
 
 type order struct {
 	trader internal.Trader
 
-	mutex   sync.RWMutex
-	running sync.Once
-	stop    chan bool
-	working []*types.Order
+	mutex     sync.RWMutex
+	stop      chan bool
+	stopped   bool
+	recovered bool
+	owned     map[string]internal.Order
+	icebergs  map[string]algo.Execution
+	streams   lifecycle.Group
 }
 
-func NewOrder(trader internal.Trader) types.OrderSvc {
+func NewOrder(trader internal.Trader) internal.OrderSvc {
 	svc := &order{
-		trader: trader,
+		trader:   trader,
+		stop:     make(chan bool),
+		owned:    make(map[string]internal.Order),
+		icebergs: make(map[string]algo.Execution),
 	}
 	return svc
 }
 
-func (svc *order) Order(mkt types.Market, id string) (order types.Order, err error) {
-	dto, err := svc.trader.Provider().Order(mkt.ToDTO(), id)
+func (svc *order) Order(mkt types.Market, id string) (types.Order, error) {
+	return svc.OrderContext(context.Background(), mkt, id)
+}
+
+func (svc *order) OrderContext(ctx context.Context, mkt types.Market, id string) (order types.Order, err error) {
+	svc.mutex.RLock()
+	ice, ok := svc.icebergs[id]
+	svc.mutex.RUnlock()
+	if ok {
+		return ice, nil
+	}
+
+	dto, err := contextual.Wrap(svc.trader.Provider()).OrderContext(ctx, mkt.ToDTO(), id)
 	if err != nil {
 		return
 	}
@@ -36,49 +60,185 @@ func (svc *order) Order(mkt types.Market, id string) (order types.Order, err err
 	return
 }
 
-func (svc *order) AttemptOrder(m types.Market, req types.OrderRequest) (order types.Order, err error) {
-	dto, err := svc.trader.Provider().AttemptOrder(req.ToDTO())
+func (svc *order) AttemptOrder(m types.Market, req types.OrderRequest) (types.Order, error) {
+	return svc.AttemptOrderContext(context.Background(), m, req)
+}
+
+func (svc *order) AttemptOrderContext(ctx context.Context, m types.Market, req types.OrderRequest) (order types.Order, err error) {
+	// Requests from the order package come with a client ID; any other gets one so the provider can tell a retry
+	// from a new order
+	request := req.ToDTO()
+	if request.ClientID == "" {
+		request.ClientID = uuid.New().String()
+	}
+	if request.DisplayQuantity.IsPositive() {
+		return svc.attemptIceberg(ctx, m, request)
+	}
+
+	dto, err := contextual.Wrap(svc.trader.Provider()).AttemptOrderContext(ctx, request)
 	if err != nil {
 		return
 	}
-	order = svc.buildOrder(dto)
+	order, created := svc.track(dto)
+	if created {
+		svc.trader.Events().Publish(types.Event{Type: types.EventOrderCreated, Market: dto.Market, Order: &dto})
+	}
 	return
 }
 
 func (svc *order) CancelOrder(order types.Order) error {
-	return svc.trader.Provider().CancelOrder(order.ToDTO())
+	return svc.CancelOrderContext(context.Background(), order)
+}
+
+func (svc *order) CancelOrderContext(ctx context.Context, order types.Order) error {
+	if ice, ok := order.(algo.Execution); ok {
+		ice.Cancel()
+		return nil
+	}
+	return contextual.Wrap(svc.trader.Provider()).CancelOrderContext(ctx, order.ToDTO())
+}
+
+// attemptIceberg starts an iceberg for the request, or returns the running one started for its client ID. The
+// iceberg's ID is its client ID, and it is forgotten once it is done. The context only bounds starting it, since the iceberg outlives the call; its slices
+// are listed and journaled like any other order, so cancelling them, as a risk manager's kill switch does, ends it.
+func (svc *order) attemptIceberg(ctx context.Context, m types.Market, request types.OrderRequestDTO) (types.Order, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	if ice, ok := svc.icebergs[request.ClientID]; ok {
+		return ice, nil
+	}
+
+	if request.Type != ord.Limit {
+		return nil, fmt.Errorf("%w: iceberg orders must be limit orders", types.ErrInvalidRequest)
+	}
+	ice, err := algo.NewIceberg(svc.trader, algo.IcebergConfig{
+		Config: algo.Config{
+			Market:     m,
+			Side:       request.Side,
+			Quantity:   request.Quantity,
+			LimitPrice: request.Price,
+		},
+		ClientID: request.ClientID,
+		Visible:  request.DisplayQuantity,
+		Variance: request.DisplayVariance,
+	})
+	if err != nil {
+		return nil, err
+	}
+	svc.icebergs[request.ClientID] = ice
+	go func() {
+		<-ice.Done()
+		svc.mutex.Lock()
+		defer svc.mutex.Unlock()
+		if svc.icebergs[request.ClientID] == ice {
+			delete(svc.icebergs, request.ClientID)
+		}
+	}()
+	return ice, nil
 }
 
 func (svc *order) OrderFromDTO(dto types.OrderDTO) types.Order {
 	return svc.buildOrder(dto)
 }
 
+func (svc *order) Orders() []types.Order {
+	svc.mutex.RLock()
+	orders := make([]types.Order, 0, len(svc.owned))
+	for _, o := range svc.owned {
+		if !o.IsDone() {
+			orders = append(orders, o)
+		}
+	}
+	svc.mutex.RUnlock()
+
+	sort.Slice(orders, func(i, j int) bool { return orders[i].CreationTime().Before(orders[j].CreationTime()) })
+	return orders
+}
+
 func (svc *order) buildOrder(dto types.OrderDTO) types.Order {
 	ord := ord.NewOrder(svc.trader, dto)
-	go svc.handleOrderStream(ord)
+	svc.watch(ord, false)
 	return ord
 }
 
-func (svc *order) handleOrderStream(o internal.Order) {
+// track builds an order the service owns, journaling it and every state it moves to. An order that is already
+// tracked, such as one placed again under the same client ID, is returned as it is and reported as not created.
+func (svc *order) track(dto types.OrderDTO) (types.Order, bool) {
+	svc.mutex.Lock()
+	if o, ok := svc.owned[orderKey(dto)]; ok {
+		svc.mutex.Unlock()
+		return o, false
+	}
+	o := ord.NewOrder(svc.trader, dto)
+	svc.owned[orderKey(dto)] = o
+	svc.mutex.Unlock()
+
+	svc.record(dto)
+	svc.watch(o, true)
+	return o, true
+}
+
+// watch streams updates to the order until it is done or the service stops
+func (svc *order) watch(o internal.Order, owned bool) {
+	svc.mutex.RLock()
+	stop := svc.stop
+	svc.mutex.RUnlock()
+	svc.streams.Go(func() { svc.handleOrderStream(stop, o, owned) })
+}
+
+// record writes the order's state to the journal, if there is one
+func (svc *order) record(dto types.OrderDTO) {
+	journal := svc.trader.Journal()
+	if journal == nil {
+		return
+	}
+	if err := journal.Record(dto); err != nil {
+		log.WithError(err).Errorf("could not journal order %s", dto.ID)
+		publishError(svc.trader, dto.Market, fmt.Errorf("could not journal order %s: %w", dto.ID, err))
+	}
+}
+
+func (svc *order) handleOrderStream(svcStop <-chan bool, o internal.Order, owned bool) {
+	// Publish the states the order moves to and journal them if it is owned, and stop tracking it once it is done
+	last := o.ToDTO()
+	update := func(dto types.OrderDTO) {
+		if dto.Status == last.Status && dto.Filled.Equal(last.Filled) {
+			return
+		}
+		publishOrder(svc.trader, last, dto)
+		last = dto
+		if owned {
+			svc.record(dto)
+		}
+	}
+	finish := func(dto types.OrderDTO) {
+		update(dto)
+		if owned {
+			svc.mutex.Lock()
+			delete(svc.owned, orderKey(dto))
+			svc.mutex.Unlock()
+		}
+	}
+
 	// Bail if the order is already closed
-	switch o.Status() {
-	case ord.Filled:
-		fallthrough
-	case ord.Canceled:
-		fallthrough
-	case ord.Expired:
-		fallthrough
-	case ord.Rejected:
+	if ord.IsDone(o.Status()) {
 		log.Debugf("status is %s: bailing on order stream", o.Status())
+		finish(o.ToDTO())
 		return
 	}
 
 	log.Debugf("starting the order stream for order %s", o.ID())
-	stop := make(chan bool)
-	stream, err := svc.trader.Provider().OrderStream(stop, o.ToDTO())
+	streamStop := make(chan bool)
+	stream, err := svc.trader.Provider().OrderStream(streamStop, o.ToDTO())
 	if err != nil {
+		// Keep refreshing the order instead, so it is still finished once it is done
 		log.WithError(err).Errorf("could not get order stream for order %s", o.ID())
-		return
+		publishError(svc.trader, o.ToDTO().Market, fmt.Errorf("could not get order stream for order %s: %w", o.ID(), err))
+		stream = nil
 	}
 
 	// Watch for updates
@@ -86,43 +246,50 @@ func (svc *order) handleOrderStream(o internal.Order) {
 	for {
 		select {
 		case <-o.Done():
-			close(stop)
+			close(streamStop)
+			finish(o.ToDTO())
 			return
 
 		case <-timer.C:
 			// Refresh the order
 			log.Debugf("refreshing order %s - no stream data received", o.ID())
 			o.Refresh()
+			update(o.ToDTO())
 
 			// No need to watch if it's already done
-			switch o.Status() {
-			case ord.Unknown:
-				timer.Reset(1 * time.Second)
-			case ord.Filled:
-				fallthrough
-			case ord.Canceled:
-				fallthrough
-			case ord.Rejected:
-				close(stop)
+			if ord.IsDone(o.Status()) {
+				close(streamStop)
+				finish(o.ToDTO())
 				return
 			}
 
-			// Reset the timer as a backup to the streams
-			timer.Reset(5 * time.Second)
-		case <-svc.stop:
-			close(stop)
+			// Reset the timer as a backup to the streams, sooner while the order's state is unknown
+			if o.Status() == ord.Unknown {
+				timer.Reset(1 * time.Second)
+			} else {
+				timer.Reset(5 * time.Second)
+			}
+		case <-svcStop:
+			close(streamStop)
 			return
-		case data := <-stream:
+		case data, ok := <-stream:
+			if !ok {
+				// Stream was closed by the provider; fall back to refreshing
+				stream = nil
+				continue
+			}
 			select {
-			case <-svc.stop:
-				close(stop)
+			case <-svcStop:
+				close(streamStop)
 				return
 			default:
 				go o.Update(data)
-				if data.Status == ord.Filled || data.Status == ord.Canceled {
-					close(stop)
+				if ord.IsDone(data.Status) {
+					close(streamStop)
+					finish(data)
 					return
 				}
+				update(data)
 				// Reset the timer as a backup to the streams
 				timer.Reset(5 * time.Second)
 			}
@@ -130,17 +297,74 @@ func (svc *order) handleOrderStream(o internal.Order) {
 	}
 }
 
+// recover picks up the open orders in the journal, refreshing each from the provider before watching it again
+func (svc *order) recover() {
+	journal := svc.trader.Journal()
+	if journal == nil {
+		return
+	}
+	dtos, err := journal.Open()
+	if err != nil {
+		log.WithError(err).Error("could not read the open orders from the journal")
+		publishError(svc.trader, types.MarketDTO{}, fmt.Errorf("could not read the open orders from the journal: %w", err))
+		return
+	}
+
+	for _, dto := range dtos {
+		// Providers report orders they no longer know of as canceled, which finishes them once they are tracked
+		refreshed, err := svc.trader.Provider().RefreshOrder(dto)
+		if err != nil {
+			log.WithError(err).Warnf("could not refresh order %s from the journal; watching it as it was", dto.ID)
+			refreshed = dto
+		}
+
+		svc.track(refreshed)
+	}
+}
+
+// Start picks up the orders in the journal the first time it is called. Later, it streams the orders the service
+// still owns again.
 func (svc *order) Start() {
-	svc.running.Do(func() {
-		svc.mutex.Lock()
-		defer svc.mutex.Unlock()
+	svc.mutex.Lock()
+	recovered, stopped := svc.recovered, svc.stopped
+	svc.recovered = true
+	if stopped {
 		svc.stop = make(chan bool)
-	})
+		svc.stopped = false
+	}
+	owned := make([]internal.Order, 0, len(svc.owned))
+	for _, o := range svc.owned {
+		owned = append(owned, o)
+	}
+	svc.mutex.Unlock()
+
+	if !recovered {
+		svc.recover()
+	}
+	if stopped {
+		for _, o := range owned {
+			svc.watch(o, true)
+		}
+	}
 }
 
+// Stop closes the order streams. Orders built after it are streamed again once the service is started.
 func (svc *order) Stop() {
 	svc.mutex.Lock()
 	defer svc.mutex.Unlock()
-	close(svc.stop)
-	svc.running = sync.Once{}
+	if !svc.stopped {
+		close(svc.stop)
+		svc.stopped = true
+	}
+}
+
+// Shutdown stops the service and waits for its order streams to close
+func (svc *order) Shutdown(ctx context.Context) error {
+	svc.Stop()
+	return svc.streams.Wait(ctx)
+}
+
+// orderKey tells orders apart across venues, since each venue hands out IDs of its own
+func orderKey(dto types.OrderDTO) string {
+	return dto.Market.Venue + "/" + dto.ID
 }
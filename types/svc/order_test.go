@@ -0,0 +1,51 @@
+package svc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+func TestAttemptOrderRetryPlacesOnce(t *testing.T) {
+	prov := simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(1), "ETH": decimal.NewFromInt(100)},
+		TickInterval: 20 * time.Millisecond,
+	})
+	trader := currencytrader.New(prov)
+	trader.Start()
+	t.Cleanup(trader.Stop)
+
+	mkt := pair(t, trader, "")
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same request value attempted twice, as a caller retrying after an error would
+	price := tkr.Bid().Mul(decimal.NewFromFloat(0.9)).Round(2)
+	req := order.NewRequest(mkt, order.Limit, order.Buy, decimal.NewFromFloat(0.01), price, decimal.Zero, false)
+	first, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ID() != second.ID() {
+		t.Errorf("retry placed order %s; expected the first order %s", second.ID(), first.ID())
+	}
+	// Only the one order holds funds at the provider, fees included
+	wal, err := prov.Wallet(mkt.QuoteCurrency().ToDTO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one := req.Quantity().Mul(price); wal.Locked.LessThan(one) || wal.Locked.GreaterThan(one.Mul(decimal.NewFromFloat(1.5))) {
+		t.Errorf("provider holds %s %s; expected about the %s of one order", wal.Locked, wal.Currency.Symbol, one)
+	}
+}
@@ -0,0 +1,325 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/go-playground/log/v7"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/algo"
+	"github.com/sinisterminister/currencytrader/types/internal"
+	ord "github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+// router splits orders on markets without a venue across every venue trading the pair
+type router struct {
+	log    log.Entry
+	trader internal.Trader
+	orders types.OrderSvc
+
+	mutex  sync.RWMutex
+	routed map[string]types.AggregateOrder
+}
+
+// leg is the share of a routed order placed on one venue
+type leg struct {
+	market   types.Market
+	price    decimal.Decimal
+	cost     decimal.Decimal
+	capacity decimal.Decimal
+	amount   decimal.Decimal
+}
+
+// NewRouter wraps the order service so orders on a market without a venue, such as the one VenueMarket returns for
+// an empty venue, are split across venues by top-of-book price, taker fees and available balances. Orders on a
+// venue's own market go straight to that venue.
+func NewRouter(trader internal.Trader, orders types.OrderSvc) types.OrderSvc {
+	return &router{
+		log:    log.WithField("source", "currencytrader.router"),
+		trader: trader,
+		orders: orders,
+		routed: make(map[string]types.AggregateOrder),
+	}
+}
+
+func (r *router) AttemptOrder(m types.Market, req types.OrderRequest) (types.Order, error) {
+	return r.AttemptOrderContext(context.Background(), m, req)
+}
+
+func (r *router) AttemptOrderContext(ctx context.Context, m types.Market, req types.OrderRequest) (types.Order, error) {
+	if m.Venue() != "" {
+		return r.orders.AttemptOrderContext(ctx, m, req)
+	}
+
+	// A request that was already routed returns the order it placed
+	r.mutex.RLock()
+	agg, ok := r.routed[req.ClientID()]
+	r.mutex.RUnlock()
+	if ok {
+		return agg, nil
+	}
+
+	legs, err := r.plan(ctx, m, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each leg gets a client ID of its own derived from the parent's, so the whole order can be retried as it is
+	id := req.ClientID()
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	// Place every leg, backing out of the ones already placed if any of them fails
+	children := make([]types.Order, 0, len(legs))
+	for _, l := range legs {
+		dto := req.ToDTO()
+		dto.ClientID = id + ":" + l.market.Venue()
+		dto.Market = l.market.ToDTO()
+		if req.Quantity().IsZero() {
+			dto.Funds = l.amount
+		} else {
+			dto.Quantity = l.amount
+		}
+
+		child, err := r.orders.AttemptOrderContext(ctx, l.market, ord.NewRequestFromDTO(l.market, dto))
+		if err != nil {
+			// The placed legs are backed out even if the context is what stopped the routing
+			for _, placed := range children {
+				if err := r.orders.CancelOrder(placed); err != nil {
+					r.log.WithError(err).Errorf("could not cancel order %s after routing failed", placed.ID())
+				}
+			}
+			return nil, fmt.Errorf("could not place %s leg of %s order: %w", l.market.Venue(), m.Name(), err)
+		}
+		children = append(children, child)
+	}
+
+	parent := req.ToDTO()
+	parent.ClientID = id
+	parent.Market = m.ToDTO()
+	agg = ord.NewAggregate(r.trader, id, parent, children)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, routed := range r.routed {
+		if routed.IsDone() {
+			delete(r.routed, id)
+		}
+	}
+	r.routed[agg.ID()] = agg
+	return agg, nil
+}
+
+func (r *router) CancelOrder(order types.Order) error {
+	return r.CancelOrderContext(context.Background(), order)
+}
+
+func (r *router) CancelOrderContext(ctx context.Context, order types.Order) (err error) {
+	// Executions cancel their own children
+	if _, ok := order.(algo.Execution); ok {
+		return r.orders.CancelOrderContext(ctx, order)
+	}
+	agg, ok := order.(types.AggregateOrder)
+	if !ok {
+		return r.orders.CancelOrderContext(ctx, order)
+	}
+
+	for _, child := range agg.Children() {
+		if child.IsDone() {
+			continue
+		}
+		if e := r.orders.CancelOrderContext(ctx, child); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func (r *router) Order(m types.Market, id string) (types.Order, error) {
+	return r.OrderContext(context.Background(), m, id)
+}
+
+func (r *router) OrderContext(ctx context.Context, m types.Market, id string) (types.Order, error) {
+	r.mutex.RLock()
+	agg, ok := r.routed[id]
+	r.mutex.RUnlock()
+	if ok {
+		return agg, nil
+	}
+	return r.orders.OrderContext(ctx, m, id)
+}
+
+func (r *router) OrderFromDTO(dto types.OrderDTO) types.Order {
+	return r.orders.OrderFromDTO(dto)
+}
+
+// Orders lists the orders of each venue, including the legs of routed orders
+func (r *router) Orders() []types.Order {
+	return r.orders.Orders()
+}
+
+// plan splits the request into legs, filling from the venue with the best price after fees first
+func (r *router) plan(ctx context.Context, m types.Market, req types.OrderRequest) ([]*leg, error) {
+	byFunds := req.Quantity().IsZero()
+	total := req.Quantity()
+	if byFunds {
+		total = req.Funds()
+	}
+	if !total.IsPositive() {
+		return nil, errors.New("routed orders need a quantity or funds")
+	}
+
+	legs, err := r.legs(ctx, m, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(legs) == 0 {
+		return nil, fmt.Errorf("no venue trades %s", m.Name())
+	}
+
+	// Cheapest asks first when buying, richest bids first when selling
+	sort.SliceStable(legs, func(i, j int) bool {
+		if req.Side() == ord.Buy {
+			return legs[i].cost.LessThan(legs[j].cost)
+		}
+		return legs[i].cost.GreaterThan(legs[j].cost)
+	})
+
+	planned := []*leg{}
+	remaining := total
+	for _, l := range legs {
+		if !remaining.IsPositive() {
+			break
+		}
+
+		amount := remaining
+		if amount.GreaterThan(l.capacity) {
+			amount = l.capacity
+		}
+		step := l.market.QuantityStepSize()
+		if byFunds {
+			step = l.market.QuoteCurrency().Increment()
+		}
+		amount = roundDown(amount, step)
+
+		// Skip venues that can't take a large enough share to meet their minimums
+		quantity, funds := amount, amount.Mul(l.price)
+		if byFunds {
+			quantity, funds = amount.Div(l.price), amount
+		}
+		if !amount.IsPositive() || quantity.LessThan(l.market.MinQuantity()) || funds.LessThan(l.market.MinFunds()) {
+			continue
+		}
+
+		l.amount = amount
+		remaining = remaining.Sub(amount)
+		planned = append(planned, l)
+	}
+
+	if remaining.IsPositive() {
+		return nil, fmt.Errorf("venues can only take %s of the %s %s order", total.Sub(remaining), total, m.Name())
+	}
+	return planned, nil
+}
+
+// legs prices the request on every venue trading the market's pair
+func (r *router) legs(ctx context.Context, m types.Market, req types.OrderRequest) ([]*leg, error) {
+	fees, err := r.trader.AccountSvc().FeesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	takerRates := map[string]decimal.Decimal{}
+	for _, f := range fees.Breakdown() {
+		takerRates[f.Venue()] = f.TakerRate()
+	}
+
+	wals, err := r.trader.AccountSvc().WalletsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Buys are limited by the quote currency held on each venue, sells by the base currency
+	symbol := m.BaseCurrency().Symbol()
+	if req.Side() == ord.Buy {
+		symbol = m.QuoteCurrency().Symbol()
+	}
+	available := map[string]decimal.Decimal{}
+	for _, wal := range wals {
+		if wal.Currency().Symbol() != symbol {
+			continue
+		}
+		for _, venueWal := range wal.Breakdown() {
+			available[venueWal.Venue()] = venueWal.Available()
+		}
+	}
+
+	legs := []*leg{}
+	for _, mkt := range r.trader.MarketSvc().Markets() {
+		if mkt.Venue() == "" || mkt.BaseCurrency().Symbol() != m.BaseCurrency().Symbol() || mkt.QuoteCurrency().Symbol() != m.QuoteCurrency().Symbol() {
+			continue
+		}
+
+		tkr, err := mkt.TickerContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			r.log.WithError(err).Warnf("skipping %s while routing: could not get ticker", mkt.Venue())
+			continue
+		}
+
+		taker, ok := takerRates[mkt.Venue()]
+		if !ok {
+			taker = fees.TakerRate()
+		}
+
+		l := &leg{market: mkt}
+		if req.Side() == ord.Buy {
+			l.price = tkr.Ask()
+			l.cost = l.price.Mul(decimal.NewFromInt(1).Add(taker))
+		} else {
+			l.price = tkr.Bid()
+			l.cost = l.price.Mul(decimal.NewFromInt(1).Sub(taker))
+		}
+		if req.Type() == ord.Limit {
+			l.price = req.Price()
+		}
+		if !l.price.IsPositive() {
+			continue
+		}
+
+		// Capacity is in the unit the order is sized in: quantity, or funds for market orders sized by funds. Buys
+		// leave some of the balance over for what venues hold beyond the cost and for rounding.
+		balance := available[mkt.Venue()]
+		if req.Side() == ord.Buy {
+			margin := decimal.NewFromFloat(viper.GetFloat64("currencytrader.router.fundsMargin"))
+			balance = balance.Mul(decimal.NewFromInt(1).Sub(margin))
+		}
+		switch {
+		case req.Side() == ord.Buy && req.Quantity().IsZero():
+			l.capacity = balance.Div(decimal.NewFromInt(1).Add(taker))
+		case req.Side() == ord.Buy:
+			l.capacity = balance.Div(l.price.Mul(decimal.NewFromInt(1).Add(taker)))
+		case req.Quantity().IsZero():
+			l.capacity = balance.Mul(l.price)
+		default:
+			l.capacity = balance
+		}
+		legs = append(legs, l)
+	}
+	return legs, nil
+}
+
+func roundDown(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Floor().Mul(step)
+}
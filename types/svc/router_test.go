@@ -0,0 +1,181 @@
+package svc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+func newRoutedTrader(t *testing.T) types.Trader {
+	venues := map[string]types.Provider{}
+	for _, venue := range []string{"alpha", "beta"} {
+		venues[venue] = simulated.New(simulated.ProviderConfig{
+			Balances: map[string]decimal.Decimal{
+				"BTC": decimal.NewFromInt(1),
+				"ETH": decimal.NewFromInt(100),
+			},
+			TickInterval: 20 * time.Millisecond,
+		})
+	}
+
+	trader := currencytrader.NewRouted(venues)
+	trader.Start()
+	t.Cleanup(trader.Stop)
+	return trader
+}
+
+func pair(t *testing.T, trader types.Trader, venue string) types.Market {
+	btc, err := trader.AccountSvc().Currency("BTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eth, err := trader.AccountSvc().Currency("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mkt, err := trader.MarketSvc().VenueMarket(venue, btc, eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mkt
+}
+
+// bestPrice is a limit price that crosses the ask on every venue
+func bestPrice(t *testing.T, trader types.Trader) decimal.Decimal {
+	price := decimal.Zero
+	for _, venue := range trader.MarketSvc().Venues() {
+		tkr, err := pair(t, trader, venue).Ticker()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tkr.Ask().GreaterThan(price) {
+			price = tkr.Ask()
+		}
+	}
+	return price.Mul(decimal.NewFromFloat(1.05)).Round(8)
+}
+
+func TestRouterSplitsAcrossVenues(t *testing.T) {
+	trader := newRoutedTrader(t)
+	mkt := pair(t, trader, "")
+	price := bestPrice(t, trader)
+
+	// Each venue can afford two thirds of the order
+	quantity := decimal.NewFromInt(150).Div(price).Round(8)
+	req := order.NewRequest(mkt, order.Limit, order.Buy, quantity, price, decimal.Zero, false)
+	parent, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agg, ok := parent.(types.AggregateOrder)
+	if !ok {
+		t.Fatalf("routed order is a %T; expected an aggregate order", parent)
+	}
+	venues := map[string]bool{}
+	for _, child := range agg.Children() {
+		venues[child.Market().Venue()] = true
+	}
+	if len(agg.Children()) != 2 || !venues["alpha"] || !venues["beta"] {
+		t.Fatalf("order was split into %d children on %v; expected one on each venue", len(agg.Children()), venues)
+	}
+
+	select {
+	case <-parent.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("routed order did not finish; last saw %s", parent.Status())
+	}
+
+	filled, paid := decimal.Zero, decimal.Zero
+	for _, child := range agg.Children() {
+		filled = filled.Add(child.Filled())
+		paid = paid.Add(child.Paid())
+	}
+	if parent.Status() != order.Filled || !parent.Filled().Equal(quantity) {
+		t.Errorf("order finished as %s with %s filled; expected %s with %s", parent.Status(), parent.Filled(), order.Filled, quantity)
+	}
+	if !parent.Filled().Equal(filled) || !parent.Paid().Equal(paid) {
+		t.Errorf("order filled %s for %s; expected the children's %s for %s", parent.Filled(), parent.Paid(), filled, paid)
+	}
+
+	found, err := trader.OrderSvc().Order(mkt, parent.ID())
+	if err != nil || found != parent {
+		t.Errorf("could not look up the routed order by id: %v", err)
+	}
+}
+
+func TestRouterRejectsOversizedOrders(t *testing.T) {
+	trader := newRoutedTrader(t)
+	mkt := pair(t, trader, "")
+	price := bestPrice(t, trader)
+
+	// Together the venues only hold 200 ETH
+	quantity := decimal.NewFromInt(250).Div(price).Round(8)
+	req := order.NewRequest(mkt, order.Limit, order.Buy, quantity, price, decimal.Zero, false)
+	if _, err := trader.OrderSvc().AttemptOrder(mkt, req); err == nil {
+		t.Fatal("order larger than the venues can afford was routed")
+	}
+
+	eth, err := trader.AccountSvc().Currency("ETH")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal, err := trader.AccountSvc().Wallet(eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wal.Locked().IsZero() {
+		t.Errorf("%s ETH was locked by a rejected order", wal.Locked())
+	}
+}
+
+func TestRouterPassesVenueOrdersThrough(t *testing.T) {
+	trader := newRoutedTrader(t)
+	mkt := pair(t, trader, "beta")
+	price := bestPrice(t, trader)
+
+	req := order.NewRequest(mkt, order.Limit, order.Buy, decimal.NewFromInt(10).Div(price).Round(8), price, decimal.Zero, false)
+	ord, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ord.(types.AggregateOrder); ok {
+		t.Fatal("order on a venue market was split")
+	}
+	if venue := ord.Market().Venue(); venue != "beta" {
+		t.Errorf("order was placed on %q; expected beta", venue)
+	}
+}
+
+func TestRouterReusesClientID(t *testing.T) {
+	trader := newRoutedTrader(t)
+	mkt := pair(t, trader, "")
+	price := bestPrice(t, trader)
+
+	quantity := decimal.NewFromInt(150).Div(price).Round(8)
+	dto := order.NewRequest(mkt, order.Limit, order.Buy, quantity, price, decimal.Zero, false).ToDTO()
+	dto.ClientID = "router-retry"
+	req := order.NewRequestFromDTO(mkt, dto)
+
+	first, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := trader.OrderSvc().AttemptOrder(mkt, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || first.ID() != "router-retry" {
+		t.Errorf("repeated client ID routed order %s; expected the first order router-retry", second.ID())
+	}
+	for _, child := range first.(types.AggregateOrder).Children() {
+		if cid, expected := child.Request().ClientID(), "router-retry:"+child.Market().Venue(); cid != expected {
+			t.Errorf("leg has client ID %q; expected %q", cid, expected)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package svc
 
 import (
+	"context"
+	"fmt"
 	"sync"
 
 	"github.com/go-playground/log/v7"
 	"github.com/sinisterminister/currencytrader/types"
 	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/provider/contextual"
 	"github.com/sinisterminister/currencytrader/types/ticker"
 	"github.com/spf13/viper"
 )
@@ -17,6 +21,7 @@ type Ticker struct {
 	streams map[types.Market][]*streamWrapper
 	sources map[types.Market]*sourceWrapper
 	running bool
+	group   lifecycle.Group
 }
 
 type streamWrapper struct {
@@ -25,6 +30,30 @@ type streamWrapper struct {
 
 	mutex  sync.Mutex
 	stream chan types.Ticker
+	closed bool
+}
+
+// send passes the ticker on unless the stream is closed or blocked
+func (w *streamWrapper) send(data types.Ticker) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.stream <- data:
+	default:
+		log.Warn("Skipping blocked ticker channel")
+	}
+}
+
+func (w *streamWrapper) close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.stream)
+	}
 }
 
 type sourceWrapper struct {
@@ -43,8 +72,12 @@ func NewTicker(trader internal.Trader) internal.TickerSvc {
 	return svc
 }
 
-func (t *Ticker) Ticker(m types.Market) (tkr types.Ticker, err error) {
-	dto, err := t.trader.Provider().Ticker(m.ToDTO())
+func (t *Ticker) Ticker(m types.Market) (types.Ticker, error) {
+	return t.TickerContext(context.Background(), m)
+}
+
+func (t *Ticker) TickerContext(ctx context.Context, m types.Market) (tkr types.Ticker, err error) {
+	dto, err := contextual.Wrap(t.trader.Provider()).TickerContext(ctx, m.ToDTO())
 	if err != nil {
 		return
 	}
@@ -76,6 +109,11 @@ func (t *Ticker) TickerStream(stop <-chan bool, market types.Market) <-chan type
 	return stream
 }
 
+// TickerStreamContext streams the market's tickers until the context is done
+func (t *Ticker) TickerStreamContext(ctx context.Context, market types.Market) <-chan types.Ticker {
+	return t.TickerStream(contextual.Stop(ctx), market)
+}
+
 func (t *Ticker) registerStream(wrapper *streamWrapper) {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
@@ -103,14 +141,7 @@ func (t *Ticker) deregisterStream(wrapper *streamWrapper) {
 		if c != wrapper {
 			filtered = append(filtered, c)
 		} else {
-			// Close the channel gracefully
-			select {
-			case <-c.stream:
-			default:
-				c.mutex.Lock()
-				close(c.stream)
-				c.mutex.Unlock()
-			}
+			c.close()
 		}
 	}
 
@@ -150,9 +181,10 @@ func (t *Ticker) handleSource(mkt types.Market) *sourceWrapper {
 		stream: stream,
 		market: mkt,
 	}
-	go func(wrapper *sourceWrapper) {
+	t.group.Go(func() {
 		if err != nil {
 			log.WithError(err).Errorf("Could not get stream for market %s", wrapper.market.Name())
+			publishError(t.trader, wrapper.market.ToDTO(), fmt.Errorf("could not get ticker stream for market %s: %w", wrapper.market.Name(), err))
 			return
 		}
 		for {
@@ -167,12 +199,17 @@ func (t *Ticker) handleSource(mkt types.Market) *sourceWrapper {
 			case <-wrapper.stop:
 				// Backup bailout
 				return
-			case payload := <-wrapper.stream:
+			case payload, ok := <-wrapper.stream:
+				if !ok {
+					log.Warnf("ticker source for market %s closed", wrapper.market.Name())
+					return
+				}
 				data := ticker.New(payload)
 				t.broadcastToStreams(wrapper.market, data)
+				t.trader.Events().Publish(types.Event{Type: types.EventTicker, Market: wrapper.market.ToDTO(), Ticker: &payload})
 			}
 		}
-	}(wrapper)
+	})
 
 	return wrapper
 }
@@ -189,11 +226,7 @@ func (t *Ticker) broadcastToStreams(market types.Market, data types.Ticker) {
 	streams = append([]*streamWrapper{}, streams...)
 	t.mutex.RUnlock()
 	for _, wrapper := range streams {
-		select {
-		case wrapper.stream <- data:
-		default:
-			log.Warn("Skipping blocked ticker channel")
-		}
+		wrapper.send(data)
 	}
 }
 
@@ -220,3 +253,9 @@ func (t *Ticker) Stop() {
 	t.mutex.Unlock()
 	t.shutdownStreams()
 }
+
+// Shutdown stops the service and waits for its ticker sources to close
+func (t *Ticker) Shutdown(ctx context.Context) error {
+	t.Stop()
+	return t.group.Wait(ctx)
+}
@@ -0,0 +1,13 @@
+package trader
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("currencytrader.trader.healthInterval", time.Second)
+	viper.SetDefault("currencytrader.trader.reconcileTimeout", 30*time.Second)
+	viper.SetDefault("currencytrader.trader.stopTimeout", 5*time.Second)
+}
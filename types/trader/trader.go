@@ -1,11 +1,21 @@
 package trader
 
 import (
+	"context"
+	"io"
 	"sync"
+	"time"
 
+	"github.com/go-playground/log/v7"
 	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/event"
 	"github.com/sinisterminister/currencytrader/types/internal"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/journal"
+	"github.com/sinisterminister/currencytrader/types/reconcile"
+	"github.com/sinisterminister/currencytrader/types/risk"
 	"github.com/sinisterminister/currencytrader/types/svc"
+	"github.com/spf13/viper"
 )
 
 type trader struct {
@@ -13,51 +23,254 @@ type trader struct {
 	marketSvc  internal.MarketSvc
 	tickerSvc  internal.TickerSvc
 	accountSvc internal.AccountSvc
+	orders     internal.OrderSvc
 	orderSvc   types.OrderSvc
+	journal    types.OrderJournal
+	reconcile  *reconcile.Config
+	events     internal.EventBus
+	log        log.Entry
 
-	mutex   sync.RWMutex
-	stop    chan bool
-	running bool
+	mutex      sync.RWMutex
+	running    bool
+	reconciled bool
+	stop       chan bool
+	watchers   lifecycle.Group
+}
+
+type TraderConfig struct {
+	// Journal keeps the orders the trader places so they are picked up again when it next starts. Orders are only
+	// kept in memory without one.
+	Journal types.OrderJournal
+
+	// Reconcile has the trader reconcile its journal with the provider the first time it starts, before it picks up
+	// the orders in the journal. A trader without a journal reconciles against an empty one kept in memory.
+	Reconcile *reconcile.Config
+
+	// Risk checks every order against its limits before it is placed. The trader's OrderSvc is then a risk.Manager,
+	// which holds the kill switch.
+	Risk *risk.Config
 }
 
 func New(provider types.Provider) internal.Trader {
+	return NewWithConfig(provider, TraderConfig{})
+}
+
+func NewWithConfig(provider types.Provider, config TraderConfig) internal.Trader {
 	t := &trader{
-		provider: provider,
-		stop:     make(chan bool),
+		provider:  provider,
+		journal:   config.Journal,
+		reconcile: config.Reconcile,
+		events:    event.New(),
+		log:       log.WithField("source", "trader"),
+	}
+	if t.reconcile != nil && t.journal == nil {
+		t.journal = journal.NewMemory()
 	}
 
 	t.accountSvc = svc.NewAccount(t)
 	t.marketSvc = svc.NewMarket(t)
 	t.tickerSvc = svc.NewTicker(t)
-	t.orderSvc = svc.NewOrder(t)
+	t.orders = svc.NewOrder(t)
+	t.orderSvc = t.orders
+	if config.Risk != nil {
+		t.orderSvc = risk.New(t, t.orderSvc, *config.Risk)
+	}
 	return t
 }
 
+// NewRouted creates a trader whose order service splits orders on markets without a venue across venues
+func NewRouted(provider types.Provider) internal.Trader {
+	return NewRoutedWithConfig(provider, TraderConfig{})
+}
+
+// NewRoutedWithConfig creates a routed trader with the optional parts set in the config. The router sits in front of
+// the risk manager, so the limits check each order it places on a venue, and the kill switch stays on the OrderSvc.
+func NewRoutedWithConfig(provider types.Provider, config TraderConfig) internal.Trader {
+	t := NewWithConfig(provider, config).(*trader)
+	router := svc.NewRouter(t, t.orderSvc)
+	if manager, ok := t.orderSvc.(risk.Manager); ok {
+		t.orderSvc = &routedManager{OrderSvc: router, manager: manager}
+	} else {
+		t.orderSvc = router
+	}
+	return t
+}
+
+// routedManager is a router in front of a risk manager, keeping the manager's kill switch
+type routedManager struct {
+	types.OrderSvc
+	manager risk.Manager
+}
+
+func (m *routedManager) Kill(reason string) error {
+	return m.manager.Kill(reason)
+}
+
+func (m *routedManager) Killed() bool {
+	return m.manager.Killed()
+}
+
+func (m *routedManager) Resume() {
+	m.manager.Resume()
+}
+
 func (t *trader) Start() {
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
 	t.startServices()
 }
 
+// Stop stops the services and waits for their streams to close, for up to currencytrader.trader.stopTimeout. The
+// provider is left running so the trader can be started again.
 func (t *trader) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("currencytrader.trader.stopTimeout"))
+	defer cancel()
+
 	t.mutex.Lock()
 	defer t.mutex.Unlock()
-	t.stopServices()
+	if err := t.stopServices(ctx); err != nil {
+		t.log.WithError(err).Warn("streams were still open when the trader stopped")
+	}
+}
+
+// Shutdown goes through every step even when one fails, so a stream that outlasts the context doesn't keep the
+// provider, event bus or journal open. It returns the first error.
+func (t *trader) Shutdown(ctx context.Context) (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	keep := func(e error) {
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+
+	keep(t.stopServices(ctx))
+	if stoppable, ok := t.provider.(types.Stoppable); ok {
+		keep(stoppable.Shutdown(ctx))
+	}
+	t.events.Close()
+	if closer, ok := t.journal.(io.Closer); ok {
+		keep(closer.Close())
+	}
+	return
+}
+
+// Health reports whether the services are running along with whatever the provider reports on itself
+func (t *trader) Health() types.Health {
+	t.mutex.RLock()
+	health := types.Health{Running: t.running, Providers: []types.ProviderHealth{}}
+	t.mutex.RUnlock()
+
+	if reporter, ok := t.provider.(types.HealthReporter); ok {
+		health.Providers = append(health.Providers, reporter.Health()...)
+	}
+	return health
 }
 
 func (t *trader) startServices() {
 	if !t.running {
+		if t.reconcile != nil && !t.reconciled {
+			t.reconciled = true
+			ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("currencytrader.trader.reconcileTimeout"))
+			if _, err := reconcile.Run(ctx, t.provider, t.journal, *t.reconcile); err != nil {
+				t.log.WithError(err).Error("could not reconcile the journal with the provider")
+				t.events.Publish(types.Event{Type: types.EventError, Err: err})
+			}
+			cancel()
+		}
+
 		t.tickerSvc.Start()
+		t.orders.Start()
+
+		t.stop = make(chan bool)
+		stop := t.stop
+		t.watchers.Go(func() { t.watchFills(stop) })
+		t.watchers.Go(func() { t.watchConnections(stop) })
 
 		t.running = true
 	}
 }
 
-func (t *trader) stopServices() {
+// stopServices stops the services in the reverse of the order they were started in. Orders go first so nothing
+// is left watching tickers for them.
+// stopServices stops every service even when waiting on one fails, returning the first error
+func (t *trader) stopServices(ctx context.Context) error {
 	if t.running {
-		t.tickerSvc.Stop()
+		close(t.stop)
+	}
+	t.running = false
+	err := t.watchers.Wait(ctx)
+	if e := t.orders.Shutdown(ctx); err == nil {
+		err = e
+	}
+	if e := t.tickerSvc.Shutdown(ctx); err == nil {
+		err = e
+	}
+	return err
+}
+
+// watchFills refreshes the wallets whenever an order fills so their changes are published. Fills that pile up while
+// the wallets are fetched are handled by a single refresh.
+func (t *trader) watchFills(stop <-chan bool) {
+	fills := t.events.Subscribe(stop, types.EventFilter{Types: []types.EventType{types.EventFill}})
 
-		t.running = false
+	// Wallets are only published once they change from what was seen before
+	if _, err := t.accountSvc.Wallets(); err != nil {
+		t.log.WithError(err).Warn("could not fetch wallets to watch")
+	}
+
+	for range fills {
+	drain:
+		for {
+			select {
+			case _, ok := <-fills:
+				if !ok {
+					return
+				}
+			default:
+				break drain
+			}
+		}
+
+		if _, err := t.accountSvc.Wallets(); err != nil {
+			t.log.WithError(err).Warn("could not refresh wallets after a fill")
+		}
+	}
+}
+
+// watchConnections polls the provider's health every currencytrader.trader.healthInterval and publishes the
+// websockets that changed state
+func (t *trader) watchConnections(stop <-chan bool) {
+	reporter, ok := t.provider.(types.HealthReporter)
+	if !ok {
+		return
+	}
+
+	states := map[string]types.WebsocketState{}
+	check := func() {
+		for _, provider := range reporter.Health() {
+			for i := range provider.Websockets {
+				socket := provider.Websockets[i]
+				key := provider.Venue + "/" + socket.Name
+				if last, seen := states[key]; seen && last == socket.State {
+					continue
+				}
+				states[key] = socket.State
+				t.events.Publish(types.Event{Type: types.EventConnection, Venue: provider.Venue, Connection: &socket})
+			}
+		}
+	}
+
+	check()
+	ticker := time.NewTicker(viper.GetDuration("currencytrader.trader.healthInterval"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			check()
+		}
 	}
 }
 
@@ -77,6 +290,14 @@ func (t *trader) TickerSvc() types.TickerSvc {
 	return t.tickerSvc
 }
 
+func (t *trader) Events() types.EventBus {
+	return t.events
+}
+
+func (t *trader) Journal() types.OrderJournal {
+	return t.journal
+}
+
 func (t *trader) Provider() types.Provider {
 	return t.provider
 }
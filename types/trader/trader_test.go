@@ -0,0 +1,270 @@
+package trader_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/journal"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+	"github.com/sinisterminister/currencytrader/types/reconcile"
+)
+
+// stoppable adds health reporting and a shutdown to a simulated provider
+type stoppable struct {
+	types.Provider
+	shutdown bool
+	err      error
+}
+
+func (s *stoppable) Health() []types.ProviderHealth {
+	state := types.WebsocketConnected
+	if s.shutdown {
+		state = types.WebsocketStopped
+	}
+	return []types.ProviderHealth{{Websockets: []types.WebsocketHealth{{Name: "feed", State: state}}}}
+}
+
+func (s *stoppable) Shutdown(ctx context.Context) error {
+	s.shutdown = true
+	return s.err
+}
+
+// closingJournal records whether it was closed
+type closingJournal struct {
+	types.OrderJournal
+	closed bool
+}
+
+func (j *closingJournal) Close() error {
+	j.closed = true
+	return nil
+}
+
+func TestHealthAndShutdown(t *testing.T) {
+	prov := &stoppable{Provider: simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(1)},
+		TickInterval: 20 * time.Millisecond,
+	})}
+	trader := currencytrader.NewMulti(map[string]types.Provider{"alpha": prov})
+
+	if trader.Health().Running {
+		t.Error("trader reports running before Start()")
+	}
+
+	trader.Start()
+	health := trader.Health()
+	if !health.Running {
+		t.Error("trader doesn't report running after Start()")
+	}
+	if len(health.Providers) != 1 || health.Providers[0].Venue != "alpha" {
+		t.Fatalf("Health() reported providers %+v; expected one for venue alpha", health.Providers)
+	}
+	if state := health.Providers[0].Websockets[0].State; state != types.WebsocketConnected {
+		t.Errorf("websocket is %s; expected %s", state, types.WebsocketConnected)
+	}
+
+	// Stopping leaves the provider up so the trader can start again
+	trader.Stop()
+	if trader.Health().Running || prov.shutdown {
+		t.Error("Stop() left the trader running or shut the provider down")
+	}
+	trader.Start()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := trader.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() returned %v", err)
+	}
+	if trader.Health().Running || !prov.shutdown {
+		t.Error("Shutdown() left the trader running or didn't shut the provider down")
+	}
+}
+
+func TestOrdersRecoveredFromJournal(t *testing.T) {
+	prov := simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(1), "ETH": decimal.NewFromInt(100)},
+		TickInterval: 20 * time.Millisecond,
+	})
+	path := filepath.Join(t.TempDir(), "orders.jsonl")
+
+	start := func() types.Trader {
+		j, err := journal.NewFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trader := currencytrader.NewWithConfig(prov, currencytrader.TraderConfig{Journal: j})
+		trader.Start()
+		return trader
+	}
+	shutdown := func(trader types.Trader) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := trader.Shutdown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rest a buy well under the market
+	trader := start()
+	btc, _ := trader.AccountSvc().Currency("BTC")
+	eth, _ := trader.AccountSvc().Currency("ETH")
+	mkt, err := trader.MarketSvc().Market(btc, eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	price := tkr.Bid().Div(decimal.NewFromInt(2)).Round(2)
+	placed, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequest(mkt, order.Limit, order.Buy, decimal.NewFromFloat(0.01), price, decimal.Zero, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown(trader)
+
+	// A new trader over the same journal picks the order up again
+	trader = start()
+	defer shutdown(trader)
+	orders := trader.OrderSvc().Orders()
+	if len(orders) != 1 || orders[0].ID() != placed.ID() {
+		t.Fatalf("trader recovered %d orders; expected order %s", len(orders), placed.ID())
+	}
+
+	if err := trader.OrderSvc().CancelOrder(orders[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-orders[0].Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("recovered order was not streamed after cancelling; last saw %s", orders[0].Status())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(trader.OrderSvc().Orders()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled order is still listed as open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartAdoptsUnknownOrders(t *testing.T) {
+	prov := simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(1), "ETH": decimal.NewFromInt(100)},
+		TickInterval: 20 * time.Millisecond,
+	})
+
+	// An order placed before the trader existed, by hand or by a run that lost its journal
+	var mkt types.MarketDTO
+	mkts, _ := prov.Markets()
+	for _, m := range mkts {
+		if m.BaseCurrency.Symbol == "BTC" && m.QuoteCurrency.Symbol == "ETH" {
+			mkt = m
+		}
+	}
+	tkr, err := prov.Ticker(mkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placed, err := prov.AttemptOrder(types.OrderRequestDTO{
+		Market:   mkt,
+		Type:     order.Limit,
+		Side:     order.Buy,
+		Price:    tkr.Bid.Div(decimal.NewFromInt(2)).Round(2),
+		Quantity: decimal.NewFromFloat(0.01),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report reconcile.Report
+	trader := currencytrader.NewWithConfig(prov, currencytrader.TraderConfig{
+		Reconcile: &reconcile.Config{
+			UnknownOrders: reconcile.Adopt,
+			OnReport:      func(r reconcile.Report) { report = r },
+		},
+	})
+	trader.Start()
+	defer trader.Stop()
+
+	if len(report.Unknown) != 1 {
+		t.Errorf("reconciliation found %d unknown orders; expected 1", len(report.Unknown))
+	}
+	orders := trader.OrderSvc().Orders()
+	if len(orders) != 1 || orders[0].ID() != placed.ID {
+		t.Errorf("trader tracks %d orders after adopting; expected order %s", len(orders), placed.ID)
+	}
+}
+
+func TestEventsFollowAFilledOrder(t *testing.T) {
+	prov := simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(1), "ETH": decimal.NewFromInt(100)},
+		TickInterval: 20 * time.Millisecond,
+	})
+	trader := currencytrader.New(prov)
+	trader.Start()
+	defer trader.Stop()
+
+	btc, _ := trader.AccountSvc().Currency("BTC")
+	eth, _ := trader.AccountSvc().Currency("ETH")
+	mkt, err := trader.MarketSvc().Market(btc, eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	events := trader.Events().Subscribe(stop, types.EventFilter{})
+	tickers := trader.TickerSvc().TickerStream(stop, mkt)
+
+	placed, err := trader.OrderSvc().AttemptOrder(mkt, order.NewRequest(mkt, order.Market, order.Buy, decimal.NewFromFloat(0.01), decimal.Zero, decimal.Zero, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[types.EventType]bool{
+		types.EventOrderCreated: true,
+		types.EventFill:         true,
+		types.EventOrderFilled:  true,
+		types.EventTicker:       true,
+		types.EventWallet:       true,
+	}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case <-tickers:
+		case event := <-events:
+			if event.Order != nil && event.Order.ID != placed.ID() {
+				t.Errorf("%s event is for order %s; expected %s", event.Type, event.Order.ID, placed.ID())
+			}
+			delete(want, event.Type)
+		case <-timeout:
+			t.Fatalf("events %v were not published", want)
+		}
+	}
+}
+
+func TestShutdownRunsEveryStep(t *testing.T) {
+	failure := errors.New("provider shutdown failed")
+	prov := &stoppable{Provider: simulated.New(simulated.ProviderConfig{}), err: failure}
+	j := &closingJournal{OrderJournal: journal.NewMemory()}
+	trader := currencytrader.NewWithConfig(prov, currencytrader.TraderConfig{Journal: j})
+	trader.Start()
+
+	// The provider failing to shut down still leaves the journal closed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := trader.Shutdown(ctx); !errors.Is(err, failure) {
+		t.Fatalf("Shutdown() returned %v; expected %v", err, failure)
+	}
+	if !j.closed {
+		t.Error("Shutdown() didn't close the journal after the provider failed")
+	}
+}
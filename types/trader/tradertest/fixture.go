@@ -0,0 +1,46 @@
+// Package tradertest holds the fixture shared by the tests of the packages that trade through a types.Trader
+package tradertest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/provider/simulated"
+)
+
+// Start starts a trader on a simulated provider holding 1 BTC and 100 ETH and returns its BTC/ETH market. The trader
+// is stopped once the test is done.
+func Start(t *testing.T) (types.Trader, types.Market) {
+	return StartWithConfig(t, currencytrader.TraderConfig{})
+}
+
+// StartWithConfig is Start for a trader with optional parts
+func StartWithConfig(t *testing.T, config currencytrader.TraderConfig) (types.Trader, types.Market) {
+	prov := simulated.New(simulated.ProviderConfig{
+		Balances:     map[string]decimal.Decimal{"BTC": decimal.NewFromInt(1), "ETH": decimal.NewFromInt(100)},
+		TickInterval: 10 * time.Millisecond,
+	})
+	trader := currencytrader.NewWithConfig(prov, config)
+	trader.Start()
+	t.Cleanup(trader.Stop)
+
+	btc, _ := trader.AccountSvc().Currency("BTC")
+	eth, _ := trader.AccountSvc().Currency("ETH")
+	mkt, err := trader.MarketSvc().Market(btc, eth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trader, mkt
+}
+
+// WaitDone waits for the order to be done, failing the test if it isn't within ten seconds
+func WaitDone(t *testing.T, ord types.Order) {
+	select {
+	case <-ord.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("order is still %s with %s filled", ord.Status(), ord.Filled())
+	}
+}
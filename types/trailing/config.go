@@ -0,0 +1,16 @@
+package trailing
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("currencytrader.trailing.retryInterval", time.Second)
+
+	// New extremes are stored at most this often, the latest one being stored once the interval is up. A restart
+	// loses the extremes of the last interval at most. Zero stores every one.
+	viper.SetDefault("currencytrader.trailing.storeInterval", time.Second)
+	viper.SetDefault("currencytrader.trailing.streamBufferSize", 8)
+}
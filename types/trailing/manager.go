@@ -0,0 +1,202 @@
+package trailing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/internal/lifecycle"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type manager struct {
+	log    log.Entry
+	trader types.Trader
+	store  Store
+
+	mutex   sync.Mutex
+	stops   map[string]*stop
+	running bool
+	halt    chan bool
+	group   lifecycle.Group
+}
+
+// New creates a manager that places orders through the trader, loading the open stops from the store. Stops are
+// only kept in memory without one.
+func New(trader types.Trader, store Store) (Manager, error) {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	m := &manager{
+		log:    log.WithField("source", "trailing"),
+		trader: trader,
+		store:  store,
+		stops:  make(map[string]*stop),
+	}
+
+	dtos, err := store.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the open stops: %w", err)
+	}
+	for _, dto := range dtos {
+		mkt, err := resolve(trader, dto.Market)
+		if err != nil {
+			return nil, fmt.Errorf("could not find the market of stop %s: %w", dto.ID, err)
+		}
+		m.stops[dto.ID] = newStop(m, mkt, dto)
+	}
+	return m, nil
+}
+
+// Start trails the open stops, picking up the orders of the ones that were already triggered
+func (m *manager) Start() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.running {
+		return
+	}
+	m.halt = make(chan bool)
+	m.running = true
+	for _, s := range m.stops {
+		m.run(s)
+	}
+}
+
+// Stop stops trailing and waits for the stops to let go. They stay open, so a later Start picks them up again.
+func (m *manager) Stop() {
+	m.mutex.Lock()
+	if !m.running {
+		m.mutex.Unlock()
+		return
+	}
+	close(m.halt)
+	m.running = false
+	m.mutex.Unlock()
+	m.group.Wait(context.Background())
+}
+
+func (m *manager) Place(mkt types.Market, req Request) (Stop, error) {
+	if req.Type == "" {
+		req.Type = order.Market
+	}
+	if mkt == nil {
+		return nil, fmt.Errorf("%w: no market", types.ErrInvalidRequest)
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	if req.ClientID == "" {
+		req.ClientID = uuid.New().String()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if s, ok := m.stops[req.ClientID]; ok {
+		return s, nil
+	}
+	for id, s := range m.stops {
+		if s.IsDone() {
+			delete(m.stops, id)
+		}
+	}
+
+	tkr, err := mkt.Ticker()
+	if err != nil {
+		return nil, fmt.Errorf("could not get the price to trail: %w", err)
+	}
+	extreme := price(tkr, req.Side)
+	if !extreme.IsPositive() {
+		return nil, fmt.Errorf("no price to trail on %s", mkt.Name())
+	}
+
+	dto := StopDTO{
+		CreationTime: time.Now(),
+		Extreme:      extreme,
+		ID:           req.ClientID,
+		Market:       mkt.ToDTO(),
+		Request:      req,
+		Status:       order.Pending,
+	}
+	if err := m.store.Record(dto); err != nil {
+		return nil, fmt.Errorf("could not store stop %s: %w", dto.ID, err)
+	}
+	s := newStop(m, mkt, dto)
+	m.stops[dto.ID] = s
+	if m.running {
+		m.run(s)
+	}
+	return s, nil
+}
+
+func (m *manager) Stops() []Stop {
+	m.mutex.Lock()
+	stops := make([]Stop, 0, len(m.stops))
+	for _, s := range m.stops {
+		if !s.IsDone() {
+			stops = append(stops, s)
+		}
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(stops, func(i, j int) bool {
+		if !stops[i].CreationTime().Equal(stops[j].CreationTime()) {
+			return stops[i].CreationTime().Before(stops[j].CreationTime())
+		}
+		return stops[i].ID() < stops[j].ID()
+	})
+	return stops
+}
+
+// run trails the stop until the manager stops. The caller holds the lock.
+func (m *manager) run(s *stop) {
+	if s.IsDone() {
+		return
+	}
+	halt := m.halt
+	m.group.Go(func() { s.run(halt) })
+}
+
+// record stores the stop's state, publishing an error if it can't
+func (m *manager) record(dto StopDTO) {
+	if err := m.store.Record(dto); err != nil {
+		m.log.WithError(err).Errorf("could not store stop %s", dto.ID)
+		m.fail(dto, fmt.Errorf("could not store stop %s: %w", dto.ID, err))
+	}
+}
+
+func (m *manager) fail(dto StopDTO, err error) {
+	m.trader.Events().Publish(types.Event{Type: types.EventError, Market: dto.Market, Err: err})
+}
+
+// resolve finds the trader's market for a stop loaded from the store
+func resolve(trader types.Trader, dto types.MarketDTO) (types.Market, error) {
+	for _, mkt := range trader.MarketSvc().Markets() {
+		if mkt.Name() != dto.Name {
+			continue
+		}
+		if mkt.Venue() == dto.Venue {
+			return mkt, nil
+		}
+		if dto.Venue == "" {
+			return trader.MarketSvc().VenueMarket("", mkt.BaseCurrency(), mkt.QuoteCurrency())
+		}
+	}
+	return nil, fmt.Errorf("no market %s on venue %q", dto.Name, dto.Venue)
+}
+
+// price is the ticker's last price, or the side of the book the stop's order would take without one
+func price(tkr types.Ticker, side types.OrderSide) decimal.Decimal {
+	if tkr.Price().IsPositive() {
+		return tkr.Price()
+	}
+	if side == order.Sell {
+		return tkr.Bid()
+	}
+	return tkr.Ask()
+}
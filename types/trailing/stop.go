@@ -0,0 +1,435 @@
+package trailing
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-playground/log/v7"
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/spf13/viper"
+)
+
+type stop struct {
+	log     log.Entry
+	manager *manager
+	market  types.Market
+
+	mutex     sync.RWMutex
+	dto       StopDTO
+	triggered types.Order
+	cancelled bool
+	stored    time.Time
+	unstored  bool
+	streams   []chan types.OrderStatus
+	done      chan bool
+}
+
+func newStop(m *manager, mkt types.Market, dto StopDTO) *stop {
+	s := &stop{
+		log:     m.log.WithField("stop", dto.ID),
+		manager: m,
+		market:  mkt,
+		dto:     dto,
+		done:    make(chan bool),
+	}
+	if order.IsDone(dto.Status) {
+		close(s.done)
+	}
+	return s
+}
+
+// run trails the stop until it triggers, then follows the order it fired until it is done or the manager stops
+func (s *stop) run(halt <-chan bool) {
+	if s.Status() == order.Pending && !s.trail(halt) {
+		return
+	}
+	child := s.fire()
+	if child == nil {
+		return
+	}
+
+	stop := make(chan bool)
+	defer close(stop)
+	statuses := child.StatusStream(stop)
+	for {
+		select {
+		case <-halt:
+			return
+		case <-child.Done():
+			s.follow(child)
+			return
+		case _, ok := <-statuses:
+			s.follow(child)
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// trail moves the stop along with the market's tickers until it triggers, reporting false if the manager stopped
+// or the stop was cancelled first. A ticker stream that closes is opened again after
+// currencytrader.trailing.retryInterval.
+func (s *stop) trail(halt <-chan bool) bool {
+	// The extreme is stored when the stop stops trailing, along with any new one the interval held back
+	var flush <-chan time.Time
+	if interval := viper.GetDuration("currencytrader.trailing.storeInterval"); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	defer s.flush()
+
+	for {
+		stop := make(chan bool)
+		tickers := s.market.TickerStream(stop)
+	follow:
+		for {
+			select {
+			case <-halt:
+				close(stop)
+				return false
+			case <-s.done:
+				close(stop)
+				return false
+			case <-flush:
+				s.flush()
+			case tkr, ok := <-tickers:
+				if !ok {
+					break follow
+				}
+				if s.move(price(tkr, s.dto.Request.Side)) {
+					close(stop)
+					return true
+				}
+			}
+		}
+		close(stop)
+
+		s.log.Warn("ticker stream closed; opening it again")
+		select {
+		case <-halt:
+			return false
+		case <-s.done:
+			return false
+		case <-time.After(viper.GetDuration("currencytrader.trailing.retryInterval")):
+		}
+	}
+}
+
+// move follows the best price and reports whether the price crossed the stop, triggering it
+func (s *stop) move(price decimal.Decimal) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.dto.Status != order.Pending || !price.IsPositive() {
+		return false
+	}
+
+	req := s.dto.Request
+	if (req.Side == order.Sell && price.GreaterThan(s.dto.Extreme)) || (req.Side == order.Buy && price.LessThan(s.dto.Extreme)) {
+		s.dto.Extreme = price
+		if time.Since(s.stored) >= viper.GetDuration("currencytrader.trailing.storeInterval") {
+			s.store()
+		} else {
+			s.unstored = true
+		}
+		return false
+	}
+
+	stopPrice := req.stopPrice(s.dto.Extreme)
+	if (req.Side == order.Sell && price.LessThanOrEqual(stopPrice)) || (req.Side == order.Buy && price.GreaterThanOrEqual(stopPrice)) {
+		s.log.Infof("triggered at %s with the stop at %s", price, stopPrice)
+		s.setStatus(order.Triggered)
+		return true
+	}
+	return false
+}
+
+// fire places the order of a triggered stop, or fetches the one it already placed. The order's client ID comes from
+// the stop's, so placing it again after a restart cut in before its ID was stored gets back the same order.
+func (s *stop) fire() types.Order {
+	svc := s.manager.trader.OrderSvc()
+	s.mutex.RLock()
+	id := s.dto.OrderID
+	s.mutex.RUnlock()
+
+	var child types.Order
+	var err error
+	if id != "" {
+		child, err = svc.Order(s.market, id)
+	} else {
+		child, err = svc.AttemptOrder(s.market, s.Request())
+	}
+
+	s.mutex.Lock()
+	if err != nil && id != "" {
+		// The order is out there, so the stop is left triggered to be picked up by the next Start
+		s.log.WithError(err).Errorf("could not fetch order %s of the triggered stop", id)
+		s.manager.fail(s.dto, err)
+		s.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		s.log.WithError(err).Error("could not place the order of the triggered stop")
+		s.manager.fail(s.dto, err)
+		s.setStatus(order.Rejected)
+		s.mutex.Unlock()
+		return nil
+	}
+	s.triggered = child
+	s.dto.OrderID = child.ID()
+	s.store()
+	cancelled := s.cancelled
+	s.mutex.Unlock()
+
+	if cancelled {
+		if err := svc.CancelOrder(child); err != nil {
+			s.log.WithError(err).Warnf("could not cancel order %s of the cancelled stop", child.ID())
+		}
+	}
+	return child
+}
+
+// follow moves the stop to the status of the order it fired
+func (s *stop) follow(child types.Order) {
+	status := child.Status()
+	switch {
+	case order.IsDone(status), status == order.Partial:
+	case child.Filled().IsPositive():
+		status = order.Partial
+	default:
+		status = order.Triggered
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.setStatus(status)
+}
+
+// setStatus moves the stop to the status, storing it and telling the streams. The caller holds the lock.
+func (s *stop) setStatus(status types.OrderStatus) {
+	if order.IsDone(s.dto.Status) || status == s.dto.Status {
+		return
+	}
+	s.dto.Status = status
+	s.store()
+
+	for _, stream := range s.streams {
+		select {
+		case stream <- status:
+		default:
+			s.log.Warn("skipping blocked order status channel")
+		}
+	}
+	if order.IsDone(status) {
+		for _, stream := range s.streams {
+			close(stream)
+		}
+		s.streams = nil
+		close(s.done)
+	}
+}
+
+// store records the stop's state. The caller holds the lock.
+func (s *stop) store() {
+	s.manager.record(s.dto)
+	s.stored = time.Now()
+	s.unstored = false
+}
+
+// flush stores a new extreme that was held back
+func (s *stop) flush() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unstored && !order.IsDone(s.dto.Status) {
+		s.store()
+	}
+}
+
+func (s *stop) Cancel() error {
+	s.mutex.Lock()
+	if order.IsDone(s.dto.Status) {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.cancelled = true
+	if s.dto.Status == order.Pending {
+		s.setStatus(order.Canceled)
+		s.mutex.Unlock()
+		return nil
+	}
+	child := s.triggered
+	s.mutex.Unlock()
+
+	// A stop that triggered without placing its order yet cancels it once it is placed
+	if child == nil {
+		return nil
+	}
+	return s.manager.trader.OrderSvc().CancelOrder(child)
+}
+
+func (s *stop) CreationTime() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.dto.CreationTime
+}
+
+func (s *stop) Done() <-chan bool { return s.done }
+
+func (s *stop) Fees() (types.OrderSide, decimal.Decimal) {
+	if child := s.Triggered(); child != nil {
+		return child.Fees()
+	}
+	return "", decimal.Zero
+}
+
+func (s *stop) Filled() decimal.Decimal {
+	if child := s.Triggered(); child != nil {
+		return child.Filled()
+	}
+	return decimal.Zero
+}
+
+func (s *stop) ID() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.dto.ID
+}
+
+func (s *stop) IsDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *stop) Market() types.Market { return s.market }
+
+func (s *stop) Paid() decimal.Decimal {
+	if child := s.Triggered(); child != nil {
+		return child.Paid()
+	}
+	return decimal.Zero
+}
+
+func (s *stop) Refresh() error {
+	child := s.Triggered()
+	if child == nil {
+		return nil
+	}
+	if err := child.Refresh(); err != nil {
+		return err
+	}
+	s.follow(child)
+	return nil
+}
+
+// Request is the request of the order the stop fires, priced at the stop price for a limit order
+func (s *stop) Request() types.OrderRequest {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	req := s.dto.Request
+	dto := types.OrderRequestDTO{
+		ClientID: s.dto.ID + ":trigger",
+		Market:   s.dto.Market,
+		Quantity: req.Quantity,
+		Side:     req.Side,
+		Type:     req.Type,
+	}
+	if req.Type == order.Limit {
+		inc := s.market.PriceIncrement()
+		stopPrice := req.stopPrice(s.dto.Extreme)
+		if req.Side == order.Sell {
+			dto.Price = roundDown(stopPrice.Sub(req.LimitOffset), inc)
+		} else {
+			dto.Price = roundUp(stopPrice.Add(req.LimitOffset), inc)
+		}
+	}
+	return order.NewRequestFromDTO(s.market, dto)
+}
+
+func (s *stop) Status() types.OrderStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.dto.Status
+}
+
+func (s *stop) StatusStream(stop <-chan bool) <-chan types.OrderStatus {
+	stream := make(chan types.OrderStatus, viper.GetInt("currencytrader.trailing.streamBufferSize"))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stream <- s.dto.Status
+	if order.IsDone(s.dto.Status) {
+		close(stream)
+		return stream
+	}
+	s.streams = append(s.streams, stream)
+
+	go func() {
+		select {
+		case <-stop:
+		case <-s.done:
+			return
+		}
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for i, c := range s.streams {
+			if c == stream {
+				s.streams = append(s.streams[:i], s.streams[i+1:]...)
+				close(stream)
+				break
+			}
+		}
+	}()
+	return stream
+}
+
+func (s *stop) StopPrice() decimal.Decimal {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.dto.Request.stopPrice(s.dto.Extreme)
+}
+
+func (s *stop) ToDTO() types.OrderDTO {
+	dto := types.OrderDTO{
+		Market:       s.market.ToDTO(),
+		CreationTime: s.CreationTime(),
+		ID:           s.ID(),
+		Request:      s.Request().ToDTO(),
+		Status:       s.Status(),
+	}
+	if child := s.Triggered(); child != nil {
+		fired := child.ToDTO()
+		dto.Fees = fired.Fees
+		dto.FeesSide = fired.FeesSide
+		dto.Filled = fired.Filled
+		dto.Paid = fired.Paid
+	}
+	return dto
+}
+
+func (s *stop) Triggered() types.Order {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.triggered
+}
+
+func roundDown(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Floor().Mul(step)
+}
+
+func roundUp(amount decimal.Decimal, step decimal.Decimal) decimal.Decimal {
+	if !step.IsPositive() {
+		return amount
+	}
+	return amount.Div(step).Ceil().Mul(step)
+}
@@ -0,0 +1,122 @@
+package trailing
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/sinisterminister/currencytrader/types/internal/filestore"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+type memory struct {
+	mutex sync.RWMutex
+	stops map[string]StopDTO
+}
+
+// NewMemoryStore returns a store that only lasts as long as the process, for paper trading and tests
+func NewMemoryStore() Store {
+	return &memory{stops: make(map[string]StopDTO)}
+}
+
+func (m *memory) Open() ([]StopDTO, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return open(m.stops), nil
+}
+
+func (m *memory) Record(dto StopDTO) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	apply(m.stops, dto)
+	return nil
+}
+
+type file struct {
+	path string
+
+	mutex sync.RWMutex
+	stops map[string]StopDTO
+}
+
+// NewFileStore opens a store kept as JSON at path, creating the file on the first record. There are only ever a
+// handful of open stops, so the whole file is rewritten with each record, replacing it in one step so a crash leaves
+// either the old file or the new one.
+func NewFileStore(path string) (Store, error) {
+	f := &file{path: path, stops: make(map[string]StopDTO)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var dtos []StopDTO
+	if err := json.Unmarshal(data, &dtos); err != nil {
+		return nil, err
+	}
+	for _, dto := range dtos {
+		apply(f.stops, dto)
+	}
+	return f, nil
+}
+
+func (f *file) Open() ([]StopDTO, error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return open(f.stops), nil
+}
+
+// Record rewrites the file with the stop's state and syncs it to disk before returning
+func (f *file) Record(dto StopDTO) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	stops := make(map[string]StopDTO, len(f.stops)+1)
+	for id, s := range f.stops {
+		stops[id] = s
+	}
+	apply(stops, dto)
+
+	data, err := json.Marshal(open(stops))
+	if err != nil {
+		return err
+	}
+	err = filestore.Replace(f.path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	f.stops = stops
+	return nil
+}
+
+// apply keeps the latest state of open stops, dropping the ones that are done
+func apply(stops map[string]StopDTO, dto StopDTO) {
+	if order.IsDone(dto.Status) {
+		delete(stops, dto.ID)
+		return
+	}
+	stops[dto.ID] = dto
+}
+
+// open lists the stops oldest first
+func open(stops map[string]StopDTO) []StopDTO {
+	dtos := make([]StopDTO, 0, len(stops))
+	for _, dto := range stops {
+		dtos = append(dtos, dto)
+	}
+	sort.Slice(dtos, func(i, j int) bool {
+		if !dtos[i].CreationTime.Equal(dtos[j].CreationTime) {
+			return dtos[i].CreationTime.Before(dtos[j].CreationTime)
+		}
+		return dtos[i].ID < dtos[j].ID
+	})
+	return dtos
+}
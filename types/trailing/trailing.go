@@ -0,0 +1,118 @@
+// Package trailing keeps trailing stops on the client for venues that have none of their own. A stop follows the
+// market's tickers and fires an order through the trader's order service once the price turns back by the trail.
+package trailing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+)
+
+// Manager places trailing stops and keeps them in its store, so they pick up where they left off when a manager is
+// created from the same store after a restart. Stops only trail while the manager is started.
+type Manager interface {
+	types.Administerable
+
+	// Place starts trailing the market from its last price, or returns the stop already placed under the request's
+	// client ID
+	Place(mkt types.Market, req Request) (Stop, error)
+
+	// Stops returns the stops that are still open, oldest first, including the ones loaded from the store
+	Stops() []Stop
+}
+
+// Stop is a trailing stop. It is pending while it trails and triggered once it fires its order, after which its
+// status, fills and fees follow that order.
+type Stop interface {
+	types.Order
+
+	// Cancel cancels the stop, or the order it fired if it was already triggered
+	Cancel() error
+
+	// StopPrice is the price that triggers the stop: the trail behind the best price seen so far
+	StopPrice() decimal.Decimal
+
+	// Triggered returns the order the stop fired, or nil until it is placed
+	Triggered() types.Order
+}
+
+// Store keeps the state of trailing stops so they survive a restart
+type Store interface {
+	// Open returns the last recorded state of every stop that wasn't done yet
+	Open() ([]StopDTO, error)
+
+	// Record stores the stop's latest state
+	Record(dto StopDTO) error
+}
+
+type Request struct {
+	// ClientID identifies the stop, and the order it fires is placed under a client ID derived from it. Defaults to
+	// a new ID.
+	ClientID string `json:"clientId"`
+
+	// Side is the side of the order the stop fires. A sell stop trails under the highest price seen and a buy stop
+	// above the lowest.
+	Side     types.OrderSide `json:"side"`
+	Quantity decimal.Decimal `json:"quantity"`
+
+	// Trail is how far the stop price stays from the best price, in the quote currency
+	Trail decimal.Decimal `json:"trail"`
+
+	// TrailPercent is the trail as a percentage of the best price, in place of Trail
+	TrailPercent decimal.Decimal `json:"trailPercent"`
+
+	// Type is the type of the order the stop fires. Defaults to order.Market.
+	Type types.OrderType `json:"type"`
+
+	// LimitOffset is how far past the stop price a limit order is placed, so it still fills as the price moves on
+	LimitOffset decimal.Decimal `json:"limitOffset"`
+}
+
+type StopDTO struct {
+	CreationTime time.Time `json:"creationTime"`
+
+	// Extreme is the best price seen while trailing: the highest for a sell stop and the lowest for a buy stop
+	Extreme decimal.Decimal `json:"extreme"`
+
+	ID     string          `json:"id"`
+	Market types.MarketDTO `json:"market"`
+
+	// OrderID is the ID of the order the stop fired, once it is placed
+	OrderID string `json:"orderId"`
+
+	Request Request           `json:"request"`
+	Status  types.OrderStatus `json:"status"`
+}
+
+func (r Request) validate() error {
+	switch {
+	case r.Side != order.Buy && r.Side != order.Sell:
+		return fmt.Errorf("%w: side %q", types.ErrInvalidRequest, r.Side)
+	case !r.Quantity.IsPositive():
+		return fmt.Errorf("%w: quantity %s", types.ErrInvalidRequest, r.Quantity)
+	case r.Trail.IsPositive() == r.TrailPercent.IsPositive():
+		return fmt.Errorf("%w: a stop needs either a trail or a trail percent", types.ErrInvalidRequest)
+	case r.Trail.IsNegative() || r.TrailPercent.IsNegative() || r.TrailPercent.GreaterThanOrEqual(decimal.NewFromInt(100)):
+		return fmt.Errorf("%w: trail %s, trail percent %s", types.ErrInvalidRequest, r.Trail, r.TrailPercent)
+	case r.Type != order.Market && r.Type != order.Limit:
+		return fmt.Errorf("%w: order type %q", types.ErrInvalidRequest, r.Type)
+	case r.LimitOffset.IsNegative():
+		return fmt.Errorf("%w: limit offset %s", types.ErrInvalidRequest, r.LimitOffset)
+	}
+	return nil
+}
+
+// stopPrice is the price that triggers a stop whose best price was the extreme
+func (r Request) stopPrice(extreme decimal.Decimal) decimal.Decimal {
+	trail := r.Trail
+	if r.TrailPercent.IsPositive() {
+		trail = extreme.Mul(r.TrailPercent).Div(decimal.NewFromInt(100))
+	}
+	if r.Side == order.Sell {
+		return extreme.Sub(trail)
+	}
+	return extreme.Add(trail)
+}
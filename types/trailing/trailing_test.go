@@ -0,0 +1,199 @@
+package trailing_test
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/sinisterminister/currencytrader/types"
+	"github.com/sinisterminister/currencytrader/types/order"
+	"github.com/sinisterminister/currencytrader/types/trader/tradertest"
+	"github.com/sinisterminister/currencytrader/types/trailing"
+	"github.com/spf13/viper"
+)
+
+func TestStopTriggersOnPullback(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	manager, err := trailing.New(trader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Start()
+	defer manager.Stop()
+
+	// The trail is a fraction of a tick, so the first move down triggers it
+	quantity := decimal.NewFromFloat(0.01)
+	stop, err := manager.Place(mkt, trailing.Request{
+		Side:         order.Sell,
+		Quantity:     quantity,
+		TrailPercent: decimal.NewFromFloat(0.01),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := stop.StatusStream(make(chan bool))
+
+	select {
+	case <-stop.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("stop is still %s at %s", stop.Status(), stop.StopPrice())
+	}
+
+	seen := []types.OrderStatus{}
+	for status := range statuses {
+		seen = append(seen, status)
+	}
+	if len(seen) < 3 || seen[0] != order.Pending || seen[1] != order.Triggered || seen[len(seen)-1] != order.Filled {
+		t.Errorf("stop went through %v; expected PENDING, TRIGGERED, ..., FILLED", seen)
+	}
+	if stop.Triggered() == nil || !stop.Filled().Equal(quantity) || !stop.Paid().Equal(stop.Triggered().Paid()) {
+		t.Errorf("stop filled %s and paid %s; expected its order's fills", stop.Filled(), stop.Paid())
+	}
+	if len(manager.Stops()) != 0 {
+		t.Errorf("manager still lists %d stops", len(manager.Stops()))
+	}
+}
+
+func TestStopsSurviveARestart(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	path := filepath.Join(t.TempDir(), "stops.json")
+	store, err := trailing.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := trailing.New(trader, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Start()
+
+	// The trail is far wider than the market moves
+	stop, err := manager.Place(mkt, trailing.Request{
+		ClientID:     "trailing-buy",
+		Side:         order.Buy,
+		Quantity:     decimal.NewFromFloat(0.01),
+		TrailPercent: decimal.NewFromInt(50),
+		Type:         order.Limit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	manager.Stop()
+	stopPrice := stop.StopPrice()
+
+	store, err = trailing.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := trailing.New(trader, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops := restarted.Stops()
+	if len(stops) != 1 || stops[0].ID() != "trailing-buy" || stops[0].Status() != order.Pending {
+		t.Fatalf("restarted manager has stops %v; expected the pending stop", stops)
+	}
+	if !stops[0].StopPrice().Equal(stopPrice) {
+		t.Errorf("restarted stop is at %s; expected %s", stops[0].StopPrice(), stopPrice)
+	}
+
+	restarted.Start()
+	defer restarted.Stop()
+	if err := stops[0].Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if stops[0].Status() != order.Canceled {
+		t.Errorf("cancelled stop is %s; expected %s", stops[0].Status(), order.Canceled)
+	}
+
+	store, err = trailing.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open, _ := store.Open(); len(open) != 0 {
+		t.Errorf("store still holds %d stops after the last one was cancelled", len(open))
+	}
+}
+
+func TestPlaceRejectsBadRequests(t *testing.T) {
+	trader, mkt := tradertest.Start(t)
+	manager, err := trailing.New(trader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := map[string]trailing.Request{
+		"no trail":   {Side: order.Sell, Quantity: decimal.NewFromInt(1)},
+		"two trails": {Side: order.Sell, Quantity: decimal.NewFromInt(1), Trail: decimal.NewFromInt(1), TrailPercent: decimal.NewFromInt(1)},
+		"no side":    {Quantity: decimal.NewFromInt(1), Trail: decimal.NewFromInt(1)},
+		"no size":    {Side: order.Buy, Trail: decimal.NewFromInt(1)},
+	}
+	for name, req := range requests {
+		if _, err := manager.Place(mkt, req); err == nil {
+			t.Errorf("Place() accepted a request with %s", name)
+		}
+	}
+}
+
+// countingStore counts the records made to the store it wraps
+type countingStore struct {
+	trailing.Store
+
+	mutex   sync.Mutex
+	records int
+}
+
+func (c *countingStore) Record(dto trailing.StopDTO) error {
+	c.mutex.Lock()
+	c.records++
+	c.mutex.Unlock()
+	return c.Store.Record(dto)
+}
+
+func (c *countingStore) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.records
+}
+
+func TestNewExtremesAreStoredAtIntervals(t *testing.T) {
+	viper.Set("currencytrader.trailing.storeInterval", time.Hour)
+	t.Cleanup(func() { viper.Set("currencytrader.trailing.storeInterval", time.Second) })
+
+	trader, mkt := tradertest.Start(t)
+	store := &countingStore{Store: trailing.NewMemoryStore()}
+	manager, err := trailing.New(trader, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Start()
+
+	stop, err := manager.Place(mkt, trailing.Request{
+		Side:         order.Buy,
+		Quantity:     decimal.NewFromFloat(0.01),
+		TrailPercent: decimal.NewFromInt(50),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// The stop is stored when it is placed and with its first extreme, the later ones waiting out the interval
+	if n := store.count(); n > 2 {
+		t.Errorf("stop was stored %d times while trailing; expected at most 2", n)
+	}
+
+	// Stopping stores the latest extreme
+	manager.Stop()
+	restarted, err := trailing.New(trader, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops := restarted.Stops()
+	if len(stops) != 1 || !stops[0].StopPrice().Equal(stop.StopPrice()) {
+		t.Fatalf("restarted manager has stops %v; expected the stop at %s", stops, stop.StopPrice())
+	}
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"time"
 
 	"github.com/shopspring/decimal"
@@ -8,10 +9,15 @@ import (
 
 type AccountSvc interface {
 	Currencies() ([]Currency, error)
+	CurrenciesContext(ctx context.Context) ([]Currency, error)
 	Currency(name string) (Currency, error)
+	CurrencyContext(ctx context.Context, name string) (Currency, error)
 	Fees() (Fees, error)
+	FeesContext(ctx context.Context) (Fees, error)
 	Wallet(currency Currency) (Wallet, error)
+	WalletContext(ctx context.Context, currency Currency) (Wallet, error)
 	Wallets() ([]Wallet, error)
+	WalletsContext(ctx context.Context) ([]Wallet, error)
 }
 
 type Administerable interface {
@@ -58,9 +64,11 @@ type CurrencyDTO struct {
 }
 
 type Fees interface {
+	Breakdown() []Fees
 	MakerRate() decimal.Decimal
 	TakerRate() decimal.Decimal
 	ToDTO() FeesDTO
+	Venue() string
 	Volume() decimal.Decimal
 }
 
@@ -68,13 +76,22 @@ type FeesDTO struct {
 	MakerRate decimal.Decimal
 	TakerRate decimal.Decimal
 	Volume    decimal.Decimal
+
+	// Venue is the name of the provider charging the fees. It is empty for a single-provider trader and for aggregates.
+	Venue string
+
+	// Breakdown holds the per-venue fees that were combined into aggregate fees
+	Breakdown []FeesDTO
 }
 
 type Market interface {
 	AttemptOrder(req OrderRequest) (Order, error)
+	AttemptOrderContext(ctx context.Context, req OrderRequest) (Order, error)
 	AverageTradeVolume() (decimal.Decimal, error)
+	AverageTradeVolumeContext(ctx context.Context) (decimal.Decimal, error)
 	BaseCurrency() Currency
 	Candles(interval CandleInterval, start time.Time, end time.Time) ([]Candle, error)
+	CandlesContext(ctx context.Context, interval CandleInterval, start time.Time, end time.Time) ([]Candle, error)
 	MaxFunds() decimal.Decimal
 	MaxPrice() decimal.Decimal
 	MaxQuantity() decimal.Decimal
@@ -86,8 +103,12 @@ type Market interface {
 	QuantityStepSize() decimal.Decimal
 	QuoteCurrency() Currency
 	Ticker() (Ticker, error)
+	TickerContext(ctx context.Context) (Ticker, error)
 	TickerStream(stop <-chan bool) <-chan Ticker
+	// TickerStreamContext streams the market's tickers until ctx is done
+	TickerStreamContext(ctx context.Context) <-chan Ticker
 	ToDTO() MarketDTO
+	Venue() string
 }
 
 type MarketDTO struct {
@@ -102,11 +123,34 @@ type MarketDTO struct {
 	MinFunds         decimal.Decimal
 	MaxFunds         decimal.Decimal
 	QuantityStepSize decimal.Decimal
+
+	// Venue is the name of the provider the market trades on. It is empty for a single-provider trader.
+	Venue string
 }
 
 type MarketSvc interface {
 	Market(cur0 Currency, cur1 Currency) (Market, error)
 	Markets() []Market
+	VenueMarket(venue string, cur0 Currency, cur1 Currency) (Market, error)
+	Venues() []string
+}
+
+// AggregateOrder is a parent order that was split into child orders, possibly across venues
+type AggregateOrder interface {
+	Order
+	Children() []Order
+}
+
+// OpenOrderLister is implemented by providers that can list the account's open orders, including the ones placed
+// outside the trader
+type OpenOrderLister interface {
+	OpenOrders() ([]OrderDTO, error)
+}
+
+// OpenOrderContextLister is an OpenOrderLister whose listing also comes in a variant taking a context
+type OpenOrderContextLister interface {
+	OpenOrderLister
+	OpenOrdersContext(ctx context.Context) ([]OrderDTO, error)
 }
 
 type Order interface {
@@ -129,15 +173,27 @@ type OrderDTO struct {
 	Market       MarketDTO
 	CreationTime time.Time       `json:"creationTime"`
 	Fees         decimal.Decimal `json:"fees"`
-	FeesSide     OrderSide       `json:"feesSide"`
-	Filled       decimal.Decimal `json:"filled"`
-	ID           string          `json:"id"`
-	Paid         decimal.Decimal `json:"paid"`
-	Request      OrderRequestDTO `json:"request"`
-	Status       OrderStatus     `json:"status"`
+	// FeesSide is the side of the market the fees are charged in: BUY for the base currency, SELL or empty for the quote currency
+	FeesSide OrderSide       `json:"feesSide"`
+	Filled   decimal.Decimal `json:"filled"`
+	ID       string          `json:"id"`
+	Paid     decimal.Decimal `json:"paid"`
+	Request  OrderRequestDTO `json:"request"`
+	Status   OrderStatus     `json:"status"`
+}
+
+// OrderJournal keeps the states orders pass through so the orders a trader placed can be picked up again after a
+// restart
+type OrderJournal interface {
+	// Open returns the last recorded state of every order that wasn't done yet
+	Open() ([]OrderDTO, error)
+
+	// Record stores the order's latest state
+	Record(dto OrderDTO) error
 }
 
 type OrderRequest interface {
+	ClientID() string
 	ForceMaker() bool
 	Funds() decimal.Decimal
 	Market() Market
@@ -149,6 +205,19 @@ type OrderRequest interface {
 }
 
 type OrderRequestDTO struct {
+	// ClientID identifies the request to the provider. Placing a request again with the same client ID returns the
+	// order it already placed instead of placing another one.
+	ClientID string `json:"clientId"`
+
+	// DisplayQuantity makes a limit order an iceberg that only shows this much of itself on the book at a time,
+	// placing the next slice as each one fills. The slices are orders of their own, listed and journaled by the
+	// order service, while the iceberg itself isn't listed and lasts only as long as the process. A slice that is
+	// cancelled, as by a risk manager's kill switch, or can't be placed ends the iceberg.
+	DisplayQuantity decimal.Decimal `json:"displayQuantity"`
+
+	// DisplayVariance varies each slice of an iceberg by up to this fraction of DisplayQuantity
+	DisplayVariance float64 `json:"displayVariance"`
+
 	// ForceMaker forces the request to place the order as a maker order
 	ForceMaker bool `json:"forceMaker"`
 
@@ -175,10 +244,20 @@ type OrderStatus string
 type OrderType string
 
 type OrderSvc interface {
+	// AttemptOrder places the request, giving it a client ID if it has none. The order is placed at most once per
+	// client ID, so a request that failed can be safely attempted again as it is; the order comes back if the
+	// first attempt made it to the provider after all.
 	AttemptOrder(m Market, req OrderRequest) (order Order, err error)
+	AttemptOrderContext(ctx context.Context, m Market, req OrderRequest) (order Order, err error)
 	CancelOrder(order Order) error
+	CancelOrderContext(ctx context.Context, order Order) error
 	Order(m Market, id string) (Order, error)
+	OrderContext(ctx context.Context, m Market, id string) (Order, error)
 	OrderFromDTO(dto OrderDTO) Order
+
+	// Orders returns the orders placed through the service that are still open, including the ones recovered from
+	// the journal when it started
+	Orders() []Order
 }
 
 type Provider interface {
@@ -198,12 +277,41 @@ type Provider interface {
 	Wallets() ([]WalletDTO, error)
 }
 
+// ContextProvider is a provider whose calls and streams also come in variants taking a context. Calls give up with
+// the context's error once it is done and streams close when it is.
+type ContextProvider interface {
+	Provider
+
+	AttemptOrderContext(ctx context.Context, req OrderRequestDTO) (OrderDTO, error)
+	AverageTradeVolumeContext(ctx context.Context, mkt MarketDTO) (decimal.Decimal, error)
+	CancelOrderContext(ctx context.Context, order OrderDTO) error
+	CandlesContext(ctx context.Context, mkt MarketDTO, interval CandleInterval, start time.Time, end time.Time) ([]CandleDTO, error)
+	CurrenciesContext(ctx context.Context) ([]CurrencyDTO, error)
+	FeesContext(ctx context.Context) (FeesDTO, error)
+	MarketsContext(ctx context.Context) ([]MarketDTO, error)
+	OrderContext(ctx context.Context, market MarketDTO, id string) (OrderDTO, error)
+	OrderStreamContext(ctx context.Context, order OrderDTO) (<-chan OrderDTO, error)
+	RefreshOrderContext(ctx context.Context, in OrderDTO) (OrderDTO, error)
+	TickerContext(ctx context.Context, market MarketDTO) (TickerDTO, error)
+	TickerStreamContext(ctx context.Context, market MarketDTO) (<-chan TickerDTO, error)
+	WalletContext(ctx context.Context, currency CurrencyDTO) (WalletDTO, error)
+	WalletsContext(ctx context.Context) ([]WalletDTO, error)
+}
+
 type Trader interface {
 	Administerable
 
 	AccountSvc() AccountSvc
+
+	// Events is the bus the trader publishes order, fill, ticker, wallet, connection and error events on
+	Events() EventBus
+	Health() Health
 	MarketSvc() MarketSvc
 	OrderSvc() OrderSvc
+
+	// Shutdown stops the services, waiting for their streams to close, and then the provider. The trader can't be
+	// started again afterwards.
+	Shutdown(ctx context.Context) error
 	TickerSvc() TickerSvc
 }
 
@@ -228,11 +336,14 @@ type TickerDTO struct {
 
 type TickerSvc interface {
 	Ticker(market Market) (Ticker, error)
+	TickerContext(ctx context.Context, market Market) (Ticker, error)
 	TickerStream(stop <-chan bool, market Market) <-chan Ticker
+	TickerStreamContext(ctx context.Context, market Market) <-chan Ticker
 }
 
 type Wallet interface {
 	Available() decimal.Decimal
+	Breakdown() []Wallet
 	Currency() Currency
 	Free() decimal.Decimal
 	ID() string
@@ -242,6 +353,7 @@ type Wallet interface {
 	Reserved() decimal.Decimal
 	ToDTO() WalletDTO
 	Total() decimal.Decimal
+	Venue() string
 }
 
 type WalletDTO struct {
@@ -250,4 +362,10 @@ type WalletDTO struct {
 	ID       string
 	Locked   decimal.Decimal
 	Reserved decimal.Decimal
+
+	// Venue is the name of the provider holding the wallet. It is empty for a single-provider trader and for aggregates.
+	Venue string
+
+	// Breakdown holds the per-venue wallets that were summed into an aggregate wallet
+	Breakdown []WalletDTO
 }
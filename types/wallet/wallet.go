@@ -36,6 +36,16 @@ func (w *wallet) Total() decimal.Decimal {
 	return w.dto.Free.Add(w.dto.Locked)
 }
 
+func (w *wallet) Breakdown() []types.Wallet {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	wals := make([]types.Wallet, 0, len(w.dto.Breakdown))
+	for _, dto := range w.dto.Breakdown {
+		wals = append(wals, New(w.trader, dto))
+	}
+	return wals
+}
+
 func (w *wallet) Free() decimal.Decimal {
 	w.mutex.RLock()
 	defer w.mutex.RUnlock()
@@ -88,6 +98,12 @@ func (w *wallet) Reserve(amount decimal.Decimal) error {
 	return nil
 }
 
+func (w *wallet) Venue() string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return w.dto.Venue
+}
+
 func (w *wallet) Update(dto types.WalletDTO) {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
@@ -95,4 +111,5 @@ func (w *wallet) Update(dto types.WalletDTO) {
 	// Skip reserved
 	w.dto.Free = dto.Free
 	w.dto.Locked = dto.Locked
+	w.dto.Breakdown = dto.Breakdown
 }